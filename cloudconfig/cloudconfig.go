@@ -18,6 +18,7 @@ import (
 	"crypto/x509"
 	"encoding/base64"
 	"fmt"
+	"io"
 	"strings"
 	"sync"
 
@@ -167,18 +168,29 @@ func (c *CloudInit) AddFile(contents []byte, path, owner, permissions string) {
 }
 
 func (c *CloudInit) Serialize() (string, error) {
+	var ret strings.Builder
+	if err := c.Write(&ret); err != nil {
+		return "", err
+	}
+	return ret.String(), nil
+}
+
+// Write serializes the cloud config directly to w, without buffering the
+// whole document in memory.
+func (c *CloudInit) Write(w io.Writer) error {
 	c.mux.Lock()
 	defer c.mux.Unlock()
 
-	ret := []string{
-		"#cloud-config",
+	if _, err := io.WriteString(w, "#cloud-config\n"); err != nil {
+		return errors.Wrap(err, "writing header")
 	}
 
-	asYaml, err := yaml.Marshal(c)
-	if err != nil {
-		return "", errors.Wrap(err, "marshaling to yaml")
+	enc := yaml.NewEncoder(w)
+	if err := enc.Encode(c); err != nil {
+		return errors.Wrap(err, "marshaling to yaml")
 	}
-
-	ret = append(ret, string(asYaml))
-	return strings.Join(ret, "\n"), nil
+	if err := enc.Close(); err != nil {
+		return errors.Wrap(err, "marshaling to yaml")
+	}
+	return nil
 }
@@ -17,6 +17,7 @@ package cloudconfig
 import (
 	"encoding/json"
 	"fmt"
+	"io"
 	"sort"
 	"strings"
 
@@ -133,9 +134,38 @@ func GetRunnerInstallScript(bootstrapParams params.BootstrapInstance, tools para
 // for most Linux machines. The install runner script must be generated separately either by GetRunnerInstallScript()
 // or some other means.
 func GetCloudInitConfig(bootstrapParams params.BootstrapInstance, installScript []byte) (string, error) {
+	cloudCfg, err := newCloudInitConfig(bootstrapParams, installScript)
+	if err != nil {
+		return "", err
+	}
+
+	asStr, err := cloudCfg.Serialize()
+	if err != nil {
+		return "", errors.Wrap(err, "creating cloud config")
+	}
+
+	return asStr, nil
+}
+
+// WriteCloudInitConfig is the streaming variant of GetCloudInitConfig. The cloud-init config is written
+// directly to w.
+func WriteCloudInitConfig(w io.Writer, bootstrapParams params.BootstrapInstance, installScript []byte) error {
+	cloudCfg, err := newCloudInitConfig(bootstrapParams, installScript)
+	if err != nil {
+		return err
+	}
+
+	if err := cloudCfg.Write(w); err != nil {
+		return errors.Wrap(err, "creating cloud config")
+	}
+
+	return nil
+}
+
+func newCloudInitConfig(bootstrapParams params.BootstrapInstance, installScript []byte) (*CloudInit, error) {
 	extraSpecs, err := GetSpecs(bootstrapParams)
 	if err != nil {
-		return "", errors.Wrap(err, "getting specs")
+		return nil, errors.Wrap(err, "getting specs")
 	}
 
 	cloudCfg := NewDefaultCloudInitConfig()
@@ -164,16 +194,11 @@ func GetCloudInitConfig(bootstrapParams params.BootstrapInstance, installScript
 	cloudCfg.AddRunCmd("rm -f /install_runner.sh")
 	if bootstrapParams.CACertBundle != nil && len(bootstrapParams.CACertBundle) > 0 {
 		if err := cloudCfg.AddCACert(bootstrapParams.CACertBundle); err != nil {
-			return "", errors.Wrap(err, "adding CA cert bundle")
+			return nil, errors.Wrap(err, "adding CA cert bundle")
 		}
 	}
 
-	asStr, err := cloudCfg.Serialize()
-	if err != nil {
-		return "", errors.Wrap(err, "creating cloud config")
-	}
-
-	return asStr, nil
+	return cloudCfg, nil
 }
 
 // GetCloudConfig is a helper function that generates a cloud-init config for Linux and a powershell script for Windows.
@@ -184,24 +209,33 @@ func GetCloudInitConfig(bootstrapParams params.BootstrapInstance, installScript
 // On other clouds it may be different. This function aims to be generic, which is why it only supports the PreInstallScripts
 // via cloud-init.
 func GetCloudConfig(bootstrapParams params.BootstrapInstance, tools params.RunnerApplicationDownload, runnerName string) (string, error) {
+	var userData strings.Builder
+	if err := WriteUserData(&userData, bootstrapParams, tools, runnerName); err != nil {
+		return "", err
+	}
+	return userData.String(), nil
+}
+
+// WriteUserData is the streaming variant of GetCloudConfig. The userdata is written directly to w, which
+// allows providers to upload large payloads to the cloud API without holding them in memory as a string.
+func WriteUserData(w io.Writer, bootstrapParams params.BootstrapInstance, tools params.RunnerApplicationDownload, runnerName string) error {
 	installScript, err := GetRunnerInstallScript(bootstrapParams, tools, runnerName)
 	if err != nil {
-		return "", errors.Wrap(err, "generating script")
+		return errors.Wrap(err, "generating script")
 	}
 
-	var asStr string
 	switch bootstrapParams.OSType {
 	case params.Linux:
-		cloudCfg, err := GetCloudInitConfig(bootstrapParams, installScript)
-		if err != nil {
-			return "", errors.Wrap(err, "getting cloud init config")
+		if err := WriteCloudInitConfig(w, bootstrapParams, installScript); err != nil {
+			return errors.Wrap(err, "getting cloud init config")
 		}
-		return cloudCfg, nil
 	case params.Windows:
-		asStr = string(installScript)
+		if _, err := w.Write(installScript); err != nil {
+			return errors.Wrap(err, "writing script")
+		}
 	default:
-		return "", fmt.Errorf("unknown os type: %s", bootstrapParams.OSType)
+		return fmt.Errorf("unknown os type: %s", bootstrapParams.OSType)
 	}
 
-	return asStr, nil
+	return nil
 }
@@ -15,6 +15,7 @@
 package cloudconfig
 
 import (
+	"bytes"
 	"fmt"
 	"testing"
 
@@ -208,3 +209,47 @@ func TestGetCloudConfigUnknownOSType(t *testing.T) {
 	require.Error(t, err)
 	require.EqualError(t, err, fmt.Sprintf("unknown os type: %s", bootstrapParams.OSType))
 }
+
+func TestWriteUserDataForLinux(t *testing.T) {
+	bootstrapParams = params.BootstrapInstance{
+		OSType: "linux",
+		UserDataOptions: params.UserDataOptions{
+			DisableUpdatesOnBoot: newCloudCfg.PackageUpgrade,
+			ExtraPackages:        newCloudCfg.Packages,
+		},
+	}
+
+	expected, err := GetCloudConfig(bootstrapParams, tools, "test-runner-name")
+	require.NoError(t, err)
+
+	var userData bytes.Buffer
+	err = WriteUserData(&userData, bootstrapParams, tools, "test-runner-name")
+	require.NoError(t, err)
+	require.Equal(t, expected, userData.String())
+}
+
+func TestWriteUserDataForWindows(t *testing.T) {
+	bootstrapParams = params.BootstrapInstance{
+		OSType: "windows",
+	}
+
+	expected, err := GetCloudConfig(bootstrapParams, tools, "test-runner-name")
+	require.NoError(t, err)
+
+	var userData bytes.Buffer
+	err = WriteUserData(&userData, bootstrapParams, tools, "test-runner-name")
+	require.NoError(t, err)
+	require.Equal(t, expected, userData.String())
+}
+
+func TestWriteUserDataUnknownOSType(t *testing.T) {
+	bootstrapParams = params.BootstrapInstance{
+		ExtraSpecs: []byte(extraSpecsJson),
+		OSType:     "dummy-os-type",
+	}
+
+	var userData bytes.Buffer
+	err := WriteUserData(&userData, bootstrapParams, tools, "test-runner-name")
+	require.EqualError(t, err, "unknown os type: dummy-os-type")
+	require.Equal(t, 0, userData.Len())
+}
@@ -0,0 +1,112 @@
+// Copyright 2023 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package errors
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+)
+
+type classifierRule struct {
+	match    func(error) bool
+	sentinel error
+}
+
+// statusCoder is implemented by the errors of many cloud SDKs.
+type statusCoder interface {
+	StatusCode() int
+}
+
+// httpStatusCoder is implemented by the errors of the AWS SDK, among others.
+type httpStatusCoder interface {
+	HTTPStatusCode() int
+}
+
+// httpStatusCode returns the HTTP status code carried by err, if any.
+func httpStatusCode(err error) (int, bool) {
+	var sc statusCoder
+	if errors.As(err, &sc) {
+		return sc.StatusCode(), true
+	}
+	var hsc httpStatusCoder
+	if errors.As(err, &hsc) {
+		return hsc.HTTPStatusCode(), true
+	}
+	return 0, false
+}
+
+// MatchHTTPStatus returns a matcher for errors that carry the HTTP status code,
+// through either a StatusCode() or an HTTPStatusCode() method.
+func MatchHTTPStatus(code int) func(error) bool {
+	return func(err error) bool {
+		errCode, ok := httpStatusCode(err)
+		return ok && errCode == code
+	}
+}
+
+var defaultClassifierRules = []classifierRule{
+	{match: MatchHTTPStatus(http.StatusNotFound), sentinel: ErrNotFound},
+	{match: MatchHTTPStatus(http.StatusConflict), sentinel: ErrDuplicateEntity},
+	{match: MatchHTTPStatus(http.StatusTooManyRequests), sentinel: ErrRateLimited},
+}
+
+// Classifier maps the errors returned by cloud SDKs to the sentinel errors in this
+// package. Providers register matchers for their SDK once, and call Classify on
+// every error they return to GARM. Errors that carry an HTTP status code of 404,
+// 409 or 429 are classified by default, after all registered matchers.
+type Classifier struct {
+	mux   sync.RWMutex
+	rules []classifierRule
+}
+
+// NewClassifier returns a new Classifier.
+func NewClassifier() *Classifier {
+	return &Classifier{}
+}
+
+// Register adds a matcher. Errors for which match returns true are classified as
+// sentinel. Matchers are evaluated in the order they were registered.
+func (c *Classifier) Register(match func(error) bool, sentinel error) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	c.rules = append(c.rules, classifierRule{match: match, sentinel: sentinel})
+}
+
+// Classify wraps err with the sentinel of the first matcher that matches it. The
+// original error is preserved in the chain. Errors that match nothing are returned
+// unchanged.
+func (c *Classifier) Classify(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	c.mux.RLock()
+	defer c.mux.RUnlock()
+
+	for _, rules := range [][]classifierRule{c.rules, defaultClassifierRules} {
+		for _, rule := range rules {
+			if rule.match(err) {
+				if errors.Is(err, rule.sentinel) {
+					return err
+				}
+				return fmt.Errorf("%w: %w", rule.sentinel, err)
+			}
+		}
+	}
+	return err
+}
@@ -0,0 +1,123 @@
+// Copyright 2023 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package errors
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+type testStatusError struct {
+	code int
+}
+
+func (e *testStatusError) Error() string {
+	return fmt.Sprintf("request failed with status %d", e.code)
+}
+
+func (e *testStatusError) StatusCode() int {
+	return e.code
+}
+
+type testAWSError struct {
+	code int
+}
+
+func (e *testAWSError) Error() string {
+	return "operation error"
+}
+
+func (e *testAWSError) HTTPStatusCode() int {
+	return e.code
+}
+
+func TestClassify(t *testing.T) {
+	errQuota := fmt.Errorf("QuotaExceeded: too many instances")
+	classifier := NewClassifier()
+	classifier.Register(func(err error) bool {
+		return strings.HasPrefix(err.Error(), "QuotaExceeded")
+	}, ErrUnprocessable)
+	// Registered matchers take precedence over the defaults.
+	classifier.Register(MatchHTTPStatus(418), ErrBadRequest)
+
+	tests := []struct {
+		name     string
+		err      error
+		expected error
+	}{
+		{
+			name:     "nil error",
+			err:      nil,
+			expected: nil,
+		},
+		{
+			name:     "registered matcher",
+			err:      errQuota,
+			expected: ErrUnprocessable,
+		},
+		{
+			name:     "default not found",
+			err:      &testStatusError{code: 404},
+			expected: ErrNotFound,
+		},
+		{
+			name:     "default duplicate",
+			err:      fmt.Errorf("wrapped: %w", &testStatusError{code: 409}),
+			expected: ErrDuplicateEntity,
+		},
+		{
+			name:     "default rate limited",
+			err:      &testAWSError{code: 429},
+			expected: ErrRateLimited,
+		},
+		{
+			name:     "registered status code",
+			err:      &testStatusError{code: 418},
+			expected: ErrBadRequest,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			err := classifier.Classify(tc.err)
+			if tc.expected == nil {
+				require.NoError(t, err)
+				return
+			}
+			require.ErrorIs(t, err, tc.expected)
+			require.ErrorIs(t, err, tc.err)
+		})
+	}
+}
+
+func TestClassifyUnmatched(t *testing.T) {
+	err := &testStatusError{code: 500}
+	require.Equal(t, error(err), NewClassifier().Classify(err))
+
+	plain := errors.New("plain error")
+	require.Equal(t, plain, NewClassifier().Classify(plain))
+}
+
+func TestClassifyAlreadyClassified(t *testing.T) {
+	classifier := NewClassifier()
+	classifier.Register(func(error) bool { return true }, ErrNotFound)
+
+	err := fmt.Errorf("missing instance: %w", ErrNotFound)
+	require.Equal(t, err, classifier.Classify(err))
+}
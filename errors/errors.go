@@ -32,6 +32,23 @@ var (
 	ErrTimeout          = fmt.Errorf("timed out")
 	ErrUnprocessable    = fmt.Errorf("cannot process request")
 	ErrNoPoolsAvailable = fmt.Errorf("no pools available")
+	// ErrInvalidConfig is returned when the provider config file is malformed.
+	// Retrying the operation will not help until the config is fixed.
+	ErrInvalidConfig = NewInvalidConfigError("invalid provider config")
+	// ErrNotImplemented is returned when a provider does not implement
+	// an optional operation.
+	ErrNotImplemented = fmt.Errorf("not implemented")
+	// ErrRateLimited is returned when the cloud API throttled a request.
+	ErrRateLimited = fmt.Errorf("rate limited")
+	// ErrTransient is returned when an operation was not attempted, or failed, due to
+	// a condition that is expected to clear up on its own.
+	ErrTransient = fmt.Errorf("transient error")
+	// ErrInstanceProvisioning is returned when an operation cannot be performed yet,
+	// because the instance is still being created.
+	ErrInstanceProvisioning = fmt.Errorf("instance is still provisioning")
+	// ErrMaintenanceMode is returned when a mutating command is rejected, because the
+	// provider is in maintenance mode.
+	ErrMaintenanceMode = fmt.Errorf("provider is in maintenance mode")
 )
 
 type baseError struct {
@@ -139,3 +156,17 @@ func NewConflictError(msg string, a ...interface{}) error {
 type ConflictError struct {
 	baseError
 }
+
+// NewInvalidConfigError returns a new InvalidConfigError
+func NewInvalidConfigError(msg string, a ...interface{}) error {
+	return &InvalidConfigError{
+		baseError{
+			msg: fmt.Sprintf(msg, a...),
+		},
+	}
+}
+
+// InvalidConfigError is returned when the provider config is invalid
+type InvalidConfigError struct {
+	baseError
+}
@@ -0,0 +1,65 @@
+// Copyright 2023 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package errors
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// RetryableError is returned when the cloud API throttled a request and told the
+// caller how long to wait before trying again, usually through a Retry-After
+// header. It matches ErrRateLimited with errors.Is.
+type RetryableError struct {
+	// Err is the error returned by the cloud API.
+	Err error
+	// RetryAfter is the time to wait before retrying the request.
+	RetryAfter time.Duration
+}
+
+// NewRetryableError returns a new RetryableError
+func NewRetryableError(err error, retryAfter time.Duration) error {
+	return &RetryableError{
+		Err:        err,
+		RetryAfter: retryAfter,
+	}
+}
+
+func (r *RetryableError) Error() string {
+	msg := ErrRateLimited.Error()
+	if r.Err != nil {
+		msg = r.Err.Error()
+	}
+	return fmt.Sprintf("%s (retry after %s)", msg, r.RetryAfter)
+}
+
+// Unwrap returns the error returned by the cloud API, along with ErrRateLimited.
+func (r *RetryableError) Unwrap() []error {
+	if r.Err == nil {
+		return []error{ErrRateLimited}
+	}
+	return []error{r.Err, ErrRateLimited}
+}
+
+// RetryAfter returns the time to wait before retrying, if err wraps a
+// RetryableError.
+func RetryAfter(err error) (time.Duration, bool) {
+	var retryable *RetryableError
+	if errors.As(err, &retryable) {
+		return retryable.RetryAfter, true
+	}
+	return 0, false
+}
@@ -0,0 +1,46 @@
+// Copyright 2023 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package errors
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRetryableError(t *testing.T) {
+	cause := fmt.Errorf("request throttled")
+	err := fmt.Errorf("failed to create instance: %w", NewRetryableError(cause, 30*time.Second))
+
+	require.ErrorIs(t, err, ErrRateLimited)
+	require.ErrorIs(t, err, cause)
+	require.EqualError(t, err, "failed to create instance: request throttled (retry after 30s)")
+
+	retryAfter, ok := RetryAfter(err)
+	require.True(t, ok)
+	require.Equal(t, 30*time.Second, retryAfter)
+
+	err = NewRetryableError(nil, time.Second)
+	require.ErrorIs(t, err, ErrRateLimited)
+	require.EqualError(t, err, "rate limited (retry after 1s)")
+
+	_, ok = RetryAfter(ErrRateLimited)
+	require.False(t, ok)
+	_, ok = RetryAfter(errors.New("other error"))
+	require.False(t, ok)
+}
@@ -0,0 +1,45 @@
+// Copyright 2023 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package errors
+
+import "fmt"
+
+// ValidationError is returned when a value GARM passes to the provider is missing
+// or invalid. Field names the environment variable at fault (eg: GARM_INSTANCE_ID),
+// so tooling can detect the misconfiguration without parsing the message. It
+// matches ErrBadRequest with errors.Is.
+type ValidationError struct {
+	// Field is the name of the environment variable at fault.
+	Field string
+	// Message describes the problem, and the likely misconfiguration if known.
+	Message string
+}
+
+// NewValidationError returns a new ValidationError
+func NewValidationError(field, msg string, a ...interface{}) error {
+	return &ValidationError{
+		Field:   field,
+		Message: fmt.Sprintf(msg, a...),
+	}
+}
+
+func (v *ValidationError) Error() string {
+	return v.Message
+}
+
+// Unwrap returns ErrBadRequest.
+func (v *ValidationError) Unwrap() error {
+	return ErrBadRequest
+}
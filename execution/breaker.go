@@ -0,0 +1,215 @@
+// Copyright 2023 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package execution
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	gErrors "github.com/cloudbase/garm-provider-common/errors"
+)
+
+// BreakerState is the state of a circuit breaker for one command.
+type BreakerState struct {
+	// Failures is the number of consecutive failures.
+	Failures int `json:"failures"`
+	// OpenUntil is the time until which calls fail fast, if the breaker tripped.
+	OpenUntil time.Time `json:"open_until,omitempty"`
+}
+
+// BreakerStore persists the state of circuit breakers. As providers usually run as
+// one shot processes, the state must outlive a single invocation to be useful.
+type BreakerStore interface {
+	// Load returns the state saved under key. A missing state is not an error, and
+	// yields the zero BreakerState.
+	Load(key string) (BreakerState, error)
+	// Save persists the state under key.
+	Save(key string, state BreakerState) error
+}
+
+// MemoryBreakerStore is a BreakerStore that keeps the state in memory. It is meant
+// for programs that run many commands in the same process, like
+// RunServerWithOptions.
+type MemoryBreakerStore struct {
+	mux    sync.Mutex
+	states map[string]BreakerState
+}
+
+// NewMemoryBreakerStore returns an empty MemoryBreakerStore.
+func NewMemoryBreakerStore() *MemoryBreakerStore {
+	return &MemoryBreakerStore{states: map[string]BreakerState{}}
+}
+
+// Load implements BreakerStore.
+func (s *MemoryBreakerStore) Load(key string) (BreakerState, error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	return s.states[key], nil
+}
+
+// Save implements BreakerStore.
+func (s *MemoryBreakerStore) Save(key string, state BreakerState) error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	s.states[key] = state
+	return nil
+}
+
+// FileBreakerStore is a BreakerStore that keeps the state of each key in a JSON file
+// in Dir, so it is shared by all invocations of the provider.
+type FileBreakerStore struct {
+	// Dir is the folder in which state files are kept. It is created if missing.
+	Dir string
+}
+
+// NewFileBreakerStore returns a FileBreakerStore that keeps its files in dir.
+func NewFileBreakerStore(dir string) *FileBreakerStore {
+	return &FileBreakerStore{Dir: dir}
+}
+
+func (s *FileBreakerStore) path(key string) string {
+	return filepath.Join(s.Dir, key+".json")
+}
+
+// Load implements BreakerStore.
+func (s *FileBreakerStore) Load(key string) (BreakerState, error) {
+	data, err := os.ReadFile(s.path(key))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return BreakerState{}, nil
+		}
+		return BreakerState{}, fmt.Errorf("failed to read breaker state: %w", err)
+	}
+
+	var state BreakerState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return BreakerState{}, fmt.Errorf("failed to decode breaker state: %w", err)
+	}
+	return state, nil
+}
+
+// Save implements BreakerStore.
+func (s *FileBreakerStore) Save(key string, state BreakerState) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return fmt.Errorf("failed to encode breaker state: %w", err)
+	}
+
+	if err := os.MkdirAll(s.Dir, 0o700); err != nil {
+		return fmt.Errorf("failed to create breaker state folder: %w", err)
+	}
+
+	// Write to a temporary file and rename it, so concurrent invocations never read
+	// a partially written state.
+	tmp, err := os.CreateTemp(s.Dir, key+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("failed to create breaker state file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write breaker state: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write breaker state: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), s.path(key)); err != nil {
+		return fmt.Errorf("failed to write breaker state: %w", err)
+	}
+	return nil
+}
+
+// CircuitBreaker fails commands fast after a number of consecutive failures, instead
+// of letting every invocation wait for an API that is down. Breakers are keyed by
+// command.
+type CircuitBreaker struct {
+	// Threshold is the number of consecutive failures after which the breaker trips.
+	Threshold int
+	// Cooldown is how long commands fail fast after the breaker tripped. Once it
+	// elapses, the next call goes through, and a failure trips the breaker again.
+	Cooldown time.Duration
+	// Store persists the state of the breaker. Defaults to a MemoryBreakerStore owned
+	// by the breaker.
+	Store BreakerStore
+
+	defaultStoreOnce sync.Once
+	defaultStore     *MemoryBreakerStore
+}
+
+// store returns the store of the breaker, falling back to the default one.
+func (b *CircuitBreaker) store() BreakerStore {
+	if b.Store != nil {
+		return b.Store
+	}
+	b.defaultStoreOnce.Do(func() {
+		b.defaultStore = NewMemoryBreakerStore()
+	})
+	return b.defaultStore
+}
+
+// isProviderFailure returns true if err indicates that the provider or the cloud
+// is not healthy. Errors caused by the request itself do not count. It decides both
+// what trips the CircuitBreaker and what the default RetryPolicy retries.
+func isProviderFailure(err error) bool {
+	if errors.Is(err, gErrors.ErrBadRequest) || errors.Is(err, gErrors.ErrNotImplemented) {
+		return false
+	}
+	return ResolveErrorToExitCode(err) == 1
+}
+
+// allow returns an error wrapping errors.ErrTransient if the breaker of cmd is open.
+// Failing to load the state never blocks the command.
+func (b *CircuitBreaker) allow(cmd ExecutionCommand, now time.Time) error {
+	state, err := b.store().Load(string(cmd))
+	if err != nil {
+		return nil
+	}
+	if now.Before(state.OpenUntil) {
+		return fmt.Errorf("circuit breaker for %s is open until %s: %w", cmd, state.OpenUntil.Format(time.RFC3339), gErrors.ErrTransient)
+	}
+	return nil
+}
+
+// record updates the breaker of cmd with the outcome of a command. The state is
+// only saved when it changes, so a healthy provider does not write to the store on
+// every command.
+func (b *CircuitBreaker) record(cmd ExecutionCommand, now time.Time, cmdErr error) error {
+	store := b.store()
+	state, loadErr := store.Load(string(cmd))
+	if cmdErr == nil || !isProviderFailure(cmdErr) {
+		if loadErr == nil && state == (BreakerState{}) {
+			return nil
+		}
+		// Reset the breaker, overwriting the state if it could not be loaded.
+		return store.Save(string(cmd), BreakerState{})
+	}
+
+	if loadErr != nil {
+		return loadErr
+	}
+	state.Failures++
+	if b.Threshold > 0 && state.Failures >= b.Threshold {
+		state.OpenUntil = now.Add(b.Cooldown)
+	}
+	return store.Save(string(cmd), state)
+}
@@ -0,0 +1,162 @@
+// Copyright 2023 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package execution
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	gErrors "github.com/cloudbase/garm-provider-common/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRunWithOptionsCircuitBreaker(t *testing.T) {
+	stores := map[string]BreakerStore{
+		"memory": NewMemoryBreakerStore(),
+		"file":   NewFileBreakerStore(filepath.Join(t.TempDir(), "breaker")),
+	}
+
+	for name, store := range stores {
+		t.Run(name, func(t *testing.T) {
+			clock := NewFakeClock(time.Now())
+			provider := &flakyProvider{failures: 3}
+			provider.mockErr = fmt.Errorf("cloud is down")
+			opts := RunOptions{
+				Clock: clock,
+				CircuitBreaker: &CircuitBreaker{
+					Threshold: 2,
+					Cooldown:  time.Minute,
+					Store:     store,
+				},
+			}
+			env := Environment{Command: GetInstanceCommand, InstanceID: "instance-id"}
+
+			// The breaker trips after two consecutive failures.
+			for i := 0; i < 2; i++ {
+				_, err := RunWithOptions(context.Background(), provider, env, opts)
+				require.EqualError(t, err, "failed to get instance from provider: cloud is down")
+			}
+			_, err := RunWithOptions(context.Background(), provider, env, opts)
+			require.ErrorIs(t, err, gErrors.ErrTransient)
+			require.Equal(t, 2, provider.calls)
+
+			// Other commands have their own breaker.
+			_, err = RunWithOptions(context.Background(), &testExternalProvider{}, Environment{Command: DeleteInstanceCommand, InstanceID: "instance-id"}, opts)
+			require.NoError(t, err)
+
+			// After the cooldown, a failure trips the breaker again right away.
+			clock.Advance(time.Minute)
+			_, err = RunWithOptions(context.Background(), provider, env, opts)
+			require.EqualError(t, err, "failed to get instance from provider: cloud is down")
+			_, err = RunWithOptions(context.Background(), provider, env, opts)
+			require.ErrorIs(t, err, gErrors.ErrTransient)
+			require.Equal(t, 3, provider.calls)
+
+			// A success resets the breaker.
+			clock.Advance(time.Minute)
+			_, err = RunWithOptions(context.Background(), provider, env, opts)
+			require.NoError(t, err)
+			state, err := store.Load(string(GetInstanceCommand))
+			require.NoError(t, err)
+			require.Equal(t, BreakerState{}, state)
+		})
+	}
+}
+
+func TestCircuitBreakerIgnoresRequestErrors(t *testing.T) {
+	provider := &flakyProvider{failures: 5}
+	provider.mockErr = fmt.Errorf("instance-id: %w", gErrors.ErrNotFound)
+	store := NewMemoryBreakerStore()
+	opts := RunOptions{
+		CircuitBreaker: &CircuitBreaker{Threshold: 1, Cooldown: time.Hour, Store: store},
+	}
+	env := Environment{Command: GetInstanceCommand, InstanceID: "instance-id"}
+
+	for i := 0; i < 3; i++ {
+		_, err := RunWithOptions(context.Background(), provider, env, opts)
+		require.ErrorIs(t, err, gErrors.ErrNotFound)
+	}
+	require.Equal(t, 3, provider.calls)
+}
+
+func TestFileBreakerStoreInvalidState(t *testing.T) {
+	dir := t.TempDir()
+	store := NewFileBreakerStore(dir)
+
+	state, err := store.Load("GetInstance")
+	require.NoError(t, err)
+	require.Equal(t, BreakerState{}, state)
+
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "GetInstance.json"), []byte("{invalid"), 0o600))
+	_, err = store.Load("GetInstance")
+	require.ErrorContains(t, err, "failed to decode breaker state")
+
+	// A corrupted state does not block the command.
+	provider := &flakyProvider{}
+	opts := RunOptions{CircuitBreaker: &CircuitBreaker{Threshold: 1, Cooldown: time.Hour, Store: store}}
+	_, err = RunWithOptions(context.Background(), provider, Environment{Command: GetInstanceCommand, InstanceID: "instance-id"}, opts)
+	require.NoError(t, err)
+}
+
+// countingBreakerStore counts the calls to Save of the wrapped store.
+type countingBreakerStore struct {
+	BreakerStore
+
+	saves int
+}
+
+func (s *countingBreakerStore) Save(key string, state BreakerState) error {
+	s.saves++
+	return s.BreakerStore.Save(key, state)
+}
+
+func TestCircuitBreakerSavesOnlyChanges(t *testing.T) {
+	store := &countingBreakerStore{BreakerStore: NewMemoryBreakerStore()}
+	breaker := &CircuitBreaker{Threshold: 3, Cooldown: time.Hour, Store: store}
+	now := time.Now()
+
+	for i := 0; i < 3; i++ {
+		require.NoError(t, breaker.record(GetInstanceCommand, now, nil))
+	}
+	require.Equal(t, 0, store.saves)
+
+	require.NoError(t, breaker.record(GetInstanceCommand, now, fmt.Errorf("cloud is down")))
+	require.Equal(t, 1, store.saves)
+
+	require.NoError(t, breaker.record(GetInstanceCommand, now, nil))
+	require.NoError(t, breaker.record(GetInstanceCommand, now, nil))
+	require.Equal(t, 2, store.saves)
+}
+
+func TestCircuitBreakerDefaultStore(t *testing.T) {
+	clock := NewFakeClock(time.Now())
+	provider := &flakyProvider{failures: 5}
+	provider.mockErr = fmt.Errorf("cloud is down")
+	opts := RunOptions{
+		Clock:          clock,
+		CircuitBreaker: &CircuitBreaker{Threshold: 1, Cooldown: time.Hour},
+	}
+	env := Environment{Command: GetInstanceCommand, InstanceID: "instance-id"}
+
+	_, err := RunWithOptions(context.Background(), provider, env, opts)
+	require.Error(t, err)
+	_, err = RunWithOptions(context.Background(), provider, env, opts)
+	require.ErrorIs(t, err, gErrors.ErrTransient)
+	require.Equal(t, 1, provider.calls)
+}
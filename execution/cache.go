@@ -0,0 +1,84 @@
+// Copyright 2023 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package execution
+
+import (
+	"sync"
+	"time"
+)
+
+// cacheableCommands holds the read only commands whose response does not depend
+// on anything but the provider itself, and can thus be cached.
+var cacheableCommands = map[ExecutionCommand]struct{}{
+	DescribeProviderCommand: {},
+}
+
+func isCacheableCommand(cmd ExecutionCommand) bool {
+	_, ok := cacheableCommands[cmd]
+	return ok
+}
+
+type cacheKey struct {
+	command          ExecutionCommand
+	interfaceVersion string
+}
+
+type cacheEntry struct {
+	response string
+	expires  time.Time
+}
+
+// ResponseCache caches the responses of cacheable commands, like DescribeProvider,
+// for RunOptions.CacheTTL. A cache must only be shared by the RunWithOptions calls
+// of a single provider, with the same options. The zero value is an empty cache.
+type ResponseCache struct {
+	mux     sync.Mutex
+	entries map[cacheKey]cacheEntry
+}
+
+// NewResponseCache returns an empty ResponseCache.
+func NewResponseCache() *ResponseCache {
+	return &ResponseCache{}
+}
+
+func (c *ResponseCache) get(env Environment, now time.Time) (string, bool) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	entry, ok := c.entries[responseCacheKey(env)]
+	if !ok || now.After(entry.expires) {
+		return "", false
+	}
+	return entry.response, true
+}
+
+func (c *ResponseCache) set(env Environment, response string, expires time.Time) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	if c.entries == nil {
+		c.entries = map[cacheKey]cacheEntry{}
+	}
+	c.entries[responseCacheKey(env)] = cacheEntry{
+		response: response,
+		expires:  expires,
+	}
+}
+
+// responseCacheKey returns the key of the response to env. The response depends on
+// the interface version, as older versions of GARM get downgraded output.
+func responseCacheKey(env Environment) cacheKey {
+	return cacheKey{command: env.Command, interfaceVersion: env.InterfaceVersion}
+}
@@ -0,0 +1,98 @@
+// Copyright 2023 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package execution
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/cloudbase/garm-provider-common/params"
+	"github.com/stretchr/testify/require"
+)
+
+type countingDescriberProvider struct {
+	testExternalProvider
+
+	calls int
+}
+
+func (p *countingDescriberProvider) Describe(ctx context.Context) (params.ProviderDescription, error) {
+	p.calls++
+	return params.ProviderDescription{Name: "test-provider"}, nil
+}
+
+func TestRunWithOptionsCacheTTL(t *testing.T) {
+	env := Environment{Command: DescribeProviderCommand}
+	provider := &countingDescriberProvider{}
+
+	// Without a TTL, every call reaches the provider.
+	for i := 0; i < 2; i++ {
+		_, err := RunWithOptions(context.Background(), provider, env, RunOptions{})
+		require.NoError(t, err)
+	}
+	require.Equal(t, 2, provider.calls)
+
+	// Without a cache, the TTL alone does not cache anything.
+	_, err := RunWithOptions(context.Background(), provider, env, RunOptions{CacheTTL: time.Hour})
+	require.NoError(t, err)
+	require.Equal(t, 3, provider.calls)
+
+	opts := RunOptions{CacheTTL: time.Hour, ResponseCache: NewResponseCache()}
+	first, err := RunWithOptions(context.Background(), provider, env, opts)
+	require.NoError(t, err)
+	second, err := RunWithOptions(context.Background(), provider, env, opts)
+	require.NoError(t, err)
+	require.Equal(t, first, second)
+	require.Equal(t, 4, provider.calls)
+
+	// Responses are not shared between caches, nor between interface versions.
+	_, err = RunWithOptions(context.Background(), provider, env, RunOptions{CacheTTL: time.Hour, ResponseCache: NewResponseCache()})
+	require.NoError(t, err)
+	require.Equal(t, 5, provider.calls)
+	env.InterfaceVersion = InterfaceVersion011
+	_, err = RunWithOptions(context.Background(), provider, env, opts)
+	require.NoError(t, err)
+	require.Equal(t, 6, provider.calls)
+}
+
+func TestRunWithOptionsCacheExpires(t *testing.T) {
+	env := Environment{Command: DescribeProviderCommand}
+	provider := &countingDescriberProvider{}
+	clock := NewFakeClock(time.Now())
+	opts := RunOptions{CacheTTL: time.Minute, ResponseCache: NewResponseCache(), Clock: clock}
+
+	_, err := RunWithOptions(context.Background(), provider, env, opts)
+	require.NoError(t, err)
+	clock.Advance(30 * time.Second)
+	_, err = RunWithOptions(context.Background(), provider, env, opts)
+	require.NoError(t, err)
+	require.Equal(t, 1, provider.calls)
+
+	clock.Advance(time.Minute)
+	_, err = RunWithOptions(context.Background(), provider, env, opts)
+	require.NoError(t, err)
+	require.Equal(t, 2, provider.calls)
+}
+
+func TestRunWithOptionsCacheSkipsOtherCommands(t *testing.T) {
+	provider := &flakyProvider{}
+	opts := RunOptions{CacheTTL: time.Hour, ResponseCache: NewResponseCache()}
+	for i := 0; i < 2; i++ {
+		_, err := RunWithOptions(context.Background(), provider, Environment{Command: GetInstanceCommand}, opts)
+		require.NoError(t, err)
+	}
+	require.Equal(t, 2, provider.calls)
+}
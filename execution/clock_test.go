@@ -0,0 +1,150 @@
+// Copyright 2023 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package execution
+
+import (
+	"context"
+	"fmt"
+	"runtime"
+	"testing"
+	"time"
+
+	gErrors "github.com/cloudbase/garm-provider-common/errors"
+	"github.com/stretchr/testify/require"
+)
+
+// waitForWaiters blocks until the code under test waits on the clock.
+func waitForWaiters(clock *FakeClock, count int) {
+	for clock.Waiters() < count {
+		runtime.Gosched()
+	}
+}
+
+func TestFakeClock(t *testing.T) {
+	start := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := NewFakeClock(start)
+	require.Equal(t, start, clock.Now())
+
+	short := clock.After(time.Second)
+	long := clock.After(time.Minute)
+	require.Equal(t, 2, clock.Waiters())
+
+	clock.Advance(time.Second)
+	require.Equal(t, start.Add(time.Second), <-short)
+	require.Equal(t, 1, clock.Waiters())
+	select {
+	case <-long:
+		t.Fatal("timer fired before its deadline")
+	default:
+	}
+
+	clock.Advance(time.Minute)
+	require.Equal(t, start.Add(time.Minute+time.Second), <-long)
+	require.Equal(t, 0, clock.Waiters())
+
+	select {
+	case <-clock.After(0):
+	default:
+		t.Fatal("timer with no duration did not fire")
+	}
+}
+
+func TestRunWithOptionsFakeClockTimeout(t *testing.T) {
+	clock := NewFakeClock(time.Now())
+	opts := RunOptions{Timeout: time.Hour, Clock: clock}
+
+	errCh := make(chan error, 1)
+	go func() {
+		_, err := RunWithOptions(context.Background(), &blockingProvider{}, Environment{Command: GetInstanceCommand}, opts)
+		errCh <- err
+	}()
+
+	waitForWaiters(clock, 1)
+	clock.Advance(time.Hour)
+	require.ErrorIs(t, <-errCh, context.DeadlineExceeded)
+}
+
+func TestRunWithOptionsFakeClockRetry(t *testing.T) {
+	clock := NewFakeClock(time.Now())
+	provider := &flakyProvider{failures: 1}
+	provider.mockErr = fmt.Errorf("transient error")
+	metrics := &testMetricsRecorder{}
+	opts := RunOptions{
+		Retry:   RetryPolicy{MaxAttempts: 2, Interval: time.Hour},
+		Metrics: metrics,
+		Clock:   clock,
+	}
+
+	errCh := make(chan error, 1)
+	go func() {
+		_, err := RunWithOptions(context.Background(), provider, Environment{Command: GetInstanceCommand}, opts)
+		errCh <- err
+	}()
+
+	waitForWaiters(clock, 1)
+	clock.Advance(time.Hour)
+	require.NoError(t, <-errCh)
+	require.Equal(t, 2, provider.calls)
+	require.Equal(t, []time.Duration{time.Hour}, metrics.durations)
+}
+
+type provisioningProvider struct {
+	testExternalProvider
+
+	provisioning int
+	deletes      int
+}
+
+func (p *provisioningProvider) DeleteInstance(ctx context.Context, instance string) error {
+	p.deletes++
+	if p.deletes <= p.provisioning {
+		return fmt.Errorf("instance %s: %w", instance, gErrors.ErrInstanceProvisioning)
+	}
+	return nil
+}
+
+func TestRunDeleteInstanceStillProvisioning(t *testing.T) {
+	clock := NewFakeClock(time.Now())
+	provider := &provisioningProvider{provisioning: 2}
+	env := Environment{Command: DeleteInstanceCommand, InstanceID: "instance-id"}
+
+	errCh := make(chan error, 1)
+	go func() {
+		_, err := RunWithOptions(context.Background(), provider, env, RunOptions{Clock: clock})
+		errCh <- err
+	}()
+
+	for i := 0; i < provider.provisioning; i++ {
+		waitForWaiters(clock, 1)
+		clock.Advance(DeleteProvisioningRetry.MaxInterval)
+	}
+	require.NoError(t, <-errCh)
+	require.Equal(t, 3, provider.deletes)
+
+	// Without delays between attempts, to not depend on the clock.
+	policy := DeleteProvisioningRetry
+	t.Cleanup(func() { DeleteProvisioningRetry = policy })
+	DeleteProvisioningRetry.Interval = 0
+	DeleteProvisioningRetry.MaxInterval = 0
+
+	provider = &provisioningProvider{provisioning: 10}
+	_, err := Run(context.Background(), provider, env)
+	require.ErrorIs(t, err, gErrors.ErrInstanceProvisioning)
+	require.Equal(t, DeleteProvisioningRetry.MaxAttempts, provider.deletes)
+
+	// Other errors are not retried.
+	_, err = Run(context.Background(), &testExternalProvider{mockErr: gErrors.ErrNotFound}, env)
+	require.ErrorIs(t, err, gErrors.ErrNotFound)
+}
@@ -24,4 +24,169 @@ const (
 	StartInstanceCommand      ExecutionCommand = "StartInstance"
 	StopInstanceCommand       ExecutionCommand = "StopInstance"
 	RemoveAllInstancesCommand ExecutionCommand = "RemoveAllInstances"
+	// DumpEnvCommand prints the decoded execution environment as JSON, with
+	// secrets redacted, without calling the provider. Useful for debugging.
+	DumpEnvCommand ExecutionCommand = "DumpEnv"
+	// UpdateInstanceStatusCommand pushes a status transition, read from stdin, to the provider.
+	UpdateInstanceStatusCommand ExecutionCommand = "UpdateInstanceStatus"
+	// EstimateCostCommand returns the estimated cost of an instance created with the
+	// bootstrap params read from stdin.
+	EstimateCostCommand ExecutionCommand = "EstimateCost"
+	// ListAllInstancesCommand lists the instances in all pools of the controller.
+	ListAllInstancesCommand ExecutionCommand = "ListAllInstances"
+	// DescribeProviderCommand returns a static self-description of the provider.
+	DescribeProviderCommand ExecutionCommand = "DescribeProvider"
+	// RotateInstanceCredentialsCommand rotates the cloud credentials of an instance
+	// without recreating it.
+	RotateInstanceCredentialsCommand ExecutionCommand = "RotateInstanceCredentials"
+	// InstanceExistsCommand reports whether an instance still exists in the provider.
+	InstanceExistsCommand ExecutionCommand = "InstanceExists"
+	// StopPoolCommand stops all instances in a pool.
+	StopPoolCommand ExecutionCommand = "StopPool"
+	// StartPoolCommand starts all instances in a pool.
+	StartPoolCommand ExecutionCommand = "StartPool"
+	// TestConfigCommand validates the provider config and credentials, without
+	// changing any resources.
+	TestConfigCommand ExecutionCommand = "TestConfig"
+	// MetricsCommand returns the metrics of the provider in the Prometheus text
+	// exposition format.
+	MetricsCommand ExecutionCommand = "Metrics"
+	// ExecActionCommand runs a provider specific action, named by GARM_INSTANCE_ACTION,
+	// against an instance. The arguments of the action are read from stdin.
+	ExecActionCommand ExecutionCommand = "ExecAction"
+	// GetInstancesCommand returns the instances whose IDs are read from stdin, as a
+	// JSON array.
+	GetInstancesCommand ExecutionCommand = "GetInstances"
+	// GetBootDiagnosticsCommand returns the boot diagnostics of an instance, to debug
+	// instances that never report back to GARM.
+	GetBootDiagnosticsCommand ExecutionCommand = "GetBootDiagnostics"
+	// AttachNICCommand attaches the network interface read from stdin to an instance.
+	AttachNICCommand ExecutionCommand = "AttachNIC"
+	// DetachNICCommand detaches the network interface read from stdin from an instance.
+	DetachNICCommand ExecutionCommand = "DetachNIC"
+	// RenderBootstrapCommand returns the user data the provider would use for an
+	// instance created with the bootstrap params read from stdin, without creating it.
+	RenderBootstrapCommand ExecutionCommand = "RenderBootstrap"
+	// WarmupCommand pre-stages the images and resources needed to create an instance
+	// with the bootstrap params read from stdin, ahead of an anticipated scale-up.
+	WarmupCommand ExecutionCommand = "Warmup"
+	// GetInstanceEventsCommand returns the events the cloud recorded for an instance,
+	// optionally limited to the ones newer than GARM_EVENTS_SINCE.
+	GetInstanceEventsCommand ExecutionCommand = "GetInstanceEvents"
+	// ResizeDiskCommand grows the disk of an instance to the size set in
+	// GARM_DISK_SIZE_GB, without recreating the instance.
+	ResizeDiskCommand ExecutionCommand = "ResizeDisk"
+	// CreateInstancesCommand creates a batch of instances from the bootstrap params
+	// template and count read from stdin, and returns the instances as an array.
+	CreateInstancesCommand ExecutionCommand = "CreateInstances"
+	// GetEffectiveConfigCommand returns the config the provider loaded, after applying
+	// defaults and overrides, with the secrets redacted.
+	GetEffectiveConfigCommand ExecutionCommand = "GetEffectiveConfig"
+	// GetExtraSpecsSchemaCommand returns the extra specs keys the provider accepts.
+	GetExtraSpecsSchemaCommand ExecutionCommand = "GetExtraSpecsSchema"
 )
+
+// builtinCommands holds the commands implemented by this package. Custom commands
+// can never override them.
+var builtinCommands = map[ExecutionCommand]struct{}{
+	CreateInstanceCommand:            {},
+	DeleteInstanceCommand:            {},
+	GetInstanceCommand:               {},
+	ListInstancesCommand:             {},
+	StartInstanceCommand:             {},
+	StopInstanceCommand:              {},
+	RemoveAllInstancesCommand:        {},
+	DumpEnvCommand:                   {},
+	UpdateInstanceStatusCommand:      {},
+	EstimateCostCommand:              {},
+	ListAllInstancesCommand:          {},
+	DescribeProviderCommand:          {},
+	RotateInstanceCredentialsCommand: {},
+	InstanceExistsCommand:            {},
+	StopPoolCommand:                  {},
+	StartPoolCommand:                 {},
+	TestConfigCommand:                {},
+	MetricsCommand:                   {},
+	ExecActionCommand:                {},
+	GetInstancesCommand:              {},
+	GetBootDiagnosticsCommand:        {},
+	AttachNICCommand:                 {},
+	DetachNICCommand:                 {},
+	RenderBootstrapCommand:           {},
+	WarmupCommand:                    {},
+	GetInstanceEventsCommand:         {},
+	ResizeDiskCommand:                {},
+	CreateInstancesCommand:           {},
+	GetEffectiveConfigCommand:        {},
+	GetExtraSpecsSchemaCommand:       {},
+}
+
+func isBuiltinCommand(cmd ExecutionCommand) bool {
+	_, ok := builtinCommands[cmd]
+	return ok
+}
+
+// mutatingCommands holds the commands that change the state of resources
+// in the provider.
+var mutatingCommands = map[ExecutionCommand]struct{}{
+	CreateInstanceCommand:     {},
+	DeleteInstanceCommand:     {},
+	StartInstanceCommand:      {},
+	StopInstanceCommand:       {},
+	RemoveAllInstancesCommand: {},
+
+	UpdateInstanceStatusCommand:      {},
+	RotateInstanceCredentialsCommand: {},
+	StopPoolCommand:                  {},
+	StartPoolCommand:                 {},
+	ExecActionCommand:                {},
+	AttachNICCommand:                 {},
+	DetachNICCommand:                 {},
+	WarmupCommand:                    {},
+	ResizeDiskCommand:                {},
+	CreateInstancesCommand:           {},
+}
+
+// nonIdempotentCommands holds the commands that must never be retried, as running
+// them twice would create duplicate resources or repeat side effects.
+var nonIdempotentCommands = map[ExecutionCommand]struct{}{
+	CreateInstanceCommand:  {},
+	CreateInstancesCommand: {},
+	ExecActionCommand:      {},
+	AttachNICCommand:       {},
+}
+
+func isIdempotentCommand(cmd ExecutionCommand) bool {
+	_, ok := nonIdempotentCommands[cmd]
+	return !ok
+}
+
+// IsMutatingCommand returns true if the command changes the state of
+// resources in the provider.
+func IsMutatingCommand(cmd ExecutionCommand) bool {
+	_, ok := mutatingCommands[cmd]
+	return ok
+}
+
+// localCommands holds the commands that are handled entirely by this package,
+// without calling the provider.
+var localCommands = map[ExecutionCommand]struct{}{
+	DumpEnvCommand: {},
+}
+
+func isLocalCommand(cmd ExecutionCommand) bool {
+	_, ok := localCommands[cmd]
+	return ok
+}
+
+// configlessCommands holds the commands that can run before the provider is
+// configured, and thus do not require a provider config file.
+var configlessCommands = map[ExecutionCommand]struct{}{
+	DescribeProviderCommand:    {},
+	GetExtraSpecsSchemaCommand: {},
+}
+
+func requiresConfig(cmd ExecutionCommand) bool {
+	_, ok := configlessCommands[cmd]
+	return !ok
+}
@@ -0,0 +1,211 @@
+// Copyright 2023 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package execution
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+
+	gErrors "github.com/cloudbase/garm-provider-common/errors"
+	"github.com/cloudbase/garm-provider-common/params"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// providerConfigFilesFromEnv returns the list of provider config files set in
+// GARM_PROVIDER_CONFIG_FILES. The list uses the path list separator of the OS
+// (":" on Linux, ";" on Windows).
+func providerConfigFilesFromEnv() []string {
+	var files []string
+	for _, file := range filepath.SplitList(os.Getenv("GARM_PROVIDER_CONFIG_FILES")) {
+		if file = strings.TrimSpace(file); file != "" {
+			files = append(files, file)
+		}
+	}
+	return files
+}
+
+// proxyConfigFromEnv returns the proxy settings of the provider process. Like
+// net/http, the upper case variables take precedence over the lower case ones.
+func proxyConfigFromEnv() params.ProxyConfig {
+	getEnv := func(name string) string {
+		if value := strings.TrimSpace(os.Getenv(name)); value != "" {
+			return value
+		}
+		return strings.TrimSpace(os.Getenv(strings.ToLower(name)))
+	}
+	return params.ProxyConfig{
+		HTTPProxy:  getEnv("HTTP_PROXY"),
+		HTTPSProxy: getEnv("HTTPS_PROXY"),
+		NoProxy:    getEnv("NO_PROXY"),
+	}
+}
+
+func (e Environment) configFiles() []string {
+	if len(e.ProviderConfigFiles) > 0 {
+		return e.ProviderConfigFiles
+	}
+	if e.ProviderConfigFile != "" {
+		return []string{e.ProviderConfigFile}
+	}
+	return nil
+}
+
+// ProviderConfig reads all provider config files and merges them into a single
+// config. Files later in the list override values set by earlier ones. Nested
+// tables are merged key by key, while any other value is replaced as a whole.
+// The format of every file is chosen from its extension: files ending in .toml are
+// parsed as TOML, like most GARM provider configs, and all others as YAML, which
+// also covers JSON. Files in different formats can be layered.
+func (e Environment) ProviderConfig() (map[string]interface{}, error) {
+	files := e.configFiles()
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no provider config file set: %w", gErrors.ErrInvalidConfig)
+	}
+
+	merged := map[string]interface{}{}
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read config file %s: %w", file, err)
+		}
+
+		cfg, err := parseConfigFile(file, data)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse config file %s: %s: %w", file, err, gErrors.ErrInvalidConfig)
+		}
+		mergeConfig(merged, cfg)
+	}
+	return merged, nil
+}
+
+// parseConfigFile decodes a config file, in the format given by its extension.
+func parseConfigFile(file string, data []byte) (map[string]interface{}, error) {
+	var cfg map[string]interface{}
+	if strings.EqualFold(filepath.Ext(file), ".toml") {
+		if err := toml.Unmarshal(data, &cfg); err != nil {
+			return nil, err
+		}
+		return cfg, nil
+	}
+	if err := yaml.Unmarshal(data, &cfg); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// loadConfig calls LoadConfig on providers that implement ConfigLoader. Local
+// commands and commands that do not need a config, like DescribeProvider, do not
+// load it. Under RunServerWithOptions, the config is only loaded once.
+func loadConfig(provider ExternalProvider, env Environment, opts RunOptions) error {
+	loader, ok := asOptional[ConfigLoader](provider)
+	if !ok || isLocalCommand(env.Command) || !requiresConfig(env.Command) {
+		return nil
+	}
+	files := env.configFiles()
+	load := loader.LoadConfig
+	if opts.serverConfig != nil {
+		load = func(paths []string) error {
+			return opts.serverConfig.load(loader, paths)
+		}
+	}
+	if err := load(files); err != nil {
+		return fmt.Errorf("failed to load config files %s: %s: %w", strings.Join(files, ", "), err, gErrors.ErrInvalidConfig)
+	}
+	return nil
+}
+
+// serverConfig loads the config of the provider shared by all the commands run by
+// RunServerWithOptions. Reloading it for every command would swap the config under
+// commands still in flight, so it is loaded once, by the first command that needs it.
+type serverConfig struct {
+	mux    sync.Mutex
+	loaded bool
+	files  []string
+}
+
+// load loads the config from files, unless it was already loaded. Commands that
+// ask for a different set of files are refused, as the provider can only hold one.
+func (s *serverConfig) load(loader ConfigLoader, files []string) error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	if s.loaded {
+		if strings.Join(files, "\x00") != strings.Join(s.files, "\x00") {
+			return fmt.Errorf("the server already loaded config files %s", strings.Join(s.files, ", "))
+		}
+		return nil
+	}
+	// A failed load is retried by the next command.
+	if err := loader.LoadConfig(files); err != nil {
+		return err
+	}
+	s.loaded = true
+	s.files = append([]string(nil), files...)
+	return nil
+}
+
+// rxSensitiveConfigKey matches config keys that are likely to hold secrets.
+var rxSensitiveConfigKey = regexp.MustCompile(`(?i)(password|passwd|secret|token|credential|private[_-]?key|api[_-]?key|access[_-]?key)`)
+
+// redactConfig returns a copy of cfg with the values of sensitive keys redacted,
+// recursing into nested tables and lists.
+func redactConfig(cfg map[string]interface{}) map[string]interface{} {
+	if cfg == nil {
+		return nil
+	}
+	redacted := make(map[string]interface{}, len(cfg))
+	for key, value := range cfg {
+		if rxSensitiveConfigKey.MatchString(key) && value != nil {
+			redacted[key] = redactedValue
+			continue
+		}
+		redacted[key] = redactConfigValue(value)
+	}
+	return redacted
+}
+
+func redactConfigValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		return redactConfig(v)
+	case []interface{}:
+		values := make([]interface{}, len(v))
+		for idx, item := range v {
+			values[idx] = redactConfigValue(item)
+		}
+		return values
+	default:
+		return value
+	}
+}
+
+// mergeConfig merges src into dst, recursing into nested maps.
+func mergeConfig(dst, src map[string]interface{}) {
+	for key, value := range src {
+		srcMap, srcIsMap := value.(map[string]interface{})
+		dstMap, dstIsMap := dst[key].(map[string]interface{})
+		if srcIsMap && dstIsMap {
+			mergeConfig(dstMap, srcMap)
+			continue
+		}
+		dst[key] = value
+	}
+}
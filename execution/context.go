@@ -0,0 +1,118 @@
+// Copyright 2023 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package execution
+
+import (
+	"context"
+	"os"
+	"regexp"
+	"strings"
+)
+
+type contextKey string
+
+const (
+	correlationIDKey contextKey = "correlation-id"
+	createAsyncKey   contextKey = "create-async"
+	reasonKey        contextKey = "operation-reason"
+	userDataKey      contextKey = "user-data"
+	includeUserData  contextKey = "include-user-data"
+)
+
+// rxTraceParent matches a W3C traceparent header. The second group is the trace ID.
+var rxTraceParent = regexp.MustCompile(`^([0-9a-f]{2})-([0-9a-f]{32})-([0-9a-f]{16})-([0-9a-f]{2})$`)
+
+// WithCorrelationID returns a copy of ctx that carries the correlation ID.
+func WithCorrelationID(ctx context.Context, correlationID string) context.Context {
+	return context.WithValue(ctx, correlationIDKey, correlationID)
+}
+
+// CorrelationIDFromContext returns the correlation ID of the current operation, or
+// an empty string if none was set. Providers can forward it in the request headers
+// of their cloud SDK to trace an operation from GARM to the cloud.
+func CorrelationIDFromContext(ctx context.Context) string {
+	correlationID, _ := ctx.Value(correlationIDKey).(string)
+	return correlationID
+}
+
+// WithCreateAsync returns a copy of ctx that asks CreateInstance to return as soon
+// as the instance has an ID, without waiting for it to be provisioned.
+func WithCreateAsync(ctx context.Context) context.Context {
+	return context.WithValue(ctx, createAsyncKey, true)
+}
+
+// IsCreateAsync returns true if GARM asked for the instance to be created
+// asynchronously, by setting GARM_CREATE_ASYNC.
+func IsCreateAsync(ctx context.Context) bool {
+	async, _ := ctx.Value(createAsyncKey).(bool)
+	return async
+}
+
+// WithOperationReason returns a copy of ctx that carries the reason for the
+// current operation.
+func WithOperationReason(ctx context.Context, reason string) context.Context {
+	return context.WithValue(ctx, reasonKey, reason)
+}
+
+// OperationReasonFromContext returns the reason GARM gave for the current operation
+// (eg: "idle timeout" or "scale-down"), or an empty string if none was given.
+// Providers can tag it on the cloud resource or log it for audit purposes.
+func OperationReasonFromContext(ctx context.Context) string {
+	reason, _ := ctx.Value(reasonKey).(string)
+	return reason
+}
+
+// WithUserData returns a copy of ctx that carries the user data rendered for the
+// instance being created.
+func WithUserData(ctx context.Context, userData []byte) context.Context {
+	return context.WithValue(ctx, userDataKey, userData)
+}
+
+// UserDataFromContext returns the user data rendered by UserDataGenerator before
+// CreateInstance was called, or nil if the provider does not implement it. Providers
+// can use it to avoid rendering the user data twice.
+func UserDataFromContext(ctx context.Context) []byte {
+	userData, _ := ctx.Value(userDataKey).([]byte)
+	return userData
+}
+
+// WithIncludeUserData returns a copy of ctx that asks GetInstance to include the
+// user data of the instance in its result.
+func WithIncludeUserData(ctx context.Context) context.Context {
+	return context.WithValue(ctx, includeUserData, true)
+}
+
+// IsUserDataRequested returns true if GARM asked for GetInstance to include the
+// user data of the instance, by setting GARM_INCLUDE_USERDATA. Providers should
+// otherwise not fetch it, as it can be large.
+func IsUserDataRequested(ctx context.Context) bool {
+	requested, _ := ctx.Value(includeUserData).(bool)
+	return requested
+}
+
+// correlationIDFromEnv returns the correlation ID set by the caller in either
+// GARM_CORRELATION_ID or a W3C TRACEPARENT, or an empty string if neither is set.
+// RunWithOptions generates one in that case.
+func correlationIDFromEnv() string {
+	if correlationID := strings.TrimSpace(os.Getenv("GARM_CORRELATION_ID")); correlationID != "" {
+		return correlationID
+	}
+
+	traceParent := strings.ToLower(strings.TrimSpace(os.Getenv("TRACEPARENT")))
+	if matches := rxTraceParent.FindStringSubmatch(traceParent); matches != nil {
+		return matches[2]
+	}
+	return ""
+}
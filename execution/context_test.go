@@ -0,0 +1,174 @@
+// Copyright 2023 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package execution
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	gErrors "github.com/cloudbase/garm-provider-common/errors"
+	"github.com/cloudbase/garm-provider-common/params"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/require"
+)
+
+type testCorrelationProvider struct {
+	testExternalProvider
+
+	correlationID string
+}
+
+func (p *testCorrelationProvider) GetInstance(ctx context.Context, instance string) (params.ProviderInstance, error) {
+	p.correlationID = CorrelationIDFromContext(ctx)
+	return p.mockInstance, nil
+}
+
+func TestCorrelationIDFromEnv(t *testing.T) {
+	tests := []struct {
+		name          string
+		correlationID string
+		traceParent   string
+		expected      string
+	}{
+		{
+			name:          "explicit correlation ID",
+			correlationID: "test-correlation-id",
+			traceParent:   "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01",
+			expected:      "test-correlation-id",
+		},
+		{
+			name:        "trace ID from traceparent",
+			traceParent: "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01",
+			expected:    "0af7651916cd43dd8448eb211c80319c",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Setenv("GARM_CORRELATION_ID", tc.correlationID)
+			t.Setenv("TRACEPARENT", tc.traceParent)
+			require.Equal(t, tc.expected, correlationIDFromEnv())
+		})
+	}
+}
+
+func TestCorrelationIDFromEnvUnset(t *testing.T) {
+	t.Setenv("GARM_CORRELATION_ID", "")
+	t.Setenv("TRACEPARENT", "bogus")
+
+	require.Equal(t, "", correlationIDFromEnv())
+}
+
+func TestCorrelationIDFromContext(t *testing.T) {
+	require.Equal(t, "", CorrelationIDFromContext(context.Background()))
+
+	ctx := WithCorrelationID(context.Background(), "test-correlation-id")
+	require.Equal(t, "test-correlation-id", CorrelationIDFromContext(ctx))
+}
+
+func TestRunSetsCorrelationIDOnContext(t *testing.T) {
+	provider := &testCorrelationProvider{}
+	env := Environment{
+		Command:       GetInstanceCommand,
+		CorrelationID: "test-correlation-id",
+	}
+
+	_, err := Run(context.Background(), provider, env)
+	require.NoError(t, err)
+	require.Equal(t, "test-correlation-id", provider.correlationID)
+}
+
+func TestRunWithOptionsGeneratesCorrelationID(t *testing.T) {
+	var stderr bytes.Buffer
+	provider := &testCorrelationProvider{}
+
+	_, err := RunWithOptions(context.Background(), provider, Environment{Command: GetInstanceCommand}, RunOptions{Stderr: &stderr})
+	require.NoError(t, err)
+	_, err = uuid.Parse(provider.correlationID)
+	require.NoError(t, err)
+	require.Regexp(t, `^INFO: GetInstance finished in \S+ \(correlation ID: `+provider.correlationID+`\)\n$`, stderr.String())
+
+	first := provider.correlationID
+	_, err = RunWithOptions(context.Background(), provider, Environment{Command: GetInstanceCommand}, RunOptions{Stderr: &stderr})
+	require.NoError(t, err)
+	require.NotEqual(t, first, provider.correlationID)
+}
+
+func TestRunWithOptionsSummaryOnFailure(t *testing.T) {
+	var stderr bytes.Buffer
+	env := Environment{
+		Command:       DeleteInstanceCommand,
+		CorrelationID: "test-correlation-id",
+	}
+
+	_, err := RunWithOptions(context.Background(), &testExternalProvider{mockErr: gErrors.ErrNotFound}, env, RunOptions{Stderr: &stderr})
+	require.ErrorIs(t, err, gErrors.ErrNotFound)
+	require.Regexp(t, `^INFO: DeleteInstance failed after \S+ \(correlation ID: test-correlation-id\)\n$`, stderr.String())
+}
+
+type testReasonProvider struct {
+	testExternalProvider
+
+	contextReason string
+	deleteReason  string
+	stopReason    string
+}
+
+func (p *testReasonProvider) DeleteInstance(ctx context.Context, instance string) error {
+	p.contextReason = OperationReasonFromContext(ctx)
+	return nil
+}
+
+func (p *testReasonProvider) DeleteInstanceWithReason(ctx context.Context, instance string, reason string) error {
+	p.contextReason = OperationReasonFromContext(ctx)
+	p.deleteReason = reason
+	return nil
+}
+
+func (p *testReasonProvider) StopWithReason(ctx context.Context, instance string, force bool, reason string) error {
+	p.stopReason = reason
+	return nil
+}
+
+func TestRunOperationReason(t *testing.T) {
+	provider := &testReasonProvider{}
+	env := Environment{
+		Command:         DeleteInstanceCommand,
+		InstanceID:      "instance-id",
+		OperationReason: "idle timeout",
+	}
+	_, err := Run(context.Background(), provider, env)
+	require.NoError(t, err)
+	require.Equal(t, "idle timeout", provider.contextReason)
+	require.Equal(t, "idle timeout", provider.deleteReason)
+
+	env.Command = StopInstanceCommand
+	env.OperationReason = "scale-down"
+	_, err = Run(context.Background(), provider, env)
+	require.NoError(t, err)
+	require.Equal(t, "scale-down", provider.stopReason)
+
+	// Without a reason, the regular methods are called.
+	provider = &testReasonProvider{}
+	env = Environment{
+		Command:    DeleteInstanceCommand,
+		InstanceID: "instance-id",
+	}
+	_, err = Run(context.Background(), provider, env)
+	require.NoError(t, err)
+	require.Equal(t, "", provider.contextReason)
+	require.Equal(t, "", provider.deleteReason)
+}
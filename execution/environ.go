@@ -0,0 +1,111 @@
+// Copyright 2023 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package execution
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// errorReader is an io.Reader that always fails with err.
+type errorReader struct {
+	err error
+}
+
+func (r errorReader) Read([]byte) (int, error) {
+	return 0, r.err
+}
+
+// Environ returns the GARM_* environment variables and the stdin payload needed to
+// run a provider binary the same way GARM would, for the command described by the
+// environment. GetEnvironment in the provider process decodes them back into an
+// equivalent Environment. The returned reader is nil for commands that do not read
+// stdin. Only the variables that are set are returned.
+func (e Environment) Environ() ([]string, io.Reader) {
+	var environ []string
+	setVar := func(name, value string) {
+		if value != "" {
+			environ = append(environ, fmt.Sprintf("%s=%s", name, value))
+		}
+	}
+	setBool := func(name string, value bool) {
+		if value {
+			setVar(name, "true")
+		}
+	}
+
+	setVar("GARM_COMMAND", string(e.Command))
+	setVar("GARM_CONTROLLER_ID", e.ControllerID)
+	setVar("GARM_POOL_ID", e.PoolID)
+	setVar("GARM_PROVIDER_CONFIG_FILE", e.ProviderConfigFile)
+	setVar("GARM_PROVIDER_CONFIG_FILES", strings.Join(e.ProviderConfigFiles, string(filepath.ListSeparator)))
+	setVar("GARM_INSTANCE_ID", e.InstanceID)
+	setVar("GARM_CORRELATION_ID", e.CorrelationID)
+	setBool("GARM_PREVALIDATE_POOL", e.PrevalidatePool)
+	setBool("GARM_CREATE_ASYNC", e.CreateAsync)
+	setBool("GARM_SKIP_NOOP", e.SkipNoop)
+	setVar("GARM_INTERFACE_VERSION", e.InterfaceVersion)
+	setVar("GARM_OPERATION_REASON", e.OperationReason)
+	setVar("GARM_INSTANCE_ACTION", e.InstanceAction)
+	setBool("GARM_REMOVE_BEST_EFFORT", e.RemoveBestEffort)
+	setVar("GARM_SIGN_OUTPUT", e.SignOutput)
+	setBool("GARM_PROVIDER_DEBUG", e.ProviderDebug)
+	setBool("GARM_GUARD_TRANSITIONS", e.GuardTransitions)
+	setBool("GARM_STRICT_STDIN", e.StrictStdin)
+	setVar("GARM_PROVIDER_NAME", e.ProviderName)
+	setBool("GARM_INCLUDE_USERDATA", e.IncludeUserData)
+	setBool("GARM_INCLUDE_USERDATA_UNREDACTED", e.UserDataUnredacted)
+	setBool("GARM_SOFT_DELETE", e.SoftDelete)
+	setBool("GARM_OUTPUT_NDJSON", e.NDJSON)
+	setBool("GARM_MAINTENANCE_MODE", e.MaintenanceMode)
+	if e.DiskSizeGB != 0 {
+		setVar("GARM_DISK_SIZE_GB", strconv.Itoa(e.DiskSizeGB))
+	}
+	if e.EventsSince != nil {
+		setVar("GARM_EVENTS_SINCE", e.EventsSince.Format(time.RFC3339Nano))
+	}
+
+	var stdin interface{}
+	switch e.Command {
+	case CreateInstanceCommand, EstimateCostCommand, RenderBootstrapCommand, WarmupCommand:
+		stdin = e.BootstrapParams
+	case CreateInstancesCommand:
+		stdin = e.createInstancesRequest()
+	case UpdateInstanceStatusCommand:
+		stdin = e.StatusUpdate
+	case GetInstancesCommand:
+		stdin = e.InstanceIDs
+	case AttachNICCommand, DetachNICCommand:
+		stdin = e.NIC
+	case ExecActionCommand:
+		stdin = e.ActionArgs
+	default:
+		return environ, nil
+	}
+
+	data, err := json.Marshal(stdin)
+	if err != nil {
+		// Surface the error to whoever consumes stdin, instead of silently sending
+		// an empty payload.
+		return environ, errorReader{err: fmt.Errorf("failed to marshal stdin for %s: %w", e.Command, err)}
+	}
+	return environ, bytes.NewReader(data)
+}
@@ -0,0 +1,201 @@
+// Copyright 2023 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package execution
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cloudbase/garm-provider-common/params"
+	"github.com/stretchr/testify/require"
+)
+
+// applyEnviron sets the environment variables and stdin returned by Environ for
+// the duration of the test, clearing any other GARM_* variables.
+func applyEnviron(t *testing.T, environ []string, stdin io.Reader) {
+	for _, kv := range os.Environ() {
+		if name, _, _ := strings.Cut(kv, "="); strings.HasPrefix(name, "GARM_") {
+			t.Setenv(name, "")
+		}
+	}
+	for _, name := range []string{"HTTP_PROXY", "HTTPS_PROXY", "NO_PROXY", "http_proxy", "https_proxy", "no_proxy"} {
+		t.Setenv(name, "")
+	}
+	for _, kv := range environ {
+		name, value, ok := strings.Cut(kv, "=")
+		require.True(t, ok)
+		t.Setenv(name, value)
+	}
+	if stdin != nil {
+		data, err := io.ReadAll(stdin)
+		require.NoError(t, err)
+		setStdin(t, string(data))
+	}
+}
+
+func TestEnvironmentEnvironRoundTrip(t *testing.T) {
+	tmpfile, err := os.CreateTemp("", "provider-config")
+	require.NoError(t, err)
+	tmpfile.Close()
+	t.Cleanup(func() { os.RemoveAll(tmpfile.Name()) })
+
+	eventsSince := time.Date(2023, 5, 1, 10, 30, 0, 0, time.UTC)
+	tests := []struct {
+		name string
+		env  Environment
+	}{
+		{
+			name: "create instance",
+			env: Environment{
+				Command:            CreateInstanceCommand,
+				ControllerID:       "controller-id",
+				PoolID:             "pool-id",
+				ProviderConfigFile: tmpfile.Name(),
+				CorrelationID:      "correlation-id",
+				CreateAsync:        true,
+				PrevalidatePool:    true,
+				BootstrapParams: params.BootstrapInstance{
+					Name:       "test-instance",
+					OSType:     params.Linux,
+					OSArch:     params.Amd64,
+					Flavor:     "m1.small",
+					Image:      "ubuntu",
+					Labels:     []string{"gpu", "linux"},
+					PoolID:     "pool-id",
+					ExtraSpecs: json.RawMessage(`{"disk_size":40}`),
+				},
+			},
+		},
+		{
+			name: "stop instance",
+			env: Environment{
+				Command:             StopInstanceCommand,
+				ControllerID:        "controller-id",
+				PoolID:              "pool-id",
+				ProviderConfigFile:  tmpfile.Name(),
+				ProviderConfigFiles: []string{tmpfile.Name(), "override.toml"},
+				InstanceID:          "instance-id",
+				CorrelationID:       "correlation-id",
+				SkipNoop:            true,
+				InterfaceVersion:    InterfaceVersion010,
+				OperationReason:     "idle timeout",
+			},
+		},
+		{
+			name: "update instance status",
+			env: Environment{
+				Command:            UpdateInstanceStatusCommand,
+				ControllerID:       "controller-id",
+				PoolID:             "pool-id",
+				ProviderConfigFile: tmpfile.Name(),
+				InstanceID:         "instance-id",
+				CorrelationID:      "correlation-id",
+				StatusUpdate: params.InstanceStatusUpdate{
+					InstanceID: "instance-id",
+					Status:     params.InstanceRunning,
+					Reason:     "boot finished",
+				},
+			},
+		},
+		{
+			name: "exec action",
+			env: Environment{
+				Command:            ExecActionCommand,
+				ControllerID:       "controller-id",
+				PoolID:             "pool-id",
+				ProviderConfigFile: tmpfile.Name(),
+				InstanceID:         "instance-id",
+				CorrelationID:      "correlation-id",
+				InstanceAction:     "reboot",
+				ActionArgs:         json.RawMessage(`{"hard":true}`),
+			},
+		},
+		{
+			name: "remove all instances",
+			env: Environment{
+				Command:            RemoveAllInstancesCommand,
+				ControllerID:       "controller-id",
+				ProviderConfigFile: tmpfile.Name(),
+				CorrelationID:      "correlation-id",
+				RemoveBestEffort:   true,
+				SoftDelete:         true,
+				NDJSON:             true,
+				MaintenanceMode:    true,
+			},
+		},
+		{
+			name: "get instance events",
+			env: Environment{
+				Command:            GetInstanceEventsCommand,
+				ControllerID:       "controller-id",
+				PoolID:             "pool-id",
+				ProviderConfigFile: tmpfile.Name(),
+				InstanceID:         "instance-id",
+				CorrelationID:      "correlation-id",
+				EventsSince:        &eventsSince,
+			},
+		},
+		{
+			name: "create instances",
+			env: Environment{
+				Command:            CreateInstancesCommand,
+				ControllerID:       "controller-id",
+				PoolID:             "pool-id",
+				ProviderConfigFile: tmpfile.Name(),
+				CorrelationID:      "correlation-id",
+				BootstrapParams: params.BootstrapInstance{
+					Name:         "test-instance",
+					OSType:       params.Linux,
+					OSArch:       params.Amd64,
+					Flavor:       "m1.small",
+					Image:        "ubuntu",
+					Labels:       []string{"linux"},
+					ExtraSpecs:   json.RawMessage(`{}`),
+					ControllerID: "controller-id",
+				},
+				InstanceCount:    3,
+				MinInstanceCount: 2,
+			},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			environ, stdin := tc.env.Environ()
+			applyEnviron(t, environ, stdin)
+
+			env, err := GetEnvironment()
+			require.NoError(t, err)
+			require.Equal(t, tc.env, env)
+		})
+	}
+}
+
+func TestEnvironmentEnvironStdin(t *testing.T) {
+	environ, stdin := Environment{Command: GetInstanceCommand, InstanceID: "instance-id"}.Environ()
+	require.Equal(t, []string{"GARM_COMMAND=GetInstance", "GARM_INSTANCE_ID=instance-id"}, environ)
+	require.Nil(t, stdin)
+
+	_, stdin = Environment{
+		Command:         CreateInstanceCommand,
+		BootstrapParams: params.BootstrapInstance{ExtraSpecs: json.RawMessage(`{invalid`)},
+	}.Environ()
+	_, err := io.ReadAll(stdin)
+	require.ErrorContains(t, err, "failed to marshal stdin for CreateInstance")
+}
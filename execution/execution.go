@@ -17,15 +17,23 @@ package execution
 import (
 	"bytes"
 	"context"
+	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"math"
 	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
 
 	gErrors "github.com/cloudbase/garm-provider-common/errors"
 	"github.com/cloudbase/garm-provider-common/params"
 
+	"github.com/google/uuid"
 	"github.com/mattn/go-isatty"
 )
 
@@ -34,6 +42,42 @@ const (
 	ExitCodeNotFound int = 30
 	// ExitCodeDuplicate is an exit code that indicates a duplicate error
 	ExitCodeDuplicate int = 31
+	// ExitCodeInvalidConfig is an exit code that indicates the provider config is invalid
+	ExitCodeInvalidConfig int = 32
+	// ExitCodeMaintenanceMode is an exit code that indicates a mutating command was
+	// rejected because the provider is in maintenance mode
+	ExitCodeMaintenanceMode int = 33
+)
+
+var (
+	// StdinReadAttempts is the number of times we try to read data from stdin,
+	// for commands that require it, before giving up. It only applies when stdin
+	// is a regular file. A pipe is read once, until the writer closes it.
+	StdinReadAttempts = 3
+	// StdinRetryInterval is the time we wait for a slow writer between attempts
+	// to read data from stdin.
+	StdinRetryInterval = 100 * time.Millisecond
+	// stdinClock measures the time between attempts to read stdin.
+	stdinClock = RealClock
+	// MaxExtraSpecsSize is the maximum size, in bytes, of the extra specs in the
+	// bootstrap params. Providers that legitimately need larger extra specs can raise
+	// it. A value of 0 disables the limit.
+	MaxExtraSpecsSize = 1 << 20
+	// MaxBootstrapParamsSize is the maximum size, in bytes, of the raw bootstrap
+	// params, checked before they are decoded. A value of 0 disables the limit.
+	MaxBootstrapParamsSize = 4 << 20
+	// DeleteProvisioningRetry controls how DeleteInstance is retried while the
+	// provider reports that the instance is still provisioning, which happens when
+	// GARM aborts a scale-up. It gives the create a chance to settle, instead of
+	// leaking a half created instance.
+	DeleteProvisioningRetry = RetryPolicy{
+		MaxAttempts: 5,
+		Interval:    2 * time.Second,
+		MaxInterval: 15 * time.Second,
+		Retryable: func(err error) bool {
+			return errors.Is(err, gErrors.ErrInstanceProvisioning)
+		},
+	}
 )
 
 func ResolveErrorToExitCode(err error) int {
@@ -42,163 +86,1516 @@ func ResolveErrorToExitCode(err error) int {
 			return ExitCodeNotFound
 		} else if errors.Is(err, gErrors.ErrDuplicateEntity) {
 			return ExitCodeDuplicate
+		} else if errors.Is(err, gErrors.ErrInvalidConfig) {
+			return ExitCodeInvalidConfig
+		} else if errors.Is(err, gErrors.ErrMaintenanceMode) {
+			return ExitCodeMaintenanceMode
 		}
 		return 1
 	}
 	return 0
 }
 
+// RetryAfterSeconds returns the number of seconds, rounded up, the caller should
+// wait before retrying, if err carries a hint from the cloud. See
+// errors.RetryableError.
+func RetryAfterSeconds(err error) (int, bool) {
+	retryAfter, ok := gErrors.RetryAfter(err)
+	if !ok || retryAfter < 0 {
+		return 0, false
+	}
+	return int(math.Ceil(retryAfter.Seconds())), true
+}
+
+// ExitCodeToError is the inverse of ResolveErrorToExitCode. It returns the error
+// that corresponds to the exit code of a provider.
+func ExitCodeToError(code int) error {
+	switch code {
+	case 0:
+		return nil
+	case ExitCodeNotFound:
+		return gErrors.ErrNotFound
+	case ExitCodeDuplicate:
+		return gErrors.ErrDuplicateEntity
+	case ExitCodeInvalidConfig:
+		return gErrors.ErrInvalidConfig
+	case ExitCodeMaintenanceMode:
+		return gErrors.ErrMaintenanceMode
+	default:
+		return fmt.Errorf("provider exited with code %d", code)
+	}
+}
+
 func GetEnvironment() (Environment, error) {
+	return GetEnvironmentWithOptions(RunOptions{})
+}
+
+// GetEnvironmentWithOptions is like GetEnvironment, but also accepts the custom
+// commands registered in opts.CustomCommandHandler.
+func GetEnvironmentWithOptions(opts RunOptions) (Environment, error) {
+	// Values are trimmed, as stray whitespace from templating bugs would otherwise
+	// lead to confusing "not found" errors. The affected variables are reported in
+	// debug mode.
+	var trimmed []string
+	getEnv := func(name string) string {
+		value := os.Getenv(name)
+		if trimmedValue := strings.TrimSpace(value); trimmedValue != value {
+			trimmed = append(trimmed, name)
+			return trimmedValue
+		}
+		return value
+	}
+
 	env := Environment{
-		Command:            ExecutionCommand(os.Getenv("GARM_COMMAND")),
-		ControllerID:       os.Getenv("GARM_CONTROLLER_ID"),
-		PoolID:             os.Getenv("GARM_POOL_ID"),
-		ProviderConfigFile: os.Getenv("GARM_PROVIDER_CONFIG_FILE"),
-		InstanceID:         os.Getenv("GARM_INSTANCE_ID"),
+		Command:            ExecutionCommand(getEnv("GARM_COMMAND")),
+		ControllerID:       params.NormalizeControllerID(getEnv("GARM_CONTROLLER_ID")),
+		PoolID:             getEnv("GARM_POOL_ID"),
+		ProviderConfigFile: getEnv("GARM_PROVIDER_CONFIG_FILE"),
+		InstanceID:         getEnv("GARM_INSTANCE_ID"),
+		CorrelationID:      correlationIDFromEnv(),
+		PrevalidatePool:    getEnvBool("GARM_PREVALIDATE_POOL"),
+		CreateAsync:        getEnvBool("GARM_CREATE_ASYNC"),
+		SkipNoop:           getEnvBool("GARM_SKIP_NOOP"),
+		InterfaceVersion:   getEnv("GARM_INTERFACE_VERSION"),
+		OperationReason:    getEnv("GARM_OPERATION_REASON"),
+		InstanceAction:     getEnv("GARM_INSTANCE_ACTION"),
+		RemoveBestEffort:   getEnvBool("GARM_REMOVE_BEST_EFFORT"),
+		SignOutput:         getEnv("GARM_SIGN_OUTPUT"),
+		ProviderDebug:      getEnvBool("GARM_PROVIDER_DEBUG"),
+		GuardTransitions:   getEnvBool("GARM_GUARD_TRANSITIONS"),
+		StrictStdin:        getEnvBool("GARM_STRICT_STDIN"),
+		ProviderName:       getEnv("GARM_PROVIDER_NAME"),
+		IncludeUserData:    getEnvBool("GARM_INCLUDE_USERDATA"),
+		UserDataUnredacted: getEnvBool("GARM_INCLUDE_USERDATA_UNREDACTED"),
+		ProxyConfig:        proxyConfigFromEnv(),
+		SoftDelete:         getEnvBool("GARM_SOFT_DELETE"),
+		NDJSON:             getEnvBool("GARM_OUTPUT_NDJSON"),
+		MaintenanceMode:    getEnvBool("GARM_MAINTENANCE_MODE"),
 	}
 
-	// If this is a CreateInstance command, we need to get the bootstrap params
-	// from stdin
-	if env.Command == CreateInstanceCommand {
-		if isatty.IsTerminal(os.Stdin.Fd()) || isatty.IsCygwinTerminal(os.Stdin.Fd()) {
-			return Environment{}, fmt.Errorf("%s requires data passed into stdin", CreateInstanceCommand)
+	if files := providerConfigFilesFromEnv(); len(files) > 0 {
+		env.ProviderConfigFiles = files
+		if env.ProviderConfigFile == "" {
+			env.ProviderConfigFile = files[0]
 		}
+	}
 
-		var data bytes.Buffer
-		if _, err := io.Copy(&data, os.Stdin); err != nil {
-			return Environment{}, fmt.Errorf("failed to copy bootstrap params")
+	switch env.Command {
+	case CreateInstanceCommand, EstimateCostCommand, RenderBootstrapCommand, WarmupCommand:
+		// Commands that operate on a prospective instance get the bootstrap params
+		// from stdin.
+		data, err := readBootstrapParams(env.Command)
+		if err != nil {
+			return Environment{}, err
 		}
 
-		if data.Len() == 0 {
-			return Environment{}, fmt.Errorf("%s requires data passed into stdin", CreateInstanceCommand)
+		bootstrapParams, err := decodeBootstrapParams(data)
+		if err != nil {
+			return Environment{}, err
+		}
+		env.BootstrapParams = bootstrapParams
+	case CreateInstancesCommand:
+		data, err := readStdin(env.Command, "create instances request")
+		if err != nil {
+			return Environment{}, err
 		}
 
-		var bootstrapParams params.BootstrapInstance
-		if err := json.Unmarshal(data.Bytes(), &bootstrapParams); err != nil {
-			return Environment{}, fmt.Errorf("failed to decode instance params: %w", err)
+		if err := env.setCreateInstancesRequest(data); err != nil {
+			return Environment{}, err
+		}
+	case UpdateInstanceStatusCommand:
+		data, err := readStdin(env.Command, "status update")
+		if err != nil {
+			return Environment{}, err
 		}
-		if bootstrapParams.ExtraSpecs == nil {
-			// Initialize ExtraSpecs as an empty JSON object
-			bootstrapParams.ExtraSpecs = json.RawMessage([]byte("{}"))
+
+		var update params.InstanceStatusUpdate
+		if err := json.Unmarshal(data, &update); err != nil {
+			return Environment{}, fmt.Errorf("failed to decode status update: %w", err)
 		}
-		env.BootstrapParams = bootstrapParams
+		if update.InstanceID == "" {
+			update.InstanceID = env.InstanceID
+		}
+		env.StatusUpdate = update
+	case GetInstancesCommand:
+		data, err := readStdin(env.Command, "instance IDs")
+		if err != nil {
+			return Environment{}, err
+		}
+
+		var ids []string
+		if err := json.Unmarshal(data, &ids); err != nil {
+			return Environment{}, fmt.Errorf("failed to decode instance IDs: %s: %w", err, gErrors.ErrBadRequest)
+		}
+		env.InstanceIDs = ids
+	case AttachNICCommand, DetachNICCommand:
+		data, err := readStdin(env.Command, "nic spec")
+		if err != nil {
+			return Environment{}, err
+		}
+
+		var nic params.NICSpec
+		if err := json.Unmarshal(data, &nic); err != nil {
+			return Environment{}, fmt.Errorf("failed to decode nic spec: %s: %w", err, gErrors.ErrBadRequest)
+		}
+		env.NIC = nic
+	case ExecActionCommand:
+		data, err := readStdin(env.Command, "action arguments")
+		if err != nil {
+			return Environment{}, err
+		}
+
+		if !json.Valid(data) {
+			return Environment{}, fmt.Errorf("failed to decode action arguments: invalid JSON: %w", gErrors.ErrBadRequest)
+		}
+		env.ActionArgs = json.RawMessage(bytes.TrimSpace(data))
+	case ResizeDiskCommand:
+		if size := getEnv("GARM_DISK_SIZE_GB"); size != "" {
+			parsed, err := strconv.Atoi(size)
+			if err != nil {
+				return Environment{}, fmt.Errorf("invalid GARM_DISK_SIZE_GB %q, must be a whole number: %w", size, gErrors.ErrBadRequest)
+			}
+			env.DiskSizeGB = parsed
+		}
+	case GetInstanceEventsCommand:
+		if since := getEnv("GARM_EVENTS_SINCE"); since != "" {
+			parsed, err := time.Parse(time.RFC3339, since)
+			if err != nil {
+				return Environment{}, fmt.Errorf("invalid GARM_EVENTS_SINCE %q, must be an RFC 3339 timestamp: %w", since, gErrors.ErrBadRequest)
+			}
+			env.EventsSince = &parsed
+		}
+	default:
+		if env.StrictStdin {
+			if err := checkUnexpectedStdin(env.Command); err != nil {
+				return Environment{}, err
+			}
+		}
+	}
+
+	env.trimmedEnvVars = trimmed
+
+	if env.Command == DumpEnvCommand && getEnvBool("GARM_DUMP_SKIP_VALIDATION") {
+		// Allow operators to inspect the environment even if it would not pass validation.
+		return env, nil
 	}
 
-	if err := env.Validate(); err != nil {
+	if err := env.validate(opts); err != nil {
 		return Environment{}, fmt.Errorf("failed to validate execution environment: %w", err)
 	}
 
 	return env, nil
 }
 
+// GetBootstrapParamsFromReader reads the bootstrap params from r, and decodes and
+// normalizes them the same way GetEnvironment does with the params read from stdin.
+func GetBootstrapParamsFromReader(r io.Reader) (params.BootstrapInstance, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return params.BootstrapInstance{}, fmt.Errorf("failed to read bootstrap params: %w", err)
+	}
+	return decodeBootstrapParams(data)
+}
+
+// setCreateInstancesRequest decodes the request read from stdin by CreateInstances,
+// normalizing the bootstrap params template like the params of CreateInstance.
+func (e *Environment) setCreateInstancesRequest(data []byte) error {
+	var request struct {
+		BootstrapParams json.RawMessage `json:"bootstrap_params"`
+		Count           int             `json:"count"`
+		MinCount        int             `json:"min_count"`
+	}
+	if err := json.Unmarshal(data, &request); err != nil {
+		return fmt.Errorf("failed to decode create instances request: %s: %w", err, gErrors.ErrBadRequest)
+	}
+	if len(request.BootstrapParams) == 0 {
+		return fmt.Errorf("missing bootstrap params in create instances request: %w", gErrors.ErrBadRequest)
+	}
+
+	bootstrapParams, err := decodeBootstrapParams(request.BootstrapParams)
+	if err != nil {
+		return err
+	}
+	e.BootstrapParams = bootstrapParams
+	e.InstanceCount = request.Count
+	e.MinInstanceCount = request.MinCount
+	return nil
+}
+
+// createInstancesRequest returns the batch requested by CreateInstances.
+func (e Environment) createInstancesRequest() params.CreateInstancesRequest {
+	return params.CreateInstancesRequest{
+		BootstrapParams: e.BootstrapParams,
+		Count:           e.InstanceCount,
+		MinCount:        e.MinInstanceCount,
+	}
+}
+
+// decodeBootstrapParams decodes and normalizes the bootstrap params sent by GARM.
+func decodeBootstrapParams(data []byte) (params.BootstrapInstance, error) {
+	// Reject oversized payloads before json.Unmarshal buffers all of them.
+	if MaxBootstrapParamsSize > 0 && len(data) > MaxBootstrapParamsSize {
+		return params.BootstrapInstance{}, fmt.Errorf("bootstrap params size of %d bytes exceeds the limit of %d bytes: %w", len(data), MaxBootstrapParamsSize, gErrors.ErrBadRequest)
+	}
+	// A mangled encoding would otherwise surface as a confusing JSON syntax error.
+	if !utf8.Valid(data) {
+		return params.BootstrapInstance{}, fmt.Errorf("bootstrap params are not valid UTF-8: %w", gErrors.ErrBadRequest)
+	}
+
+	var bootstrapParams params.BootstrapInstance
+	if err := json.Unmarshal(data, &bootstrapParams); err != nil {
+		return params.BootstrapInstance{}, fmt.Errorf("failed to decode instance params: %w", err)
+	}
+	if bootstrapParams.ExtraSpecs == nil || jsonValueType(bootstrapParams.ExtraSpecs) == "null" {
+		// Initialize ExtraSpecs as an empty JSON object
+		bootstrapParams.ExtraSpecs = json.RawMessage([]byte("{}"))
+	}
+	if MaxExtraSpecsSize > 0 && len(bootstrapParams.ExtraSpecs) > MaxExtraSpecsSize {
+		return params.BootstrapInstance{}, fmt.Errorf("extra specs size of %d bytes exceeds the limit of %d bytes: %w", len(bootstrapParams.ExtraSpecs), MaxExtraSpecsSize, gErrors.ErrBadRequest)
+	}
+	// Providers expect to be able to unmarshal extra specs into a struct.
+	if valueType := jsonValueType(bootstrapParams.ExtraSpecs); valueType != "object" {
+		return params.BootstrapInstance{}, fmt.Errorf("extra specs must be a JSON object, got %s: %w", valueType, gErrors.ErrBadRequest)
+	}
+	if err := bootstrapParams.ApplyCommonExtraSpecs(); err != nil {
+		return params.BootstrapInstance{}, fmt.Errorf("failed to parse extra specs: %w", err)
+	}
+	bootstrapParams.Labels = params.NormalizeLabels(bootstrapParams.Labels)
+	bootstrapParams.ControllerID = params.NormalizeControllerID(bootstrapParams.ControllerID)
+	return bootstrapParams, nil
+}
+
+// stdinIsTerminal returns true if stdin is a terminal rather than a pipe or a
+// regular file. Reading from a terminal would block until the user types something.
+func stdinIsTerminal() bool {
+	if fi, err := os.Stdin.Stat(); err == nil && fi.Mode()&os.ModeCharDevice != 0 {
+		return true
+	}
+	return isatty.IsTerminal(os.Stdin.Fd()) || isatty.IsCygwinTerminal(os.Stdin.Fd())
+}
+
+// readStdin returns the data passed into stdin for commands that require it. The
+// description names the expected payload in error messages.
+func readStdin(cmd ExecutionCommand, description string) ([]byte, error) {
+	if stdinIsTerminal() {
+		return nil, fmt.Errorf("no %s on stdin: %s requires data passed into stdin", description, cmd)
+	}
+
+	// Reading a pipe blocks until the writer closes it, so EOF is final. A regular
+	// file may still be written to after the provider was started, so if nothing was
+	// written yet, give the writer a chance to catch up.
+	attempts := 1
+	if fi, err := os.Stdin.Stat(); err == nil && fi.Mode().IsRegular() {
+		attempts = StdinReadAttempts
+	}
+
+	var data bytes.Buffer
+	for attempt := 0; attempt < attempts; attempt++ {
+		if attempt > 0 {
+			<-stdinClock.After(StdinRetryInterval)
+		}
+		if _, err := io.Copy(&data, os.Stdin); err != nil {
+			return nil, fmt.Errorf("failed to read stdin: %w", err)
+		}
+		if data.Len() > 0 {
+			return data.Bytes(), nil
+		}
+	}
+
+	return nil, fmt.Errorf("%s requires data passed into stdin", cmd)
+}
+
+// checkUnexpectedStdin returns an error if data was passed into stdin for a command
+// that does not read it. Stdin is read until EOF, so callers must close it.
+func checkUnexpectedStdin(cmd ExecutionCommand) error {
+	if stdinIsTerminal() {
+		return nil
+	}
+	data, err := io.ReadAll(os.Stdin)
+	if err != nil {
+		return fmt.Errorf("failed to read stdin: %w", err)
+	}
+	if len(bytes.TrimSpace(data)) > 0 {
+		return fmt.Errorf("unexpected stdin data for command %s: %w", cmd, gErrors.ErrBadRequest)
+	}
+	return nil
+}
+
+// readBootstrapParams returns the bootstrap params passed into stdin. Where piping
+// stdin is awkward, the params can instead be passed in the file set in
+// GARM_BOOTSTRAP_PARAMS_FILE or base64 encoded in GARM_BOOTSTRAP_PARAMS_B64. Data on
+// stdin takes precedence over the file, which takes precedence over the env var.
+func readBootstrapParams(cmd ExecutionCommand) ([]byte, error) {
+	file := os.Getenv("GARM_BOOTSTRAP_PARAMS_FILE")
+	encoded := os.Getenv("GARM_BOOTSTRAP_PARAMS_B64")
+	if file == "" && encoded == "" {
+		return readStdin(cmd, "bootstrap params")
+	}
+
+	// With a fallback available, an empty stdin is not waited on.
+	if !stdinIsTerminal() {
+		data, err := io.ReadAll(os.Stdin)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read stdin: %w", err)
+		}
+		if len(bytes.TrimSpace(data)) > 0 {
+			return data, nil
+		}
+	}
+
+	if file != "" {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read GARM_BOOTSTRAP_PARAMS_FILE: %w", err)
+		}
+		return data, nil
+	}
+
+	data, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode GARM_BOOTSTRAP_PARAMS_B64: %s: %w", err, gErrors.ErrBadRequest)
+	}
+	return data, nil
+}
+
+// getEnvBool returns the boolean value of an environment variable. Unset or
+// unparsable values are treated as false.
+func getEnvBool(name string) bool {
+	val, err := strconv.ParseBool(strings.TrimSpace(os.Getenv(name)))
+	return err == nil && val
+}
+
+// jsonValueType returns the type of the top level value in an already validated
+// JSON document.
+func jsonValueType(data []byte) string {
+	trimmed := bytes.TrimSpace(data)
+	if len(trimmed) == 0 {
+		return "empty"
+	}
+
+	switch trimmed[0] {
+	case '{':
+		return "object"
+	case '[':
+		return "array"
+	case '"':
+		return "string"
+	case 't', 'f':
+		return "boolean"
+	case 'n':
+		return "null"
+	default:
+		return "number"
+	}
+}
+
 type Environment struct {
-	Command            ExecutionCommand
-	ControllerID       string
-	PoolID             string
-	ProviderConfigFile string
-	InstanceID         string
-	BootstrapParams    params.BootstrapInstance
+	Command            ExecutionCommand `json:"command"`
+	ControllerID       string           `json:"controller_id"`
+	PoolID             string           `json:"pool_id"`
+	ProviderConfigFile string           `json:"provider_config_file"`
+	// ProviderConfigFiles is the list of layered config files set in GARM_PROVIDER_CONFIG_FILES.
+	// Later files override earlier ones. Use ProviderConfig to get the merged config.
+	ProviderConfigFiles []string                 `json:"provider_config_files,omitempty"`
+	InstanceID          string                   `json:"instance_id"`
+	BootstrapParams     params.BootstrapInstance `json:"bootstrap_params"`
+	// StatusUpdate is read from stdin for the UpdateInstanceStatus command.
+	StatusUpdate params.InstanceStatusUpdate `json:"status_update"`
+	// CorrelationID identifies this invocation across GARM, the provider and the cloud.
+	// If empty, RunWithOptions generates a random one, so every invocation can be
+	// traced.
+	CorrelationID string `json:"correlation_id"`
+	// PrevalidatePool enables the PoolValidator check before CreateInstance. It is
+	// set via GARM_PREVALIDATE_POOL.
+	PrevalidatePool bool `json:"prevalidate_pool,omitempty"`
+	// CreateAsync allows CreateInstance to return an instance that is still being
+	// provisioned. It is set via GARM_CREATE_ASYNC.
+	CreateAsync bool `json:"create_async,omitempty"`
+	// SkipNoop makes Start and Stop check the power state of the instance first, and
+	// skip the operation if the instance is already in the desired state. This costs
+	// an extra GetInstance call. It is set via GARM_SKIP_NOOP.
+	SkipNoop bool `json:"skip_noop,omitempty"`
+	// InterfaceVersion is the version of the external provider interface GARM speaks,
+	// set via GARM_INTERFACE_VERSION. When it is v0.1.0, commands and fields added in
+	// later versions are suppressed, so one provider binary can serve old and new GARM.
+	InterfaceVersion string `json:"interface_version,omitempty"`
+	// OperationReason is the reason GARM gave for the operation (eg: "idle timeout"),
+	// set via GARM_OPERATION_REASON. It is available on the context of the command.
+	OperationReason string `json:"operation_reason,omitempty"`
+	// InstanceAction is the name of the action run by ExecAction, set via
+	// GARM_INSTANCE_ACTION.
+	InstanceAction string `json:"instance_action,omitempty"`
+	// ActionArgs holds the arguments of the action run by ExecAction, read from stdin.
+	ActionArgs json.RawMessage `json:"action_args,omitempty"`
+	// RemoveBestEffort makes RemoveAllInstances attempt to remove all instances, even
+	// if some of them fail, and report the outcome for each of them. It is set via
+	// GARM_REMOVE_BEST_EFFORT.
+	RemoveBestEffort bool `json:"remove_best_effort,omitempty"`
+	// InstanceIDs holds the IDs of the instances fetched by GetInstances, read from stdin.
+	InstanceIDs []string `json:"instance_ids,omitempty"`
+	// NIC is the network interface attached or detached by AttachNIC and DetachNIC,
+	// read from stdin.
+	NIC params.NICSpec `json:"nic"`
+	// SignOutput names the algorithm used to append a checksum line to the output of
+	// the command, so GARM can detect if the output was corrupted on the way. It is
+	// set via GARM_SIGN_OUTPUT. Only OutputSignatureSHA256 is supported.
+	SignOutput string `json:"sign_output,omitempty"`
+	// ProviderDebug enables assertions that catch provider bugs during development,
+	// at the cost of extra provider calls. It is set via GARM_PROVIDER_DEBUG.
+	ProviderDebug bool `json:"provider_debug,omitempty"`
+	// GuardTransitions makes Start and Stop refuse to act on instances that are being
+	// created or deleted, which would otherwise fail with a cloud error. This costs
+	// an extra GetInstance call. It is set via GARM_GUARD_TRANSITIONS.
+	GuardTransitions bool `json:"guard_transitions,omitempty"`
+	// StrictStdin makes GetEnvironment fail if data is passed into stdin for a command
+	// that does not read it, like bootstrap params piped to DeleteInstance, instead of
+	// silently ignoring it. It is set via GARM_STRICT_STDIN.
+	StrictStdin bool `json:"strict_stdin,omitempty"`
+	// EventsSince limits GetInstanceEvents to the events newer than it. It is set via
+	// GARM_EVENTS_SINCE, as an RFC 3339 timestamp.
+	EventsSince *time.Time `json:"events_since,omitempty"`
+	// ProviderName selects the provider of a ProviderRegistry, in binaries that act as
+	// several providers. It is set via GARM_PROVIDER_NAME.
+	ProviderName string `json:"provider_name,omitempty"`
+	// IncludeUserData asks GetInstance to return the user data of the instance, for
+	// debugging. User data usually holds credentials, like the token the instance uses
+	// to authenticate against GARM. Known secrets are redacted, and encrypted or
+	// compressed user data, which cannot be inspected, is withheld. It is set via
+	// GARM_INCLUDE_USERDATA.
+	IncludeUserData bool `json:"include_user_data,omitempty"`
+	// UserDataUnredacted disables the redaction of the user data returned by
+	// GetInstance. The output then holds live credentials, and must be treated as a
+	// secret. It is set via GARM_INCLUDE_USERDATA_UNREDACTED.
+	UserDataUnredacted bool `json:"user_data_unredacted,omitempty"`
+	// DiskSizeGB is the new size of the disk for ResizeDisk. It is set via
+	// GARM_DISK_SIZE_GB.
+	DiskSizeGB int `json:"disk_size_gb,omitempty"`
+	// InstanceCount and MinInstanceCount are the counts of the batch created by
+	// CreateInstances, read from stdin along with the bootstrap params template.
+	InstanceCount    int `json:"instance_count,omitempty"`
+	MinInstanceCount int `json:"min_instance_count,omitempty"`
+	// ProxyConfig holds the proxy settings of the provider process, read from the
+	// standard HTTP_PROXY, HTTPS_PROXY and NO_PROXY variables. Providers can pass it
+	// on to runners with BootstrapInstance.WithProxy.
+	ProxyConfig params.ProxyConfig `json:"proxy_config,omitempty"`
+	// SoftDelete makes DeleteInstance stop instances and mark them for reuse by a
+	// later CreateInstance, instead of destroying them. It only applies to providers
+	// that implement InstanceReuser. It is set via GARM_SOFT_DELETE.
+	SoftDelete bool `json:"soft_delete,omitempty"`
+	// NDJSON makes ListInstances write one instance per line, instead of a JSON
+	// array, so instances can be written as the provider discovers them. It is set
+	// via GARM_OUTPUT_NDJSON.
+	NDJSON bool `json:"ndjson,omitempty"`
+	// MaintenanceMode makes the provider reject mutating commands with
+	// errors.ErrMaintenanceMode, while still serving read only commands. Operators set
+	// it during cloud maintenance windows. It is set via GARM_MAINTENANCE_MODE.
+	MaintenanceMode bool `json:"maintenance_mode,omitempty"`
+
+	// trimmedEnvVars holds the names of the variables GetEnvironment removed
+	// surrounding whitespace from.
+	trimmedEnvVars []string
+}
+
+// InstanceRef returns the instance ID set in GARM_INSTANCE_ID, parsed as a
+// structured reference. Providers that encode the zone or region in the instance
+// ID can use this instead of splitting InstanceID themselves.
+func (e Environment) InstanceRef() (params.InstanceRef, error) {
+	return params.ParseInstanceRef(e.InstanceID)
+}
+
+const redactedValue = "<redacted>"
+
+// Redacted returns a copy of the environment with any secrets masked. The result
+// is safe to log or print.
+func (e Environment) Redacted() Environment {
+	if e.BootstrapParams.InstanceToken != "" {
+		e.BootstrapParams.InstanceToken = redactedValue
+	}
+
+	if e.BootstrapParams.Tools != nil {
+		tools := make([]params.RunnerApplicationDownload, len(e.BootstrapParams.Tools))
+		for idx, tool := range e.BootstrapParams.Tools {
+			if tool.TempDownloadToken != nil {
+				token := redactedValue
+				tool.TempDownloadToken = &token
+			}
+			tools[idx] = tool
+		}
+		e.BootstrapParams.Tools = tools
+	}
+
+	e.ProxyConfig = e.ProxyConfig.Redacted()
+	return e
+}
+
+// missingInstanceIDError returns the error for instance scoped commands run without
+// an instance ID. If a pool ID is set, a pool scoped command may have been intended
+// instead, so the error suggests it.
+func (e Environment) missingInstanceIDError() error {
+	if e.PoolID != "" {
+		switch e.Command {
+		case GetInstanceCommand:
+			return gErrors.NewValidationError("GARM_INSTANCE_ID", "missing instance ID: %s requires GARM_INSTANCE_ID, use %s to list the instances of pool %s", e.Command, ListInstancesCommand, e.PoolID)
+		case StartInstanceCommand:
+			return gErrors.NewValidationError("GARM_INSTANCE_ID", "missing instance ID: %s requires GARM_INSTANCE_ID, use %s to start all instances of pool %s", e.Command, StartPoolCommand, e.PoolID)
+		case StopInstanceCommand:
+			return gErrors.NewValidationError("GARM_INSTANCE_ID", "missing instance ID: %s requires GARM_INSTANCE_ID, use %s to stop all instances of pool %s", e.Command, StopPoolCommand, e.PoolID)
+		}
+	}
+	return gErrors.NewValidationError("GARM_INSTANCE_ID", "missing instance ID: %s requires GARM_INSTANCE_ID", e.Command)
 }
 
 func (e Environment) Validate() error {
+	return e.validate(RunOptions{})
+}
+
+// validate checks the environment, honoring the options that relax validation, like
+// custom commands.
+func (e Environment) validate(opts RunOptions) error {
 	if e.Command == "" {
 		return fmt.Errorf("missing GARM_COMMAND")
 	}
 
-	if e.ProviderConfigFile == "" {
-		return fmt.Errorf("missing GARM_PROVIDER_CONFIG_FILE")
-	}
+	if requiresConfig(e.Command) {
+		files := e.configFiles()
+		if len(files) == 0 {
+			return fmt.Errorf("missing GARM_PROVIDER_CONFIG_FILE or GARM_PROVIDER_CONFIG_FILES")
+		}
 
-	if _, err := os.Lstat(e.ProviderConfigFile); err != nil {
-		return fmt.Errorf("error accessing config file: %w", err)
+		if _, err := os.Lstat(files[0]); err != nil {
+			return fmt.Errorf("error accessing config file: %w", err)
+		}
 	}
 
 	if e.ControllerID == "" {
 		return fmt.Errorf("missing GARM_CONTROLLER_ID")
 	}
 
+	if e.SignOutput != "" && e.SignOutput != OutputSignatureSHA256 {
+		return fmt.Errorf("invalid GARM_SIGN_OUTPUT: unsupported algorithm %q", e.SignOutput)
+	}
+
+	if e.InterfaceVersion != "" {
+		if _, err := normalizeInterfaceVersion(e.InterfaceVersion); err != nil {
+			return fmt.Errorf("invalid GARM_INTERFACE_VERSION: %w", err)
+		}
+	}
+
 	switch e.Command {
-	case CreateInstanceCommand:
+	case CreateInstanceCommand, CreateInstancesCommand:
+		if e.Command == CreateInstancesCommand {
+			if err := e.createInstancesRequest().Validate(); err != nil {
+				return fmt.Errorf("invalid create instances request: %w", err)
+			}
+		}
 		if e.BootstrapParams.Name == "" {
 			return fmt.Errorf("missing bootstrap params")
 		}
+		if err := e.BootstrapParams.Validate(); err != nil {
+			return fmt.Errorf("invalid bootstrap params: %w", err)
+		}
+		if err := params.ValidateBootstrapConstraints(e.BootstrapParams, opts.BootstrapConstraints...); err != nil {
+			return fmt.Errorf("invalid bootstrap params: %w", err)
+		}
 		if e.ControllerID == "" {
 			return fmt.Errorf("missing controller ID")
 		}
 		if e.PoolID == "" {
 			return fmt.Errorf("missing pool ID")
 		}
+		if e.BootstrapParams.Flavor == "" && !opts.AllowEmptyFlavor {
+			// Otherwise the create fails deep in the cloud call with a vague error.
+			return fmt.Errorf("missing flavor in bootstrap params, the pool must set one: %w", gErrors.ErrBadRequest)
+		}
 	case DeleteInstanceCommand, GetInstanceCommand,
-		StartInstanceCommand, StopInstanceCommand:
+		StartInstanceCommand, StopInstanceCommand,
+		RotateInstanceCredentialsCommand, InstanceExistsCommand,
+		GetBootDiagnosticsCommand, GetInstanceEventsCommand:
 		if e.InstanceID == "" {
-			return fmt.Errorf("missing instance ID")
+			return e.missingInstanceIDError()
 		}
-	case ListInstancesCommand:
+	case ResizeDiskCommand:
+		if e.InstanceID == "" {
+			return e.missingInstanceIDError()
+		}
+		if e.DiskSizeGB <= 0 {
+			return fmt.Errorf("disk size must be positive, got %d: %w", e.DiskSizeGB, gErrors.ErrBadRequest)
+		}
+	case GetInstancesCommand:
+		if len(e.InstanceIDs) == 0 {
+			return fmt.Errorf("missing instance IDs")
+		}
+		for idx, id := range e.InstanceIDs {
+			if id == "" {
+				return fmt.Errorf("empty instance ID at index %d", idx)
+			}
+		}
+	case AttachNICCommand, DetachNICCommand:
+		if e.InstanceID == "" {
+			return e.missingInstanceIDError()
+		}
+		if err := e.NIC.Validate(); err != nil {
+			return fmt.Errorf("invalid nic spec: %w", err)
+		}
+	case ExecActionCommand:
+		if e.InstanceID == "" {
+			return e.missingInstanceIDError()
+		}
+		if e.InstanceAction == "" {
+			return fmt.Errorf("missing GARM_INSTANCE_ACTION")
+		}
+	case ListInstancesCommand, StopPoolCommand, StartPoolCommand:
 		if e.PoolID == "" {
 			return fmt.Errorf("missing pool ID")
 		}
-	case RemoveAllInstancesCommand:
+	case RemoveAllInstancesCommand, ListAllInstancesCommand:
 		if e.ControllerID == "" {
 			return fmt.Errorf("missing controller ID")
 		}
+	case UpdateInstanceStatusCommand:
+		if e.StatusUpdate.InstanceID == "" {
+			return e.missingInstanceIDError()
+		}
+		if !e.StatusUpdate.Status.IsValid() {
+			return fmt.Errorf("invalid instance status: %q", e.StatusUpdate.Status)
+		}
+	case EstimateCostCommand, RenderBootstrapCommand, WarmupCommand:
+		if err := e.BootstrapParams.Validate(); err != nil {
+			return fmt.Errorf("invalid bootstrap params: %w", err)
+		}
+	case DumpEnvCommand, DescribeProviderCommand, TestConfigCommand, MetricsCommand,
+		GetEffectiveConfigCommand, GetExtraSpecsSchemaCommand:
 	default:
-		return fmt.Errorf("unknown GARM_COMMAND: %s", e.Command)
+		if _, ok := opts.CustomCommandHandler[e.Command]; !ok {
+			return fmt.Errorf("unknown GARM_COMMAND: %s", e.Command)
+		}
 	}
 	return nil
 }
 
+// Run executes the command described by env against the provider, using the
+// default RunOptions.
 func Run(ctx context.Context, provider ExternalProvider, env Environment) (string, error) {
+	return RunWithOptions(ctx, provider, env, RunOptions{})
+}
+
+// RunToStreams executes the command described by env against the provider, using
+// the default RunOptions. The result of the command, which GARM parses as JSON, is
+// the only thing ever written to stdout. Everything else, like debug messages and
+// warnings, goes to stderr. The error is returned, and is not written to either.
+// A nil stdout or stderr defaults to os.Stdout or os.Stderr respectively.
+func RunToStreams(ctx context.Context, provider ExternalProvider, env Environment, stdout, stderr io.Writer) error {
+	if stdout == nil {
+		stdout = os.Stdout
+	}
+	_, err := RunWithOptions(ctx, provider, env, RunOptions{Output: stdout, Stderr: stderr})
+	return err
+}
+
+// RunWithOptions executes the command described by env against the provider and
+// returns the serialized result. If opts.Output is set, the result is also written
+// to it. Commands that partially fail, like RemoveAllInstances in best effort mode,
+// return a result along with the error.
+func RunWithOptions(ctx context.Context, provider ExternalProvider, env Environment, opts RunOptions) (string, error) {
+	if provider == nil && !isLocalCommand(env.Command) {
+		return "", fmt.Errorf("provider must not be nil")
+	}
+
+	if err := env.assertV010Command(); err != nil {
+		return "", err
+	}
+
+	if opts.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = withTimeout(ctx, opts.clock(), opts.Timeout)
+		defer cancel()
+	}
+
+	if env.MaintenanceMode && opts.isMutating(env.Command) {
+		return "", fmt.Errorf("refusing to run %s: %w", env.Command, gErrors.ErrMaintenanceMode)
+	}
+
+	if opts.DryRun && opts.isMutating(env.Command) {
+		opts.debugf("dry run enabled, skipping %s", env.Command)
+		return "", nil
+	}
+
+	for _, name := range env.trimmedEnvVars {
+		opts.debugf("removed surrounding whitespace from the value of %s", name)
+	}
+
+	if env.CorrelationID == "" {
+		env.CorrelationID = uuid.New().String()
+	}
+	ctx = WithCorrelationID(ctx, env.CorrelationID)
+
+	if env.OperationReason != "" {
+		ctx = WithOperationReason(ctx, env.OperationReason)
+	}
+
+	if env.CreateAsync && env.Command == CreateInstanceCommand {
+		ctx = WithCreateAsync(ctx)
+	}
+
+	switch env.Command {
+	case CreateInstanceCommand, CreateInstancesCommand, EstimateCostCommand, RenderBootstrapCommand, WarmupCommand:
+		// Make the IDs known to GARM available to BootstrapInstance.StandardTags.
+		if env.BootstrapParams.ControllerID == "" {
+			env.BootstrapParams.ControllerID = env.ControllerID
+		}
+		if env.BootstrapParams.PoolID == "" {
+			env.BootstrapParams.PoolID = env.PoolID
+		}
+	}
+
+	if (env.Command == CreateInstanceCommand || env.Command == CreateInstancesCommand) && env.BootstrapParams.Image != "" {
+		// Catch malformed image references before a VM launch is attempted.
+		image, err := opts.canonicalImageRef(env)
+		if err != nil {
+			return "", fmt.Errorf("invalid image reference: %w", err)
+		}
+		env.BootstrapParams.Image = image
+	}
+
+	if opts.NameRewriter != nil && env.Command == CreateInstanceCommand {
+		env.BootstrapParams.OriginalName = env.BootstrapParams.Name
+		env.BootstrapParams.Name = opts.NameRewriter(env.BootstrapParams.Name)
+		opts.debugf("rewrote instance name %q to %q", env.BootstrapParams.OriginalName, env.BootstrapParams.Name)
+	}
+
+	if err := loadConfig(provider, env, opts); err != nil {
+		return "", err
+	}
+
+	useCache := opts.CacheTTL > 0 && opts.ResponseCache != nil && isCacheableCommand(env.Command)
+	ret, cached := "", false
+	if useCache {
+		ret, cached = opts.ResponseCache.get(env, opts.clock().Now())
+	}
+
+	var runErr error
+	if cached {
+		fmt.Fprintf(opts.stderr(), "INFO: %s returned a cached response (correlation ID: %s)\n", env.Command, env.CorrelationID)
+	} else {
+		ret, runErr = func() (string, error) {
+			unlock, err := lockInstance(ctx, env, opts)
+			if err != nil {
+				return "", err
+			}
+			// Deferred, so a provider that panics, as recovered by RunServer, does
+			// not leave the instance locked.
+			defer unlock()
+			return executeWithBreaker(ctx, provider, env, opts)
+		}()
+		if runErr != nil && ret == "" {
+			return "", runErr
+		}
+		if runErr == nil && useCache {
+			opts.ResponseCache.set(env, ret, opts.clock().Now().Add(opts.CacheTTL))
+		}
+	}
+
+	ret, err := env.signOutput(ret)
+	if err != nil {
+		return "", err
+	}
+
+	if opts.Output != nil {
+		if _, err := io.WriteString(opts.Output, ret); err != nil {
+			return "", fmt.Errorf("failed to write response: %w", err)
+		}
+	}
+	return ret, runErr
+}
+
+// executeWithBreaker runs execute, guarded by the circuit breaker if one is set.
+// Local commands do not call the provider, and thus bypass the breaker.
+func executeWithBreaker(ctx context.Context, provider ExternalProvider, env Environment, opts RunOptions) (string, error) {
+	breaker := opts.CircuitBreaker
+	if breaker == nil || isLocalCommand(env.Command) {
+		return execute(ctx, provider, env, opts)
+	}
+
+	if err := breaker.allow(env.Command, opts.clock().Now()); err != nil {
+		return "", err
+	}
+	ret, err := execute(ctx, provider, env, opts)
+	if recordErr := breaker.record(env.Command, opts.clock().Now(), err); recordErr != nil {
+		opts.debugf("failed to record circuit breaker state for %s: %q", env.Command, recordErr)
+	}
+	return ret, err
+}
+
+// execute calls the provider, retrying as needed, and records the outcome.
+func execute(ctx context.Context, provider ExternalProvider, env Environment, opts RunOptions) (string, error) {
+	opts.debugf("running %s (correlation ID: %s)", env.Command, env.CorrelationID)
+	ctx, collected := withWarnings(ctx)
+	clock := opts.clock()
+	start := clock.Now()
+	ret, err := opts.Retry.do(ctx, clock, opts.isIdempotent(env.Command), func() (string, error) {
+		return dispatch(ctx, provider, env, opts)
+	})
+	duration := clock.Now().Sub(start)
+	collected.flush(env, opts)
+	if opts.Metrics != nil {
+		opts.Metrics.ObserveCommand(env.Command, duration, err)
+	}
+	if err != nil {
+		opts.debugf("%s failed: %q", env.Command, err)
+		fmt.Fprintf(opts.stderr(), "INFO: %s failed after %s (correlation ID: %s)\n", env.Command, duration, env.CorrelationID)
+		if seconds, ok := RetryAfterSeconds(err); ok {
+			// Let GARM back off for as long as the cloud asked, instead of guessing.
+			fmt.Fprintf(opts.stderr(), "GARM_RETRY_AFTER=%d\n", seconds)
+		}
+		return ret, err
+	}
+	fmt.Fprintf(opts.stderr(), "INFO: %s finished in %s (correlation ID: %s)\n", env.Command, duration, env.CorrelationID)
+	return ret, nil
+}
+
+// removeAllBestEffort removes all instances through a BestEffortRemover. If any of
+// the instances could not be removed, the result is returned along with an error.
+func removeAllBestEffort(ctx context.Context, provider ExternalProvider, opts RunOptions) (string, error) {
+	remover, ok := asOptional[BestEffortRemover](provider)
+	if !ok {
+		return "", fmt.Errorf("failed to destroy environment in best effort mode: %w", gErrors.ErrNotImplemented)
+	}
+
+	removed, failed := remover.RemoveAllInstancesBestEffort(ctx)
+	result := params.RemoveAllResult{Removed: removed}
+	if result.Removed == nil {
+		result.Removed = []string{}
+	}
+	sort.Strings(result.Removed)
+
+	ids := make([]string, 0, len(failed))
+	for id := range failed {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	var errs []error
+	for _, id := range ids {
+		if result.Failed == nil {
+			result.Failed = map[string]string{}
+		}
+		result.Failed[id] = failed[id].Error()
+		errs = append(errs, fmt.Errorf("instance %s: %w", id, failed[id]))
+	}
+
+	ret, err := opts.marshal(result)
+	if err != nil {
+		return "", err
+	}
+	if len(errs) > 0 {
+		// The errors of individual instances are not wrapped, so that a single missing
+		// instance does not turn the outcome of the whole command into ErrNotFound.
+		return ret, fmt.Errorf("failed to remove %d of %d instances: %s", len(errs), len(errs)+len(result.Removed), errors.Join(errs...))
+	}
+	return ret, nil
+}
+
+// verifyInstanceID checks, in provider debug mode, that the provider resolves the
+// instance ID it was given to the same instance. A provider that mis-parses IDs may
+// otherwise operate on the wrong instance. Mismatches are reported as warnings, as the
+// operation already happened.
+func verifyInstanceID(ctx context.Context, provider ExternalProvider, env Environment) {
+	if !env.ProviderDebug {
+		return
+	}
+
+	instance, err := provider.GetInstance(ctx, env.InstanceID)
+	if err != nil {
+		AddWarning(ctx, "PROVIDER DEBUG: failed to verify instance %s after %s: %s", env.InstanceID, env.Command, err)
+		return
+	}
+	if instance.ProviderID != env.InstanceID && instance.Name != env.InstanceID {
+		AddWarning(ctx, "PROVIDER DEBUG: %s was requested for instance %s, but GetInstance returned instance %q (name %q)", env.Command, env.InstanceID, instance.ProviderID, instance.Name)
+	}
+}
+
+// prepareInstance fills in any fields of an instance returned by the provider
+// which can be derived from the other fields.
+func prepareInstance(instance params.ProviderInstance) params.ProviderInstance {
+	// User data is only returned by GetInstance, when explicitly requested.
+	instance.UserData = nil
+
+	if instance.PowerState == "" {
+		if powerState := params.PowerStateFromStatus(instance.Status); powerState != params.PowerStateUnknown {
+			instance.PowerState = powerState
+		}
+	}
+
+	if instance.Addresses != nil {
+		addresses := make([]params.Address, len(instance.Addresses))
+		for idx, address := range instance.Addresses {
+			if address.Family == "" {
+				address.Family = params.AddressFamilyOf(address.Address)
+			}
+			addresses[idx] = address
+		}
+		instance.Addresses = addresses
+	}
+	return instance
+}
+
+// createInstances creates the batch requested by CreateInstances. If the cloud
+// creates fewer instances than the minimum, the ones it created are deleted, so
+// GARM does not have to track instances of a failed batch.
+func createInstances(ctx context.Context, provider ExternalProvider, env Environment, opts RunOptions) ([]params.ProviderInstance, error) {
+	creator, ok := asOptional[BatchCreator](provider)
+	if !ok {
+		return nil, fmt.Errorf("failed to create instances: %w", gErrors.ErrNotImplemented)
+	}
+	if err := prevalidatePool(ctx, provider, env); err != nil {
+		return nil, err
+	}
+
+	request := env.createInstancesRequest()
+	instances, err := creator.CreateInstances(ctx, env.BootstrapParams, request.Count)
+	if len(instances) < request.MinInstances() {
+		for _, instance := range instances {
+			id := instance.ProviderID
+			if id == "" {
+				id = instance.Name
+			}
+			if deleteErr := provider.DeleteInstance(ctx, id); deleteErr != nil {
+				opts.debugf("failed to clean up instance %s of failed batch: %q", id, deleteErr)
+			}
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to create instances in provider: %w", err)
+		}
+		return nil, fmt.Errorf("provider created %d instances, fewer than the minimum of %d", len(instances), request.MinInstances())
+	}
+	if err != nil {
+		opts.debugf("provider created %d of %d instances: %q", len(instances), request.Count, err)
+	}
+
+	ret := make([]params.ProviderInstance, len(instances))
+	for idx, instance := range instances {
+		instance = sanitizeHostname(ctx, prepareInstance(instance))
+		if instance.RunnerLabels == nil {
+			instance.RunnerLabels = env.BootstrapParams.Labels
+		}
+		ret[idx] = env.downgradeInstance(opts.mapStatus(instance))
+	}
+	return ret, nil
+}
+
+// sanitizeHostname clears the hostname of an instance if it is invalid, and reports
+// it as a warning. Failing the command instead would hide an instance that exists
+// from GARM.
+func sanitizeHostname(ctx context.Context, instance params.ProviderInstance) params.ProviderInstance {
+	if instance.Hostname == "" {
+		return instance
+	}
+	if err := params.ValidateHostname(instance.Hostname); err != nil {
+		AddWarning(ctx, "ignoring invalid hostname of instance %s: %s", instance.Name, err)
+		instance.Hostname = ""
+	}
+	return instance
+}
+
+// prevalidatePool checks the pool of the instance that is about to be created, if
+// enabled and supported by the provider.
+func prevalidatePool(ctx context.Context, provider ExternalProvider, env Environment) error {
+	if !env.PrevalidatePool {
+		return nil
+	}
+
+	validator, ok := asOptional[PoolValidator](provider)
+	if !ok {
+		return nil
+	}
+
+	poolID := env.BootstrapParams.PoolID
+	if poolID == "" {
+		poolID = env.PoolID
+	}
+	if err := validator.ValidatePool(ctx, poolID); err != nil {
+		return fmt.Errorf("failed to validate pool %s: %w", poolID, err)
+	}
+	return nil
+}
+
+// isInPowerState returns true if no-op skipping is enabled and the instance is
+// already in the desired power state. If transition guarding is enabled, it returns
+// an error if the instance is being created or deleted. Both checks cost an extra
+// GetInstance call for every Start and Stop, and rely on the provider reporting a
+// reliable status.
+func isInPowerState(ctx context.Context, provider ExternalProvider, env Environment, desired params.PowerState) (bool, error) {
+	if !env.SkipNoop && !env.GuardTransitions {
+		return false, nil
+	}
+
+	instance, err := provider.GetInstance(ctx, env.InstanceID)
+	if err != nil {
+		if !env.SkipNoop && errors.Is(err, gErrors.ErrNotImplemented) {
+			// The guard is best effort, and is skipped for providers that cannot
+			// report the status of an instance.
+			return false, nil
+		}
+		return false, fmt.Errorf("failed to get instance from provider: %w", err)
+	}
+
+	if env.GuardTransitions && instance.Status.IsTransitional() {
+		return false, fmt.Errorf("cannot run %s on instance %s while it is %s: %w", env.Command, env.InstanceID, instance.Status, gErrors.ErrBadRequest)
+	}
+	return env.SkipNoop && prepareInstance(instance).PowerState == desired, nil
+}
+
+// instanceExists checks if the instance exists, using GetInstance if the provider
+// does not implement ExistenceChecker.
+func instanceExists(ctx context.Context, provider ExternalProvider, instance string) (bool, error) {
+	if checker, ok := asOptional[ExistenceChecker](provider); ok {
+		return checker.InstanceExists(ctx, instance)
+	}
+
+	if _, err := provider.GetInstance(ctx, instance); err != nil {
+		if errors.Is(err, gErrors.ErrNotFound) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// createInstance creates an instance, reusing a soft deleted one if possible.
+func createInstance(ctx context.Context, provider ExternalProvider, env Environment, opts RunOptions) (params.ProviderInstance, error) {
+	if reuser, ok := asOptional[InstanceReuser](provider); ok && env.SoftDelete {
+		instance, err := reuser.ReuseInstance(ctx, env.BootstrapParams)
+		if err == nil {
+			opts.debugf("reused soft deleted instance %s for %s", instance.ProviderID, env.BootstrapParams.Name)
+			return instance, nil
+		}
+		if !errors.Is(err, gErrors.ErrNotFound) {
+			return params.ProviderInstance{}, fmt.Errorf("failed to reuse instance: %w", err)
+		}
+	}
+	return provider.CreateInstance(ctx, env.BootstrapParams)
+}
+
+// deleteInstance deletes an instance, passing along the reason of the operation if
+// the provider can make use of it. In soft delete mode, the instance is stopped
+// and marked for reuse instead.
+func deleteInstance(ctx context.Context, provider ExternalProvider, env Environment) error {
+	if reuser, ok := asOptional[InstanceReuser](provider); ok && env.SoftDelete {
+		if err := stopInstance(ctx, provider, env); err != nil {
+			return err
+		}
+		return reuser.MarkForReuse(ctx, env.InstanceID)
+	}
+	if deleter, ok := asOptional[ReasonedDeleter](provider); ok && env.OperationReason != "" {
+		return deleter.DeleteInstanceWithReason(ctx, env.InstanceID, env.OperationReason)
+	}
+	return provider.DeleteInstance(ctx, env.InstanceID)
+}
+
+// stopInstance stops an instance, passing along the reason of the operation if the
+// provider can make use of it.
+func stopInstance(ctx context.Context, provider ExternalProvider, env Environment) error {
+	if stopper, ok := asOptional[ReasonedStopper](provider); ok && env.OperationReason != "" {
+		return stopper.StopWithReason(ctx, env.InstanceID, true, env.OperationReason)
+	}
+	return provider.Stop(ctx, env.InstanceID, true)
+}
+
+func dispatch(ctx context.Context, provider ExternalProvider, env Environment, opts RunOptions) (string, error) {
 	var ret string
 	switch env.Command {
 	case CreateInstanceCommand:
-		instance, err := provider.CreateInstance(ctx, env.BootstrapParams)
+		if err := prevalidatePool(ctx, provider, env); err != nil {
+			return "", err
+		}
+
+		if generator, ok := asOptional[UserDataGenerator](provider); ok {
+			userData, err := generator.GenerateUserData(ctx, env.BootstrapParams)
+			if err != nil {
+				return "", fmt.Errorf("failed to generate user data: %w", err)
+			}
+			if err := params.ValidateUserDataSize(userData, generator.MaxUserDataSize()); err != nil {
+				return "", fmt.Errorf("invalid user data: %w", err)
+			}
+			if !opts.AllowEmptyUserData {
+				if err := params.ValidateUserDataNotEmpty(userData); err != nil {
+					return "", fmt.Errorf("invalid user data: %w", err)
+				}
+			}
+			ctx = WithUserData(ctx, userData)
+		}
+		if !opts.AllowEmptyUserData && env.BootstrapParams.InstanceToken == "" {
+			// Without a token the runner can neither register nor report back to GARM.
+			return "", fmt.Errorf("missing instance token in bootstrap params: %w", gErrors.ErrBadRequest)
+		}
+
+		instance, err := createInstance(ctx, provider, env, opts)
 		if err != nil {
 			return "", fmt.Errorf("failed to create instance in provider: %w", err)
 		}
+		if env.CreateAsync {
+			// GARM polls GetInstance to follow the progress of instances created
+			// asynchronously, so we need an ID it can poll with.
+			if instance.ProviderID == "" {
+				return "", fmt.Errorf("provider returned an instance without a provider ID in async mode")
+			}
+			if instance.Status == "" {
+				instance.Status = params.InstancePendingCreate
+			}
+		}
+		instance = sanitizeHostname(ctx, prepareInstance(instance))
+		// Instances may not have an address yet, but if the provider reports addresses,
+		// at least one of them must be usable.
+		if len(instance.Addresses) > 0 && !instance.HasUsableAddress() {
+			return "", fmt.Errorf("instance %s has no usable address", instance.Name)
+		}
+		if instance.RunnerLabels == nil {
+			instance.RunnerLabels = env.BootstrapParams.Labels
+		}
 
-		asJs, err := json.Marshal(instance)
+		asJs, err := opts.marshal(env.downgradeInstance(opts.mapStatus(instance)))
 		if err != nil {
-			return "", fmt.Errorf("failed to marshal response: %w", err)
+			return "", err
 		}
-		ret = string(asJs)
+		ret = asJs
 	case GetInstanceCommand:
+		if env.IncludeUserData {
+			ctx = WithIncludeUserData(ctx)
+		}
 		instance, err := provider.GetInstance(ctx, env.InstanceID)
 		if err != nil {
 			return "", fmt.Errorf("failed to get instance from provider: %w", err)
 		}
-		asJs, err := json.Marshal(instance)
+		userData := instance.UserData
+		instance = sanitizeHostname(ctx, prepareInstance(instance))
+		if env.IncludeUserData {
+			if !env.UserDataUnredacted {
+				userData = redactUserData(userData)
+			}
+			instance.UserData = userData
+		}
+		asJs, err := opts.marshal(env.downgradeInstance(opts.mapStatus(instance)))
+		if err != nil {
+			return "", err
+		}
+		ret = asJs
+	case GetInstancesCommand:
+		results, err := getInstances(ctx, provider, env, opts)
 		if err != nil {
-			return "", fmt.Errorf("failed to marshal response: %w", err)
+			return "", err
 		}
-		ret = string(asJs)
+		asJs, err := opts.marshal(results)
+		if err != nil {
+			return "", err
+		}
+		ret = asJs
 	case ListInstancesCommand:
-		instances, err := provider.ListInstances(ctx, env.PoolID)
+		asJs, err := listInstances(ctx, provider, env, opts)
 		if err != nil {
-			return "", fmt.Errorf("failed to list instances from provider: %w", err)
+			return "", err
 		}
-		asJs, err := json.Marshal(instances)
+		ret = asJs
+	case ListAllInstancesCommand:
+		lister, ok := asOptional[AllInstancesLister](provider)
+		if !ok {
+			return "", fmt.Errorf("failed to list all instances from provider: %w", gErrors.ErrNotImplemented)
+		}
+		instances, err := lister.ListAllInstances(ctx, env.ControllerID)
 		if err != nil {
-			return "", fmt.Errorf("failed to marshal response: %w", err)
+			return "", fmt.Errorf("failed to list all instances from provider: %w", err)
+		}
+		for idx := range instances {
+			instances[idx] = opts.mapStatus(sanitizeHostname(ctx, prepareInstance(instances[idx])))
 		}
-		ret = string(asJs)
+		asJs, err := opts.marshal(instances)
+		if err != nil {
+			return "", err
+		}
+		ret = asJs
+	case InstanceExistsCommand:
+		exists, err := instanceExists(ctx, provider, env.InstanceID)
+		if err != nil {
+			return "", fmt.Errorf("failed to check if instance exists: %w", err)
+		}
+
+		asJs, err := opts.marshal(params.InstanceExistence{Exists: exists})
+		if err != nil {
+			return "", err
+		}
+		ret = asJs
 	case DeleteInstanceCommand:
-		if err := provider.DeleteInstance(ctx, env.InstanceID); err != nil {
+		_, err := DeleteProvisioningRetry.do(ctx, opts.clock(), true, func() (string, error) {
+			return "", deleteInstance(ctx, provider, env)
+		})
+		if err != nil {
 			return "", fmt.Errorf("failed to delete instance from provider: %w", err)
 		}
 	case RemoveAllInstancesCommand:
+		if env.RemoveBestEffort {
+			return removeAllBestEffort(ctx, provider, opts)
+		}
 		if err := provider.RemoveAllInstances(ctx); err != nil {
 			return "", fmt.Errorf("failed to destroy environment: %w", err)
 		}
 	case StartInstanceCommand:
+		noop, err := isInPowerState(ctx, provider, env, params.PowerStateOn)
+		if err != nil {
+			return "", err
+		}
+		if noop {
+			opts.debugf("instance %s is already running, skipping %s", env.InstanceID, env.Command)
+			break
+		}
 		if err := provider.Start(ctx, env.InstanceID); err != nil {
 			return "", fmt.Errorf("failed to start instance: %w", err)
 		}
+		verifyInstanceID(ctx, provider, env)
 	case StopInstanceCommand:
-		if err := provider.Stop(ctx, env.InstanceID, true); err != nil {
+		noop, err := isInPowerState(ctx, provider, env, params.PowerStateOff)
+		if err != nil {
+			return "", err
+		}
+		if noop {
+			opts.debugf("instance %s is already stopped, skipping %s", env.InstanceID, env.Command)
+			break
+		}
+		if err := stopInstance(ctx, provider, env); err != nil {
 			return "", fmt.Errorf("failed to stop instance: %w", err)
 		}
+		verifyInstanceID(ctx, provider, env)
+	case StopPoolCommand, StartPoolCommand:
+		instances, poolErr := setPoolPowerState(ctx, provider, env, opts)
+		if poolErr != nil && len(instances) == 0 {
+			return "", poolErr
+		}
+
+		asJs, err := opts.marshal(params.PoolOperationResult{PoolID: env.PoolID, Instances: instances})
+		if err != nil {
+			return "", err
+		}
+		if poolErr != nil {
+			// Report the instances that were affected, so GARM knows their state.
+			return asJs, partialOutputError{poolErr}
+		}
+		ret = asJs
+	case TestConfigCommand:
+		tester, ok := asOptional[ConfigTester](provider)
+		if !ok {
+			return "", fmt.Errorf("failed to test config: %w", gErrors.ErrNotImplemented)
+		}
+		if err := tester.TestConfig(ctx); err != nil {
+			return "", fmt.Errorf("failed to test config: %w", err)
+		}
+	case MetricsCommand:
+		// Providers without metrics have nothing to report.
+		exporter, ok := asOptional[MetricsExporter](provider)
+		if !ok {
+			break
+		}
+		metrics, err := exporter.Metrics(ctx)
+		if err != nil {
+			return "", fmt.Errorf("failed to get metrics: %w", err)
+		}
+		// The exposition format is text, so it is returned as is instead of being
+		// marshaled to JSON.
+		ret = string(metrics)
+	case UpdateInstanceStatusCommand:
+		updater, ok := asOptional[StatusUpdater](provider)
+		if !ok {
+			return "", fmt.Errorf("failed to update instance status: %w", gErrors.ErrNotImplemented)
+		}
+		if err := updater.UpdateStatus(ctx, env.StatusUpdate); err != nil {
+			return "", fmt.Errorf("failed to update instance status: %w", err)
+		}
+	case RotateInstanceCredentialsCommand:
+		rotator, ok := asOptional[CredentialRotator](provider)
+		if !ok {
+			return "", fmt.Errorf("failed to rotate instance credentials: %w", gErrors.ErrNotImplemented)
+		}
+		if err := rotator.RotateCredentials(ctx, env.InstanceID); err != nil {
+			return "", fmt.Errorf("failed to rotate instance credentials: %w", err)
+		}
+	case AttachNICCommand, DetachNICCommand:
+		manager, ok := asOptional[NICManager](provider)
+		if !ok {
+			return "", fmt.Errorf("failed to run %s: %w", env.Command, gErrors.ErrNotImplemented)
+		}
+		var err error
+		if env.Command == AttachNICCommand {
+			err = manager.AttachNIC(ctx, env.InstanceID, env.NIC)
+		} else {
+			err = manager.DetachNIC(ctx, env.InstanceID, env.NIC)
+		}
+		if err != nil {
+			return "", fmt.Errorf("failed to run %s: %w", env.Command, err)
+		}
+	case WarmupCommand:
+		warmer, ok := asOptional[Warmer](provider)
+		if !ok {
+			return "", fmt.Errorf("failed to warm up: %w", gErrors.ErrNotImplemented)
+		}
+		if err := warmer.Warmup(ctx, env.BootstrapParams); err != nil {
+			return "", fmt.Errorf("failed to warm up: %w", err)
+		}
+	case RenderBootstrapCommand:
+		generator, ok := asOptional[UserDataGenerator](provider)
+		if !ok {
+			return "", fmt.Errorf("failed to render bootstrap: %w", gErrors.ErrNotImplemented)
+		}
+		userData, err := generator.GenerateUserData(ctx, env.BootstrapParams)
+		if err != nil {
+			return "", fmt.Errorf("failed to render bootstrap: %w", err)
+		}
+		asJs, err := opts.marshal(params.RenderedBootstrap{UserData: userData})
+		if err != nil {
+			return "", err
+		}
+		ret = asJs
+	case GetEffectiveConfigCommand:
+		reporter, ok := asOptional[EffectiveConfigReporter](provider)
+		if !ok {
+			return "", fmt.Errorf("failed to get effective config: %w", gErrors.ErrNotImplemented)
+		}
+		cfg, err := reporter.EffectiveConfig(ctx)
+		if err != nil {
+			return "", fmt.Errorf("failed to get effective config: %w", err)
+		}
+		if cfg == nil {
+			cfg = map[string]interface{}{}
+		}
+		asJs, err := opts.marshal(redactConfig(cfg))
+		if err != nil {
+			return "", err
+		}
+		ret = asJs
+	case CreateInstancesCommand:
+		instances, err := createInstances(ctx, provider, env, opts)
+		if err != nil {
+			return "", err
+		}
+		asJs, err := opts.marshal(instances)
+		if err != nil {
+			return "", err
+		}
+		ret = asJs
+	case ResizeDiskCommand:
+		resizer, ok := asOptional[DiskResizer](provider)
+		if !ok {
+			return "", fmt.Errorf("failed to resize disk: %w", gErrors.ErrNotImplemented)
+		}
+		if err := resizer.ResizeDisk(ctx, env.InstanceID, env.DiskSizeGB); err != nil {
+			return "", fmt.Errorf("failed to resize disk: %w", err)
+		}
+	case GetInstanceEventsCommand:
+		getter, ok := asOptional[EventsGetter](provider)
+		if !ok {
+			return "", fmt.Errorf("failed to get instance events: %w", gErrors.ErrNotImplemented)
+		}
+		var since time.Time
+		if env.EventsSince != nil {
+			since = *env.EventsSince
+		}
+		events, err := getter.GetEvents(ctx, env.InstanceID, since)
+		if err != nil {
+			return "", fmt.Errorf("failed to get instance events: %w", err)
+		}
+		if events == nil {
+			events = []params.InstanceEvent{}
+		}
+		asJs, err := opts.marshal(events)
+		if err != nil {
+			return "", err
+		}
+		ret = asJs
+	case GetBootDiagnosticsCommand:
+		getter, ok := asOptional[BootDiagnosticsGetter](provider)
+		if !ok {
+			return "", fmt.Errorf("failed to get boot diagnostics: %w", gErrors.ErrNotImplemented)
+		}
+		diagnostics, err := getter.GetBootDiagnostics(ctx, env.InstanceID)
+		if err != nil {
+			return "", fmt.Errorf("failed to get boot diagnostics: %w", err)
+		}
+		asJs, err := opts.marshal(diagnostics)
+		if err != nil {
+			return "", err
+		}
+		ret = asJs
+	case ExecActionCommand:
+		executor, ok := asOptional[ActionExecutor](provider)
+		if !ok {
+			return "", fmt.Errorf("failed to run action %q: %w", env.InstanceAction, gErrors.ErrNotImplemented)
+		}
+		result, err := executor.ExecAction(ctx, env.InstanceID, env.InstanceAction, env.ActionArgs)
+		if err != nil {
+			return "", fmt.Errorf("failed to run action %q: %w", env.InstanceAction, err)
+		}
+		// The result is opaque to this package, and is passed to GARM as is.
+		ret = string(result)
+	case EstimateCostCommand:
+		estimator, ok := asOptional[CostEstimator](provider)
+		if !ok {
+			return "", fmt.Errorf("failed to estimate cost: %w", gErrors.ErrNotImplemented)
+		}
+		estimate, err := estimator.EstimateCost(ctx, env.BootstrapParams)
+		if err != nil {
+			return "", fmt.Errorf("failed to estimate cost: %w", err)
+		}
+		asJs, err := opts.marshal(estimate)
+		if err != nil {
+			return "", err
+		}
+		ret = asJs
+	case DescribeProviderCommand:
+		describer, ok := asOptional[Describer](provider)
+		if !ok {
+			return "", fmt.Errorf("failed to describe provider: %w", gErrors.ErrNotImplemented)
+		}
+		description, err := describer.Describe(ctx)
+		if err != nil {
+			return "", fmt.Errorf("failed to describe provider: %w", err)
+		}
+		asJs, err := opts.marshal(description)
+		if err != nil {
+			return "", err
+		}
+		ret = asJs
+	case GetExtraSpecsSchemaCommand:
+		documenter, ok := asOptional[ExtraSpecsDocumenter](provider)
+		if !ok {
+			return "", fmt.Errorf("failed to get extra specs schema: %w", gErrors.ErrNotImplemented)
+		}
+		doc, err := documenter.ExtraSpecsSchema(ctx)
+		if err != nil {
+			return "", fmt.Errorf("failed to get extra specs schema: %w", err)
+		}
+		if err := doc.Validate(); err != nil {
+			return "", fmt.Errorf("provider returned an invalid extra specs schema: %w", err)
+		}
+		asJs, err := opts.marshal(doc.Sorted())
+		if err != nil {
+			return "", err
+		}
+		ret = asJs
+	case DumpEnvCommand:
+		// DumpEnv never calls the provider, so nothing else would notice that the
+		// command was canceled.
+		if err := ctx.Err(); err != nil {
+			return "", err
+		}
+		asJs, err := opts.marshal(env.Redacted())
+		if err != nil {
+			return "", err
+		}
+		ret = asJs
 	default:
-		return "", fmt.Errorf("invalid command: %s", env.Command)
+		// Custom commands are only consulted for commands that are not built in, so
+		// they can never override the behavior GARM relies on.
+		custom, ok := opts.customCommand(env.Command)
+		if !ok || custom.Run == nil {
+			return "", fmt.Errorf("invalid command: %s", env.Command)
+		}
+		return custom.Run(ctx, env)
 	}
 	return ret, nil
 }
@@ -15,13 +15,19 @@
 package execution
 
 import (
+	"bytes"
 	"context"
+	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"log"
 	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
 	"testing"
+	"time"
 
 	gErrors "github.com/cloudbase/garm-provider-common/errors"
 	"github.com/cloudbase/garm-provider-common/params"
@@ -82,6 +88,340 @@ func (p *testExternalProvider) Start(context.Context, string) error {
 	return nil
 }
 
+type testStatusUpdaterProvider struct {
+	testExternalProvider
+
+	update params.InstanceStatusUpdate
+}
+
+func (p *testStatusUpdaterProvider) UpdateStatus(ctx context.Context, update params.InstanceStatusUpdate) error {
+	if p.mockErr != nil {
+		return p.mockErr
+	}
+	p.update = update
+	return nil
+}
+
+type testCostEstimatorProvider struct {
+	testExternalProvider
+
+	estimate params.CostEstimate
+}
+
+func (p *testCostEstimatorProvider) EstimateCost(ctx context.Context, bootstrapParams params.BootstrapInstance) (params.CostEstimate, error) {
+	if p.mockErr != nil {
+		return params.CostEstimate{}, p.mockErr
+	}
+	return p.estimate, nil
+}
+
+type testAllInstancesListerProvider struct {
+	testExternalProvider
+
+	controllerID string
+}
+
+func (p *testAllInstancesListerProvider) ListAllInstances(ctx context.Context, controllerID string) ([]params.ProviderInstance, error) {
+	if p.mockErr != nil {
+		return nil, p.mockErr
+	}
+	p.controllerID = controllerID
+	return []params.ProviderInstance{p.mockInstance, p.mockInstance}, nil
+}
+
+type testDescriberProvider struct {
+	testExternalProvider
+}
+
+func (p *testDescriberProvider) Describe(ctx context.Context) (params.ProviderDescription, error) {
+	if p.mockErr != nil {
+		return params.ProviderDescription{}, p.mockErr
+	}
+	return params.ProviderDescription{
+		Name:             "test-provider",
+		SupportedClouds:  []string{"test-cloud"},
+		SupportedOSTypes: []params.OSType{params.Linux},
+	}, nil
+}
+
+type testPoolValidatorProvider struct {
+	testExternalProvider
+
+	created bool
+}
+
+func (p *testPoolValidatorProvider) ValidatePool(ctx context.Context, poolID string) error {
+	if poolID != "test-pool-id" {
+		return fmt.Errorf("pool %s: %w", poolID, gErrors.ErrNotFound)
+	}
+	return nil
+}
+
+func (p *testPoolValidatorProvider) CreateInstance(ctx context.Context, bootstrapParams params.BootstrapInstance) (params.ProviderInstance, error) {
+	p.created = true
+	return p.mockInstance, nil
+}
+
+type testCredentialRotatorProvider struct {
+	testExternalProvider
+
+	rotated string
+}
+
+func (p *testCredentialRotatorProvider) RotateCredentials(ctx context.Context, instance string) error {
+	if p.mockErr != nil {
+		return p.mockErr
+	}
+	p.rotated = instance
+	return nil
+}
+
+type testActionExecutorProvider struct {
+	testExternalProvider
+
+	instance string
+	action   string
+	args     json.RawMessage
+}
+
+func (p *testActionExecutorProvider) ExecAction(ctx context.Context, instance string, action string, args json.RawMessage) (json.RawMessage, error) {
+	if p.mockErr != nil {
+		return nil, p.mockErr
+	}
+	p.instance = instance
+	p.action = action
+	p.args = args
+	return json.RawMessage(`{"rebooted": true}`), nil
+}
+
+type testBestEffortRemoverProvider struct {
+	testExternalProvider
+
+	removed []string
+	failed  map[string]error
+}
+
+func (p *testBestEffortRemoverProvider) RemoveAllInstancesBestEffort(ctx context.Context) ([]string, map[string]error) {
+	return p.removed, p.failed
+}
+
+type testWarmerProvider struct {
+	testExternalProvider
+
+	warmedUp params.BootstrapInstance
+}
+
+func (p *testWarmerProvider) Warmup(ctx context.Context, bootstrapParams params.BootstrapInstance) error {
+	if p.mockErr != nil {
+		return p.mockErr
+	}
+	p.warmedUp = bootstrapParams
+	return nil
+}
+
+type testUserDataGeneratorProvider struct {
+	testExternalProvider
+
+	userDataSize int
+	maxSize      int
+	userData     []byte
+	created      bool
+}
+
+func (p *testUserDataGeneratorProvider) GenerateUserData(ctx context.Context, bootstrapParams params.BootstrapInstance) ([]byte, error) {
+	if p.mockErr != nil {
+		return nil, p.mockErr
+	}
+	return []byte(strings.Repeat("a", p.userDataSize)), nil
+}
+
+func (p *testUserDataGeneratorProvider) MaxUserDataSize() int {
+	return p.maxSize
+}
+
+func (p *testUserDataGeneratorProvider) CreateInstance(ctx context.Context, bootstrapParams params.BootstrapInstance) (params.ProviderInstance, error) {
+	p.created = true
+	p.userData = UserDataFromContext(ctx)
+	return params.ProviderInstance{ProviderID: "instance-id", Name: bootstrapParams.Name}, nil
+}
+
+type testDiskResizerProvider struct {
+	testExternalProvider
+
+	instance string
+	sizeGB   int
+}
+
+func (p *testDiskResizerProvider) ResizeDisk(ctx context.Context, instance string, newSizeGB int) error {
+	if p.mockErr != nil {
+		return p.mockErr
+	}
+	p.instance = instance
+	p.sizeGB = newSizeGB
+	return nil
+}
+
+type testEventsProvider struct {
+	testExternalProvider
+
+	events []params.InstanceEvent
+	since  time.Time
+}
+
+func (p *testEventsProvider) GetEvents(ctx context.Context, instance string, since time.Time) ([]params.InstanceEvent, error) {
+	if p.mockErr != nil {
+		return nil, p.mockErr
+	}
+	p.since = since
+	return p.events, nil
+}
+
+type testBootDiagnosticsProvider struct {
+	testExternalProvider
+
+	instance string
+}
+
+func (p *testBootDiagnosticsProvider) GetBootDiagnostics(ctx context.Context, instance string) (params.BootDiagnostics, error) {
+	if p.mockErr != nil {
+		return params.BootDiagnostics{}, p.mockErr
+	}
+	p.instance = instance
+	return params.BootDiagnostics{
+		Screenshot:       []byte("png data"),
+		ScreenshotFormat: "png",
+		SerialLog:        "Kernel panic - not syncing",
+	}, nil
+}
+
+type testNICManagerProvider struct {
+	testExternalProvider
+
+	attached []params.NICSpec
+	detached []params.NICSpec
+}
+
+func (p *testNICManagerProvider) AttachNIC(ctx context.Context, instance string, nic params.NICSpec) error {
+	if p.mockErr != nil {
+		return p.mockErr
+	}
+	p.attached = append(p.attached, nic)
+	return nil
+}
+
+func (p *testNICManagerProvider) DetachNIC(ctx context.Context, instance string, nic params.NICSpec) error {
+	if p.mockErr != nil {
+		return p.mockErr
+	}
+	p.detached = append(p.detached, nic)
+	return nil
+}
+
+type testAsyncProvider struct {
+	testExternalProvider
+
+	async bool
+}
+
+func (p *testAsyncProvider) CreateInstance(ctx context.Context, bootstrapParams params.BootstrapInstance) (params.ProviderInstance, error) {
+	p.async = IsCreateAsync(ctx)
+	return p.mockInstance, nil
+}
+
+type testPowerProvider struct {
+	testExternalProvider
+
+	started bool
+	stopped bool
+}
+
+func (p *testPowerProvider) Start(context.Context, string) error {
+	p.started = true
+	return nil
+}
+
+func (p *testPowerProvider) Stop(context.Context, string, bool) error {
+	p.stopped = true
+	return nil
+}
+
+type testExistenceCheckerProvider struct {
+	testExternalProvider
+
+	exists bool
+}
+
+func (p *testExistenceCheckerProvider) InstanceExists(ctx context.Context, instance string) (bool, error) {
+	if p.mockErr != nil {
+		return false, p.mockErr
+	}
+	return p.exists, nil
+}
+
+type testConfigTesterProvider struct {
+	testExternalProvider
+}
+
+func (p *testConfigTesterProvider) TestConfig(ctx context.Context) error {
+	return p.mockErr
+}
+
+type testMetricsExporterProvider struct {
+	testExternalProvider
+}
+
+func (p *testMetricsExporterProvider) Metrics(ctx context.Context) ([]byte, error) {
+	if p.mockErr != nil {
+		return nil, p.mockErr
+	}
+	return []byte("# TYPE garm_provider_instances gauge\ngarm_provider_instances 3\n"), nil
+}
+
+// withoutSummary removes the summary lines RunWithOptions writes to stderr after
+// every command.
+func withoutSummary(stderr string) string {
+	var lines []string
+	for _, line := range strings.SplitAfter(stderr, "\n") {
+		if !strings.HasPrefix(line, "INFO: ") {
+			lines = append(lines, line)
+		}
+	}
+	return strings.Join(lines, "")
+}
+
+// setStdin replaces os.Stdin with a file holding data for the duration of the test.
+func setStdin(t *testing.T, data string) {
+	tmpfile, err := os.CreateTemp("", "test-stdin")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(tmpfile.Name()) })
+
+	_, err = tmpfile.Write([]byte(data))
+	require.NoError(t, err)
+	_, err = tmpfile.Seek(0, 0)
+	require.NoError(t, err)
+
+	oldStdin := os.Stdin
+	os.Stdin = tmpfile
+	t.Cleanup(func() {
+		os.Stdin = oldStdin
+		tmpfile.Close()
+	})
+}
+
+// setGarmEnv sets the environment variables GARM passes to every provider call.
+func setGarmEnv(t *testing.T, command ExecutionCommand) {
+	tmpfile, err := os.CreateTemp("", "provider-config")
+	require.NoError(t, err)
+	tmpfile.Close()
+	t.Cleanup(func() { os.RemoveAll(tmpfile.Name()) })
+
+	t.Setenv("GARM_COMMAND", string(command))
+	t.Setenv("GARM_CONTROLLER_ID", "test-controller-id")
+	t.Setenv("GARM_POOL_ID", "test-pool-id")
+	t.Setenv("GARM_INSTANCE_ID", "")
+	t.Setenv("GARM_PROVIDER_CONFIG_FILE", tmpfile.Name())
+}
+
 func TestResolveErrorToExitCode(t *testing.T) {
 	tests := []struct {
 		name string
@@ -103,6 +443,16 @@ func TestResolveErrorToExitCode(t *testing.T) {
 			err:  gErrors.ErrDuplicateEntity,
 			code: ExitCodeDuplicate,
 		},
+		{
+			name: "invalid config error",
+			err:  fmt.Errorf("failed to parse config: %w", gErrors.ErrInvalidConfig),
+			code: ExitCodeInvalidConfig,
+		},
+		{
+			name: "maintenance mode error",
+			err:  fmt.Errorf("refusing to run DeleteInstance: %w", gErrors.ErrMaintenanceMode),
+			code: ExitCodeMaintenanceMode,
+		},
 		{
 			name: "other error",
 			err:  errors.New("other error"),
@@ -118,6 +468,52 @@ func TestResolveErrorToExitCode(t *testing.T) {
 	}
 }
 
+func TestExitCodeToError(t *testing.T) {
+	tests := []struct {
+		name string
+		code int
+		err  error
+	}{
+		{
+			name: "success",
+			code: 0,
+			err:  nil,
+		},
+		{
+			name: "not found",
+			code: ExitCodeNotFound,
+			err:  gErrors.ErrNotFound,
+		},
+		{
+			name: "duplicate",
+			code: ExitCodeDuplicate,
+			err:  gErrors.ErrDuplicateEntity,
+		},
+		{
+			name: "invalid config",
+			code: ExitCodeInvalidConfig,
+			err:  gErrors.ErrInvalidConfig,
+		},
+		{
+			name: "maintenance mode",
+			code: ExitCodeMaintenanceMode,
+			err:  gErrors.ErrMaintenanceMode,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			err := ExitCodeToError(tc.code)
+			require.Equal(t, tc.err, err)
+			require.Equal(t, tc.code, ResolveErrorToExitCode(err))
+		})
+	}
+
+	err := ExitCodeToError(1)
+	require.EqualError(t, err, "provider exited with code 1")
+	require.Equal(t, 1, ResolveErrorToExitCode(err))
+}
+
 func TestValidateEnvironment(t *testing.T) {
 	// Create a temporary file
 	tmpfile, err := os.CreateTemp("", "provider-config")
@@ -130,6 +526,7 @@ func TestValidateEnvironment(t *testing.T) {
 	tests := []struct {
 		name      string
 		env       Environment
+		opts      RunOptions
 		errString string
 	}{
 		{
@@ -141,11 +538,25 @@ func TestValidateEnvironment(t *testing.T) {
 				ProviderConfigFile: tmpfile.Name(),
 				InstanceID:         "instance-id",
 				BootstrapParams: params.BootstrapInstance{
-					Name: "instance-name",
+					Name:   "instance-name",
+					Flavor: "m1.small",
 				},
 			},
 			errString: "",
 		},
+		{
+			name: "missing flavor",
+			env: Environment{
+				Command:            CreateInstanceCommand,
+				ControllerID:       "controller-id",
+				PoolID:             "pool-id",
+				ProviderConfigFile: tmpfile.Name(),
+				BootstrapParams: params.BootstrapInstance{
+					Name: "instance-name",
+				},
+			},
+			errString: "missing flavor in bootstrap params, the pool must set one: invalid request",
+		},
 		{
 			name: "invalid command",
 			env: Environment{
@@ -209,6 +620,21 @@ func TestValidateEnvironment(t *testing.T) {
 			},
 			errString: "missing bootstrap params",
 		},
+		{
+			name: "conflicting bootstrap params",
+			env: Environment{
+				Command:            CreateInstanceCommand,
+				ProviderConfigFile: tmpfile.Name(),
+				ControllerID:       "controller-id",
+				PoolID:             "pool-id",
+				BootstrapParams: params.BootstrapInstance{
+					Name:       "test-instance",
+					ExtraSpecs: json.RawMessage(`{"image_id": "ami-123", "image_family": "ubuntu"}`),
+				},
+			},
+			opts:      RunOptions{BootstrapConstraints: []params.BootstrapConstraint{params.MutuallyExclusive("image_id", "image_family")}},
+			errString: "invalid bootstrap params: image_id and image_family are mutually exclusive: invalid request",
+		},
 		{
 			name: "missing pool ID",
 			env: Environment{
@@ -223,45 +649,147 @@ func TestValidateEnvironment(t *testing.T) {
 			errString: "missing pool ID",
 		},
 		{
-			name: "unknown command",
+			name: "valid status update",
 			env: Environment{
-				Command:            "unknown-command",
+				Command:            UpdateInstanceStatusCommand,
 				ProviderConfigFile: tmpfile.Name(),
 				ControllerID:       "controller-id",
-				PoolID:             "pool-id",
-				BootstrapParams: params.BootstrapInstance{
-					Name: "instance-name",
+				StatusUpdate: params.InstanceStatusUpdate{
+					InstanceID: "instance-id",
+					Status:     params.InstanceRunning,
 				},
 			},
-			errString: "unknown GARM_COMMAND",
+			errString: "",
 		},
-	}
-
-	for _, tc := range tests {
-		t.Run(tc.name, func(t *testing.T) {
-			err := tc.env.Validate()
-			if tc.errString == "" {
-				require.NoError(t, err)
-			} else {
-				require.Error(t, err)
-				require.Regexp(t, tc.errString, err.Error())
-			}
-		})
-	}
-}
-
-func TestRun(t *testing.T) {
-	tests := []struct {
-		name             string
-		providerEnv      Environment
-		providerInstance params.ProviderInstance
-		providerErr      error
-		expectedErrMsg   string
-	}{
+		{
+			name: "status update missing instance ID",
+			env: Environment{
+				Command:            UpdateInstanceStatusCommand,
+				ProviderConfigFile: tmpfile.Name(),
+				ControllerID:       "controller-id",
+				StatusUpdate: params.InstanceStatusUpdate{
+					Status: params.InstanceRunning,
+				},
+			},
+			errString: "missing instance ID",
+		},
+		{
+			name: "status update with unknown status",
+			env: Environment{
+				Command:            UpdateInstanceStatusCommand,
+				ProviderConfigFile: tmpfile.Name(),
+				ControllerID:       "controller-id",
+				StatusUpdate: params.InstanceStatusUpdate{
+					InstanceID: "instance-id",
+					Status:     "bogus",
+				},
+			},
+			errString: `invalid instance status: "bogus"`,
+		},
+		{
+			name: "invalid interface version",
+			env: Environment{
+				Command:            GetInstanceCommand,
+				ProviderConfigFile: tmpfile.Name(),
+				ControllerID:       "controller-id",
+				InstanceID:         "instance-id",
+				InterfaceVersion:   "bogus",
+			},
+			errString: `invalid GARM_INTERFACE_VERSION: invalid interface version "bogus"`,
+		},
+		{
+			name: "test config without instance or pool",
+			env: Environment{
+				Command:            TestConfigCommand,
+				ProviderConfigFile: tmpfile.Name(),
+				ControllerID:       "controller-id",
+			},
+			errString: "",
+		},
+		{
+			name: "test config missing config file",
+			env: Environment{
+				Command:      TestConfigCommand,
+				ControllerID: "controller-id",
+			},
+			errString: "missing GARM_PROVIDER_CONFIG_FILE",
+		},
+		{
+			name: "rotate credentials missing instance ID",
+			env: Environment{
+				Command:            RotateInstanceCredentialsCommand,
+				ProviderConfigFile: tmpfile.Name(),
+				ControllerID:       "controller-id",
+			},
+			errString: "missing instance ID",
+		},
+		{
+			name: "exec action missing action",
+			env: Environment{
+				Command:            ExecActionCommand,
+				ProviderConfigFile: tmpfile.Name(),
+				ControllerID:       "controller-id",
+				InstanceID:         "instance-id",
+			},
+			errString: "missing GARM_INSTANCE_ACTION",
+		},
+		{
+			name: "list all instances without controller ID",
+			env: Environment{
+				Command:            ListAllInstancesCommand,
+				ProviderConfigFile: tmpfile.Name(),
+			},
+			errString: "missing GARM_CONTROLLER_ID",
+		},
+		{
+			name: "describe does not require a config file",
+			env: Environment{
+				Command:      DescribeProviderCommand,
+				ControllerID: "controller-id",
+			},
+			errString: "",
+		},
+		{
+			name: "unknown command",
+			env: Environment{
+				Command:            "unknown-command",
+				ProviderConfigFile: tmpfile.Name(),
+				ControllerID:       "controller-id",
+				PoolID:             "pool-id",
+				BootstrapParams: params.BootstrapInstance{
+					Name: "instance-name",
+				},
+			},
+			errString: "unknown GARM_COMMAND",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.env.validate(tc.opts)
+			if tc.errString == "" {
+				require.NoError(t, err)
+			} else {
+				require.Error(t, err)
+				require.Regexp(t, tc.errString, err.Error())
+			}
+		})
+	}
+}
+
+func TestRun(t *testing.T) {
+	tests := []struct {
+		name             string
+		providerEnv      Environment
+		providerInstance params.ProviderInstance
+		providerErr      error
+		expectedErrMsg   string
+	}{
 		{
 			name: "Valid environment",
 			providerEnv: Environment{
-				Command: CreateInstanceCommand,
+				Command:         CreateInstanceCommand,
+				BootstrapParams: params.BootstrapInstance{InstanceToken: "instance-token"},
 			},
 			providerInstance: params.ProviderInstance{
 				Name:   "test-instance",
@@ -273,7 +801,8 @@ func TestRun(t *testing.T) {
 		{
 			name: "Failed to create instance",
 			providerEnv: Environment{
-				Command: CreateInstanceCommand,
+				Command:         CreateInstanceCommand,
+				BootstrapParams: params.BootstrapInstance{InstanceToken: "instance-token"},
 			},
 			providerInstance: params.ProviderInstance{
 				Name:   "test-instance",
@@ -397,7 +926,7 @@ func TestGetEnvironment(t *testing.T) {
 	}{
 		{
 			name:      "The environment is valid",
-			stdinData: `{"name": "test"}`,
+			stdinData: `{"name": "test", "flavor": "m1.small"}`,
 			errString: "",
 		},
 		{
@@ -410,6 +939,26 @@ func TestGetEnvironment(t *testing.T) {
 			stdinData: `bogus`,
 			errString: "failed to decode instance params: invalid character 'b' looking for beginning of value",
 		},
+		{
+			name:      "Null extra specs",
+			stdinData: `{"name": "test", "flavor": "m1.small", "extra_specs": null}`,
+			errString: "",
+		},
+		{
+			name:      "Extra specs is an array",
+			stdinData: `{"name": "test", "flavor": "m1.small", "extra_specs": [1, 2]}`,
+			errString: "extra specs must be a JSON object, got array: invalid request",
+		},
+		{
+			name:      "Invalid extra env name",
+			stdinData: `{"name": "test", "flavor": "m1.small", "extra_specs": {"garm": {"extra_env": {"1BOGUS": "value"}}}}`,
+			errString: `failed to validate execution environment: invalid bootstrap params: invalid environment variable name "1BOGUS" in extra_env: invalid request`,
+		},
+		{
+			name:      "Extra specs is a scalar",
+			stdinData: `{"name": "test", "flavor": "m1.small", "extra_specs": "bogus"}`,
+			errString: "extra specs must be a JSON object, got string: invalid request",
+		},
 	}
 
 	for _, tc := range tests {
@@ -492,3 +1041,1826 @@ func TestGetEnvValidateFailed(t *testing.T) {
 	require.Error(t, err)
 	require.Equal(t, "failed to validate execution environment: unknown GARM_COMMAND: unknown-command", err.Error())
 }
+
+func TestRunSetsPowerState(t *testing.T) {
+	tests := []struct {
+		name     string
+		instance params.ProviderInstance
+		expected params.PowerState
+	}{
+		{
+			name:     "running instance is powered on",
+			instance: params.ProviderInstance{Status: params.InstanceRunning},
+			expected: params.PowerStateOn,
+		},
+		{
+			name:     "stopped instance is powered off",
+			instance: params.ProviderInstance{Status: params.InstanceStopped},
+			expected: params.PowerStateOff,
+		},
+		{
+			name:     "transitional status leaves power state unset",
+			instance: params.ProviderInstance{Status: params.InstanceCreating},
+			expected: "",
+		},
+		{
+			name: "provider supplied power state is preserved",
+			instance: params.ProviderInstance{
+				Status:     params.InstanceRunning,
+				PowerState: params.PowerStateUnknown,
+			},
+			expected: params.PowerStateUnknown,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			provider := &testExternalProvider{mockInstance: tc.instance}
+
+			out, err := Run(context.Background(), provider, Environment{Command: GetInstanceCommand})
+			require.NoError(t, err)
+			var instance params.ProviderInstance
+			require.NoError(t, json.Unmarshal([]byte(out), &instance))
+			require.Equal(t, tc.expected, instance.PowerState)
+			require.Equal(t, tc.instance.Status, instance.Status)
+		})
+	}
+}
+
+func TestRunPreservesRunnerLabels(t *testing.T) {
+	tests := []struct {
+		name     string
+		env      Environment
+		instance params.ProviderInstance
+		expected []string
+	}{
+		{
+			name: "create mirrors bootstrap labels",
+			env: Environment{
+				Command: CreateInstanceCommand,
+				BootstrapParams: params.BootstrapInstance{
+					Labels:        []string{"self-hosted", "linux"},
+					InstanceToken: "instance-token",
+				},
+			},
+			expected: []string{"self-hosted", "linux"},
+		},
+		{
+			name: "create keeps labels reported by the provider",
+			env: Environment{
+				Command: CreateInstanceCommand,
+				BootstrapParams: params.BootstrapInstance{
+					Labels:        []string{"self-hosted", "linux"},
+					InstanceToken: "instance-token",
+				},
+			},
+			instance: params.ProviderInstance{RunnerLabels: []string{"self-hosted"}},
+			expected: []string{"self-hosted"},
+		},
+		{
+			name:     "get passes labels through",
+			env:      Environment{Command: GetInstanceCommand},
+			instance: params.ProviderInstance{RunnerLabels: []string{"gpu"}},
+			expected: []string{"gpu"},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			provider := &testExternalProvider{mockInstance: tc.instance}
+
+			out, err := Run(context.Background(), provider, tc.env)
+			require.NoError(t, err)
+			var instance params.ProviderInstance
+			require.NoError(t, json.Unmarshal([]byte(out), &instance))
+			require.Equal(t, tc.expected, instance.RunnerLabels)
+		})
+	}
+}
+
+func TestEnvironmentRedacted(t *testing.T) {
+	token := "secret-download-token"
+	env := Environment{
+		Command: CreateInstanceCommand,
+		BootstrapParams: params.BootstrapInstance{
+			Name:          "instance-name",
+			InstanceToken: "secret-instance-token",
+			Tools: []params.RunnerApplicationDownload{
+				{TempDownloadToken: &token},
+				{},
+			},
+		},
+	}
+
+	redacted := env.Redacted()
+	require.Equal(t, "instance-name", redacted.BootstrapParams.Name)
+	require.Equal(t, "<redacted>", redacted.BootstrapParams.InstanceToken)
+	require.Equal(t, "<redacted>", redacted.BootstrapParams.Tools[0].GetTempDownloadToken())
+	require.Nil(t, redacted.BootstrapParams.Tools[1].TempDownloadToken)
+
+	// The original environment must not be modified.
+	require.Equal(t, "secret-instance-token", env.BootstrapParams.InstanceToken)
+	require.Equal(t, "secret-download-token", token)
+}
+
+func TestRunDumpEnv(t *testing.T) {
+	env := Environment{
+		Command:      DumpEnvCommand,
+		ControllerID: "controller-id",
+		BootstrapParams: params.BootstrapInstance{
+			InstanceToken: "secret-instance-token",
+		},
+	}
+
+	// The provider is never called.
+	out, err := Run(context.Background(), nil, env)
+	require.NoError(t, err)
+	require.NotContains(t, out, "secret-instance-token")
+
+	var dumped Environment
+	require.NoError(t, json.Unmarshal([]byte(out), &dumped))
+	require.Equal(t, DumpEnvCommand, dumped.Command)
+	require.Equal(t, "controller-id", dumped.ControllerID)
+	require.Equal(t, "<redacted>", dumped.BootstrapParams.InstanceToken)
+}
+
+func TestGetEnvironmentDumpEnvSkipValidation(t *testing.T) {
+	t.Setenv("GARM_COMMAND", string(DumpEnvCommand))
+	t.Setenv("GARM_CONTROLLER_ID", "")
+	t.Setenv("GARM_PROVIDER_CONFIG_FILE", "/does/not/exist")
+
+	_, err := GetEnvironment()
+	require.ErrorContains(t, err, "error accessing config file")
+
+	t.Setenv("GARM_DUMP_SKIP_VALIDATION", "true")
+	env, err := GetEnvironment()
+	require.NoError(t, err)
+	require.Equal(t, DumpEnvCommand, env.Command)
+	require.Equal(t, "/does/not/exist", env.ProviderConfigFile)
+}
+
+func TestRunUpdateInstanceStatus(t *testing.T) {
+	update := params.InstanceStatusUpdate{
+		InstanceID: "instance-id",
+		Status:     params.InstanceRunning,
+		Reason:     "boot finished",
+	}
+	env := Environment{
+		Command:      UpdateInstanceStatusCommand,
+		StatusUpdate: update,
+	}
+
+	provider := &testStatusUpdaterProvider{}
+	out, err := Run(context.Background(), provider, env)
+	require.NoError(t, err)
+	require.Equal(t, "", out)
+	require.Equal(t, update, provider.update)
+
+	provider = &testStatusUpdaterProvider{
+		testExternalProvider: testExternalProvider{mockErr: gErrors.ErrNotFound},
+	}
+	_, err = Run(context.Background(), provider, env)
+	require.ErrorIs(t, err, gErrors.ErrNotFound)
+
+	_, err = Run(context.Background(), &testExternalProvider{}, env)
+	require.ErrorIs(t, err, gErrors.ErrNotImplemented)
+	require.EqualError(t, err, "failed to update instance status: not implemented")
+}
+
+func TestGetEnvironmentStatusUpdate(t *testing.T) {
+	setGarmEnv(t, UpdateInstanceStatusCommand)
+	t.Setenv("GARM_INSTANCE_ID", "instance-id")
+	setStdin(t, `{"status": "running", "reason": "boot finished"}`)
+
+	env, err := GetEnvironment()
+	require.NoError(t, err)
+	require.Equal(t, params.InstanceStatusUpdate{
+		InstanceID: "instance-id",
+		Status:     params.InstanceRunning,
+		Reason:     "boot finished",
+	}, env.StatusUpdate)
+}
+
+func TestGetEnvironmentStdinIsTerminal(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the null device is not a character device on Windows")
+	}
+	setGarmEnv(t, CreateInstanceCommand)
+
+	// The null device is a character device, just like a terminal.
+	devNull, err := os.Open(os.DevNull)
+	require.NoError(t, err)
+	oldStdin := os.Stdin
+	os.Stdin = devNull
+	t.Cleanup(func() {
+		os.Stdin = oldStdin
+		devNull.Close()
+	})
+
+	_, err = GetEnvironment()
+	require.EqualError(t, err, "no bootstrap params on stdin: CreateInstance requires data passed into stdin")
+}
+
+func TestRunEstimateCost(t *testing.T) {
+	env := Environment{Command: EstimateCostCommand}
+	provider := &testCostEstimatorProvider{
+		estimate: params.CostEstimate{Hourly: 0.5, Monthly: 365, Currency: "USD"},
+	}
+
+	out, err := Run(context.Background(), provider, env)
+	require.NoError(t, err)
+	require.JSONEq(t, `{"hourly": 0.5, "monthly": 365, "currency": "USD"}`, out)
+
+	provider.mockErr = gErrors.ErrNotImplemented
+	_, err = Run(context.Background(), provider, env)
+	require.ErrorIs(t, err, gErrors.ErrNotImplemented)
+
+	_, err = Run(context.Background(), &testExternalProvider{}, env)
+	require.EqualError(t, err, "failed to estimate cost: not implemented")
+}
+
+func TestGetEnvironmentEstimateCost(t *testing.T) {
+	setGarmEnv(t, EstimateCostCommand)
+	setStdin(t, `{"flavor": "m1.small", "image": "ubuntu"}`)
+
+	env, err := GetEnvironment()
+	require.NoError(t, err)
+	require.Equal(t, "m1.small", env.BootstrapParams.Flavor)
+	require.Equal(t, json.RawMessage("{}"), env.BootstrapParams.ExtraSpecs)
+}
+
+func TestGetEnvironmentNormalizesLabels(t *testing.T) {
+	setGarmEnv(t, CreateInstanceCommand)
+	setStdin(t, `{"name": "test", "flavor": "m1.small", "labels": ["Linux", " gpu ", "", "linux"]}`)
+
+	env, err := GetEnvironment()
+	require.NoError(t, err)
+	require.Equal(t, []string{"linux", "gpu"}, env.BootstrapParams.Labels)
+}
+
+func TestGetEnvironmentExtraSpecsTooLarge(t *testing.T) {
+	oldMax := MaxExtraSpecsSize
+	MaxExtraSpecsSize = 32
+	t.Cleanup(func() { MaxExtraSpecsSize = oldMax })
+
+	setGarmEnv(t, CreateInstanceCommand)
+	setStdin(t, `{"name": "test", "flavor": "m1.small", "extra_specs": {"key": "a value that is way too long"}}`)
+
+	_, err := GetEnvironment()
+	require.ErrorIs(t, err, gErrors.ErrBadRequest)
+	require.ErrorContains(t, err, "exceeds the limit of 32 bytes")
+
+	MaxExtraSpecsSize = 0
+	setStdin(t, `{"name": "test", "flavor": "m1.small", "extra_specs": {"key": "a value that is way too long"}}`)
+	_, err = GetEnvironment()
+	require.NoError(t, err)
+}
+
+func TestGetEnvironmentBootstrapParamsTooLarge(t *testing.T) {
+	oldMax := MaxBootstrapParamsSize
+	MaxBootstrapParamsSize = 32
+	t.Cleanup(func() { MaxBootstrapParamsSize = oldMax })
+
+	// Not valid JSON either, the size is checked before decoding.
+	setGarmEnv(t, CreateInstanceCommand)
+	setStdin(t, `{"name": "test", "flavor": "m1.small", "labels": [`)
+
+	_, err := GetEnvironment()
+	require.ErrorIs(t, err, gErrors.ErrBadRequest)
+	require.ErrorContains(t, err, "bootstrap params size of 50 bytes exceeds the limit of 32 bytes")
+
+	MaxBootstrapParamsSize = 0
+	setStdin(t, `{"name": "test", "flavor": "m1.small", "labels": ["linux"]}`)
+	_, err = GetEnvironment()
+	require.NoError(t, err)
+}
+
+func TestRunNilProvider(t *testing.T) {
+	commands := []ExecutionCommand{
+		CreateInstanceCommand,
+		DeleteInstanceCommand,
+		GetInstanceCommand,
+		ListInstancesCommand,
+		StartInstanceCommand,
+		StopInstanceCommand,
+		RemoveAllInstancesCommand,
+	}
+
+	for _, cmd := range commands {
+		t.Run(string(cmd), func(t *testing.T) {
+			out, err := Run(context.Background(), nil, Environment{Command: cmd})
+			require.EqualError(t, err, "provider must not be nil")
+			require.Equal(t, "", out)
+		})
+	}
+
+	_, err := Run(context.Background(), nil, Environment{Command: DumpEnvCommand})
+	require.NoError(t, err)
+}
+
+func TestRunListAllInstances(t *testing.T) {
+	env := Environment{
+		Command:      ListAllInstancesCommand,
+		ControllerID: "controller-id",
+	}
+	provider := &testAllInstancesListerProvider{
+		testExternalProvider: testExternalProvider{
+			mockInstance: params.ProviderInstance{Name: "test-instance"},
+		},
+	}
+
+	out, err := Run(context.Background(), provider, env)
+	require.NoError(t, err)
+	require.Equal(t, "controller-id", provider.controllerID)
+	var instances []params.ProviderInstance
+	require.NoError(t, json.Unmarshal([]byte(out), &instances))
+	require.Len(t, instances, 2)
+
+	provider.mockErr = fmt.Errorf("bogus error")
+	_, err = Run(context.Background(), provider, env)
+	require.EqualError(t, err, "failed to list all instances from provider: bogus error")
+
+	_, err = Run(context.Background(), &testExternalProvider{}, env)
+	require.ErrorIs(t, err, gErrors.ErrNotImplemented)
+}
+
+func TestRunDescribeProvider(t *testing.T) {
+	env := Environment{Command: DescribeProviderCommand}
+
+	out, err := Run(context.Background(), &testDescriberProvider{}, env)
+	require.NoError(t, err)
+	require.JSONEq(t, `{"name": "test-provider", "supported_clouds": ["test-cloud"], "supported_os_types": ["linux"]}`, out)
+
+	_, err = Run(context.Background(), &testExternalProvider{}, env)
+	require.ErrorIs(t, err, gErrors.ErrNotImplemented)
+}
+
+func TestGetEnvironmentDelayedPipeWriter(t *testing.T) {
+	setGarmEnv(t, CreateInstanceCommand)
+
+	reader, writer, err := os.Pipe()
+	require.NoError(t, err)
+	oldStdin := os.Stdin
+	os.Stdin = reader
+	t.Cleanup(func() {
+		os.Stdin = oldStdin
+		reader.Close()
+	})
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		writer.Write([]byte(`{"name": "test", "flavor": "m1.small",`))
+		time.Sleep(50 * time.Millisecond)
+		writer.Write([]byte(` "flavor": "m1.small"}`))
+		writer.Close()
+	}()
+
+	env, err := GetEnvironment()
+	require.NoError(t, err)
+	require.Equal(t, "test", env.BootstrapParams.Name)
+}
+
+func TestGetEnvironmentDelayedFileWriter(t *testing.T) {
+	setGarmEnv(t, CreateInstanceCommand)
+	setStdin(t, "")
+
+	clock := NewFakeClock(time.Now())
+	oldClock := stdinClock
+	stdinClock = clock
+	t.Cleanup(func() { stdinClock = oldClock })
+
+	// The writer only starts writing after our first attempt at reading stdin.
+	type result struct {
+		env Environment
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		env, err := GetEnvironment()
+		done <- result{env: env, err: err}
+	}()
+
+	require.Eventually(t, func() bool { return clock.Waiters() == 1 }, time.Second, time.Millisecond)
+	writer, err := os.OpenFile(os.Stdin.Name(), os.O_WRONLY|os.O_APPEND, 0)
+	require.NoError(t, err)
+	_, err = writer.Write([]byte(`{"name": "test", "flavor": "m1.small"}`))
+	require.NoError(t, err)
+	require.NoError(t, writer.Close())
+	clock.Advance(StdinRetryInterval)
+
+	res := <-done
+	require.NoError(t, res.err)
+	env := res.env
+	require.Equal(t, "test", env.BootstrapParams.Name)
+}
+
+func TestRunPrevalidatePool(t *testing.T) {
+	tests := []struct {
+		name            string
+		prevalidate     bool
+		poolID          string
+		expectedCreated bool
+		errString       string
+	}{
+		{
+			name:            "known pool",
+			prevalidate:     true,
+			poolID:          "test-pool-id",
+			expectedCreated: true,
+		},
+		{
+			name:            "unknown pool",
+			prevalidate:     true,
+			poolID:          "typo-pool-id",
+			expectedCreated: false,
+			errString:       "failed to validate pool typo-pool-id",
+		},
+		{
+			name:            "prevalidation disabled",
+			prevalidate:     false,
+			poolID:          "typo-pool-id",
+			expectedCreated: true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			env := Environment{
+				Command:         CreateInstanceCommand,
+				PrevalidatePool: tc.prevalidate,
+				BootstrapParams: params.BootstrapInstance{PoolID: tc.poolID, InstanceToken: "instance-token"},
+			}
+
+			provider := &testPoolValidatorProvider{}
+			_, err := Run(context.Background(), provider, env)
+			if tc.errString == "" {
+				require.NoError(t, err)
+			} else {
+				require.ErrorIs(t, err, gErrors.ErrNotFound)
+				require.ErrorContains(t, err, tc.errString)
+			}
+			require.Equal(t, tc.expectedCreated, provider.created)
+		})
+	}
+
+	// Providers that do not implement PoolValidator skip the check.
+	env := Environment{
+		Command:         CreateInstanceCommand,
+		PrevalidatePool: true,
+		BootstrapParams: params.BootstrapInstance{PoolID: "typo-pool-id", InstanceToken: "instance-token"},
+	}
+	_, err := Run(context.Background(), &testExternalProvider{}, env)
+	require.NoError(t, err)
+}
+
+func TestEnvironmentInstanceRef(t *testing.T) {
+	env := Environment{InstanceID: "us-east-1a/i-123"}
+	ref, err := env.InstanceRef()
+	require.NoError(t, err)
+	require.Equal(t, params.InstanceRef{Zone: "us-east-1a", ID: "i-123"}, ref)
+
+	_, err = Environment{}.InstanceRef()
+	require.ErrorIs(t, err, gErrors.ErrBadRequest)
+}
+
+func TestRunRotateInstanceCredentials(t *testing.T) {
+	env := Environment{
+		Command:    RotateInstanceCredentialsCommand,
+		InstanceID: "instance-id",
+	}
+
+	provider := &testCredentialRotatorProvider{}
+	out, err := Run(context.Background(), provider, env)
+	require.NoError(t, err)
+	require.Equal(t, "", out)
+	require.Equal(t, "instance-id", provider.rotated)
+
+	provider = &testCredentialRotatorProvider{
+		testExternalProvider: testExternalProvider{mockErr: gErrors.ErrNotFound},
+	}
+	_, err = Run(context.Background(), provider, env)
+	require.ErrorIs(t, err, gErrors.ErrNotFound)
+
+	_, err = Run(context.Background(), &testExternalProvider{}, env)
+	require.ErrorIs(t, err, gErrors.ErrNotImplemented)
+	require.EqualError(t, err, "failed to rotate instance credentials: not implemented")
+}
+
+func TestRunCreateInstanceAsync(t *testing.T) {
+	tests := []struct {
+		name           string
+		async          bool
+		instance       params.ProviderInstance
+		expectedStatus params.InstanceStatus
+		errString      string
+	}{
+		{
+			name:           "async create defaults to pending status",
+			async:          true,
+			instance:       params.ProviderInstance{ProviderID: "i-123"},
+			expectedStatus: params.InstancePendingCreate,
+		},
+		{
+			name:           "async create keeps status set by provider",
+			async:          true,
+			instance:       params.ProviderInstance{ProviderID: "i-123", Status: params.InstanceCreating},
+			expectedStatus: params.InstanceCreating,
+		},
+		{
+			name:      "async create without provider ID",
+			async:     true,
+			instance:  params.ProviderInstance{},
+			errString: "provider returned an instance without a provider ID in async mode",
+		},
+		{
+			name:           "sync create",
+			async:          false,
+			instance:       params.ProviderInstance{ProviderID: "i-123"},
+			expectedStatus: "",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			provider := &testAsyncProvider{
+				testExternalProvider: testExternalProvider{mockInstance: tc.instance},
+			}
+			env := Environment{
+				Command:         CreateInstanceCommand,
+				CreateAsync:     tc.async,
+				BootstrapParams: params.BootstrapInstance{InstanceToken: "instance-token"},
+			}
+
+			out, err := Run(context.Background(), provider, env)
+			require.Equal(t, tc.async, provider.async)
+			if tc.errString != "" {
+				require.EqualError(t, err, tc.errString)
+				return
+			}
+			require.NoError(t, err)
+
+			var instance params.ProviderInstance
+			err = json.Unmarshal([]byte(out), &instance)
+			require.NoError(t, err)
+			require.Equal(t, tc.instance.ProviderID, instance.ProviderID)
+			require.Equal(t, tc.expectedStatus, instance.Status)
+		})
+	}
+}
+
+func TestRunSkipNoop(t *testing.T) {
+	tests := []struct {
+		name           string
+		command        ExecutionCommand
+		skipNoop       bool
+		instance       params.ProviderInstance
+		getErr         error
+		expectedCalled bool
+		errString      string
+	}{
+		{
+			name:           "start running instance",
+			command:        StartInstanceCommand,
+			skipNoop:       true,
+			instance:       params.ProviderInstance{Status: params.InstanceRunning},
+			expectedCalled: false,
+		},
+		{
+			name:           "start stopped instance",
+			command:        StartInstanceCommand,
+			skipNoop:       true,
+			instance:       params.ProviderInstance{PowerState: params.PowerStateOff},
+			expectedCalled: true,
+		},
+		{
+			name:           "stop stopped instance",
+			command:        StopInstanceCommand,
+			skipNoop:       true,
+			instance:       params.ProviderInstance{PowerState: params.PowerStateOff},
+			expectedCalled: false,
+		},
+		{
+			name:           "stop instance in unknown state",
+			command:        StopInstanceCommand,
+			skipNoop:       true,
+			instance:       params.ProviderInstance{Status: params.InstanceError},
+			expectedCalled: true,
+		},
+		{
+			name:           "skip noop disabled",
+			command:        StartInstanceCommand,
+			skipNoop:       false,
+			instance:       params.ProviderInstance{Status: params.InstanceRunning},
+			expectedCalled: true,
+		},
+		{
+			name:           "get instance fails",
+			command:        StopInstanceCommand,
+			skipNoop:       true,
+			getErr:         gErrors.ErrNotFound,
+			expectedCalled: false,
+			errString:      "failed to get instance from provider: not found",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			provider := &testPowerProvider{
+				testExternalProvider: testExternalProvider{
+					mockInstance: tc.instance,
+					mockErr:      tc.getErr,
+				},
+			}
+			env := Environment{
+				Command:    tc.command,
+				InstanceID: "instance-id",
+				SkipNoop:   tc.skipNoop,
+			}
+
+			_, err := Run(context.Background(), provider, env)
+			if tc.errString != "" {
+				require.EqualError(t, err, tc.errString)
+			} else {
+				require.NoError(t, err)
+			}
+			require.Equal(t, tc.expectedCalled, provider.started || provider.stopped)
+		})
+	}
+}
+
+func TestRunInstanceExists(t *testing.T) {
+	tests := []struct {
+		name      string
+		provider  ExternalProvider
+		expected  string
+		errString string
+	}{
+		{
+			name:     "existence checker reports instance",
+			provider: &testExistenceCheckerProvider{exists: true},
+			expected: `{"exists": true}`,
+		},
+		{
+			name:     "existence checker reports missing instance",
+			provider: &testExistenceCheckerProvider{exists: false},
+			expected: `{"exists": false}`,
+		},
+		{
+			name: "existence checker fails",
+			provider: &testExistenceCheckerProvider{
+				testExternalProvider: testExternalProvider{mockErr: fmt.Errorf("mock error")},
+			},
+			errString: "failed to check if instance exists: mock error",
+		},
+		{
+			name:     "fall back to GetInstance",
+			provider: &testExternalProvider{},
+			expected: `{"exists": true}`,
+		},
+		{
+			name:     "fall back to GetInstance with missing instance",
+			provider: &testExternalProvider{mockErr: gErrors.ErrNotFound},
+			expected: `{"exists": false}`,
+		},
+		{
+			name:      "fall back to GetInstance fails",
+			provider:  &testExternalProvider{mockErr: fmt.Errorf("mock error")},
+			errString: "failed to check if instance exists: mock error",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			env := Environment{
+				Command:    InstanceExistsCommand,
+				InstanceID: "instance-id",
+			}
+
+			out, err := Run(context.Background(), tc.provider, env)
+			if tc.errString != "" {
+				require.EqualError(t, err, tc.errString)
+				return
+			}
+			require.NoError(t, err)
+			require.JSONEq(t, tc.expected, out)
+		})
+	}
+}
+
+func TestRunCreateInstanceAddresses(t *testing.T) {
+	provider := &testExternalProvider{
+		mockInstance: params.ProviderInstance{
+			Name: "test-instance",
+			Addresses: []params.Address{
+				{Address: "2001:db8::5", Type: params.PublicAddress},
+			},
+		},
+	}
+	env := Environment{
+		Command:         CreateInstanceCommand,
+		BootstrapParams: params.BootstrapInstance{InstanceToken: "instance-token"},
+	}
+	out, err := Run(context.Background(), provider, env)
+	require.NoError(t, err)
+
+	var instance params.ProviderInstance
+	err = json.Unmarshal([]byte(out), &instance)
+	require.NoError(t, err)
+	require.Equal(t, []params.Address{
+		{Address: "2001:db8::5", Type: params.PublicAddress, Family: params.IPv6Address},
+	}, instance.Addresses)
+
+	provider.mockInstance.Addresses = []params.Address{{Address: "fe80::1", Type: params.PrivateAddress}}
+	_, err = Run(context.Background(), provider, env)
+	require.EqualError(t, err, "instance test-instance has no usable address")
+}
+
+func TestRunTestConfig(t *testing.T) {
+	env := Environment{Command: TestConfigCommand}
+
+	out, err := Run(context.Background(), &testConfigTesterProvider{}, env)
+	require.NoError(t, err)
+	require.Equal(t, "", out)
+
+	provider := &testConfigTesterProvider{
+		testExternalProvider: testExternalProvider{mockErr: fmt.Errorf("invalid credentials: %w", gErrors.ErrInvalidConfig)},
+	}
+	_, err = Run(context.Background(), provider, env)
+	require.ErrorIs(t, err, gErrors.ErrInvalidConfig)
+	require.EqualError(t, err, "failed to test config: invalid credentials: invalid provider config")
+
+	_, err = Run(context.Background(), &testExternalProvider{}, env)
+	require.ErrorIs(t, err, gErrors.ErrNotImplemented)
+}
+
+func TestRunMetrics(t *testing.T) {
+	env := Environment{Command: MetricsCommand}
+
+	out, err := Run(context.Background(), &testMetricsExporterProvider{}, env)
+	require.NoError(t, err)
+	require.Equal(t, "# TYPE garm_provider_instances gauge\ngarm_provider_instances 3\n", out)
+
+	provider := &testMetricsExporterProvider{
+		testExternalProvider: testExternalProvider{mockErr: fmt.Errorf("mock error")},
+	}
+	_, err = Run(context.Background(), provider, env)
+	require.EqualError(t, err, "failed to get metrics: mock error")
+
+	out, err = Run(context.Background(), &testExternalProvider{}, env)
+	require.NoError(t, err)
+	require.Equal(t, "", out)
+}
+
+func TestRunDumpEnvCanceledContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	out, err := Run(ctx, nil, Environment{Command: DumpEnvCommand})
+	require.ErrorIs(t, err, context.Canceled)
+	require.Equal(t, "", out)
+}
+
+func TestRunExecAction(t *testing.T) {
+	env := Environment{
+		Command:        ExecActionCommand,
+		InstanceID:     "instance-id",
+		InstanceAction: "reboot",
+		ActionArgs:     json.RawMessage(`{"hard": true}`),
+	}
+
+	provider := &testActionExecutorProvider{}
+	out, err := Run(context.Background(), provider, env)
+	require.NoError(t, err)
+	require.Equal(t, `{"rebooted": true}`, out)
+	require.Equal(t, "instance-id", provider.instance)
+	require.Equal(t, "reboot", provider.action)
+	require.JSONEq(t, `{"hard": true}`, string(provider.args))
+
+	provider = &testActionExecutorProvider{
+		testExternalProvider: testExternalProvider{mockErr: gErrors.ErrNotFound},
+	}
+	_, err = Run(context.Background(), provider, env)
+	require.ErrorIs(t, err, gErrors.ErrNotFound)
+
+	_, err = Run(context.Background(), &testExternalProvider{}, env)
+	require.ErrorIs(t, err, gErrors.ErrNotImplemented)
+	require.EqualError(t, err, `failed to run action "reboot": not implemented`)
+}
+
+func TestGetEnvironmentExecAction(t *testing.T) {
+	setGarmEnv(t, ExecActionCommand)
+	t.Setenv("GARM_INSTANCE_ID", "instance-id")
+	t.Setenv("GARM_INSTANCE_ACTION", "reset-password")
+	setStdin(t, `{"user": "runner"}`+"\n")
+
+	env, err := GetEnvironment()
+	require.NoError(t, err)
+	require.Equal(t, "reset-password", env.InstanceAction)
+	require.Equal(t, json.RawMessage(`{"user": "runner"}`), env.ActionArgs)
+
+	setStdin(t, `{"user": `)
+	_, err = GetEnvironment()
+	require.ErrorIs(t, err, gErrors.ErrBadRequest)
+}
+
+func TestRunRemoveAllInstancesBestEffort(t *testing.T) {
+	env := Environment{
+		Command:          RemoveAllInstancesCommand,
+		RemoveBestEffort: true,
+	}
+
+	provider := &testBestEffortRemoverProvider{removed: []string{"instance-2", "instance-1"}}
+	out, err := Run(context.Background(), provider, env)
+	require.NoError(t, err)
+	require.JSONEq(t, `{"removed": ["instance-1", "instance-2"]}`, out)
+
+	provider = &testBestEffortRemoverProvider{
+		removed: []string{"instance-1"},
+		failed: map[string]error{
+			"instance-3": fmt.Errorf("volume is attached"),
+			"instance-2": gErrors.ErrNotFound,
+		},
+	}
+	var output bytes.Buffer
+	out, err = RunWithOptions(context.Background(), provider, env, RunOptions{Output: &output})
+	require.EqualError(t, err, "failed to remove 2 of 3 instances: instance instance-2: not found\ninstance instance-3: volume is attached")
+	require.Equal(t, 1, ResolveErrorToExitCode(err))
+	require.JSONEq(t, `{"removed": ["instance-1"], "failed": {"instance-2": "not found", "instance-3": "volume is attached"}}`, out)
+	require.Equal(t, out, output.String())
+
+	_, err = Run(context.Background(), &testExternalProvider{}, env)
+	require.ErrorIs(t, err, gErrors.ErrNotImplemented)
+}
+
+func TestGetEnvironmentRemoveBestEffort(t *testing.T) {
+	setGarmEnv(t, RemoveAllInstancesCommand)
+	t.Setenv("GARM_REMOVE_BEST_EFFORT", "true")
+
+	env, err := GetEnvironment()
+	require.NoError(t, err)
+	require.True(t, env.RemoveBestEffort)
+}
+
+func TestGetBootstrapParamsFromReader(t *testing.T) {
+	bootstrapParams, err := GetBootstrapParamsFromReader(strings.NewReader(`{"name": "test", "flavor": "m1.small", "labels": ["Linux"]}`))
+	require.NoError(t, err)
+	require.Equal(t, "test", bootstrapParams.Name)
+	require.Equal(t, []string{"linux"}, bootstrapParams.Labels)
+	require.Equal(t, json.RawMessage("{}"), bootstrapParams.ExtraSpecs)
+}
+
+func TestGetBootstrapParamsFromReaderInvalidUTF8(t *testing.T) {
+	// "café" encoded as Latin-1, as a terminal with the wrong locale would send it.
+	data := []byte("{\"name\": \"caf\xe9\"}")
+
+	_, err := GetBootstrapParamsFromReader(bytes.NewReader(data))
+	require.ErrorIs(t, err, gErrors.ErrBadRequest)
+	require.EqualError(t, err, "bootstrap params are not valid UTF-8: invalid request")
+
+	setGarmEnv(t, CreateInstanceCommand)
+	setStdin(t, string(data))
+	_, err = GetEnvironment()
+	require.ErrorIs(t, err, gErrors.ErrBadRequest)
+	require.ErrorContains(t, err, "bootstrap params are not valid UTF-8")
+}
+
+func TestRunCreateInstanceUserDataSize(t *testing.T) {
+	env := Environment{
+		Command:         CreateInstanceCommand,
+		BootstrapParams: params.BootstrapInstance{Name: "test-instance", InstanceToken: "instance-token"},
+	}
+
+	provider := &testUserDataGeneratorProvider{userDataSize: 16, maxSize: 16}
+	_, err := Run(context.Background(), provider, env)
+	require.NoError(t, err)
+	require.True(t, provider.created)
+	require.Equal(t, []byte(strings.Repeat("a", 16)), provider.userData)
+
+	provider = &testUserDataGeneratorProvider{userDataSize: 17, maxSize: 16}
+	_, err = Run(context.Background(), provider, env)
+	require.ErrorIs(t, err, gErrors.ErrBadRequest)
+	require.EqualError(t, err, "invalid user data: user data size of 17 bytes exceeds the limit of 16 bytes: invalid request")
+	require.False(t, provider.created)
+
+	provider = &testUserDataGeneratorProvider{
+		testExternalProvider: testExternalProvider{mockErr: fmt.Errorf("mock error")},
+	}
+	_, err = Run(context.Background(), provider, env)
+	require.EqualError(t, err, "failed to generate user data: mock error")
+	require.False(t, provider.created)
+}
+
+func TestRunCreateInstanceEmptyUserData(t *testing.T) {
+	env := Environment{
+		Command:         CreateInstanceCommand,
+		BootstrapParams: params.BootstrapInstance{Name: "test-instance"},
+	}
+
+	provider := &testUserDataGeneratorProvider{userDataSize: 16}
+	_, err := Run(context.Background(), provider, env)
+	require.ErrorIs(t, err, gErrors.ErrBadRequest)
+	require.EqualError(t, err, "missing instance token in bootstrap params: invalid request")
+	require.False(t, provider.created)
+
+	env.BootstrapParams.InstanceToken = "instance-token"
+	provider = &testUserDataGeneratorProvider{userDataSize: 0}
+	_, err = Run(context.Background(), provider, env)
+	require.ErrorIs(t, err, gErrors.ErrBadRequest)
+	require.EqualError(t, err, "invalid user data: user data is empty: invalid request")
+	require.False(t, provider.created)
+
+	// Providers with a legitimate need for empty user data can opt out.
+	env.BootstrapParams.InstanceToken = ""
+	_, err = RunWithOptions(context.Background(), provider, env, RunOptions{AllowEmptyUserData: true})
+	require.NoError(t, err)
+	require.True(t, provider.created)
+}
+
+func TestGetEnvironmentBootstrapParamsFallbacks(t *testing.T) {
+	paramsFile := filepath.Join(t.TempDir(), "bootstrap.json")
+	require.NoError(t, os.WriteFile(paramsFile, []byte(`{"name": "from-file", "flavor": "m1.small"}`), 0o600))
+	encoded := base64.StdEncoding.EncodeToString([]byte(`{"name": "from-env", "flavor": "m1.small"}`))
+
+	tests := []struct {
+		name         string
+		stdin        string
+		file         string
+		encoded      string
+		expectedName string
+		errString    string
+	}{
+		{name: "stdin takes precedence", stdin: `{"name": "from-stdin", "flavor": "m1.small"}`, file: paramsFile, encoded: encoded, expectedName: "from-stdin"},
+		{name: "file over env var", file: paramsFile, encoded: encoded, expectedName: "from-file"},
+		{name: "base64 env var", encoded: encoded, expectedName: "from-env"},
+		{name: "whitespace on stdin is ignored", stdin: "\n", encoded: encoded, expectedName: "from-env"},
+		{name: "missing file", file: filepath.Join(t.TempDir(), "missing.json"), errString: "failed to read GARM_BOOTSTRAP_PARAMS_FILE"},
+		{name: "invalid base64", encoded: "not base64!", errString: "failed to decode GARM_BOOTSTRAP_PARAMS_B64"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			setGarmEnv(t, CreateInstanceCommand)
+			setStdin(t, tc.stdin)
+			t.Setenv("GARM_BOOTSTRAP_PARAMS_FILE", tc.file)
+			t.Setenv("GARM_BOOTSTRAP_PARAMS_B64", tc.encoded)
+
+			env, err := GetEnvironment()
+			if tc.errString != "" {
+				require.ErrorContains(t, err, tc.errString)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tc.expectedName, env.BootstrapParams.Name)
+		})
+	}
+}
+
+func TestRunGetBootDiagnostics(t *testing.T) {
+	env := Environment{
+		Command:    GetBootDiagnosticsCommand,
+		InstanceID: "instance-id",
+	}
+
+	provider := &testBootDiagnosticsProvider{}
+	out, err := Run(context.Background(), provider, env)
+	require.NoError(t, err)
+	require.JSONEq(t, `{"screenshot": "cG5nIGRhdGE=", "screenshot_format": "png", "serial_log": "Kernel panic - not syncing"}`, out)
+	require.Equal(t, "instance-id", provider.instance)
+
+	provider = &testBootDiagnosticsProvider{
+		testExternalProvider: testExternalProvider{mockErr: gErrors.ErrNotFound},
+	}
+	_, err = Run(context.Background(), provider, env)
+	require.ErrorIs(t, err, gErrors.ErrNotFound)
+
+	_, err = Run(context.Background(), &testExternalProvider{}, env)
+	require.ErrorIs(t, err, gErrors.ErrNotImplemented)
+	require.EqualError(t, err, "failed to get boot diagnostics: not implemented")
+}
+
+func TestGetEnvironmentTrimsWhitespace(t *testing.T) {
+	setGarmEnv(t, GetInstanceCommand)
+	t.Setenv("GARM_POOL_ID", "test-pool-id \n")
+	t.Setenv("GARM_INSTANCE_ID", "\t instance-id")
+	t.Setenv("GARM_CONTROLLER_ID", "test-controller-id")
+	t.Setenv("GARM_SKIP_NOOP", " true\n")
+	t.Setenv("GARM_PROVIDER_CONFIG_FILES", os.Getenv("GARM_PROVIDER_CONFIG_FILE")+" ")
+
+	env, err := GetEnvironment()
+	require.NoError(t, err)
+	require.Equal(t, "test-pool-id", env.PoolID)
+	require.Equal(t, "instance-id", env.InstanceID)
+	require.Equal(t, "test-controller-id", env.ControllerID)
+	require.True(t, env.SkipNoop)
+	require.Equal(t, []string{os.Getenv("GARM_PROVIDER_CONFIG_FILE")}, env.ProviderConfigFiles)
+	require.Equal(t, []string{"GARM_POOL_ID", "GARM_INSTANCE_ID"}, env.trimmedEnvVars)
+
+	var stderr bytes.Buffer
+	_, err = RunWithOptions(context.Background(), &testExternalProvider{}, env, RunOptions{Debug: true, Stderr: &stderr})
+	require.NoError(t, err)
+	require.Contains(t, stderr.String(), "DEBUG: removed surrounding whitespace from the value of GARM_POOL_ID\n")
+	require.Contains(t, stderr.String(), "DEBUG: removed surrounding whitespace from the value of GARM_INSTANCE_ID\n")
+}
+
+func TestGetEnvironmentNormalizesControllerID(t *testing.T) {
+	setGarmEnv(t, RemoveAllInstancesCommand)
+	t.Setenv("GARM_CONTROLLER_ID", "9C2E8F1A-4B7D-4E2A-8F3C-1D5E6A7B8C9D")
+
+	env, err := GetEnvironment()
+	require.NoError(t, err)
+	require.Equal(t, "9c2e8f1a-4b7d-4e2a-8f3c-1d5e6a7b8c9d", env.ControllerID)
+}
+
+func TestRunAttachDetachNIC(t *testing.T) {
+	nic := params.NICSpec{Network: "job-network", SecurityGroups: []string{"runners"}}
+
+	provider := &testNICManagerProvider{}
+	out, err := Run(context.Background(), provider, Environment{Command: AttachNICCommand, InstanceID: "instance-id", NIC: nic})
+	require.NoError(t, err)
+	require.Equal(t, "", out)
+	require.Equal(t, []params.NICSpec{nic}, provider.attached)
+
+	_, err = Run(context.Background(), provider, Environment{Command: DetachNICCommand, InstanceID: "instance-id", NIC: params.NICSpec{ID: "eni-123"}})
+	require.NoError(t, err)
+	require.Equal(t, []params.NICSpec{{ID: "eni-123"}}, provider.detached)
+
+	provider = &testNICManagerProvider{
+		testExternalProvider: testExternalProvider{mockErr: gErrors.ErrNotFound},
+	}
+	_, err = Run(context.Background(), provider, Environment{Command: DetachNICCommand, InstanceID: "instance-id", NIC: nic})
+	require.ErrorIs(t, err, gErrors.ErrNotFound)
+
+	_, err = Run(context.Background(), &testExternalProvider{}, Environment{Command: AttachNICCommand, InstanceID: "instance-id", NIC: nic})
+	require.ErrorIs(t, err, gErrors.ErrNotImplemented)
+	require.EqualError(t, err, "failed to run AttachNIC: not implemented")
+}
+
+func TestGetEnvironmentNIC(t *testing.T) {
+	setGarmEnv(t, AttachNICCommand)
+	t.Setenv("GARM_INSTANCE_ID", "instance-id")
+	setStdin(t, `{"network": "job-network", "subnet": "job-subnet"}`)
+
+	env, err := GetEnvironment()
+	require.NoError(t, err)
+	require.Equal(t, params.NICSpec{Network: "job-network", Subnet: "job-subnet"}, env.NIC)
+
+	setStdin(t, `{"subnet": "job-subnet"}`)
+	_, err = GetEnvironment()
+	require.ErrorIs(t, err, gErrors.ErrBadRequest)
+	require.ErrorContains(t, err, "invalid nic spec")
+}
+
+func TestRunProviderDebugVerifiesInstanceID(t *testing.T) {
+	tests := []struct {
+		name          string
+		providerDebug bool
+		mockInstance  params.ProviderInstance
+		mockErr       error
+		warning       string
+	}{
+		{
+			name:          "matching provider ID",
+			providerDebug: true,
+			mockInstance:  params.ProviderInstance{ProviderID: "instance-id", Name: "runner-1"},
+		},
+		{
+			name:          "matching name",
+			providerDebug: true,
+			mockInstance:  params.ProviderInstance{ProviderID: "i-123", Name: "instance-id"},
+		},
+		{
+			name:          "mismatch",
+			providerDebug: true,
+			mockInstance:  params.ProviderInstance{ProviderID: "other-id", Name: "runner-2"},
+			warning:       "WARNING: PROVIDER DEBUG: %s was requested for instance instance-id, but GetInstance returned instance \"other-id\" (name \"runner-2\")\n",
+		},
+		{
+			name:         "mismatch without debug mode",
+			mockInstance: params.ProviderInstance{ProviderID: "other-id", Name: "runner-2"},
+		},
+	}
+
+	for _, tc := range tests {
+		for _, command := range []ExecutionCommand{StartInstanceCommand, StopInstanceCommand} {
+			t.Run(fmt.Sprintf("%s %s", command, tc.name), func(t *testing.T) {
+				provider := &testExternalProvider{mockInstance: tc.mockInstance}
+				env := Environment{
+					Command:       command,
+					InstanceID:    "instance-id",
+					ProviderDebug: tc.providerDebug,
+				}
+
+				var stderr bytes.Buffer
+				_, err := RunWithOptions(context.Background(), provider, env, RunOptions{Stderr: &stderr})
+				require.NoError(t, err)
+				if tc.warning == "" {
+					require.Empty(t, withoutSummary(stderr.String()))
+					return
+				}
+				require.Equal(t, fmt.Sprintf(tc.warning, command), withoutSummary(stderr.String()))
+			})
+		}
+	}
+}
+
+func TestRunRenderBootstrap(t *testing.T) {
+	env := Environment{
+		Command:         RenderBootstrapCommand,
+		BootstrapParams: params.BootstrapInstance{Name: "test-instance"},
+	}
+
+	provider := &testUserDataGeneratorProvider{userDataSize: 4}
+	out, err := Run(context.Background(), provider, env)
+	require.NoError(t, err)
+	require.JSONEq(t, `{"user_data": "YWFhYQ=="}`, out)
+	require.False(t, provider.created)
+
+	provider = &testUserDataGeneratorProvider{
+		testExternalProvider: testExternalProvider{mockErr: fmt.Errorf("mock error")},
+	}
+	_, err = Run(context.Background(), provider, env)
+	require.EqualError(t, err, "failed to render bootstrap: mock error")
+
+	_, err = Run(context.Background(), &testExternalProvider{}, env)
+	require.ErrorIs(t, err, gErrors.ErrNotImplemented)
+}
+
+func TestGetEnvironmentRenderBootstrap(t *testing.T) {
+	setGarmEnv(t, RenderBootstrapCommand)
+	setStdin(t, `{"name": "test", "flavor": "m1.small", "labels": ["Linux"]}`)
+
+	env, err := GetEnvironment()
+	require.NoError(t, err)
+	require.Equal(t, "test", env.BootstrapParams.Name)
+	require.Equal(t, []string{"linux"}, env.BootstrapParams.Labels)
+}
+
+func TestRunGuardTransitions(t *testing.T) {
+	tests := []struct {
+		name             string
+		command          ExecutionCommand
+		guardTransitions bool
+		skipNoop         bool
+		instance         params.ProviderInstance
+		getErr           error
+		expectedCalled   bool
+		errString        string
+	}{
+		{
+			name:             "start creating instance",
+			command:          StartInstanceCommand,
+			guardTransitions: true,
+			instance:         params.ProviderInstance{Status: params.InstanceCreating},
+			errString:        "cannot run StartInstance on instance instance-id while it is creating: invalid request",
+		},
+		{
+			name:             "stop deleting instance",
+			command:          StopInstanceCommand,
+			guardTransitions: true,
+			instance:         params.ProviderInstance{Status: params.InstancePendingDelete},
+			errString:        "cannot run StopInstance on instance instance-id while it is pending_delete: invalid request",
+		},
+		{
+			name:             "stop running instance",
+			command:          StopInstanceCommand,
+			guardTransitions: true,
+			instance:         params.ProviderInstance{Status: params.InstanceRunning},
+			expectedCalled:   true,
+		},
+		{
+			name:             "guard and skip noop",
+			command:          StartInstanceCommand,
+			guardTransitions: true,
+			skipNoop:         true,
+			instance:         params.ProviderInstance{Status: params.InstanceRunning},
+			expectedCalled:   false,
+		},
+		{
+			name:           "guard disabled",
+			command:        StartInstanceCommand,
+			instance:       params.ProviderInstance{Status: params.InstanceCreating},
+			expectedCalled: true,
+		},
+		{
+			name:             "get instance not implemented",
+			command:          StartInstanceCommand,
+			guardTransitions: true,
+			getErr:           gErrors.ErrNotImplemented,
+			expectedCalled:   true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			provider := &testPowerProvider{
+				testExternalProvider: testExternalProvider{
+					mockInstance: tc.instance,
+					mockErr:      tc.getErr,
+				},
+			}
+			env := Environment{
+				Command:          tc.command,
+				InstanceID:       "instance-id",
+				SkipNoop:         tc.skipNoop,
+				GuardTransitions: tc.guardTransitions,
+			}
+
+			_, err := Run(context.Background(), provider, env)
+			if tc.errString != "" {
+				require.ErrorIs(t, err, gErrors.ErrBadRequest)
+				require.EqualError(t, err, tc.errString)
+			} else {
+				require.NoError(t, err)
+			}
+			require.Equal(t, tc.expectedCalled, provider.started || provider.stopped)
+		})
+	}
+}
+
+func TestRunWarmup(t *testing.T) {
+	env := Environment{
+		Command:         WarmupCommand,
+		BootstrapParams: params.BootstrapInstance{Name: "test-instance", Image: "ubuntu"},
+	}
+
+	provider := &testWarmerProvider{}
+	out, err := Run(context.Background(), provider, env)
+	require.NoError(t, err)
+	require.Empty(t, out)
+	require.Equal(t, env.BootstrapParams, provider.warmedUp)
+
+	provider = &testWarmerProvider{
+		testExternalProvider: testExternalProvider{mockErr: fmt.Errorf("mock error")},
+	}
+	_, err = Run(context.Background(), provider, env)
+	require.EqualError(t, err, "failed to warm up: mock error")
+
+	_, err = Run(context.Background(), &testExternalProvider{}, env)
+	require.ErrorIs(t, err, gErrors.ErrNotImplemented)
+}
+
+func TestGetEnvironmentWarmup(t *testing.T) {
+	setGarmEnv(t, WarmupCommand)
+	setStdin(t, `{"name": "test", "flavor": "m1.small", "image": "ubuntu"}`)
+
+	env, err := GetEnvironment()
+	require.NoError(t, err)
+	require.Equal(t, "ubuntu", env.BootstrapParams.Image)
+}
+
+func TestGetEnvironmentStrictStdin(t *testing.T) {
+	tests := []struct {
+		name      string
+		strict    string
+		stdin     string
+		errString string
+	}{
+		{
+			name:  "lenient by default",
+			stdin: `{"name": "test", "flavor": "m1.small"}`,
+		},
+		{
+			name:      "strict with data",
+			strict:    "true",
+			stdin:     `{"name": "test", "flavor": "m1.small"}`,
+			errString: "unexpected stdin data for command DeleteInstance: invalid request",
+		},
+		{
+			name:   "strict with whitespace",
+			strict: "true",
+			stdin:  "\n",
+		},
+		{
+			name:   "strict without data",
+			strict: "true",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			setGarmEnv(t, DeleteInstanceCommand)
+			t.Setenv("GARM_INSTANCE_ID", "instance-id")
+			t.Setenv("GARM_STRICT_STDIN", tc.strict)
+			setStdin(t, tc.stdin)
+
+			env, err := GetEnvironment()
+			if tc.errString != "" {
+				require.ErrorIs(t, err, gErrors.ErrBadRequest)
+				require.EqualError(t, err, tc.errString)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, "instance-id", env.InstanceID)
+		})
+	}
+}
+
+func TestRunGetInstanceEvents(t *testing.T) {
+	since := time.Date(2023, 5, 1, 10, 0, 0, 0, time.UTC)
+	env := Environment{
+		Command:     GetInstanceEventsCommand,
+		InstanceID:  "instance-id",
+		EventsSince: &since,
+	}
+
+	provider := &testEventsProvider{
+		events: []params.InstanceEvent{
+			{
+				Timestamp: time.Date(2023, 5, 1, 10, 5, 0, 0, time.UTC),
+				Type:      "error",
+				Reason:    "InsufficientCapacity",
+				Message:   "no capacity left in zone",
+			},
+		},
+	}
+	out, err := Run(context.Background(), provider, env)
+	require.NoError(t, err)
+	require.JSONEq(t, `[{"timestamp": "2023-05-01T10:05:00Z", "type": "error", "reason": "InsufficientCapacity", "message": "no capacity left in zone"}]`, out)
+	require.Equal(t, since, provider.since)
+
+	env.EventsSince = nil
+	provider = &testEventsProvider{}
+	out, err = Run(context.Background(), provider, env)
+	require.NoError(t, err)
+	require.Equal(t, "[]", out)
+	require.True(t, provider.since.IsZero())
+
+	_, err = Run(context.Background(), &testExternalProvider{}, env)
+	require.ErrorIs(t, err, gErrors.ErrNotImplemented)
+	require.EqualError(t, err, "failed to get instance events: not implemented")
+}
+
+func TestGetEnvironmentEventsSince(t *testing.T) {
+	setGarmEnv(t, GetInstanceEventsCommand)
+	t.Setenv("GARM_INSTANCE_ID", "instance-id")
+	t.Setenv("GARM_EVENTS_SINCE", "2023-05-01T12:00:00+02:00")
+
+	env, err := GetEnvironment()
+	require.NoError(t, err)
+	require.NotNil(t, env.EventsSince)
+	require.True(t, env.EventsSince.Equal(time.Date(2023, 5, 1, 10, 0, 0, 0, time.UTC)))
+
+	t.Setenv("GARM_EVENTS_SINCE", "yesterday")
+	_, err = GetEnvironment()
+	require.ErrorIs(t, err, gErrors.ErrBadRequest)
+	require.ErrorContains(t, err, `invalid GARM_EVENTS_SINCE "yesterday"`)
+}
+
+func TestRunThreadsIDsIntoBootstrapParams(t *testing.T) {
+	env := Environment{
+		Command:         WarmupCommand,
+		ControllerID:    "controller-id",
+		PoolID:          "pool-id",
+		BootstrapParams: params.BootstrapInstance{Name: "test-instance"},
+	}
+
+	provider := &testWarmerProvider{}
+	_, err := Run(context.Background(), provider, env)
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{
+		params.TagControllerID: "controller-id",
+		params.TagPoolID:       "pool-id",
+		params.TagInstanceName: "test-instance",
+	}, provider.warmedUp.StandardTags())
+
+	// IDs sent by GARM in the bootstrap params are kept.
+	env.BootstrapParams.PoolID = "other-pool-id"
+	_, err = Run(context.Background(), provider, env)
+	require.NoError(t, err)
+	require.Equal(t, "other-pool-id", provider.warmedUp.PoolID)
+}
+
+func TestRunResizeDisk(t *testing.T) {
+	env := Environment{
+		Command:    ResizeDiskCommand,
+		InstanceID: "instance-id",
+		DiskSizeGB: 200,
+	}
+
+	provider := &testDiskResizerProvider{}
+	out, err := Run(context.Background(), provider, env)
+	require.NoError(t, err)
+	require.Empty(t, out)
+	require.Equal(t, "instance-id", provider.instance)
+	require.Equal(t, 200, provider.sizeGB)
+
+	provider = &testDiskResizerProvider{
+		testExternalProvider: testExternalProvider{mockErr: gErrors.ErrBadRequest},
+	}
+	_, err = Run(context.Background(), provider, env)
+	require.ErrorIs(t, err, gErrors.ErrBadRequest)
+
+	_, err = Run(context.Background(), &testExternalProvider{}, env)
+	require.ErrorIs(t, err, gErrors.ErrNotImplemented)
+	require.EqualError(t, err, "failed to resize disk: not implemented")
+}
+
+func TestGetEnvironmentResizeDisk(t *testing.T) {
+	tests := []struct {
+		name      string
+		size      string
+		expected  int
+		errString string
+	}{
+		{
+			name:     "valid size",
+			size:     "200",
+			expected: 200,
+		},
+		{
+			name:      "missing size",
+			size:      "",
+			errString: "disk size must be positive, got 0",
+		},
+		{
+			name:      "negative size",
+			size:      "-10",
+			errString: "disk size must be positive, got -10",
+		},
+		{
+			name:      "not a number",
+			size:      "200GB",
+			errString: `invalid GARM_DISK_SIZE_GB "200GB", must be a whole number`,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			setGarmEnv(t, ResizeDiskCommand)
+			t.Setenv("GARM_INSTANCE_ID", "instance-id")
+			t.Setenv("GARM_DISK_SIZE_GB", tc.size)
+
+			env, err := GetEnvironment()
+			if tc.errString != "" {
+				require.ErrorIs(t, err, gErrors.ErrBadRequest)
+				require.ErrorContains(t, err, tc.errString)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tc.expected, env.DiskSizeGB)
+		})
+	}
+}
+
+type testBatchCreatorProvider struct {
+	testExternalProvider
+
+	created int
+	deleted []string
+}
+
+func (p *testBatchCreatorProvider) CreateInstances(ctx context.Context, bootstrapParams params.BootstrapInstance, count int) ([]params.ProviderInstance, error) {
+	var instances []params.ProviderInstance
+	for idx := 0; idx < count && idx < p.created; idx++ {
+		instances = append(instances, params.ProviderInstance{
+			ProviderID: fmt.Sprintf("provider-id-%d", idx),
+			Name:       fmt.Sprintf("%s-%d", bootstrapParams.Name, idx),
+			Status:     params.InstanceRunning,
+		})
+	}
+	if len(instances) < count {
+		return instances, fmt.Errorf("insufficient capacity")
+	}
+	return instances, nil
+}
+
+func (p *testBatchCreatorProvider) DeleteInstance(ctx context.Context, instance string) error {
+	p.deleted = append(p.deleted, instance)
+	return nil
+}
+
+func TestRunCreateInstances(t *testing.T) {
+	env := Environment{
+		Command:          CreateInstancesCommand,
+		BootstrapParams:  params.BootstrapInstance{Name: "runner", Labels: []string{"linux"}},
+		InstanceCount:    3,
+		MinInstanceCount: 2,
+	}
+
+	provider := &testBatchCreatorProvider{created: 2}
+	out, err := Run(context.Background(), provider, env)
+	require.NoError(t, err)
+	var instances []params.ProviderInstance
+	require.NoError(t, json.Unmarshal([]byte(out), &instances))
+	require.Len(t, instances, 2)
+	require.Equal(t, "runner-1", instances[1].Name)
+	require.Equal(t, []string{"linux"}, instances[1].RunnerLabels)
+	require.Empty(t, provider.deleted)
+
+	provider = &testBatchCreatorProvider{created: 1}
+	_, err = Run(context.Background(), provider, env)
+	require.EqualError(t, err, "failed to create instances in provider: insufficient capacity")
+	require.Equal(t, []string{"provider-id-0"}, provider.deleted)
+
+	env.MinInstanceCount = 0
+	provider = &testBatchCreatorProvider{created: 2}
+	_, err = Run(context.Background(), provider, env)
+	require.Error(t, err)
+	require.Equal(t, []string{"provider-id-0", "provider-id-1"}, provider.deleted)
+
+	_, err = Run(context.Background(), &testExternalProvider{}, env)
+	require.ErrorIs(t, err, gErrors.ErrNotImplemented)
+}
+
+func TestGetEnvironmentCreateInstances(t *testing.T) {
+	setGarmEnv(t, CreateInstancesCommand)
+	setStdin(t, `{"bootstrap_params": {"name": "runner", "flavor": "m1.small", "labels": ["Linux"]}, "count": 3, "min_count": 1}`)
+
+	env, err := GetEnvironment()
+	require.NoError(t, err)
+	require.Equal(t, "runner", env.BootstrapParams.Name)
+	require.Equal(t, []string{"linux"}, env.BootstrapParams.Labels)
+	require.Equal(t, 3, env.InstanceCount)
+	require.Equal(t, 1, env.MinInstanceCount)
+
+	setStdin(t, `{"bootstrap_params": {"name": "runner", "flavor": "m1.small"}, "count": 1, "min_count": 2}`)
+	_, err = GetEnvironment()
+	require.ErrorIs(t, err, gErrors.ErrBadRequest)
+
+	setStdin(t, `{"count": 1}`)
+	_, err = GetEnvironment()
+	require.ErrorIs(t, err, gErrors.ErrBadRequest)
+}
+
+type testInstanceReuserProvider struct {
+	testExternalProvider
+
+	stopped  []string
+	reusable []string
+	deleted  bool
+}
+
+func (p *testInstanceReuserProvider) Stop(ctx context.Context, instance string, force bool) error {
+	p.stopped = append(p.stopped, instance)
+	return nil
+}
+
+func (p *testInstanceReuserProvider) DeleteInstance(ctx context.Context, instance string) error {
+	p.deleted = true
+	return nil
+}
+
+func (p *testInstanceReuserProvider) MarkForReuse(ctx context.Context, instance string) error {
+	p.reusable = append(p.reusable, instance)
+	return nil
+}
+
+func (p *testInstanceReuserProvider) ReuseInstance(ctx context.Context, bootstrapParams params.BootstrapInstance) (params.ProviderInstance, error) {
+	if p.mockErr != nil {
+		return params.ProviderInstance{}, p.mockErr
+	}
+	if len(p.reusable) == 0 {
+		return params.ProviderInstance{}, gErrors.ErrNotFound
+	}
+	id := p.reusable[0]
+	p.reusable = p.reusable[1:]
+	return params.ProviderInstance{ProviderID: id, Name: bootstrapParams.Name, Status: params.InstanceRunning}, nil
+}
+
+func TestRunSoftDelete(t *testing.T) {
+	provider := &testInstanceReuserProvider{
+		testExternalProvider: testExternalProvider{
+			mockInstance: params.ProviderInstance{ProviderID: "new-instance", Name: "runner-2"},
+		},
+	}
+
+	deleteEnv := Environment{Command: DeleteInstanceCommand, InstanceID: "old-instance"}
+	_, err := Run(context.Background(), provider, deleteEnv)
+	require.NoError(t, err)
+	require.True(t, provider.deleted)
+	require.Empty(t, provider.reusable)
+
+	provider.deleted = false
+	deleteEnv.SoftDelete = true
+	_, err = Run(context.Background(), provider, deleteEnv)
+	require.NoError(t, err)
+	require.False(t, provider.deleted)
+	require.Equal(t, []string{"old-instance"}, provider.stopped)
+	require.Equal(t, []string{"old-instance"}, provider.reusable)
+
+	createEnv := Environment{
+		Command:    CreateInstanceCommand,
+		SoftDelete: true,
+		BootstrapParams: params.BootstrapInstance{
+			Name:          "runner-1",
+			InstanceToken: "instance-token",
+		},
+	}
+	out, err := Run(context.Background(), provider, createEnv)
+	require.NoError(t, err)
+	var instance params.ProviderInstance
+	require.NoError(t, json.Unmarshal([]byte(out), &instance))
+	require.Equal(t, "old-instance", instance.ProviderID)
+	require.Equal(t, "runner-1", instance.Name)
+
+	// Nothing left to reuse, so a new instance is created.
+	out, err = Run(context.Background(), provider, createEnv)
+	require.NoError(t, err)
+	require.NoError(t, json.Unmarshal([]byte(out), &instance))
+	require.Equal(t, "new-instance", instance.ProviderID)
+
+	provider.mockErr = fmt.Errorf("mock error")
+	_, err = Run(context.Background(), provider, createEnv)
+	require.EqualError(t, err, "failed to create instance in provider: failed to reuse instance: mock error")
+}
+
+func TestRunCreateInstanceCanonicalImageRef(t *testing.T) {
+	env := Environment{
+		Command: CreateInstanceCommand,
+		BootstrapParams: params.BootstrapInstance{
+			Name:          "test-instance",
+			Image:         " ubuntu-22.04\n",
+			InstanceToken: "instance-token",
+		},
+	}
+
+	provider := &recordingProvider{}
+	_, err := Run(context.Background(), provider, env)
+	require.NoError(t, err)
+	require.Equal(t, "ubuntu-22.04", provider.bootstrapParams.Image)
+
+	env.BootstrapParams.Image = "Ubuntu 22.04 LTS"
+	_, err = Run(context.Background(), provider, env)
+	require.NoError(t, err)
+	require.Equal(t, "Ubuntu 22.04 LTS", provider.bootstrapParams.Image)
+
+	opts := RunOptions{
+		ImageRefCanonicalizer: func(raw string) (string, error) {
+			if strings.Contains(raw, " ") {
+				return "", fmt.Errorf("image %q must be an image ID: %w", raw, gErrors.ErrBadRequest)
+			}
+			return strings.ToLower(raw), nil
+		},
+	}
+	_, err = RunWithOptions(context.Background(), provider, env, opts)
+	require.ErrorIs(t, err, gErrors.ErrBadRequest)
+	require.EqualError(t, err, `invalid image reference: image "Ubuntu 22.04 LTS" must be an image ID: invalid request`)
+
+	env.BootstrapParams.Image = "AMI-123"
+	_, err = RunWithOptions(context.Background(), provider, env, opts)
+	require.NoError(t, err)
+	require.Equal(t, "ami-123", provider.bootstrapParams.Image)
+}
+
+func TestValidateMissingInstanceID(t *testing.T) {
+	tmpfile, err := os.CreateTemp("", "provider-config")
+	require.NoError(t, err)
+	tmpfile.Close()
+	t.Cleanup(func() { os.RemoveAll(tmpfile.Name()) })
+
+	tests := []struct {
+		command   ExecutionCommand
+		errString string
+	}{
+		{
+			command:   GetInstanceCommand,
+			errString: "missing instance ID: GetInstance requires GARM_INSTANCE_ID, use ListInstances to list the instances of pool pool-id",
+		},
+		{
+			command:   StartInstanceCommand,
+			errString: "missing instance ID: StartInstance requires GARM_INSTANCE_ID, use StartPool to start all instances of pool pool-id",
+		},
+		{
+			command:   StopInstanceCommand,
+			errString: "missing instance ID: StopInstance requires GARM_INSTANCE_ID, use StopPool to stop all instances of pool pool-id",
+		},
+		{command: DeleteInstanceCommand, errString: "missing instance ID: DeleteInstance requires GARM_INSTANCE_ID"},
+		{command: RotateInstanceCredentialsCommand, errString: "missing instance ID: RotateInstanceCredentials requires GARM_INSTANCE_ID"},
+		{command: InstanceExistsCommand, errString: "missing instance ID: InstanceExists requires GARM_INSTANCE_ID"},
+		{command: GetBootDiagnosticsCommand, errString: "missing instance ID: GetBootDiagnostics requires GARM_INSTANCE_ID"},
+		{command: GetInstanceEventsCommand, errString: "missing instance ID: GetInstanceEvents requires GARM_INSTANCE_ID"},
+		{command: ResizeDiskCommand, errString: "missing instance ID: ResizeDisk requires GARM_INSTANCE_ID"},
+		{command: AttachNICCommand, errString: "missing instance ID: AttachNIC requires GARM_INSTANCE_ID"},
+		{command: DetachNICCommand, errString: "missing instance ID: DetachNIC requires GARM_INSTANCE_ID"},
+		{command: ExecActionCommand, errString: "missing instance ID: ExecAction requires GARM_INSTANCE_ID"},
+		{command: UpdateInstanceStatusCommand, errString: "missing instance ID: UpdateInstanceStatus requires GARM_INSTANCE_ID"},
+	}
+
+	for _, tc := range tests {
+		t.Run(string(tc.command), func(t *testing.T) {
+			env := Environment{
+				Command:            tc.command,
+				ProviderConfigFile: tmpfile.Name(),
+				ControllerID:       "controller-id",
+				PoolID:             "pool-id",
+			}
+			err := env.Validate()
+			require.EqualError(t, err, tc.errString)
+			require.ErrorIs(t, err, gErrors.ErrBadRequest)
+
+			var validationErr *gErrors.ValidationError
+			require.ErrorAs(t, err, &validationErr)
+			require.Equal(t, "GARM_INSTANCE_ID", validationErr.Field)
+		})
+	}
+}
+
+func TestRunInstanceHostname(t *testing.T) {
+	provider := &testExternalProvider{
+		mockInstance: params.ProviderInstance{
+			Name:     "runner-1",
+			Hostname: "ip-10-0-0-5.ec2.internal",
+		},
+	}
+
+	out, err := Run(context.Background(), provider, Environment{Command: GetInstanceCommand, InstanceID: "runner-1"})
+	require.NoError(t, err)
+	require.Contains(t, out, `"hostname":"ip-10-0-0-5.ec2.internal"`)
+
+	// An invalid hostname does not hide the instance from GARM.
+	provider.mockInstance.Hostname = "ip_10_0_0_5"
+	for _, env := range []Environment{
+		{Command: GetInstanceCommand, InstanceID: "runner-1"},
+		{Command: GetInstancesCommand, InstanceIDs: []string{"runner-1"}},
+		{Command: ListInstancesCommand, PoolID: "pool-id"},
+		{Command: CreateInstanceCommand, BootstrapParams: params.BootstrapInstance{Name: "runner-1", InstanceToken: "instance-token"}},
+	} {
+		var stderr bytes.Buffer
+		out, err := RunWithOptions(context.Background(), provider, env, RunOptions{Stderr: &stderr})
+		require.NoError(t, err, env.Command)
+		require.Contains(t, out, `"name":"runner-1"`, env.Command)
+		require.NotContains(t, out, "ip_10_0_0_5", env.Command)
+		require.Contains(t, stderr.String(), "WARNING: ignoring invalid hostname of instance runner-1", env.Command)
+	}
+}
+
+type testExtraSpecsDocumenterProvider struct {
+	testExternalProvider
+
+	doc params.SchemaDoc
+}
+
+func (p *testExtraSpecsDocumenterProvider) ExtraSpecsSchema(ctx context.Context) (params.SchemaDoc, error) {
+	if p.mockErr != nil {
+		return params.SchemaDoc{}, p.mockErr
+	}
+	return p.doc, nil
+}
+
+func TestRunGetExtraSpecsSchema(t *testing.T) {
+	env := Environment{Command: GetExtraSpecsSchemaCommand}
+
+	provider := &testExtraSpecsDocumenterProvider{
+		doc: params.SchemaDoc{Keys: []params.SchemaKey{
+			{Name: "subnet_id", Type: params.SchemaKeyString, Required: true, Description: "The subnet runners are connected to."},
+			{Name: "disk_size", Type: params.SchemaKeyInteger},
+		}},
+	}
+	out, err := Run(context.Background(), provider, env)
+	require.NoError(t, err)
+	require.JSONEq(t, `{"keys": [
+		{"name": "disk_size", "type": "integer"},
+		{"name": "subnet_id", "type": "string", "required": true, "description": "The subnet runners are connected to."}
+	]}`, out)
+
+	provider.doc.Keys = append(provider.doc.Keys, params.SchemaKey{Name: "disk_size", Type: params.SchemaKeyString})
+	_, err = Run(context.Background(), provider, env)
+	require.EqualError(t, err, `provider returned an invalid extra specs schema: duplicate key "disk_size": invalid request`)
+
+	provider = &testExtraSpecsDocumenterProvider{
+		testExternalProvider: testExternalProvider{mockErr: fmt.Errorf("mock error")},
+	}
+	_, err = Run(context.Background(), provider, env)
+	require.EqualError(t, err, "failed to get extra specs schema: mock error")
+
+	_, err = Run(context.Background(), &testExternalProvider{}, env)
+	require.ErrorIs(t, err, gErrors.ErrNotImplemented)
+}
+
+func TestRunMaintenanceMode(t *testing.T) {
+	provider := &testExternalProvider{
+		mockInstance: params.ProviderInstance{ProviderID: "instance-1", Name: "runner-1"},
+	}
+
+	tests := []struct {
+		name    string
+		command ExecutionCommand
+		errIs   error
+	}{
+		{name: "create instance", command: CreateInstanceCommand, errIs: gErrors.ErrMaintenanceMode},
+		{name: "delete instance", command: DeleteInstanceCommand, errIs: gErrors.ErrMaintenanceMode},
+		{name: "start instance", command: StartInstanceCommand, errIs: gErrors.ErrMaintenanceMode},
+		{name: "stop instance", command: StopInstanceCommand, errIs: gErrors.ErrMaintenanceMode},
+		{name: "remove all instances", command: RemoveAllInstancesCommand, errIs: gErrors.ErrMaintenanceMode},
+		{name: "get instance", command: GetInstanceCommand},
+		{name: "list instances", command: ListInstancesCommand},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			env := Environment{
+				Command:         tc.command,
+				InstanceID:      "instance-1",
+				MaintenanceMode: true,
+				BootstrapParams: params.BootstrapInstance{Name: "runner-1", InstanceToken: "instance-token"},
+			}
+			_, err := Run(context.Background(), provider, env)
+			if tc.errIs == nil {
+				require.NoError(t, err)
+				return
+			}
+			require.ErrorIs(t, err, tc.errIs)
+			require.Equal(t, ExitCodeMaintenanceMode, ResolveErrorToExitCode(err))
+		})
+	}
+}
@@ -0,0 +1,211 @@
+// Copyright 2023 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+// Package executiontest holds helpers to test providers built on the execution
+// package. It is meant to be imported from test files only.
+package executiontest
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/cloudbase/garm-provider-common/execution"
+	"github.com/cloudbase/garm-provider-common/params"
+)
+
+const (
+	conformanceInstanceName = "garm-conformance-runner"
+	conformancePoolID       = "garm-conformance-pool"
+	conformanceMissingID    = "garm-conformance-missing-instance"
+)
+
+// ConformanceSuite returns a test that drives the provider through every command of
+// the execution.ExternalProvider interface, the way GARM would, and checks that the
+// output and exit codes follow the interface contract. Providers run it from their
+// own tests:
+//
+//	func TestConformance(t *testing.T) {
+//		executiontest.ConformanceSuite(newProviderWithFakeCloud())(t)
+//	}
+//
+// The suite creates, stops, starts and deletes an instance named
+// garm-conformance-runner in the pool garm-conformance-pool, and ends with
+// RemoveAllInstances, so the provider should be backed by a fake or a disposable
+// cloud.
+func ConformanceSuite(provider execution.ExternalProvider) func(t *testing.T) {
+	return func(t *testing.T) {
+		ctx := context.Background()
+		run := func(t *testing.T, env execution.Environment) (string, error) {
+			t.Helper()
+			out, err := execution.Run(ctx, provider, env)
+			if err != nil {
+				t.Logf("%s failed with exit code %d: %s", env.Command, execution.ResolveErrorToExitCode(err), err)
+			}
+			return out, err
+		}
+
+		var providerID string
+		ok := t.Run(string(execution.CreateInstanceCommand), func(t *testing.T) {
+			out, err := run(t, execution.Environment{
+				Command:         execution.CreateInstanceCommand,
+				BootstrapParams: conformanceBootstrapParams(),
+			})
+			if err != nil {
+				t.Fatalf("failed to create instance: %s", err)
+			}
+			instance := decodeConformanceInstance(t, out)
+			if instance.Name != conformanceInstanceName {
+				t.Errorf("expected instance name %q, got %q", conformanceInstanceName, instance.Name)
+			}
+			providerID = instance.ProviderID
+		})
+		if !ok {
+			t.Fatalf("%s failed, skipping the remaining commands", execution.CreateInstanceCommand)
+		}
+		t.Cleanup(func() {
+			// Best effort, in case the suite failed before deleting the instance.
+			_, _ = execution.Run(ctx, provider, execution.Environment{Command: execution.DeleteInstanceCommand, InstanceID: providerID})
+		})
+
+		t.Run(string(execution.GetInstanceCommand), func(t *testing.T) {
+			out, err := run(t, execution.Environment{Command: execution.GetInstanceCommand, InstanceID: providerID})
+			if err != nil {
+				t.Fatalf("failed to get instance: %s", err)
+			}
+			if instance := decodeConformanceInstance(t, out); instance.ProviderID != providerID {
+				t.Errorf("expected provider ID %q, got %q", providerID, instance.ProviderID)
+			}
+		})
+
+		t.Run(string(execution.GetInstanceCommand)+"NotFound", func(t *testing.T) {
+			_, err := run(t, execution.Environment{Command: execution.GetInstanceCommand, InstanceID: conformanceMissingID})
+			if code := execution.ResolveErrorToExitCode(err); code != execution.ExitCodeNotFound {
+				t.Errorf("expected exit code %d for a missing instance, got %d", execution.ExitCodeNotFound, code)
+			}
+		})
+
+		t.Run(string(execution.ListInstancesCommand), func(t *testing.T) {
+			out, err := run(t, execution.Environment{Command: execution.ListInstancesCommand, PoolID: conformancePoolID})
+			if err != nil {
+				t.Fatalf("failed to list instances: %s", err)
+			}
+			if !strings.HasPrefix(strings.TrimSpace(out), "[") {
+				t.Fatalf("expected a JSON array, got %q", out)
+			}
+			var instances []params.ProviderInstance
+			if err := json.Unmarshal([]byte(out), &instances); err != nil {
+				t.Fatalf("failed to decode instances: %s", err)
+			}
+			found := false
+			for _, instance := range instances {
+				checkConformanceInstance(t, instance)
+				found = found || instance.ProviderID == providerID
+			}
+			if !found {
+				t.Errorf("instance %s is missing from pool %s", providerID, conformancePoolID)
+			}
+		})
+
+		t.Run(string(execution.StopInstanceCommand), func(t *testing.T) {
+			out, err := run(t, execution.Environment{Command: execution.StopInstanceCommand, InstanceID: providerID})
+			if err != nil {
+				t.Fatalf("failed to stop instance: %s", err)
+			}
+			checkConformanceEmptyOutput(t, out)
+
+			// A stopped instance must still exist, and be powered off.
+			out, err = run(t, execution.Environment{Command: execution.GetInstanceCommand, InstanceID: providerID})
+			if err != nil {
+				t.Fatalf("failed to get stopped instance: %s", err)
+			}
+			if instance := decodeConformanceInstance(t, out); instance.PowerState != params.PowerStateOff {
+				t.Errorf("expected power state %q for a stopped instance, got %q", params.PowerStateOff, instance.PowerState)
+			}
+		})
+
+		t.Run(string(execution.StartInstanceCommand), func(t *testing.T) {
+			out, err := run(t, execution.Environment{Command: execution.StartInstanceCommand, InstanceID: providerID})
+			if err != nil {
+				t.Fatalf("failed to start instance: %s", err)
+			}
+			checkConformanceEmptyOutput(t, out)
+		})
+
+		t.Run(string(execution.DeleteInstanceCommand), func(t *testing.T) {
+			out, err := run(t, execution.Environment{Command: execution.DeleteInstanceCommand, InstanceID: providerID})
+			if err != nil {
+				t.Fatalf("failed to delete instance: %s", err)
+			}
+			checkConformanceEmptyOutput(t, out)
+		})
+
+		t.Run(string(execution.RemoveAllInstancesCommand), func(t *testing.T) {
+			out, err := run(t, execution.Environment{Command: execution.RemoveAllInstancesCommand})
+			if err != nil {
+				t.Fatalf("failed to remove all instances: %s", err)
+			}
+			checkConformanceEmptyOutput(t, out)
+		})
+	}
+}
+
+// conformanceBootstrapParams returns the bootstrap params of the instance created by
+// the conformance suite.
+func conformanceBootstrapParams() params.BootstrapInstance {
+	return params.BootstrapInstance{
+		Name:          conformanceInstanceName,
+		PoolID:        conformancePoolID,
+		OSType:        params.Linux,
+		OSArch:        params.Amd64,
+		Flavor:        "m1.small",
+		Image:         "ubuntu:22.04",
+		Labels:        []string{"conformance"},
+		InstanceToken: "conformance-token",
+	}
+}
+
+func decodeConformanceInstance(t *testing.T, out string) params.ProviderInstance {
+	t.Helper()
+
+	var instance params.ProviderInstance
+	if err := json.Unmarshal([]byte(out), &instance); err != nil {
+		t.Fatalf("expected a JSON instance, got %q: %s", out, err)
+	}
+	checkConformanceInstance(t, instance)
+	return instance
+}
+
+func checkConformanceInstance(t *testing.T, instance params.ProviderInstance) {
+	t.Helper()
+
+	if instance.ProviderID == "" {
+		t.Errorf("instance %q has no provider ID", instance.Name)
+	}
+	if instance.Name == "" {
+		t.Errorf("instance %q has no name", instance.ProviderID)
+	}
+	if instance.Status != "" && !instance.Status.IsValid() {
+		t.Errorf("instance %q has an invalid status %q", instance.Name, instance.Status)
+	}
+}
+
+func checkConformanceEmptyOutput(t *testing.T, out string) {
+	t.Helper()
+
+	if out != "" {
+		t.Errorf("expected no output, got %q", out)
+	}
+}
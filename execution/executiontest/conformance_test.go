@@ -0,0 +1,118 @@
+// Copyright 2023 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package executiontest
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+
+	gErrors "github.com/cloudbase/garm-provider-common/errors"
+	"github.com/cloudbase/garm-provider-common/params"
+	"github.com/stretchr/testify/require"
+)
+
+// memoryProvider is an execution.ExternalProvider that keeps its instances in memory, and
+// follows the interface contract.
+type memoryProvider struct {
+	mux       sync.Mutex
+	instances map[string]params.ProviderInstance
+	nextID    int
+}
+
+func (p *memoryProvider) CreateInstance(_ context.Context, bootstrapParams params.BootstrapInstance) (params.ProviderInstance, error) {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+
+	p.nextID++
+	instance := params.ProviderInstance{
+		ProviderID: fmt.Sprintf("instance-%d", p.nextID),
+		Name:       bootstrapParams.Name,
+		OSType:     bootstrapParams.OSType,
+		OSArch:     bootstrapParams.OSArch,
+		Status:     params.InstanceRunning,
+	}
+	if p.instances == nil {
+		p.instances = map[string]params.ProviderInstance{}
+	}
+	p.instances[instance.ProviderID] = instance
+	return instance, nil
+}
+
+func (p *memoryProvider) DeleteInstance(_ context.Context, instance string) error {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+
+	delete(p.instances, instance)
+	return nil
+}
+
+func (p *memoryProvider) GetInstance(_ context.Context, instance string) (params.ProviderInstance, error) {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+
+	found, ok := p.instances[instance]
+	if !ok {
+		return params.ProviderInstance{}, fmt.Errorf("instance %s: %w", instance, gErrors.ErrNotFound)
+	}
+	return found, nil
+}
+
+func (p *memoryProvider) ListInstances(context.Context, string) ([]params.ProviderInstance, error) {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+
+	instances := []params.ProviderInstance{}
+	for _, instance := range p.instances {
+		instances = append(instances, instance)
+	}
+	return instances, nil
+}
+
+func (p *memoryProvider) RemoveAllInstances(context.Context) error {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+
+	p.instances = nil
+	return nil
+}
+
+func (p *memoryProvider) setStatus(instance string, status params.InstanceStatus) error {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+
+	found, ok := p.instances[instance]
+	if !ok {
+		return fmt.Errorf("instance %s: %w", instance, gErrors.ErrNotFound)
+	}
+	found.Status = status
+	p.instances[instance] = found
+	return nil
+}
+
+func (p *memoryProvider) Stop(_ context.Context, instance string, _ bool) error {
+	return p.setStatus(instance, params.InstanceStopped)
+}
+
+func (p *memoryProvider) Start(_ context.Context, instance string) error {
+	return p.setStatus(instance, params.InstanceRunning)
+}
+
+func TestConformanceSuite(t *testing.T) {
+	provider := &memoryProvider{}
+	ConformanceSuite(provider)(t)
+	require.Empty(t, provider.instances)
+}
@@ -0,0 +1,101 @@
+// Copyright 2023 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package execution
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	gErrors "github.com/cloudbase/garm-provider-common/errors"
+	"github.com/cloudbase/garm-provider-common/params"
+)
+
+// getInstances fetches the instances in env.InstanceIDs. The results are in the same
+// order as the IDs, with missing instances marked as not found.
+func getInstances(ctx context.Context, provider ExternalProvider, env Environment, opts RunOptions) ([]params.InstanceLookupResult, error) {
+	results := make([]params.InstanceLookupResult, len(env.InstanceIDs))
+	for idx, id := range env.InstanceIDs {
+		results[idx] = params.InstanceLookupResult{ID: id, NotFound: true}
+	}
+
+	setInstance := func(idx int, instance params.ProviderInstance) {
+		instance = env.downgradeInstance(opts.mapStatus(sanitizeHostname(ctx, prepareInstance(instance))))
+		results[idx].NotFound = false
+		results[idx].Instance = &instance
+	}
+
+	if getter, ok := asOptional[BatchGetter](provider); ok {
+		instances, err := getter.GetInstances(ctx, env.InstanceIDs)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get instances from provider: %w", err)
+		}
+
+		byID := make(map[string]params.ProviderInstance, len(instances))
+		for _, instance := range instances {
+			if instance.ProviderID != "" {
+				byID[instance.ProviderID] = instance
+			}
+			if instance.Name != "" {
+				byID[instance.Name] = instance
+			}
+		}
+		for idx, id := range env.InstanceIDs {
+			if instance, ok := byID[id]; ok {
+				setInstance(idx, instance)
+			}
+		}
+		return results, nil
+	}
+
+	var mux sync.Mutex
+	var wg sync.WaitGroup
+	var errs []error
+	sem := make(chan struct{}, opts.poolConcurrency())
+	for idx, id := range env.InstanceIDs {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(idx int, id string) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+
+			var instance params.ProviderInstance
+			err := recoverPanic(func() error {
+				var err error
+				instance, err = provider.GetInstance(ctx, id)
+				return err
+			})
+
+			mux.Lock()
+			defer mux.Unlock()
+			if err != nil {
+				if !errors.Is(err, gErrors.ErrNotFound) {
+					errs = append(errs, fmt.Errorf("instance %s: %w", id, err))
+				}
+				return
+			}
+			setInstance(idx, instance)
+		}(idx, id)
+	}
+	wg.Wait()
+
+	if len(errs) > 0 {
+		return nil, fmt.Errorf("failed to get instances from provider: %w", errors.Join(errs...))
+	}
+	return results, nil
+}
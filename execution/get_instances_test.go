@@ -0,0 +1,160 @@
+// Copyright 2023 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package execution
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"testing"
+
+	gErrors "github.com/cloudbase/garm-provider-common/errors"
+	"github.com/cloudbase/garm-provider-common/params"
+	"github.com/stretchr/testify/require"
+)
+
+type instancesProvider struct {
+	testExternalProvider
+
+	instances map[string]params.ProviderInstance
+	failFor   string
+	panicFor  string
+
+	mux     sync.Mutex
+	active  int
+	maxSeen int
+}
+
+func (p *instancesProvider) GetInstance(ctx context.Context, instance string) (params.ProviderInstance, error) {
+	p.mux.Lock()
+	p.active++
+	if p.active > p.maxSeen {
+		p.maxSeen = p.active
+	}
+	p.mux.Unlock()
+
+	defer func() {
+		p.mux.Lock()
+		p.active--
+		p.mux.Unlock()
+	}()
+
+	if instance == p.failFor {
+		return params.ProviderInstance{}, fmt.Errorf("mock error")
+	}
+	if instance == p.panicFor {
+		panic("mock panic")
+	}
+	ret, ok := p.instances[instance]
+	if !ok {
+		return params.ProviderInstance{}, fmt.Errorf("instance %s: %w", instance, gErrors.ErrNotFound)
+	}
+	return ret, nil
+}
+
+type testBatchGetterProvider struct {
+	testExternalProvider
+
+	ids []string
+}
+
+func (p *testBatchGetterProvider) GetInstances(ctx context.Context, ids []string) ([]params.ProviderInstance, error) {
+	if p.mockErr != nil {
+		return nil, p.mockErr
+	}
+	p.ids = ids
+	return []params.ProviderInstance{
+		{Name: "runner-2", Status: params.InstanceStopped},
+		{ProviderID: "i-1", Status: params.InstanceRunning},
+	}, nil
+}
+
+func TestRunGetInstances(t *testing.T) {
+	provider := &instancesProvider{
+		instances: map[string]params.ProviderInstance{
+			"i-1": {ProviderID: "i-1", Status: params.InstanceRunning},
+			"i-2": {ProviderID: "i-2", Status: params.InstanceStopped},
+			"i-4": {ProviderID: "i-4", Status: params.InstanceRunning},
+		},
+	}
+	env := Environment{
+		Command:     GetInstancesCommand,
+		InstanceIDs: []string{"i-4", "i-3", "i-1", "i-2"},
+	}
+
+	out, err := RunWithOptions(context.Background(), provider, env, RunOptions{PoolConcurrency: 2})
+	require.NoError(t, err)
+	require.JSONEq(t, `[
+		{"id": "i-4", "instance": {"provider_id": "i-4", "status": "running", "power_state": "on"}},
+		{"id": "i-3", "not_found": true},
+		{"id": "i-1", "instance": {"provider_id": "i-1", "status": "running", "power_state": "on"}},
+		{"id": "i-2", "instance": {"provider_id": "i-2", "status": "stopped", "power_state": "off"}}
+	]`, out)
+	require.LessOrEqual(t, provider.maxSeen, 2)
+
+	provider.failFor = "i-1"
+	_, err = Run(context.Background(), provider, env)
+	require.EqualError(t, err, "failed to get instances from provider: instance i-1: mock error")
+
+	provider.failFor = ""
+	provider.panicFor = "i-2"
+	_, err = Run(context.Background(), provider, env)
+	require.EqualError(t, err, "failed to get instances from provider: instance i-2: panic while calling provider: mock panic")
+}
+
+func TestRunGetInstancesBatchGetter(t *testing.T) {
+	env := Environment{
+		Command:     GetInstancesCommand,
+		InstanceIDs: []string{"runner-2", "i-3", "i-1"},
+	}
+
+	provider := &testBatchGetterProvider{}
+	out, err := Run(context.Background(), provider, env)
+	require.NoError(t, err)
+	require.Equal(t, env.InstanceIDs, provider.ids)
+
+	var results []params.InstanceLookupResult
+	require.NoError(t, json.Unmarshal([]byte(out), &results))
+	require.Len(t, results, 3)
+	require.Equal(t, "runner-2", results[0].ID)
+	require.Equal(t, "runner-2", results[0].Instance.Name)
+	require.Equal(t, params.PowerStateOff, results[0].Instance.PowerState)
+	require.Equal(t, params.InstanceLookupResult{ID: "i-3", NotFound: true}, results[1])
+	require.Equal(t, "i-1", results[2].Instance.ProviderID)
+
+	provider = &testBatchGetterProvider{
+		testExternalProvider: testExternalProvider{mockErr: fmt.Errorf("mock error")},
+	}
+	_, err = Run(context.Background(), provider, env)
+	require.EqualError(t, err, "failed to get instances from provider: mock error")
+}
+
+func TestGetEnvironmentGetInstances(t *testing.T) {
+	setGarmEnv(t, GetInstancesCommand)
+	setStdin(t, `["i-1", "i-2"]`)
+
+	env, err := GetEnvironment()
+	require.NoError(t, err)
+	require.Equal(t, []string{"i-1", "i-2"}, env.InstanceIDs)
+
+	setStdin(t, `[]`)
+	_, err = GetEnvironment()
+	require.ErrorContains(t, err, "missing instance IDs")
+
+	setStdin(t, `{"id": "i-1"}`)
+	_, err = GetEnvironment()
+	require.ErrorIs(t, err, gErrors.ErrBadRequest)
+}
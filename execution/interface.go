@@ -16,15 +16,47 @@ package execution
 
 import (
 	"context"
+	"encoding/json"
+	"time"
 
 	"github.com/cloudbase/garm-provider-common/params"
 )
 
+// ProviderUnwrapper is implemented by providers that wrap another provider, like
+// RunRecorder. The optional interfaces, like StatusUpdater, that the wrapper does
+// not implement itself are looked up on the wrapped provider, so wrapping a provider
+// does not change which code paths run.
+type ProviderUnwrapper interface {
+	// Unwrap returns the wrapped provider.
+	Unwrap() ExternalProvider
+}
+
+// asOptional returns the provider as the optional interface T, looking through
+// wrappers that implement ProviderUnwrapper.
+func asOptional[T any](provider ExternalProvider) (T, bool) {
+	for provider != nil {
+		if ret, ok := provider.(T); ok {
+			return ret, true
+		}
+		wrapper, ok := provider.(ProviderUnwrapper)
+		if !ok {
+			break
+		}
+		provider = wrapper.Unwrap()
+	}
+	var zero T
+	return zero, false
+}
+
 // ExternalProvider defines an interface that external providers need to implement.
 // This is very similar to the common.Provider interface, and was redefined here to
 // decouple it, in case it may diverge from native providers.
 type ExternalProvider interface {
-	// CreateInstance creates a new compute instance in the provider.
+	// CreateInstance creates a new compute instance in the provider. If IsCreateAsync(ctx)
+	// returns true, the provider may return as soon as the cloud has assigned an ID to
+	// the instance, before it is fully provisioned. The returned ProviderID must be
+	// resolvable by GetInstance right away, as GARM will poll it to follow the progress
+	// of the instance.
 	CreateInstance(ctx context.Context, bootstrapParams params.BootstrapInstance) (params.ProviderInstance, error)
 	// Delete instance will delete the instance in a provider.
 	DeleteInstance(ctx context.Context, instance string) error
@@ -34,8 +66,273 @@ type ExternalProvider interface {
 	ListInstances(ctx context.Context, poolID string) ([]params.ProviderInstance, error)
 	// RemoveAllInstances will remove all instances created by this provider.
 	RemoveAllInstances(ctx context.Context) error
-	// Stop shuts down the instance.
+	// Stop shuts down the instance. A stopped instance must still be returned by
+	// GetInstance and ListInstances, with a PowerState of params.PowerStateOff.
 	Stop(ctx context.Context, instance string, force bool) error
 	// Start boots up an instance.
 	Start(ctx context.Context, instance string) error
 }
+
+// StatusUpdater is an optional interface that providers may implement to receive
+// instance status transitions as they happen, instead of waiting to be polled.
+type StatusUpdater interface {
+	// UpdateStatus applies a status transition to an instance.
+	UpdateStatus(ctx context.Context, update params.InstanceStatusUpdate) error
+}
+
+// CostEstimator is an optional interface that providers may implement to report
+// the estimated cost of running an instance. Providers that have no pricing data
+// should return errors.ErrNotImplemented.
+type CostEstimator interface {
+	// EstimateCost returns the estimated cost of an instance created with bootstrapParams.
+	EstimateCost(ctx context.Context, bootstrapParams params.BootstrapInstance) (params.CostEstimate, error)
+}
+
+// AllInstancesLister is an optional interface that providers may implement to list
+// every instance they own for a controller, regardless of pool. This complements
+// RemoveAllInstances, which also operates at controller scope.
+type AllInstancesLister interface {
+	// ListAllInstances will list all instances created by this provider for the controller.
+	ListAllInstances(ctx context.Context, controllerID string) ([]params.ProviderInstance, error)
+}
+
+// Describer is an optional interface that providers may implement to describe
+// themselves to discovery tooling. Describe must return static information and
+// must not require a connection to the cloud or valid credentials.
+type Describer interface {
+	// Describe returns the self-description of the provider.
+	Describe(ctx context.Context) (params.ProviderDescription, error)
+}
+
+// ExtraSpecsDocumenter is an optional interface that providers may implement to list
+// the extra specs keys they accept, so tooling can document them. Like Describe,
+// ExtraSpecsSchema must return static information and must not require a
+// connection to the cloud or valid credentials.
+type ExtraSpecsDocumenter interface {
+	// ExtraSpecsSchema returns the extra specs keys the provider accepts.
+	ExtraSpecsSchema(ctx context.Context) (params.SchemaDoc, error)
+}
+
+// CredentialRotator is an optional interface that providers may implement to rotate
+// the cloud credentials or instance profile of long lived runners, without recreating
+// them. Providers that cannot rotate credentials should return errors.ErrNotImplemented.
+type CredentialRotator interface {
+	// RotateCredentials rotates the credentials of an instance.
+	RotateCredentials(ctx context.Context, instance string) error
+}
+
+// ExistenceChecker is an optional interface that providers may implement to check
+// if an instance exists using a cheaper API call than GetInstance. Providers that
+// do not implement it fall back to GetInstance.
+type ExistenceChecker interface {
+	// InstanceExists returns true if the instance exists in the provider.
+	InstanceExists(ctx context.Context, instance string) (bool, error)
+}
+
+// PoolPowerManager is an optional interface that providers may implement to stop
+// and start all instances in a pool in bulk, if the cloud has a cheaper way of doing
+// so than one call per instance. Providers that do not implement it get the per
+// instance Stop and Start called for every instance in the pool.
+type PoolPowerManager interface {
+	// StopPool stops all instances in a pool and returns the IDs of the instances
+	// that were stopped.
+	StopPool(ctx context.Context, poolID string) ([]string, error)
+	// StartPool starts all instances in a pool and returns the IDs of the instances
+	// that were started.
+	StartPool(ctx context.Context, poolID string) ([]string, error)
+}
+
+// ConfigTester is an optional interface that providers may implement to validate
+// their config at setup time. Unlike a simple connectivity check, TestConfig should
+// exercise the full config, for example by authenticating and listing regions. It
+// must not have any side effects.
+type ConfigTester interface {
+	// TestConfig returns a descriptive error if the provider config is not usable.
+	TestConfig(ctx context.Context) error
+}
+
+// ConfigLoader is an optional interface that providers may implement to have their
+// config loaded once, before any command runs. Failures are reported as
+// ErrInvalidConfig, so GARM sees the same exit code regardless of the provider.
+// Providers that load their config lazily need not implement it.
+type ConfigLoader interface {
+	// LoadConfig loads the provider config from paths. When GARM passes several
+	// layered files via GARM_PROVIDER_CONFIG_FILES, files later in the list override
+	// values set by earlier ones. Environment.ProviderConfig implements this merge
+	// for YAML, JSON and TOML files. RunServer calls it once, before the first
+	// command that needs the config, while the one shot CLI calls it for every
+	// command.
+	LoadConfig(paths []string) error
+}
+
+// EffectiveConfigReporter is an optional interface that providers may implement to
+// report the config they actually use, to help debug which of the defaults, config
+// files and environment variables won.
+type EffectiveConfigReporter interface {
+	// EffectiveConfig returns the parsed config. Providers should redact secrets, but
+	// values of keys that look sensitive are redacted regardless.
+	EffectiveConfig(ctx context.Context) (map[string]interface{}, error)
+}
+
+// MetricsExporter is an optional interface that providers may implement to expose
+// their counters (instances managed, API calls, errors, etc) to deployments that
+// run the provider as a one shot process, and thus cannot use a MetricsRecorder.
+type MetricsExporter interface {
+	// Metrics returns the metrics of the provider in the Prometheus text exposition
+	// format.
+	Metrics(ctx context.Context) ([]byte, error)
+}
+
+// ReasonedDeleter is an optional interface that providers may implement to receive
+// the reason an instance is being deleted, as set by GARM in GARM_OPERATION_REASON.
+// It is only used when a reason is set.
+type ReasonedDeleter interface {
+	// DeleteInstanceWithReason deletes an instance, recording the reason.
+	DeleteInstanceWithReason(ctx context.Context, instance string, reason string) error
+}
+
+// ReasonedStopper is an optional interface that providers may implement to receive
+// the reason an instance is being stopped, as set by GARM in GARM_OPERATION_REASON.
+// It is only used when a reason is set.
+type ReasonedStopper interface {
+	// StopWithReason stops an instance, recording the reason.
+	StopWithReason(ctx context.Context, instance string, force bool, reason string) error
+}
+
+// ActionExecutor is an optional interface that providers may implement to expose
+// cloud specific instance actions (reboot, password reset, reinstall, etc), without
+// a dedicated command for each of them. Providers should list the actions they
+// support in the SupportedActions field of their description.
+type ActionExecutor interface {
+	// ExecAction runs action against an instance. The args and the returned result
+	// are opaque JSON documents, whose format is defined by the action. Unknown
+	// actions should return errors.ErrNotImplemented.
+	ExecAction(ctx context.Context, instance string, action string, args json.RawMessage) (json.RawMessage, error)
+}
+
+// BestEffortRemover is an optional interface that providers may implement to keep
+// removing instances when RemoveAllInstances fails to remove one of them. It is only
+// used if GARM_REMOVE_BEST_EFFORT is set to true.
+type BestEffortRemover interface {
+	// RemoveAllInstancesBestEffort attempts to remove all instances created by the
+	// controller, and returns the IDs of the removed instances along with the errors
+	// of the ones that could not be removed.
+	RemoveAllInstancesBestEffort(ctx context.Context) (removed []string, failed map[string]error)
+}
+
+// InstanceStreamer is an optional interface that providers which can enumerate
+// instances lazily, like through a paginated API, may implement. It is used instead
+// of ListInstances, and lets GARM_OUTPUT_NDJSON write instances as they are found,
+// bounding memory use regardless of the size of the pool.
+type InstanceStreamer interface {
+	// ListInstancesFunc calls emit for every instance in the pool, and stops at the
+	// first error emit returns.
+	ListInstancesFunc(ctx context.Context, poolID string, emit func(params.ProviderInstance) error) error
+}
+
+// BatchGetter is an optional interface that providers may implement to fetch several
+// instances with fewer API calls than one GetInstance per instance. Providers that do
+// not implement it fall back to concurrent GetInstance calls.
+type BatchGetter interface {
+	// GetInstances returns the instances with the given IDs, in any order. Instances
+	// that do not exist are left out.
+	GetInstances(ctx context.Context, ids []string) ([]params.ProviderInstance, error)
+}
+
+// UserDataGenerator is an optional interface that providers may implement to have
+// the size of the user data checked against the limit of the cloud, before the
+// instance is created. It also powers the RenderBootstrap command, which lets
+// operators inspect the user data of an instance without creating it.
+type UserDataGenerator interface {
+	// GenerateUserData renders the user data of an instance. The result is made
+	// available to CreateInstance through UserDataFromContext.
+	GenerateUserData(ctx context.Context, bootstrapParams params.BootstrapInstance) ([]byte, error)
+	// MaxUserDataSize returns the maximum size of the user data accepted by the
+	// cloud, in bytes. Values lower than 1 disable the check.
+	MaxUserDataSize() int
+}
+
+// BootDiagnosticsGetter is an optional interface that providers may implement to
+// expose the boot diagnostics of instances. Providers that cannot get them should
+// return errors.ErrNotImplemented.
+type BootDiagnosticsGetter interface {
+	// GetBootDiagnostics returns the boot diagnostics of an instance.
+	GetBootDiagnostics(ctx context.Context, instance string) (params.BootDiagnostics, error)
+}
+
+// EventsGetter is an optional interface that providers may implement to expose the
+// events the cloud recorded for an instance, which often explain why it failed.
+// Providers that cannot get them should return errors.ErrNotImplemented.
+type EventsGetter interface {
+	// GetEvents returns the events of an instance that happened after since. A zero
+	// since returns all the events the cloud still holds.
+	GetEvents(ctx context.Context, instance string, since time.Time) ([]params.InstanceEvent, error)
+}
+
+// DiskResizer is an optional interface that providers which can grow the disk of a
+// running instance may implement. Providers that cannot resize disks online should
+// return errors.ErrNotImplemented. Providers should reject sizes smaller than the
+// current one with errors.ErrBadRequest, unless their cloud supports shrinking.
+type DiskResizer interface {
+	// ResizeDisk resizes the disk of an instance to newSizeGB.
+	ResizeDisk(ctx context.Context, instance string, newSizeGB int) error
+}
+
+// BatchCreator is an optional interface that providers for clouds which create
+// instances in batches may implement, to scale up more efficiently.
+type BatchCreator interface {
+	// CreateInstances creates up to count instances using bootstrapParams as a
+	// template. Clouds may partially fulfill the request, in which case the instances
+	// that were created are returned along with the error, if any.
+	CreateInstances(ctx context.Context, bootstrapParams params.BootstrapInstance, count int) ([]params.ProviderInstance, error)
+}
+
+// InstanceReuser is an optional interface that providers may implement to support
+// soft deletes, enabled with GARM_SOFT_DELETE. The lifecycle of a soft deleted
+// instance is:
+//
+//  1. DeleteInstance stops the instance and calls MarkForReuse, instead of
+//     destroying it. GARM considers the instance gone, so the provider owns it from
+//     then on, and must not report it in ListInstances.
+//  2. CreateInstance calls ReuseInstance first. The provider picks one of the
+//     instances it marked, clears the mark, re-bootstraps it with the new params
+//     (the runner of the old instance is gone from GitHub and cannot be restarted)
+//     and starts it. If no instance can be reused, the provider returns
+//     ErrNotFound and a new instance is created as usual.
+//
+// Providers should garbage collect instances that stay marked for too long.
+// Providers that do not implement it always destroy instances, even in soft delete
+// mode.
+type InstanceReuser interface {
+	// MarkForReuse tags a stopped instance as available for reuse.
+	MarkForReuse(ctx context.Context, instance string) error
+	// ReuseInstance reclaims a stopped instance for bootstrapParams and returns it,
+	// as CreateInstance would.
+	ReuseInstance(ctx context.Context, bootstrapParams params.BootstrapInstance) (params.ProviderInstance, error)
+}
+
+// NICManager is an optional interface that providers which support multiple network
+// interfaces per instance may implement. Providers that do not support it should
+// return errors.ErrNotImplemented.
+type NICManager interface {
+	// AttachNIC attaches a network interface to an instance.
+	AttachNIC(ctx context.Context, instance string, nic params.NICSpec) error
+	// DetachNIC detaches a network interface from an instance.
+	DetachNIC(ctx context.Context, instance string, nic params.NICSpec) error
+}
+
+// Warmer is an optional interface that providers which cache images or templates
+// may implement, to pre-stage them before instances are created. Providers that
+// have nothing to warm up should return errors.ErrNotImplemented.
+type Warmer interface {
+	// Warmup prepares the resources needed to create an instance with bootstrapParams.
+	Warmup(ctx context.Context, bootstrapParams params.BootstrapInstance) error
+}
+
+// PoolValidator is an optional interface that providers which pre-register pools
+// may implement to reject unknown pools before an instance is created. It is only
+// called if GARM_PREVALIDATE_POOL is set to true.
+type PoolValidator interface {
+	// ValidatePool returns an error if poolID is not a pool known to the provider.
+	ValidatePool(ctx context.Context, poolID string) error
+}
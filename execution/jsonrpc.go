@@ -0,0 +1,145 @@
+// Copyright 2023 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package execution
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+)
+
+const jsonRPCVersion = "2.0"
+
+// JSON-RPC 2.0 error codes.
+const (
+	jsonRPCParseError     = -32700
+	jsonRPCInvalidRequest = -32600
+	jsonRPCInvalidParams  = -32602
+	// jsonRPCCommandError is returned for errors returned by the command itself.
+	jsonRPCCommandError = -32000
+)
+
+type jsonRPCRequest struct {
+	JSONRPC string          `json:"jsonrpc"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params,omitempty"`
+	ID      json.RawMessage `json:"id,omitempty"`
+}
+
+// JSONRPCErrorData is the data attached to JSON-RPC errors.
+type JSONRPCErrorData struct {
+	// ExitCode is the exit code the command would have had when run in the
+	// default mode. See ResolveErrorToExitCode.
+	ExitCode int `json:"exit_code"`
+	// RetryAfter is the number of seconds to wait before retrying, if the cloud
+	// throttled the command and said for how long.
+	RetryAfter int `json:"retry_after,omitempty"`
+	// Result is the output of commands that partially fail, like StopPool. JSON-RPC
+	// does not allow a result next to an error, so it is carried here instead.
+	Result json.RawMessage `json:"result,omitempty"`
+}
+
+// JSONRPCError is the error object of a JSON-RPC response.
+type JSONRPCError struct {
+	Code    int              `json:"code"`
+	Message string           `json:"message"`
+	Data    JSONRPCErrorData `json:"data"`
+}
+
+// JSONRPCResponse is the response written by RunJSONRPC.
+type JSONRPCResponse struct {
+	JSONRPC string          `json:"jsonrpc"`
+	Result  json.RawMessage `json:"result,omitempty"`
+	Error   *JSONRPCError   `json:"error,omitempty"`
+	ID      json.RawMessage `json:"id"`
+}
+
+// JSONRPCEnabled returns true if GARM_PROTOCOL is set to jsonrpc. Providers should
+// then call RunJSONRPC instead of GetEnvironment and Run.
+func JSONRPCEnabled() bool {
+	return os.Getenv("GARM_PROTOCOL") == "jsonrpc"
+}
+
+// RunJSONRPC reads a JSON-RPC 2.0 request from r, runs it and writes the response
+// to w. The method of the request is the command to run and the params are the
+// JSON encoded Environment, minus the command. Errors returned by the command are
+// reported in the response, with the exit code and any partial result in the error
+// data. The returned
+// error is only set if the response could not be written.
+func RunJSONRPC(ctx context.Context, provider ExternalProvider, r io.Reader, w io.Writer) error {
+	resp := handleJSONRPC(ctx, provider, r)
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		return fmt.Errorf("failed to write response: %w", err)
+	}
+	return nil
+}
+
+func newJSONRPCError(id json.RawMessage, code int, err error) JSONRPCResponse {
+	if id == nil {
+		id = json.RawMessage("null")
+	}
+	retryAfter, _ := RetryAfterSeconds(err)
+	return JSONRPCResponse{
+		JSONRPC: jsonRPCVersion,
+		Error: &JSONRPCError{
+			Code:    code,
+			Message: err.Error(),
+			Data:    JSONRPCErrorData{ExitCode: ResolveErrorToExitCode(err), RetryAfter: retryAfter},
+		},
+		ID: id,
+	}
+}
+
+func handleJSONRPC(ctx context.Context, provider ExternalProvider, r io.Reader) JSONRPCResponse {
+	var req jsonRPCRequest
+	if err := json.NewDecoder(r).Decode(&req); err != nil {
+		return newJSONRPCError(nil, jsonRPCParseError, fmt.Errorf("failed to decode request: %w", err))
+	}
+	if req.JSONRPC != jsonRPCVersion || req.Method == "" {
+		return newJSONRPCError(req.ID, jsonRPCInvalidRequest, fmt.Errorf("invalid JSON-RPC 2.0 request"))
+	}
+
+	var env Environment
+	if len(req.Params) > 0 {
+		if err := json.Unmarshal(req.Params, &env); err != nil {
+			return newJSONRPCError(req.ID, jsonRPCInvalidParams, fmt.Errorf("failed to decode params: %w", err))
+		}
+	}
+	env.Command = ExecutionCommand(req.Method)
+
+	env, err := prepareEnvironment(env, RunOptions{})
+	if err != nil {
+		return newJSONRPCError(req.ID, jsonRPCInvalidParams, err)
+	}
+
+	ret, err := Run(ctx, provider, env)
+	if err != nil {
+		resp := newJSONRPCError(req.ID, jsonRPCCommandError, err)
+		resp.Error.Data.Result = outputToJSON(ret)
+		return resp
+	}
+
+	result := outputToJSON(ret)
+	if result == nil {
+		result = json.RawMessage("null")
+	}
+	return JSONRPCResponse{
+		JSONRPC: jsonRPCVersion,
+		Result:  result,
+		ID:      req.ID,
+	}
+}
@@ -0,0 +1,117 @@
+// Copyright 2023 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package execution
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	gErrors "github.com/cloudbase/garm-provider-common/errors"
+	"github.com/cloudbase/garm-provider-common/params"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRunJSONRPC(t *testing.T) {
+	tmpfile, err := os.CreateTemp("", "provider-config")
+	require.NoError(t, err)
+	tmpfile.Close()
+	t.Cleanup(func() { os.RemoveAll(tmpfile.Name()) })
+
+	validParams := fmt.Sprintf(`{"controller_id": "controller-id", "provider_config_file": %q, "instance_id": "instance-id"}`, tmpfile.Name())
+
+	tests := []struct {
+		name     string
+		provider ExternalProvider
+		request  string
+		expected string
+	}{
+		{
+			name:     "get instance",
+			provider: &testExternalProvider{mockInstance: params.ProviderInstance{Name: "test-instance"}},
+			request:  fmt.Sprintf(`{"jsonrpc": "2.0", "method": "GetInstance", "params": %s, "id": 1}`, validParams),
+			expected: `{"jsonrpc": "2.0", "result": {"name": "test-instance"}, "id": 1}`,
+		},
+		{
+			name:     "command without output",
+			provider: &testExternalProvider{},
+			request:  fmt.Sprintf(`{"jsonrpc": "2.0", "method": "DeleteInstance", "params": %s, "id": "abc"}`, validParams),
+			expected: `{"jsonrpc": "2.0", "result": null, "id": "abc"}`,
+		},
+		{
+			name:     "text output",
+			provider: &testMetricsExporterProvider{},
+			request:  fmt.Sprintf(`{"jsonrpc": "2.0", "method": "Metrics", "params": %s, "id": 1}`, validParams),
+			expected: `{"jsonrpc": "2.0", "result": "# TYPE garm_provider_instances gauge\ngarm_provider_instances 3\n", "id": 1}`,
+		},
+		{
+			name:     "command error carries exit code",
+			provider: &testExternalProvider{mockErr: gErrors.ErrNotFound},
+			request:  fmt.Sprintf(`{"jsonrpc": "2.0", "method": "GetInstance", "params": %s, "id": 1}`, validParams),
+			expected: `{"jsonrpc": "2.0", "error": {"code": -32000, "message": "failed to get instance from provider: not found", "data": {"exit_code": 30}}, "id": 1}`,
+		},
+		{
+			name:     "command error carries retry hint",
+			provider: &testExternalProvider{mockErr: gErrors.NewRetryableError(fmt.Errorf("throttled"), 1500*time.Millisecond)},
+			request:  fmt.Sprintf(`{"jsonrpc": "2.0", "method": "GetInstance", "params": %s, "id": 1}`, validParams),
+			expected: `{"jsonrpc": "2.0", "error": {"code": -32000, "message": "failed to get instance from provider: throttled (retry after 1.5s)", "data": {"exit_code": 1, "retry_after": 2}}, "id": 1}`,
+		},
+		{
+			name:     "partial failure carries result",
+			provider: &poolProvider{instances: testPoolInstances(), failFor: "i-2"},
+			request:  fmt.Sprintf(`{"jsonrpc": "2.0", "method": "StopPool", "params": {"controller_id": "controller-id", "provider_config_file": %q, "pool_id": "pool-id"}, "id": 1}`, tmpfile.Name()),
+			expected: `{"jsonrpc": "2.0", "error": {"code": -32000, "message": "failed to run StopPool: instance i-2: mock error", "data": {"exit_code": 1, "result": {"pool_id": "pool-id", "instances": ["i-1", "runner-4"]}}}, "id": 1}`,
+		},
+		{
+			name:     "invalid params",
+			provider: &testExternalProvider{},
+			request:  `{"jsonrpc": "2.0", "method": "GetInstance", "params": {"controller_id": "controller-id"}, "id": 1}`,
+			expected: `{"jsonrpc": "2.0", "error": {"code": -32602, "message": "failed to validate execution environment: missing GARM_PROVIDER_CONFIG_FILE or GARM_PROVIDER_CONFIG_FILES", "data": {"exit_code": 1}}, "id": 1}`,
+		},
+		{
+			name:     "invalid version",
+			provider: &testExternalProvider{},
+			request:  `{"jsonrpc": "1.0", "method": "GetInstance", "id": 1}`,
+			expected: `{"jsonrpc": "2.0", "error": {"code": -32600, "message": "invalid JSON-RPC 2.0 request", "data": {"exit_code": 1}}, "id": 1}`,
+		},
+		{
+			name:     "parse error",
+			provider: &testExternalProvider{},
+			request:  `bogus`,
+			expected: `{"jsonrpc": "2.0", "error": {"code": -32700, "message": "failed to decode request: invalid character 'b' looking for beginning of value", "data": {"exit_code": 1}}, "id": null}`,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var out bytes.Buffer
+			err := RunJSONRPC(context.Background(), tc.provider, strings.NewReader(tc.request), &out)
+			require.NoError(t, err)
+			require.JSONEq(t, tc.expected, out.String())
+		})
+	}
+}
+
+func TestJSONRPCEnabled(t *testing.T) {
+	t.Setenv("GARM_PROTOCOL", "")
+	require.False(t, JSONRPCEnabled())
+
+	t.Setenv("GARM_PROTOCOL", "jsonrpc")
+	require.True(t, JSONRPCEnabled())
+}
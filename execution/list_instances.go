@@ -0,0 +1,104 @@
+// Copyright 2023 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package execution
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/cloudbase/garm-provider-common/params"
+)
+
+// partialOutputError marks errors that happened after part of the response was
+// already produced. Retrying would write the same instances again, or lose track of
+// the ones that were already affected.
+type partialOutputError struct {
+	error
+}
+
+func (e partialOutputError) Unwrap() error {
+	return e.error
+}
+
+// listInstances lists the instances of env.PoolID. Providers that implement
+// InstanceStreamer are preferred. In NDJSON mode, each instance is written on its
+// own line. If the output is not signed, instances are written to opts.Output as
+// soon as the provider emits them, so memory use does not grow with the size of the
+// pool.
+func listInstances(ctx context.Context, provider ExternalProvider, env Environment, opts RunOptions) (string, error) {
+	var instances []params.ProviderInstance
+	var ndjson strings.Builder
+	var out io.Writer = &ndjson
+	streaming := env.NDJSON && opts.Output != nil && env.SignOutput == ""
+	if streaming {
+		out = opts.Output
+	}
+	written := 0
+
+	emit := func(instance params.ProviderInstance) error {
+		instance = env.downgradeInstance(opts.mapStatus(sanitizeHostname(ctx, prepareInstance(instance))))
+		if !env.NDJSON {
+			instances = append(instances, instance)
+			return nil
+		}
+
+		asJs, err := opts.marshal(instance)
+		if err != nil {
+			return err
+		}
+		// Custom marshalers may indent their output, which would break NDJSON.
+		var line bytes.Buffer
+		if err := json.Compact(&line, []byte(asJs)); err != nil {
+			return fmt.Errorf("failed to compact response: %w", err)
+		}
+		line.WriteByte('\n')
+		if _, err := out.Write(line.Bytes()); err != nil {
+			return fmt.Errorf("failed to write response: %w", err)
+		}
+		written++
+		return nil
+	}
+
+	var err error
+	if streamer, ok := asOptional[InstanceStreamer](provider); ok {
+		instances = []params.ProviderInstance{}
+		err = streamer.ListInstancesFunc(ctx, env.PoolID, emit)
+	} else {
+		var listed []params.ProviderInstance
+		listed, err = provider.ListInstances(ctx, env.PoolID)
+		if listed != nil {
+			// Preserve the difference between nil and empty lists.
+			instances = make([]params.ProviderInstance, 0, len(listed))
+		}
+		for idx := 0; err == nil && idx < len(listed); idx++ {
+			err = emit(listed[idx])
+		}
+	}
+	if err != nil {
+		if streaming && written > 0 {
+			err = partialOutputError{err}
+		}
+		return "", fmt.Errorf("failed to list instances from provider: %w", err)
+	}
+
+	if env.NDJSON {
+		return ndjson.String(), nil
+	}
+	return opts.marshal(instances)
+}
@@ -0,0 +1,97 @@
+// Copyright 2023 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package execution
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/cloudbase/garm-provider-common/params"
+	"github.com/stretchr/testify/require"
+)
+
+type testInstanceStreamerProvider struct {
+	testExternalProvider
+
+	names    []string
+	failAt   int
+	attempts int
+}
+
+func (p *testInstanceStreamerProvider) ListInstancesFunc(ctx context.Context, poolID string, emit func(params.ProviderInstance) error) error {
+	p.attempts++
+	for idx, name := range p.names {
+		if p.failAt > 0 && idx == p.failAt {
+			return fmt.Errorf("mock error")
+		}
+		if err := emit(params.ProviderInstance{Name: name, Status: params.InstanceRunning}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func TestRunListInstancesStreamer(t *testing.T) {
+	env := Environment{Command: ListInstancesCommand, PoolID: "pool-id"}
+	provider := &testInstanceStreamerProvider{names: []string{"runner-1", "runner-2"}}
+
+	out, err := Run(context.Background(), provider, env)
+	require.NoError(t, err)
+	require.JSONEq(t, `[{"name": "runner-1", "status": "running", "power_state": "on"}, {"name": "runner-2", "status": "running", "power_state": "on"}]`, out)
+
+	out, err = Run(context.Background(), &testInstanceStreamerProvider{}, env)
+	require.NoError(t, err)
+	require.Equal(t, "[]", out)
+}
+
+func TestRunListInstancesNDJSON(t *testing.T) {
+	env := Environment{Command: ListInstancesCommand, PoolID: "pool-id", NDJSON: true}
+	expected := `{"name":"runner-1","status":"running","power_state":"on"}` + "\n" +
+		`{"name":"runner-2","status":"running","power_state":"on"}` + "\n"
+
+	// Streamed to the output.
+	var output bytes.Buffer
+	provider := &testInstanceStreamerProvider{names: []string{"runner-1", "runner-2"}}
+	out, err := RunWithOptions(context.Background(), provider, env, RunOptions{Output: &output})
+	require.NoError(t, err)
+	require.Equal(t, "", out)
+	require.Equal(t, expected, output.String())
+
+	// Returned, for providers with a batch API.
+	batch := &testExternalProvider{mockInstance: params.ProviderInstance{Name: "runner-1", Status: params.InstanceRunning}}
+	out, err = Run(context.Background(), batch, env)
+	require.NoError(t, err)
+	require.Equal(t, `{"name":"runner-1","status":"running","power_state":"on"}`+"\n", out)
+
+	// Signed output needs the whole response, so it is not streamed.
+	output.Reset()
+	signedEnv := env
+	signedEnv.SignOutput = OutputSignatureSHA256
+	out, err = RunWithOptions(context.Background(), provider, signedEnv, RunOptions{Output: &output})
+	require.NoError(t, err)
+	require.Equal(t, out, output.String())
+	require.Contains(t, out, expected)
+
+	// Errors after instances were written are not retried, to not write them twice.
+	output.Reset()
+	provider = &testInstanceStreamerProvider{names: []string{"runner-1", "runner-2"}, failAt: 1}
+	opts := RunOptions{Output: &output, Retry: RetryPolicy{MaxAttempts: 3}}
+	_, err = RunWithOptions(context.Background(), provider, env, opts)
+	require.EqualError(t, err, "failed to list instances from provider: mock error")
+	require.Equal(t, 1, provider.attempts)
+	require.Equal(t, `{"name":"runner-1","status":"running","power_state":"on"}`+"\n", output.String())
+}
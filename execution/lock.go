@@ -0,0 +1,133 @@
+// Copyright 2023 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package execution
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	gErrors "github.com/cloudbase/garm-provider-common/errors"
+)
+
+// DefaultInstanceLockTimeout is the default value of RunOptions.InstanceLockTimeout.
+const DefaultInstanceLockTimeout = 5 * time.Second
+
+// InstanceLocker serializes mutating commands on the same instance, like a Start
+// and a Delete GARM sent concurrently, which would otherwise race in the cloud.
+type InstanceLocker interface {
+	// Lock acquires the lock of the instance, waiting until ctx is done. The
+	// returned function releases the lock.
+	Lock(ctx context.Context, instanceID string) (func(), error)
+}
+
+// MemoryInstanceLocker is an InstanceLocker that locks instances within the process.
+// The one shot CLI runs every command in its own process, so locking across
+// commands needs the daemon mode (RunServerWithOptions) with a shared
+// MemoryInstanceLocker, or an InstanceLocker backed by an external store.
+type MemoryInstanceLocker struct {
+	mux   sync.Mutex
+	locks map[string]*instanceLock
+}
+
+type instanceLock struct {
+	ch   chan struct{}
+	refs int
+}
+
+// NewMemoryInstanceLocker returns a new MemoryInstanceLocker.
+func NewMemoryInstanceLocker() *MemoryInstanceLocker {
+	return &MemoryInstanceLocker{locks: map[string]*instanceLock{}}
+}
+
+// Lock implements InstanceLocker.
+func (l *MemoryInstanceLocker) Lock(ctx context.Context, instanceID string) (func(), error) {
+	l.mux.Lock()
+	lock, ok := l.locks[instanceID]
+	if !ok {
+		lock = &instanceLock{ch: make(chan struct{}, 1)}
+		l.locks[instanceID] = lock
+	}
+	lock.refs++
+	l.mux.Unlock()
+
+	select {
+	case lock.ch <- struct{}{}:
+		return func() {
+			<-lock.ch
+			l.release(instanceID, lock)
+		}, nil
+	case <-ctx.Done():
+		l.release(instanceID, lock)
+		return nil, ctx.Err()
+	}
+}
+
+// release drops a reference to the lock, and forgets the lock once nobody holds or
+// waits for it.
+func (l *MemoryInstanceLocker) release(instanceID string, lock *instanceLock) {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+
+	lock.refs--
+	if lock.refs == 0 {
+		delete(l.locks, instanceID)
+	}
+}
+
+// lockedInstanceID returns the ID of the instance a mutating command acts on, or an
+// empty string if the command does not act on a single existing instance.
+func lockedInstanceID(env Environment, opts RunOptions) string {
+	if !opts.isMutating(env.Command) {
+		return ""
+	}
+	switch env.Command {
+	case CreateInstanceCommand, CreateInstancesCommand, RemoveAllInstancesCommand,
+		StopPoolCommand, StartPoolCommand, WarmupCommand:
+		return ""
+	case UpdateInstanceStatusCommand:
+		return env.StatusUpdate.InstanceID
+	default:
+		return env.InstanceID
+	}
+}
+
+// lockInstance acquires the lock of the instance the command acts on, if a locker
+// is set. It fails with errors.ErrTransient if the lock is not acquired within
+// opts.InstanceLockTimeout.
+func lockInstance(ctx context.Context, env Environment, opts RunOptions) (func(), error) {
+	instanceID := lockedInstanceID(env, opts)
+	if opts.InstanceLocker == nil || instanceID == "" {
+		return func() {}, nil
+	}
+
+	timeout := opts.InstanceLockTimeout
+	if timeout <= 0 {
+		timeout = DefaultInstanceLockTimeout
+	}
+	lockCtx, cancel := withTimeout(ctx, opts.clock(), timeout)
+	defer cancel()
+
+	unlock, err := opts.InstanceLocker.Lock(lockCtx, instanceID)
+	if err != nil {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return nil, ctxErr
+		}
+		return nil, fmt.Errorf("instance %s is busy with another operation: %s: %w", instanceID, err, gErrors.ErrTransient)
+	}
+	opts.debugf("acquired lock of instance %s for %s", instanceID, env.Command)
+	return unlock, nil
+}
@@ -0,0 +1,152 @@
+// Copyright 2023 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package execution
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	gErrors "github.com/cloudbase/garm-provider-common/errors"
+	"github.com/cloudbase/garm-provider-common/params"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLockedInstanceID(t *testing.T) {
+	tests := []struct {
+		name string
+		env  Environment
+		want string
+	}{
+		{
+			name: "delete instance",
+			env:  Environment{Command: DeleteInstanceCommand, InstanceID: "instance-1"},
+			want: "instance-1",
+		},
+		{
+			name: "update instance status",
+			env: Environment{
+				Command:      UpdateInstanceStatusCommand,
+				StatusUpdate: params.InstanceStatusUpdate{InstanceID: "instance-2"},
+			},
+			want: "instance-2",
+		},
+		{
+			name: "read only command",
+			env:  Environment{Command: GetInstanceCommand, InstanceID: "instance-1"},
+			want: "",
+		},
+		{
+			name: "create instance",
+			env:  Environment{Command: CreateInstanceCommand},
+			want: "",
+		},
+		{
+			name: "custom command",
+			env:  Environment{Command: "SnapshotInstance", InstanceID: "instance-1"},
+			want: "instance-1",
+		},
+		{
+			name: "read only custom command",
+			env:  Environment{Command: "DescribeSnapshots", InstanceID: "instance-1"},
+			want: "",
+		},
+	}
+
+	opts := RunOptions{
+		CustomCommandHandler: map[ExecutionCommand]CustomCommand{
+			"SnapshotInstance":  {},
+			"DescribeSnapshots": {ReadOnly: true},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			require.Equal(t, tc.want, lockedInstanceID(tc.env, opts))
+		})
+	}
+}
+
+func TestLockInstance(t *testing.T) {
+	clock := NewFakeClock(time.Now())
+	opts := RunOptions{
+		Clock:               clock,
+		InstanceLocker:      NewMemoryInstanceLocker(),
+		InstanceLockTimeout: time.Second,
+	}
+	env := Environment{Command: StopInstanceCommand, InstanceID: "instance-1"}
+
+	unlock, err := lockInstance(context.Background(), env, opts)
+	require.NoError(t, err)
+
+	// Other instances are not affected by the lock.
+	other := env
+	other.InstanceID = "instance-2"
+	unlockOther, err := lockInstance(context.Background(), other, opts)
+	require.NoError(t, err)
+	unlockOther()
+
+	// The timers of the locks taken above are not removed from the clock.
+	waiters := clock.Waiters()
+	errCh := make(chan error, 1)
+	go func() {
+		_, err := lockInstance(context.Background(), env, opts)
+		errCh <- err
+	}()
+	waitForWaiters(clock, waiters+1)
+	clock.Advance(time.Second)
+	err = <-errCh
+	require.ErrorIs(t, err, gErrors.ErrTransient)
+	require.ErrorContains(t, err, "instance instance-1 is busy with another operation")
+
+	unlock()
+	unlock, err = lockInstance(context.Background(), env, opts)
+	require.NoError(t, err)
+	unlock()
+	require.Empty(t, opts.InstanceLocker.(*MemoryInstanceLocker).locks)
+}
+
+func TestLockInstanceWithoutLocker(t *testing.T) {
+	unlock, err := lockInstance(context.Background(), Environment{Command: StopInstanceCommand, InstanceID: "instance-1"}, RunOptions{})
+	require.NoError(t, err)
+	unlock()
+}
+
+func TestRunWithOptionsUnlocksAfterPanic(t *testing.T) {
+	panicking := true
+	opts := RunOptions{
+		InstanceLocker:      NewMemoryInstanceLocker(),
+		InstanceLockTimeout: 10 * time.Millisecond,
+		CustomCommandHandler: map[ExecutionCommand]CustomCommand{
+			"SnapshotInstance": {
+				Run: func(ctx context.Context, env Environment) (string, error) {
+					if panicking {
+						panic("boom")
+					}
+					return "done", nil
+				},
+			},
+		},
+	}
+	env := Environment{Command: "SnapshotInstance", InstanceID: "instance-1"}
+
+	require.PanicsWithValue(t, "boom", func() {
+		_, _ = RunWithOptions(context.Background(), &testExternalProvider{}, env, opts)
+	})
+
+	panicking = false
+	out, err := RunWithOptions(context.Background(), &testExternalProvider{}, env, opts)
+	require.NoError(t, err)
+	require.Equal(t, "done", out)
+}
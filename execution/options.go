@@ -0,0 +1,321 @@
+// Copyright 2023 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package execution
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	gErrors "github.com/cloudbase/garm-provider-common/errors"
+	"github.com/cloudbase/garm-provider-common/params"
+	"github.com/cloudbase/garm-provider-common/util"
+)
+
+// OutputMarshaler serializes the result of a command before it is handed
+// back to GARM.
+type OutputMarshaler func(interface{}) ([]byte, error)
+
+// MetricsRecorder is notified once for every command executed by RunWithOptions.
+type MetricsRecorder interface {
+	// ObserveCommand records the outcome of a command. The error is nil if the
+	// command succeeded.
+	ObserveCommand(command ExecutionCommand, duration time.Duration, err error)
+}
+
+// RetryPolicy controls how failed provider calls are retried. The zero value
+// disables retries.
+type RetryPolicy struct {
+	// MaxAttempts is the total number of times a command is attempted. Values
+	// lower than 2 disable retries.
+	MaxAttempts int
+	// Interval is the time to wait between attempts. If MaxInterval is set, it is
+	// the base delay of an exponential backoff instead.
+	Interval time.Duration
+	// MaxInterval, if set, enables exponential backoff with jitter between attempts,
+	// as computed by util.BackoffWithJitter, capped at MaxInterval. Retry hints from
+	// the cloud that are longer than MaxInterval, or Interval if MaxInterval is not
+	// set, are not waited for. The error is returned instead.
+	MaxInterval time.Duration
+	// Retryable decides if an error warrants another attempt. When nil, all errors
+	// that do not resolve to a dedicated exit code are retried, except for errors
+	// caused by the request itself, like ErrBadRequest and ErrNotImplemented.
+	Retryable func(error) bool
+}
+
+func (r RetryPolicy) isRetryable(err error) bool {
+	if r.Retryable != nil {
+		return r.Retryable(err)
+	}
+	return isProviderFailure(err)
+}
+
+// wait returns the time to wait before the given attempt, starting at 1. If the
+// previous attempt failed with a retry hint from the cloud, the hint is honored as
+// long as it is no longer than MaxInterval (or Interval, if MaxInterval is not set)
+// and ends before the deadline of ctx. Otherwise wait returns false, and the error
+// is handed back to GARM along with the hint.
+func (r RetryPolicy) wait(ctx context.Context, attempt int, err error) (time.Duration, bool) {
+	if retryAfter, ok := gErrors.RetryAfter(err); ok && retryAfter > 0 {
+		limit := r.MaxInterval
+		if limit <= 0 {
+			limit = r.Interval
+		}
+		if retryAfter > limit {
+			return 0, false
+		}
+		if deadline, ok := ctx.Deadline(); ok && retryAfter > time.Until(deadline) {
+			return 0, false
+		}
+		return retryAfter, true
+	}
+	if r.MaxInterval > 0 {
+		return util.BackoffWithJitter(attempt-1, r.Interval, r.MaxInterval), true
+	}
+	return r.Interval, true
+}
+
+// do calls fn until it succeeds, returns an error that is not retryable or runs
+// out of attempts. Calls that are not idempotent, like CreateInstance, are never
+// retried.
+func (r RetryPolicy) do(ctx context.Context, clock Clock, idempotent bool, fn func() (string, error)) (string, error) {
+	attempts := r.MaxAttempts
+	if attempts < 1 || !idempotent {
+		attempts = 1
+	}
+
+	var ret string
+	var err error
+	for i := 0; i < attempts; i++ {
+		if i > 0 {
+			delay, ok := r.wait(ctx, i, err)
+			if !ok {
+				break
+			}
+			select {
+			case <-ctx.Done():
+				return "", fmt.Errorf("giving up after %d attempts: %w", i, err)
+			case <-clock.After(delay):
+			}
+		}
+
+		ret, err = fn()
+		var partial partialOutputError
+		if err == nil || !r.isRetryable(err) || errors.As(err, &partial) {
+			break
+		}
+	}
+	return ret, err
+}
+
+// CustomCommandFunc runs a provider specific command.
+type CustomCommandFunc func(ctx context.Context, env Environment) (string, error)
+
+// CustomCommand is a provider specific command, registered in
+// RunOptions.CustomCommandHandler. The zero value of the flags is the safe one: custom
+// commands are treated as mutating and not idempotent unless stated otherwise.
+type CustomCommand struct {
+	// Run runs the command.
+	Run CustomCommandFunc
+	// ReadOnly marks commands that do not change the state of resources. Commands
+	// that are not read only are refused in maintenance mode, skipped in dry run mode
+	// and serialized by the InstanceLocker, like the built-in mutating commands.
+	ReadOnly bool
+	// Idempotent marks commands that can safely run more than once, and thus may be
+	// retried by the RetryPolicy.
+	Idempotent bool
+}
+
+// RunOptions holds optional settings that alter the behavior of RunWithOptions.
+// The zero value is valid and yields the same behavior as Run.
+type RunOptions struct {
+	// OutputMarshaler is used to serialize the values returned by the provider.
+	// Providers may set this to embed provider specific fields in the output,
+	// which GARM will pass through opaquely. Defaults to json.Marshal.
+	OutputMarshaler OutputMarshaler
+	// Timeout is the maximum amount of time a command may run for, including
+	// retries. A value of 0 disables the timeout.
+	Timeout time.Duration
+	// Retry controls how failed provider calls are retried.
+	Retry RetryPolicy
+	// Metrics, if set, is notified of the outcome of every command.
+	Metrics MetricsRecorder
+	// Output, if set, receives the serialized result of the command, in addition
+	// to it being returned. Nothing but the result is ever written to Output.
+	Output io.Writer
+	// Stderr receives diagnostic output, like debug messages and warnings. Defaults
+	// to os.Stderr.
+	Stderr io.Writer
+	// DryRun validates the command without calling the provider for commands that
+	// would change the state of resources. Read only commands run as usual.
+	DryRun bool
+	// Debug enables debug messages, which are written to Stderr.
+	Debug bool
+	// NameRewriter, if set, is applied to the name of the instance before it is
+	// passed to CreateInstance. Providers can use it to satisfy cloud specific naming
+	// rules. The original name is preserved in BootstrapParams.OriginalName.
+	NameRewriter func(string) string
+	// ImageRefCanonicalizer, if set, validates the image of CreateInstance and
+	// CreateInstances and returns it in the canonical form of the provider. When unset,
+	// the canonicalizer registered for GARM_PROVIDER_NAME is used, if any, and the
+	// image otherwise only has its surrounding whitespace removed. See
+	// params.CanonicalImageRef.
+	ImageRefCanonicalizer params.ImageRefCanonicalizer
+	// CacheTTL enables caching the responses of idempotent, read only commands like
+	// DescribeProvider in ResponseCache. Cached responses are kept for CacheTTL. This
+	// only helps programs that run many commands, like RunServerWithOptions, not the
+	// one shot CLI.
+	CacheTTL time.Duration
+	// ResponseCache holds the responses cached when CacheTTL is set. Caching is
+	// disabled if it is nil, except under RunServerWithOptions, which uses a cache of
+	// its own.
+	ResponseCache *ResponseCache
+	// PoolConcurrency is the maximum number of instances StopPool, StartPool and
+	// GetInstances act on in parallel, for providers that do not implement
+	// PoolPowerManager or BatchGetter. Defaults to DefaultPoolConcurrency.
+	PoolConcurrency int
+	// Clock is used to measure timeouts, retry intervals, command durations and
+	// cache expiry. Tests can set it to a FakeClock. Defaults to RealClock.
+	Clock Clock
+	// CircuitBreaker, if set, fails commands fast with errors.ErrTransient after the
+	// same command failed too many times in a row.
+	CircuitBreaker *CircuitBreaker
+	// StatusMapper, if set, rewrites the status of the instances returned by the
+	// commands that output instances, like CreateInstance, GetInstance and
+	// ListInstances. Providers can use it to map newer statuses to ones understood
+	// by older versions of GARM. The power state is derived before the mapping.
+	StatusMapper func(params.InstanceStatus) params.InstanceStatus
+	// AllowEmptyUserData disables the checks CreateInstance runs to avoid creating
+	// instances that can never register as runners: that the bootstrap params hold an
+	// instance token and, for providers implementing UserDataGenerator, that the user
+	// data is not blank. Providers with a legitimate flow that needs neither can set it.
+	AllowEmptyUserData bool
+	// AllowEmptyFlavor disables the check that the bootstrap params of CreateInstance
+	// hold a flavor, for providers that derive it from their config. It is honored by
+	// GetEnvironmentWithOptions.
+	AllowEmptyFlavor bool
+	// BootstrapConstraints are checked against the bootstrap params of CreateInstance
+	// and CreateInstances, after params.DefaultBootstrapConstraints. Providers can use
+	// them to reject combinations of their own extra specs. They are honored by
+	// GetEnvironmentWithOptions.
+	BootstrapConstraints []params.BootstrapConstraint
+	// CustomCommandHandler maps commands that are not part of the GARM command set to
+	// the functions that run them, letting providers add their own commands. Built-in
+	// commands always take precedence. Use GetEnvironmentWithOptions to accept them in
+	// GARM_COMMAND.
+	CustomCommandHandler map[ExecutionCommand]CustomCommand
+	// InstanceLocker, if set, serializes the mutating commands that act on the same
+	// instance. See MemoryInstanceLocker for the limits of in-process locking.
+	InstanceLocker InstanceLocker
+	// InstanceLockTimeout is the maximum amount of time to wait for the lock of an
+	// instance, before failing with errors.ErrTransient. Defaults to
+	// DefaultInstanceLockTimeout.
+	InstanceLockTimeout time.Duration
+
+	// serverConfig is set by RunServerWithOptions, to load the config only once.
+	serverConfig *serverConfig
+}
+
+// DefaultPoolConcurrency is the default value of RunOptions.PoolConcurrency.
+const DefaultPoolConcurrency = 4
+
+func (o RunOptions) poolConcurrency() int {
+	if o.PoolConcurrency < 1 {
+		return DefaultPoolConcurrency
+	}
+	return o.PoolConcurrency
+}
+
+// customCommand returns the custom command registered for cmd. Built-in commands
+// are never resolved to custom commands.
+func (o RunOptions) customCommand(cmd ExecutionCommand) (CustomCommand, bool) {
+	if isBuiltinCommand(cmd) {
+		return CustomCommand{}, false
+	}
+	custom, ok := o.CustomCommandHandler[cmd]
+	return custom, ok
+}
+
+// isMutating returns true if the command changes the state of resources in the
+// provider, taking the custom commands into account.
+func (o RunOptions) isMutating(cmd ExecutionCommand) bool {
+	if custom, ok := o.customCommand(cmd); ok {
+		return !custom.ReadOnly
+	}
+	return IsMutatingCommand(cmd)
+}
+
+// isIdempotent returns true if the command can safely be retried, taking the custom
+// commands into account.
+func (o RunOptions) isIdempotent(cmd ExecutionCommand) bool {
+	if custom, ok := o.customCommand(cmd); ok {
+		return custom.Idempotent
+	}
+	return isIdempotentCommand(cmd)
+}
+
+// canonicalImageRef returns the canonical form of the image of the bootstrap params.
+func (o RunOptions) canonicalImageRef(env Environment) (string, error) {
+	if o.ImageRefCanonicalizer != nil {
+		return o.ImageRefCanonicalizer(env.BootstrapParams.Image)
+	}
+	return params.CanonicalImageRef(env.ProviderName, env.BootstrapParams.Image)
+}
+
+func (o RunOptions) clock() Clock {
+	if o.Clock == nil {
+		return RealClock
+	}
+	return o.Clock
+}
+
+// mapStatus applies the StatusMapper to the instance.
+func (o RunOptions) mapStatus(instance params.ProviderInstance) params.ProviderInstance {
+	if o.StatusMapper != nil {
+		instance.Status = o.StatusMapper(instance.Status)
+	}
+	return instance
+}
+
+func (o RunOptions) marshal(v interface{}) (string, error) {
+	marshaler := o.OutputMarshaler
+	if marshaler == nil {
+		marshaler = json.Marshal
+	}
+
+	asJs, err := marshaler(v)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal response: %w", err)
+	}
+	return string(asJs), nil
+}
+
+func (o RunOptions) stderr() io.Writer {
+	if o.Stderr == nil {
+		return os.Stderr
+	}
+	return o.Stderr
+}
+
+func (o RunOptions) debugf(format string, a ...interface{}) {
+	if !o.Debug {
+		return
+	}
+	fmt.Fprintf(o.stderr(), "DEBUG: "+format+"\n", a...)
+}
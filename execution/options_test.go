@@ -0,0 +1,539 @@
+// Copyright 2023 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package execution
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	gErrors "github.com/cloudbase/garm-provider-common/errors"
+	"github.com/cloudbase/garm-provider-common/params"
+	"github.com/stretchr/testify/require"
+)
+
+type flakyProvider struct {
+	testExternalProvider
+
+	failures int
+	calls    int
+}
+
+func (p *flakyProvider) GetInstance(ctx context.Context, instance string) (params.ProviderInstance, error) {
+	p.calls++
+	if p.calls <= p.failures {
+		return params.ProviderInstance{}, p.mockErr
+	}
+	return p.mockInstance, nil
+}
+
+func (p *flakyProvider) CreateInstance(ctx context.Context, bootstrapParams params.BootstrapInstance) (params.ProviderInstance, error) {
+	p.calls++
+	return params.ProviderInstance{}, p.mockErr
+}
+
+type blockingProvider struct {
+	testExternalProvider
+}
+
+func (p *blockingProvider) GetInstance(ctx context.Context, instance string) (params.ProviderInstance, error) {
+	<-ctx.Done()
+	return params.ProviderInstance{}, ctx.Err()
+}
+
+type recordingProvider struct {
+	testExternalProvider
+
+	bootstrapParams params.BootstrapInstance
+}
+
+func (p *recordingProvider) CreateInstance(ctx context.Context, bootstrapParams params.BootstrapInstance) (params.ProviderInstance, error) {
+	p.bootstrapParams = bootstrapParams
+	return p.mockInstance, nil
+}
+
+type testMetricsRecorder struct {
+	commands  []ExecutionCommand
+	durations []time.Duration
+	errs      []error
+}
+
+func (m *testMetricsRecorder) ObserveCommand(command ExecutionCommand, duration time.Duration, err error) {
+	m.commands = append(m.commands, command)
+	m.durations = append(m.durations, duration)
+	m.errs = append(m.errs, err)
+}
+
+func TestRunWithOptionsOutputMarshaler(t *testing.T) {
+	provider := &testExternalProvider{
+		mockInstance: params.ProviderInstance{
+			Name:   "test-instance",
+			OSType: params.Linux,
+		},
+	}
+	opts := RunOptions{
+		OutputMarshaler: func(v interface{}) ([]byte, error) {
+			return json.Marshal(map[string]interface{}{
+				"instance":       v,
+				"provider_extra": map[string]string{"zone": "test-zone"},
+			})
+		},
+	}
+
+	out, err := RunWithOptions(context.Background(), provider, Environment{Command: GetInstanceCommand}, opts)
+	require.NoError(t, err)
+	require.JSONEq(t, `{"instance": {"name": "test-instance", "os_type": "linux"}, "provider_extra": {"zone": "test-zone"}}`, out)
+}
+
+func TestRunWithOptionsOutputMarshalerFailed(t *testing.T) {
+	provider := &testExternalProvider{}
+	opts := RunOptions{
+		OutputMarshaler: func(interface{}) ([]byte, error) {
+			return nil, fmt.Errorf("bogus marshaler")
+		},
+	}
+
+	out, err := RunWithOptions(context.Background(), provider, Environment{Command: ListInstancesCommand}, opts)
+	require.EqualError(t, err, "failed to marshal response: bogus marshaler")
+	require.Equal(t, "", out)
+}
+
+func TestRunWithOptionsZeroValueMatchesRun(t *testing.T) {
+	provider := &testExternalProvider{
+		mockInstance: params.ProviderInstance{Name: "test-instance"},
+	}
+	env := Environment{Command: GetInstanceCommand}
+
+	expected, err := Run(context.Background(), provider, env)
+	require.NoError(t, err)
+	out, err := RunWithOptions(context.Background(), provider, env, RunOptions{})
+	require.NoError(t, err)
+	require.Equal(t, expected, out)
+}
+
+func TestRunWithOptionsTimeout(t *testing.T) {
+	opts := RunOptions{Timeout: 10 * time.Millisecond}
+
+	_, err := RunWithOptions(context.Background(), &blockingProvider{}, Environment{Command: GetInstanceCommand}, opts)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+}
+
+func TestRunWithOptionsRetry(t *testing.T) {
+	tests := []struct {
+		name          string
+		command       ExecutionCommand
+		mockErr       error
+		failures      int
+		expectedCalls int
+		expectErr     bool
+	}{
+		{
+			name:          "succeeds after transient failures",
+			command:       GetInstanceCommand,
+			mockErr:       fmt.Errorf("transient error"),
+			failures:      2,
+			expectedCalls: 3,
+		},
+		{
+			name:          "gives up after max attempts",
+			command:       GetInstanceCommand,
+			mockErr:       fmt.Errorf("transient error"),
+			failures:      5,
+			expectedCalls: 3,
+			expectErr:     true,
+		},
+		{
+			name:          "does not retry not found",
+			command:       GetInstanceCommand,
+			mockErr:       gErrors.ErrNotFound,
+			failures:      5,
+			expectedCalls: 1,
+			expectErr:     true,
+		},
+		{
+			name:          "does not retry bad request",
+			command:       GetInstanceCommand,
+			mockErr:       fmt.Errorf("invalid instance: %w", gErrors.ErrBadRequest),
+			failures:      5,
+			expectedCalls: 1,
+			expectErr:     true,
+		},
+		{
+			name:          "does not retry validation errors",
+			command:       GetInstanceCommand,
+			mockErr:       gErrors.NewValidationError("GARM_INSTANCE_ID", "missing instance ID"),
+			failures:      5,
+			expectedCalls: 1,
+			expectErr:     true,
+		},
+		{
+			name:          "does not retry not implemented",
+			command:       GetInstanceCommand,
+			mockErr:       gErrors.ErrNotImplemented,
+			failures:      5,
+			expectedCalls: 1,
+			expectErr:     true,
+		},
+		{
+			name:          "does not retry create",
+			command:       CreateInstanceCommand,
+			mockErr:       fmt.Errorf("transient error"),
+			failures:      5,
+			expectedCalls: 1,
+			expectErr:     true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			provider := &flakyProvider{
+				testExternalProvider: testExternalProvider{mockErr: tc.mockErr},
+				failures:             tc.failures,
+			}
+			opts := RunOptions{
+				Retry: RetryPolicy{MaxAttempts: 3, Interval: time.Millisecond},
+			}
+
+			env := Environment{
+				Command:         tc.command,
+				BootstrapParams: params.BootstrapInstance{InstanceToken: "instance-token"},
+			}
+			_, err := RunWithOptions(context.Background(), provider, env, opts)
+			if tc.expectErr {
+				require.Error(t, err)
+			} else {
+				require.NoError(t, err)
+			}
+			require.Equal(t, tc.expectedCalls, provider.calls)
+		})
+	}
+}
+
+func TestRetryPolicyNonIdempotentCommands(t *testing.T) {
+	policy := RetryPolicy{MaxAttempts: 3}
+	opts := RunOptions{
+		CustomCommandHandler: map[ExecutionCommand]CustomCommand{
+			"SnapshotInstance": {},
+			"RefreshInstance":  {Idempotent: true},
+		},
+	}
+	tests := map[ExecutionCommand]int{
+		CreateInstanceCommand:  1,
+		CreateInstancesCommand: 1,
+		ExecActionCommand:      1,
+		AttachNICCommand:       1,
+		"SnapshotInstance":     1,
+		"RefreshInstance":      3,
+		StopInstanceCommand:    3,
+	}
+	for cmd, expectedCalls := range tests {
+		t.Run(string(cmd), func(t *testing.T) {
+			calls := 0
+			_, err := policy.do(context.Background(), realClock{}, opts.isIdempotent(cmd), func() (string, error) {
+				calls++
+				return "", fmt.Errorf("transient error")
+			})
+			require.Error(t, err)
+			require.Equal(t, expectedCalls, calls)
+		})
+	}
+}
+
+func TestRetryPolicyWait(t *testing.T) {
+	ctx := context.Background()
+	wait := func(policy RetryPolicy, ctx context.Context, attempt int, err error) time.Duration {
+		delay, ok := policy.wait(ctx, attempt, err)
+		require.True(t, ok)
+		return delay
+	}
+
+	policy := RetryPolicy{Interval: time.Second}
+	require.Equal(t, time.Second, wait(policy, ctx, 1, nil))
+	require.Equal(t, time.Second, wait(policy, ctx, 5, nil))
+
+	policy.MaxInterval = 3 * time.Second
+	for i := 0; i < 100; i++ {
+		require.LessOrEqual(t, wait(policy, ctx, 1, nil), time.Second)
+		require.LessOrEqual(t, wait(policy, ctx, 2, nil), 2*time.Second)
+		require.LessOrEqual(t, wait(policy, ctx, 10, nil), 3*time.Second)
+	}
+	// Hints from the cloud take precedence, up to MaxInterval.
+	err := gErrors.NewRetryableError(fmt.Errorf("throttled"), 2*time.Second)
+	require.Equal(t, 2*time.Second, wait(policy, ctx, 1, err))
+
+	err = gErrors.NewRetryableError(fmt.Errorf("throttled"), time.Hour)
+	_, ok := policy.wait(ctx, 1, err)
+	require.False(t, ok)
+
+	// Without MaxInterval, hints are capped at Interval.
+	_, ok = RetryPolicy{Interval: time.Second}.wait(ctx, 1, gErrors.NewRetryableError(fmt.Errorf("throttled"), 2*time.Second))
+	require.False(t, ok)
+
+	// Hints that end after the deadline of the context are not honored.
+	deadlineCtx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	_, ok = policy.wait(deadlineCtx, 1, gErrors.NewRetryableError(fmt.Errorf("throttled"), 2*time.Second))
+	require.False(t, ok)
+}
+
+func TestRetryPolicyLongRetryAfter(t *testing.T) {
+	policy := RetryPolicy{MaxAttempts: 3, Interval: time.Millisecond}
+	calls := 0
+	_, err := policy.do(context.Background(), realClock{}, true, func() (string, error) {
+		calls++
+		return "", gErrors.NewRetryableError(fmt.Errorf("throttled"), time.Hour)
+	})
+	require.Equal(t, 1, calls)
+	retryAfter, ok := RetryAfterSeconds(err)
+	require.True(t, ok)
+	require.Equal(t, 3600, retryAfter)
+}
+
+func TestRunWithOptionsRetryAfter(t *testing.T) {
+	var stderr bytes.Buffer
+	provider := &testExternalProvider{
+		mockErr: gErrors.NewRetryableError(fmt.Errorf("throttled"), 2500*time.Millisecond),
+	}
+
+	_, err := RunWithOptions(context.Background(), provider, Environment{Command: GetInstanceCommand}, RunOptions{Stderr: &stderr})
+	require.ErrorIs(t, err, gErrors.ErrRateLimited)
+	require.Equal(t, "GARM_RETRY_AFTER=3\n", withoutSummary(stderr.String()))
+
+	stderr.Reset()
+	provider.mockErr = gErrors.ErrRateLimited
+	_, err = RunWithOptions(context.Background(), provider, Environment{Command: GetInstanceCommand}, RunOptions{Stderr: &stderr})
+	require.ErrorIs(t, err, gErrors.ErrRateLimited)
+	require.Empty(t, withoutSummary(stderr.String()))
+}
+
+func TestRunWithOptionsMetrics(t *testing.T) {
+	metrics := &testMetricsRecorder{}
+	opts := RunOptions{Metrics: metrics}
+
+	_, err := RunWithOptions(context.Background(), &testExternalProvider{}, Environment{Command: GetInstanceCommand}, opts)
+	require.NoError(t, err)
+	_, err = RunWithOptions(context.Background(), &testExternalProvider{mockErr: gErrors.ErrNotFound}, Environment{Command: DeleteInstanceCommand}, opts)
+	require.Error(t, err)
+
+	require.Equal(t, []ExecutionCommand{GetInstanceCommand, DeleteInstanceCommand}, metrics.commands)
+	require.NoError(t, metrics.errs[0])
+	require.ErrorIs(t, metrics.errs[1], gErrors.ErrNotFound)
+}
+
+func TestRunWithOptionsOutput(t *testing.T) {
+	var output bytes.Buffer
+	provider := &testExternalProvider{
+		mockInstance: params.ProviderInstance{Name: "test-instance"},
+	}
+
+	out, err := RunWithOptions(context.Background(), provider, Environment{Command: GetInstanceCommand}, RunOptions{Output: &output})
+	require.NoError(t, err)
+	require.Equal(t, out, output.String())
+}
+
+func TestRunWithOptionsDryRun(t *testing.T) {
+	provider := &flakyProvider{
+		testExternalProvider: testExternalProvider{mockErr: fmt.Errorf("should not be called")},
+		failures:             1,
+	}
+	opts := RunOptions{DryRun: true}
+
+	out, err := RunWithOptions(context.Background(), provider, Environment{Command: CreateInstanceCommand}, opts)
+	require.NoError(t, err)
+	require.Equal(t, "", out)
+	require.Equal(t, 0, provider.calls)
+
+	_, err = RunWithOptions(context.Background(), provider, Environment{Command: GetInstanceCommand}, opts)
+	require.Error(t, err)
+	require.Equal(t, 1, provider.calls)
+}
+
+func TestRunWithOptionsDebug(t *testing.T) {
+	var stderr bytes.Buffer
+	opts := RunOptions{Debug: true, Stderr: &stderr}
+
+	_, err := RunWithOptions(context.Background(), &testExternalProvider{}, Environment{Command: GetInstanceCommand}, opts)
+	require.NoError(t, err)
+	require.Contains(t, stderr.String(), "DEBUG: running GetInstance")
+
+	stderr.Reset()
+	opts.Debug = false
+	_, err = RunWithOptions(context.Background(), &testExternalProvider{}, Environment{Command: GetInstanceCommand}, opts)
+	require.NoError(t, err)
+	require.NotContains(t, stderr.String(), "DEBUG:")
+}
+
+func TestRunWithOptionsNameRewriter(t *testing.T) {
+	env := Environment{
+		Command:         CreateInstanceCommand,
+		BootstrapParams: params.BootstrapInstance{Name: "1-runner", InstanceToken: "instance-token"},
+	}
+
+	provider := &recordingProvider{}
+	_, err := RunWithOptions(context.Background(), provider, env, RunOptions{})
+	require.NoError(t, err)
+	require.Equal(t, "1-runner", provider.bootstrapParams.Name)
+	require.Equal(t, "", provider.bootstrapParams.OriginalName)
+
+	opts := RunOptions{
+		NameRewriter: func(name string) string {
+			return "garm-" + name
+		},
+	}
+	_, err = RunWithOptions(context.Background(), provider, env, opts)
+	require.NoError(t, err)
+	require.Equal(t, "garm-1-runner", provider.bootstrapParams.Name)
+	require.Equal(t, "1-runner", provider.bootstrapParams.OriginalName)
+}
+
+func TestRunWithOptionsStatusMapper(t *testing.T) {
+	provider := &testExternalProvider{
+		mockInstance: params.ProviderInstance{
+			ProviderID: "instance-id",
+			Name:       "test-instance",
+			Status:     params.InstanceCreating,
+		},
+	}
+	opts := RunOptions{
+		StatusMapper: func(status params.InstanceStatus) params.InstanceStatus {
+			if status == params.InstanceCreating {
+				return params.InstancePendingCreate
+			}
+			return status
+		},
+	}
+
+	tests := []struct {
+		name string
+		env  Environment
+	}{
+		{
+			name: "create instance",
+			env:  Environment{Command: CreateInstanceCommand, BootstrapParams: params.BootstrapInstance{Name: "test-instance", InstanceToken: "instance-token"}},
+		},
+		{
+			name: "get instance",
+			env:  Environment{Command: GetInstanceCommand, InstanceID: "instance-id"},
+		},
+		{
+			name: "list instances",
+			env:  Environment{Command: ListInstancesCommand, PoolID: "pool-id"},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			out, err := RunWithOptions(context.Background(), provider, tc.env, opts)
+			require.NoError(t, err)
+			require.Contains(t, out, `"status":"pending_create"`)
+			require.NotContains(t, out, `"status":"creating"`)
+
+			out, err = RunWithOptions(context.Background(), provider, tc.env, RunOptions{})
+			require.NoError(t, err)
+			require.Contains(t, out, `"status":"creating"`)
+		})
+	}
+}
+
+func TestRunWithOptionsCustomCommand(t *testing.T) {
+	var got Environment
+	opts := RunOptions{
+		CustomCommandHandler: map[ExecutionCommand]CustomCommand{
+			"SnapshotInstance": {
+				Run: func(ctx context.Context, env Environment) (string, error) {
+					got = env
+					return `{"snapshot": "snap-1"}`, nil
+				},
+			},
+			"DescribeSnapshots": {
+				Run: func(ctx context.Context, env Environment) (string, error) {
+					return `[]`, nil
+				},
+				ReadOnly: true,
+			},
+			MetricsCommand: {
+				Run: func(ctx context.Context, env Environment) (string, error) {
+					return "overridden", nil
+				},
+			},
+		},
+	}
+
+	env := Environment{Command: "SnapshotInstance", InstanceID: "instance-id"}
+	out, err := RunWithOptions(context.Background(), &testExternalProvider{}, env, opts)
+	require.NoError(t, err)
+	require.Equal(t, `{"snapshot": "snap-1"}`, out)
+	require.Equal(t, "instance-id", got.InstanceID)
+
+	// Custom commands are mutating, unless registered as read only.
+	opts.DryRun = true
+	out, err = RunWithOptions(context.Background(), &testExternalProvider{}, env, opts)
+	require.NoError(t, err)
+	require.Equal(t, "", out)
+	out, err = RunWithOptions(context.Background(), &testExternalProvider{}, Environment{Command: "DescribeSnapshots"}, opts)
+	require.NoError(t, err)
+	require.Equal(t, `[]`, out)
+	opts.DryRun = false
+
+	env.MaintenanceMode = true
+	_, err = RunWithOptions(context.Background(), &testExternalProvider{}, env, opts)
+	require.ErrorIs(t, err, gErrors.ErrMaintenanceMode)
+	_, err = RunWithOptions(context.Background(), &testExternalProvider{}, Environment{Command: "DescribeSnapshots", MaintenanceMode: true}, opts)
+	require.NoError(t, err)
+
+	out, err = RunWithOptions(context.Background(), &testExternalProvider{}, Environment{Command: MetricsCommand}, opts)
+	require.NoError(t, err)
+	require.Equal(t, "", out)
+
+	_, err = RunWithOptions(context.Background(), &testExternalProvider{}, Environment{Command: "Unknown"}, opts)
+	require.EqualError(t, err, "invalid command: Unknown")
+}
+
+func TestGetEnvironmentWithOptionsCustomCommand(t *testing.T) {
+	setGarmEnv(t, "SnapshotInstance")
+
+	_, err := GetEnvironment()
+	require.ErrorContains(t, err, "unknown GARM_COMMAND: SnapshotInstance")
+
+	opts := RunOptions{
+		CustomCommandHandler: map[ExecutionCommand]CustomCommand{
+			"SnapshotInstance": {
+				Run: func(ctx context.Context, env Environment) (string, error) {
+					return "", nil
+				},
+			},
+		},
+	}
+	env, err := GetEnvironmentWithOptions(opts)
+	require.NoError(t, err)
+	require.Equal(t, ExecutionCommand("SnapshotInstance"), env.Command)
+}
+
+func TestGetEnvironmentWithOptionsAllowEmptyFlavor(t *testing.T) {
+	setGarmEnv(t, CreateInstanceCommand)
+	setStdin(t, `{"name": "test"}`)
+
+	_, err := GetEnvironment()
+	require.ErrorIs(t, err, gErrors.ErrBadRequest)
+	require.ErrorContains(t, err, "missing flavor in bootstrap params")
+
+	setStdin(t, `{"name": "test"}`)
+	env, err := GetEnvironmentWithOptions(RunOptions{AllowEmptyFlavor: true})
+	require.NoError(t, err)
+	require.Equal(t, "", env.BootstrapParams.Flavor)
+}
@@ -0,0 +1,121 @@
+// Copyright 2023 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package execution
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/cloudbase/garm-provider-common/params"
+)
+
+// setPoolPowerState stops or starts all instances in a pool and returns the IDs of
+// the affected instances. If some instances fail, the ones that were affected are
+// returned along with the error.
+func setPoolPowerState(ctx context.Context, provider ExternalProvider, env Environment, opts RunOptions) ([]string, error) {
+	stop := env.Command == StopPoolCommand
+
+	if manager, ok := asOptional[PoolPowerManager](provider); ok {
+		var instances []string
+		var err error
+		if stop {
+			instances, err = manager.StopPool(ctx, env.PoolID)
+		} else {
+			instances, err = manager.StartPool(ctx, env.PoolID)
+		}
+		if err != nil {
+			return instances, fmt.Errorf("failed to run %s: %w", env.Command, err)
+		}
+		return instances, nil
+	}
+
+	instances, err := provider.ListInstances(ctx, env.PoolID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list instances from provider: %w", err)
+	}
+
+	desired := params.PowerStateOn
+	if stop {
+		desired = params.PowerStateOff
+	}
+
+	var targets []string
+	for _, instance := range instances {
+		if prepareInstance(instance).PowerState == desired {
+			continue
+		}
+		id := instance.ProviderID
+		if id == "" {
+			id = instance.Name
+		}
+		targets = append(targets, id)
+	}
+
+	var mux sync.Mutex
+	var wg sync.WaitGroup
+	var errs []error
+	affected := []string{}
+	sem := make(chan struct{}, opts.poolConcurrency())
+	for _, target := range targets {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(instance string) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+
+			err := recoverPanic(func() error {
+				if stop {
+					return provider.Stop(ctx, instance, true)
+				}
+				return provider.Start(ctx, instance)
+			})
+
+			mux.Lock()
+			defer mux.Unlock()
+			if err != nil {
+				errs = append(errs, fmt.Errorf("instance %s: %w", instance, err))
+				return
+			}
+			affected = append(affected, instance)
+		}(target)
+	}
+	wg.Wait()
+
+	sort.Strings(affected)
+	if len(errs) > 0 {
+		// The errors of individual instances are not wrapped, so that a single instance
+		// deleted in the meantime does not turn the outcome of the whole command into
+		// ErrNotFound.
+		return affected, fmt.Errorf("failed to run %s: %s", env.Command, errors.Join(errs...))
+	}
+	return affected, nil
+}
+
+// recoverPanic calls fn, turning a panic into an error. Provider calls made from
+// worker goroutines use it, as a panic there would otherwise crash the whole process,
+// out of reach of the recover of RunServer.
+func recoverPanic(fn func() error) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic while calling provider: %v", r)
+		}
+	}()
+	return fn()
+}
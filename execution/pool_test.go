@@ -0,0 +1,193 @@
+// Copyright 2023 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package execution
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+
+	gErrors "github.com/cloudbase/garm-provider-common/errors"
+	"github.com/cloudbase/garm-provider-common/params"
+	"github.com/stretchr/testify/require"
+)
+
+type poolProvider struct {
+	testExternalProvider
+
+	instances []params.ProviderInstance
+	failFor   string
+	failErr   error
+	panicFor  string
+
+	mux     sync.Mutex
+	active  int
+	maxSeen int
+	stopped []string
+	started []string
+}
+
+func (p *poolProvider) ListInstances(context.Context, string) ([]params.ProviderInstance, error) {
+	return p.instances, nil
+}
+
+func (p *poolProvider) track(instance string, calls *[]string) error {
+	p.mux.Lock()
+	p.active++
+	if p.active > p.maxSeen {
+		p.maxSeen = p.active
+	}
+	p.mux.Unlock()
+
+	defer func() {
+		p.mux.Lock()
+		p.active--
+		p.mux.Unlock()
+	}()
+
+	if instance == p.failFor {
+		if p.failErr != nil {
+			return p.failErr
+		}
+		return fmt.Errorf("mock error")
+	}
+	if instance == p.panicFor {
+		panic("mock panic")
+	}
+	p.mux.Lock()
+	*calls = append(*calls, instance)
+	p.mux.Unlock()
+	return nil
+}
+
+func (p *poolProvider) Stop(ctx context.Context, instance string, force bool) error {
+	return p.track(instance, &p.stopped)
+}
+
+func (p *poolProvider) Start(ctx context.Context, instance string) error {
+	return p.track(instance, &p.started)
+}
+
+type testPoolPowerManagerProvider struct {
+	testExternalProvider
+}
+
+func (p *testPoolPowerManagerProvider) StopPool(ctx context.Context, poolID string) ([]string, error) {
+	if p.mockErr != nil {
+		return nil, p.mockErr
+	}
+	return []string{"i-1", "i-2"}, nil
+}
+
+func (p *testPoolPowerManagerProvider) StartPool(ctx context.Context, poolID string) ([]string, error) {
+	if p.mockErr != nil {
+		return nil, p.mockErr
+	}
+	return []string{"i-3"}, nil
+}
+
+func testPoolInstances() []params.ProviderInstance {
+	return []params.ProviderInstance{
+		{ProviderID: "i-1", Status: params.InstanceRunning},
+		{ProviderID: "i-2", Status: params.InstanceRunning},
+		{ProviderID: "i-3", Status: params.InstanceStopped},
+		{Name: "runner-4", Status: params.InstanceRunning},
+	}
+}
+
+func TestRunStopPool(t *testing.T) {
+	provider := &poolProvider{instances: testPoolInstances()}
+	env := Environment{Command: StopPoolCommand, PoolID: "pool-id"}
+
+	out, err := RunWithOptions(context.Background(), provider, env, RunOptions{PoolConcurrency: 2})
+	require.NoError(t, err)
+	require.JSONEq(t, `{"pool_id": "pool-id", "instances": ["i-1", "i-2", "runner-4"]}`, out)
+	require.ElementsMatch(t, []string{"i-1", "i-2", "runner-4"}, provider.stopped)
+	require.LessOrEqual(t, provider.maxSeen, 2)
+}
+
+func TestRunStartPool(t *testing.T) {
+	provider := &poolProvider{instances: testPoolInstances()}
+	env := Environment{Command: StartPoolCommand, PoolID: "pool-id"}
+
+	out, err := Run(context.Background(), provider, env)
+	require.NoError(t, err)
+	require.JSONEq(t, `{"pool_id": "pool-id", "instances": ["i-3"]}`, out)
+	require.Equal(t, []string{"i-3"}, provider.started)
+}
+
+func TestRunStopPoolPartialFailure(t *testing.T) {
+	provider := &poolProvider{instances: testPoolInstances(), failFor: "i-2"}
+	env := Environment{Command: StopPoolCommand, PoolID: "pool-id"}
+
+	out, err := Run(context.Background(), provider, env)
+	require.EqualError(t, err, "failed to run StopPool: instance i-2: mock error")
+	require.JSONEq(t, `{"pool_id": "pool-id", "instances": ["i-1", "runner-4"]}`, out)
+
+	provider = &poolProvider{instances: testPoolInstances()[:2], failFor: "i-1"}
+	provider.instances[1].Status = params.InstanceStopped
+	out, err = Run(context.Background(), provider, env)
+	require.EqualError(t, err, "failed to run StopPool: instance i-1: mock error")
+	require.Empty(t, out)
+}
+
+func TestRunPoolPowerManager(t *testing.T) {
+	env := Environment{Command: StopPoolCommand, PoolID: "pool-id"}
+	out, err := Run(context.Background(), &testPoolPowerManagerProvider{}, env)
+	require.NoError(t, err)
+	require.JSONEq(t, `{"pool_id": "pool-id", "instances": ["i-1", "i-2"]}`, out)
+
+	env.Command = StartPoolCommand
+	out, err = Run(context.Background(), &testPoolPowerManagerProvider{}, env)
+	require.NoError(t, err)
+	require.JSONEq(t, `{"pool_id": "pool-id", "instances": ["i-3"]}`, out)
+
+	provider := &testPoolPowerManagerProvider{
+		testExternalProvider: testExternalProvider{mockErr: gErrors.ErrNotFound},
+	}
+	_, err = Run(context.Background(), provider, env)
+	require.ErrorIs(t, err, gErrors.ErrNotFound)
+}
+
+func TestRunStopPoolPartialFailureNotRetried(t *testing.T) {
+	provider := &poolProvider{instances: testPoolInstances(), failFor: "i-2"}
+	env := Environment{Command: StopPoolCommand, PoolID: "pool-id"}
+
+	out, err := RunWithOptions(context.Background(), provider, env, RunOptions{Retry: RetryPolicy{MaxAttempts: 3}})
+	require.ErrorContains(t, err, "instance i-2: mock error")
+	require.JSONEq(t, `{"pool_id": "pool-id", "instances": ["i-1", "runner-4"]}`, out)
+	require.ElementsMatch(t, []string{"i-1", "runner-4"}, provider.stopped)
+}
+
+func TestRunStopPoolRecoversPanic(t *testing.T) {
+	provider := &poolProvider{instances: testPoolInstances(), panicFor: "i-2"}
+	env := Environment{Command: StopPoolCommand, PoolID: "pool-id"}
+
+	out, err := Run(context.Background(), provider, env)
+	require.EqualError(t, err, "failed to run StopPool: instance i-2: panic while calling provider: mock panic")
+	require.JSONEq(t, `{"pool_id": "pool-id", "instances": ["i-1", "runner-4"]}`, out)
+}
+
+func TestRunStopPoolInstanceNotFound(t *testing.T) {
+	provider := &poolProvider{instances: testPoolInstances(), failFor: "i-2", failErr: gErrors.ErrNotFound}
+	env := Environment{Command: StopPoolCommand, PoolID: "pool-id"}
+
+	out, err := Run(context.Background(), provider, env)
+	require.EqualError(t, err, "failed to run StopPool: instance i-2: not found")
+	require.NotErrorIs(t, err, gErrors.ErrNotFound)
+	require.Equal(t, 1, ResolveErrorToExitCode(err))
+	require.JSONEq(t, `{"pool_id": "pool-id", "instances": ["i-1", "runner-4"]}`, out)
+}
@@ -0,0 +1,314 @@
+// Copyright 2023 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package execution
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+
+	"github.com/cloudbase/garm-provider-common/params"
+)
+
+var rxUnsafeFileChars = regexp.MustCompile(`[^A-Za-z0-9._-]`)
+
+// Recording is a single provider call, as stored by RunRecorder and served by
+// ReplayProvider.
+type Recording struct {
+	// Command is the command that was run.
+	Command ExecutionCommand `json:"command"`
+	// Target is the instance ID, instance name or pool ID the command operated on,
+	// if any.
+	Target string `json:"target,omitempty"`
+	// Input holds any other arguments of the command, like the bootstrap params of
+	// CreateInstance. Secrets are redacted.
+	Input json.RawMessage `json:"input,omitempty"`
+	// Output is the JSON encoded value returned by the provider, if any.
+	Output json.RawMessage `json:"output,omitempty"`
+	// Error is the error returned by the provider, if any.
+	Error string `json:"error,omitempty"`
+	// ExitCode is the exit code that corresponds to Error. It is used to restore
+	// the error type on replay.
+	ExitCode int `json:"exit_code,omitempty"`
+}
+
+// recordingName returns the name shared by the recordings of a command and target.
+func recordingName(cmd ExecutionCommand, target string) string {
+	name := string(cmd)
+	if target != "" {
+		name += "-" + rxUnsafeFileChars.ReplaceAllString(target, "_")
+	}
+	return name
+}
+
+// recordingPath returns the path of the recording of a call, given the name of its
+// command and target and its sequence number, starting at 1.
+func recordingPath(dir, name string, seq int) string {
+	return filepath.Join(dir, fmt.Sprintf("%s.%d.json", name, seq))
+}
+
+// RunRecorder wraps a provider and records every call, with its inputs and outputs,
+// as a JSON file in Dir. Files are named after the command and the instance or pool
+// it operated on, followed by a sequence number, so repeated calls, like polling an
+// instance with GetInstance, are all kept. Numbers continue from the recordings
+// already in Dir, so the one shot CLI can record a session one command at a time.
+// The recordings can be served by a ReplayProvider to build deterministic tests
+// from a session against a real cloud.
+//
+// Only the methods of ExternalProvider are recorded. The optional interfaces of the
+// wrapped provider are still used, through Unwrap, but their calls are not recorded.
+// Failures to write a recording are reported as warnings, and never change the
+// outcome of the call.
+type RunRecorder struct {
+	Provider ExternalProvider
+	Dir      string
+
+	mux  sync.Mutex
+	next map[string]int
+}
+
+// NewRunRecorder returns a RunRecorder that records the calls to provider in dir.
+func NewRunRecorder(provider ExternalProvider, dir string) *RunRecorder {
+	return &RunRecorder{
+		Provider: provider,
+		Dir:      dir,
+	}
+}
+
+var _ ExternalProvider = &RunRecorder{}
+
+// Unwrap returns the recorded provider. See ProviderUnwrapper.
+func (r *RunRecorder) Unwrap() ExternalProvider {
+	return r.Provider
+}
+
+// record saves a recording. Failures are reported as warnings, as the call to the
+// provider already happened, and its result must reach GARM regardless.
+func (r *RunRecorder) record(ctx context.Context, cmd ExecutionCommand, target string, input, output interface{}, providerErr error) {
+	if err := r.write(cmd, target, input, output, providerErr); err != nil {
+		AddWarning(ctx, "failed to record %s: %s", cmd, err)
+	}
+}
+
+func (r *RunRecorder) write(cmd ExecutionCommand, target string, input, output interface{}, providerErr error) error {
+	rec := Recording{
+		Command: cmd,
+		Target:  target,
+	}
+
+	if input != nil {
+		asJs, err := json.Marshal(input)
+		if err != nil {
+			return fmt.Errorf("failed to marshal input: %w", err)
+		}
+		rec.Input = asJs
+	}
+
+	if providerErr != nil {
+		rec.Error = providerErr.Error()
+		rec.ExitCode = ResolveErrorToExitCode(providerErr)
+	} else if output != nil {
+		asJs, err := json.Marshal(output)
+		if err != nil {
+			return fmt.Errorf("failed to marshal output: %w", err)
+		}
+		rec.Output = asJs
+	}
+
+	asJs, err := json.MarshalIndent(rec, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal recording: %w", err)
+	}
+	if err := os.MkdirAll(r.Dir, 0o755); err != nil {
+		return fmt.Errorf("failed to create recording dir: %w", err)
+	}
+	file, err := r.create(recordingName(cmd, target))
+	if err != nil {
+		return fmt.Errorf("failed to create recording: %w", err)
+	}
+	defer file.Close()
+	if _, err := file.Write(append(asJs, '\n')); err != nil {
+		return fmt.Errorf("failed to write recording: %w", err)
+	}
+	return nil
+}
+
+// create creates the file of the next recording with the given name. Sequence
+// numbers already taken, by this recorder or an earlier one, are skipped.
+func (r *RunRecorder) create(name string) (*os.File, error) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	if r.next == nil {
+		r.next = map[string]int{}
+	}
+	seq := r.next[name] + 1
+	for {
+		file, err := os.OpenFile(recordingPath(r.Dir, name, seq), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+		if err == nil {
+			r.next[name] = seq
+			return file, nil
+		}
+		if !errors.Is(err, os.ErrExist) {
+			return nil, err
+		}
+		seq++
+	}
+}
+
+func (r *RunRecorder) CreateInstance(ctx context.Context, bootstrapParams params.BootstrapInstance) (params.ProviderInstance, error) {
+	instance, err := r.Provider.CreateInstance(ctx, bootstrapParams)
+	redacted := Environment{BootstrapParams: bootstrapParams}.Redacted().BootstrapParams
+	r.record(ctx, CreateInstanceCommand, bootstrapParams.Name, redacted, instance, err)
+	return instance, err
+}
+
+func (r *RunRecorder) DeleteInstance(ctx context.Context, instance string) error {
+	err := r.Provider.DeleteInstance(ctx, instance)
+	r.record(ctx, DeleteInstanceCommand, instance, nil, nil, err)
+	return err
+}
+
+func (r *RunRecorder) GetInstance(ctx context.Context, instance string) (params.ProviderInstance, error) {
+	ret, err := r.Provider.GetInstance(ctx, instance)
+	r.record(ctx, GetInstanceCommand, instance, nil, ret, err)
+	return ret, err
+}
+
+func (r *RunRecorder) ListInstances(ctx context.Context, poolID string) ([]params.ProviderInstance, error) {
+	ret, err := r.Provider.ListInstances(ctx, poolID)
+	r.record(ctx, ListInstancesCommand, poolID, nil, ret, err)
+	return ret, err
+}
+
+func (r *RunRecorder) RemoveAllInstances(ctx context.Context) error {
+	err := r.Provider.RemoveAllInstances(ctx)
+	r.record(ctx, RemoveAllInstancesCommand, "", nil, nil, err)
+	return err
+}
+
+func (r *RunRecorder) Stop(ctx context.Context, instance string, force bool) error {
+	err := r.Provider.Stop(ctx, instance, force)
+	r.record(ctx, StopInstanceCommand, instance, map[string]bool{"force": force}, nil, err)
+	return err
+}
+
+func (r *RunRecorder) Start(ctx context.Context, instance string) error {
+	err := r.Provider.Start(ctx, instance)
+	r.record(ctx, StartInstanceCommand, instance, nil, nil, err)
+	return err
+}
+
+// ReplayProvider is an ExternalProvider that serves the recordings made by a
+// RunRecorder from Dir. Repeated calls with the same command and target are served
+// the recordings in the order they were made. Calls for which there is no recording
+// left fail.
+type ReplayProvider struct {
+	Dir string
+
+	mux  sync.Mutex
+	next map[string]int
+}
+
+var _ ExternalProvider = &ReplayProvider{}
+
+// load reads the next recording for a command and target.
+func (r *ReplayProvider) load(cmd ExecutionCommand, target string) ([]byte, error) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	if r.next == nil {
+		r.next = map[string]int{}
+	}
+	name := recordingName(cmd, target)
+	data, err := os.ReadFile(recordingPath(r.Dir, name, r.next[name]+1))
+	if err != nil {
+		return nil, err
+	}
+	r.next[name]++
+	return data, nil
+}
+
+// replay loads the next recording for a command and decodes its output into out.
+func (r *ReplayProvider) replay(cmd ExecutionCommand, target string, out interface{}) error {
+	data, err := r.load(cmd, target)
+	if err != nil {
+		return fmt.Errorf("failed to load recording for %s: %w", cmd, err)
+	}
+
+	var rec Recording
+	if err := json.Unmarshal(data, &rec); err != nil {
+		return fmt.Errorf("failed to decode recording for %s: %w", cmd, err)
+	}
+
+	if rec.Error != "" {
+		if rec.ExitCode == 0 || rec.ExitCode == 1 {
+			return errors.New(rec.Error)
+		}
+		return fmt.Errorf("%s: %w", rec.Error, ExitCodeToError(rec.ExitCode))
+	}
+
+	if out != nil && len(rec.Output) > 0 {
+		if err := json.Unmarshal(rec.Output, out); err != nil {
+			return fmt.Errorf("failed to decode recorded output for %s: %w", cmd, err)
+		}
+	}
+	return nil
+}
+
+func (r *ReplayProvider) CreateInstance(ctx context.Context, bootstrapParams params.BootstrapInstance) (params.ProviderInstance, error) {
+	var instance params.ProviderInstance
+	if err := r.replay(CreateInstanceCommand, bootstrapParams.Name, &instance); err != nil {
+		return params.ProviderInstance{}, err
+	}
+	return instance, nil
+}
+
+func (r *ReplayProvider) DeleteInstance(ctx context.Context, instance string) error {
+	return r.replay(DeleteInstanceCommand, instance, nil)
+}
+
+func (r *ReplayProvider) GetInstance(ctx context.Context, instance string) (params.ProviderInstance, error) {
+	var ret params.ProviderInstance
+	if err := r.replay(GetInstanceCommand, instance, &ret); err != nil {
+		return params.ProviderInstance{}, err
+	}
+	return ret, nil
+}
+
+func (r *ReplayProvider) ListInstances(ctx context.Context, poolID string) ([]params.ProviderInstance, error) {
+	var ret []params.ProviderInstance
+	if err := r.replay(ListInstancesCommand, poolID, &ret); err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+func (r *ReplayProvider) RemoveAllInstances(ctx context.Context) error {
+	return r.replay(RemoveAllInstancesCommand, "", nil)
+}
+
+func (r *ReplayProvider) Stop(ctx context.Context, instance string, force bool) error {
+	return r.replay(StopInstanceCommand, instance, nil)
+}
+
+func (r *ReplayProvider) Start(ctx context.Context, instance string) error {
+	return r.replay(StartInstanceCommand, instance, nil)
+}
@@ -0,0 +1,141 @@
+// Copyright 2023 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package execution
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	gErrors "github.com/cloudbase/garm-provider-common/errors"
+	"github.com/cloudbase/garm-provider-common/params"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRecordAndReplay(t *testing.T) {
+	dir := t.TempDir()
+	instance := params.ProviderInstance{
+		ProviderID: "i-123",
+		Name:       "runner-1",
+		Status:     params.InstanceRunning,
+	}
+
+	recorder := NewRunRecorder(&testExternalProvider{mockInstance: instance}, dir)
+	env := Environment{
+		Command: CreateInstanceCommand,
+		BootstrapParams: params.BootstrapInstance{
+			Name:          "runner-1",
+			InstanceToken: "super-secret-token",
+		},
+	}
+	recordedCreate, err := Run(context.Background(), recorder, env)
+	require.NoError(t, err)
+
+	env = Environment{Command: GetInstanceCommand, InstanceID: "us-east-1a/i-123"}
+	recordedGet, err := Run(context.Background(), recorder, env)
+	require.NoError(t, err)
+
+	env = Environment{Command: ListInstancesCommand, PoolID: "pool-id"}
+	recordedList, err := Run(context.Background(), recorder, env)
+	require.NoError(t, err)
+
+	recorder.Provider = &testExternalProvider{mockErr: gErrors.ErrNotFound}
+	env = Environment{Command: DeleteInstanceCommand, InstanceID: "i-456"}
+	_, err = Run(context.Background(), recorder, env)
+	require.ErrorIs(t, err, gErrors.ErrNotFound)
+
+	// Recordings are named after the command and target, and secrets are redacted.
+	data, err := os.ReadFile(filepath.Join(dir, "CreateInstance-runner-1.1.json"))
+	require.NoError(t, err)
+	require.NotContains(t, string(data), "super-secret-token")
+	require.FileExists(t, filepath.Join(dir, "GetInstance-us-east-1a_i-123.1.json"))
+
+	replay := &ReplayProvider{Dir: dir}
+	out, err := Run(context.Background(), replay, Environment{
+		Command:         CreateInstanceCommand,
+		BootstrapParams: params.BootstrapInstance{Name: "runner-1", InstanceToken: "super-secret-token"},
+	})
+	require.NoError(t, err)
+	require.JSONEq(t, recordedCreate, out)
+
+	out, err = Run(context.Background(), replay, Environment{Command: GetInstanceCommand, InstanceID: "us-east-1a/i-123"})
+	require.NoError(t, err)
+	require.JSONEq(t, recordedGet, out)
+
+	out, err = Run(context.Background(), replay, Environment{Command: ListInstancesCommand, PoolID: "pool-id"})
+	require.NoError(t, err)
+	require.JSONEq(t, recordedList, out)
+
+	_, err = Run(context.Background(), replay, Environment{Command: DeleteInstanceCommand, InstanceID: "i-456"})
+	require.ErrorIs(t, err, gErrors.ErrNotFound)
+
+	_, err = Run(context.Background(), replay, Environment{Command: GetInstanceCommand, InstanceID: "unknown"})
+	require.ErrorContains(t, err, "failed to load recording for GetInstance")
+}
+
+func TestRecordAndReplaySequence(t *testing.T) {
+	dir := t.TempDir()
+	provider := &testExternalProvider{
+		mockInstance: params.ProviderInstance{ProviderID: "i-123", Name: "runner-1", Status: params.InstancePendingCreate},
+	}
+	env := Environment{Command: GetInstanceCommand, InstanceID: "i-123"}
+
+	var recorded []string
+	for _, status := range []params.InstanceStatus{params.InstancePendingCreate, params.InstanceRunning} {
+		provider.mockInstance.Status = status
+		// Every command gets a recorder of its own, like in the one shot CLI.
+		out, err := Run(context.Background(), NewRunRecorder(provider, dir), env)
+		require.NoError(t, err)
+		recorded = append(recorded, out)
+	}
+	require.FileExists(t, filepath.Join(dir, "GetInstance-i-123.1.json"))
+	require.FileExists(t, filepath.Join(dir, "GetInstance-i-123.2.json"))
+
+	replay := &ReplayProvider{Dir: dir}
+	for _, expected := range recorded {
+		out, err := Run(context.Background(), replay, env)
+		require.NoError(t, err)
+		require.JSONEq(t, expected, out)
+	}
+	_, err := Run(context.Background(), replay, env)
+	require.ErrorContains(t, err, "failed to load recording for GetInstance")
+}
+
+func TestRunRecorderOptionalInterfaces(t *testing.T) {
+	recorder := NewRunRecorder(&testPoolPowerManagerProvider{}, t.TempDir())
+
+	out, err := Run(context.Background(), recorder, Environment{Command: StopPoolCommand, PoolID: "pool-id"})
+	require.NoError(t, err)
+	require.JSONEq(t, `{"pool_id": "pool-id", "instances": ["i-1", "i-2"]}`, out)
+}
+
+func TestRunRecorderWriteFailure(t *testing.T) {
+	// The recording dir is a file, so recordings can not be written.
+	dir := filepath.Join(t.TempDir(), "recordings")
+	require.NoError(t, os.WriteFile(dir, nil, 0o644))
+
+	recorder := NewRunRecorder(&testExternalProvider{mockInstance: params.ProviderInstance{ProviderID: "i-123", Name: "runner-1"}}, dir)
+	env := Environment{
+		Command:         CreateInstanceCommand,
+		BootstrapParams: params.BootstrapInstance{Name: "runner-1", InstanceToken: "instance-token"},
+	}
+	var stderr bytes.Buffer
+	out, err := RunWithOptions(context.Background(), recorder, env, RunOptions{Stderr: &stderr})
+	require.NoError(t, err)
+	require.Contains(t, out, `"provider_id":"i-123"`)
+	require.Contains(t, stderr.String(), "WARNING: failed to record CreateInstance: failed to create recording dir")
+}
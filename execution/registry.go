@@ -0,0 +1,88 @@
+// Copyright 2023 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package execution
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	gErrors "github.com/cloudbase/garm-provider-common/errors"
+)
+
+// ProviderNameConfigKey is the key in the provider config that selects the provider
+// of a ProviderRegistry, when GARM_PROVIDER_NAME is not set.
+const ProviderNameConfigKey = "provider"
+
+// ProviderFactory creates a provider for the given environment.
+type ProviderFactory func(ctx context.Context, env Environment) (ExternalProvider, error)
+
+// ProviderRegistry maps provider names to factories, allowing a single binary to
+// act as several providers, selected at runtime.
+type ProviderRegistry map[string]ProviderFactory
+
+// Names returns the sorted names of the registered providers.
+func (r ProviderRegistry) Names() []string {
+	names := make([]string, 0, len(r))
+	for name := range r {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// providerName returns the name of the provider selected by the environment.
+func providerName(env Environment) (string, error) {
+	if env.ProviderName != "" {
+		return env.ProviderName, nil
+	}
+
+	if len(env.configFiles()) > 0 {
+		cfg, err := env.ProviderConfig()
+		if err != nil {
+			return "", err
+		}
+		if name, ok := cfg[ProviderNameConfigKey].(string); ok && name != "" {
+			return name, nil
+		}
+	}
+	return "", fmt.Errorf("no provider name set in GARM_PROVIDER_NAME or in the %q key of the provider config: %w", ProviderNameConfigKey, gErrors.ErrInvalidConfig)
+}
+
+// RunRegistered creates the provider selected by GARM_PROVIDER_NAME, or by the
+// "provider" key of the provider config, and runs the command described by env
+// against it. Local commands do not need a provider, and run without selecting one.
+func RunRegistered(ctx context.Context, reg ProviderRegistry, env Environment) (string, error) {
+	if isLocalCommand(env.Command) {
+		return Run(ctx, nil, env)
+	}
+
+	name, err := providerName(env)
+	if err != nil {
+		return "", err
+	}
+
+	factory, ok := reg[name]
+	if !ok || factory == nil {
+		return "", fmt.Errorf("provider %q is not registered (available: %s): %w", name, strings.Join(reg.Names(), ", "), gErrors.ErrInvalidConfig)
+	}
+
+	provider, err := factory(ctx, env)
+	if err != nil {
+		return "", fmt.Errorf("failed to create provider %q: %w", name, err)
+	}
+	return Run(ctx, provider, env)
+}
@@ -0,0 +1,107 @@
+// Copyright 2023 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package execution
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	gErrors "github.com/cloudbase/garm-provider-common/errors"
+	"github.com/cloudbase/garm-provider-common/params"
+	"github.com/stretchr/testify/require"
+)
+
+func testRegistry() ProviderRegistry {
+	newProvider := func(name string) ProviderFactory {
+		return func(context.Context, Environment) (ExternalProvider, error) {
+			return &testExternalProvider{
+				mockInstance: params.ProviderInstance{ProviderID: "instance-id", Name: name},
+			}, nil
+		}
+	}
+	return ProviderRegistry{
+		"aws":   newProvider("aws-instance"),
+		"azure": newProvider("azure-instance"),
+		"broken": func(context.Context, Environment) (ExternalProvider, error) {
+			return nil, fmt.Errorf("missing credentials")
+		},
+	}
+}
+
+func TestRunRegistered(t *testing.T) {
+	config := writeConfigFile(t, "config.yaml", "provider: azure\n")
+	emptyConfig := writeConfigFile(t, "empty.yaml", "region: us-east-1\n")
+
+	tests := []struct {
+		name         string
+		env          Environment
+		expectedName string
+		errString    string
+		errIs        error
+	}{
+		{
+			name:         "name from env",
+			env:          Environment{ProviderName: "aws", ProviderConfigFile: config},
+			expectedName: "aws-instance",
+		},
+		{
+			name:         "name from config",
+			env:          Environment{ProviderConfigFile: config},
+			expectedName: "azure-instance",
+		},
+		{
+			name:      "no name",
+			env:       Environment{ProviderConfigFile: emptyConfig},
+			errString: `no provider name set in GARM_PROVIDER_NAME or in the "provider" key of the provider config: invalid provider config`,
+			errIs:     gErrors.ErrInvalidConfig,
+		},
+		{
+			name:      "not registered",
+			env:       Environment{ProviderName: "gcp"},
+			errString: `provider "gcp" is not registered (available: aws, azure, broken): invalid provider config`,
+			errIs:     gErrors.ErrInvalidConfig,
+		},
+		{
+			name:      "factory error",
+			env:       Environment{ProviderName: "broken"},
+			errString: `failed to create provider "broken": missing credentials`,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			tc.env.Command = GetInstanceCommand
+			tc.env.InstanceID = "instance-id"
+
+			out, err := RunRegistered(context.Background(), testRegistry(), tc.env)
+			if tc.errString != "" {
+				require.EqualError(t, err, tc.errString)
+				if tc.errIs != nil {
+					require.ErrorIs(t, err, tc.errIs)
+				}
+				return
+			}
+			require.NoError(t, err)
+			require.Contains(t, out, tc.expectedName)
+		})
+	}
+}
+
+func TestRunRegisteredLocalCommand(t *testing.T) {
+	out, err := RunRegistered(context.Background(), ProviderRegistry{}, Environment{Command: DumpEnvCommand})
+	require.NoError(t, err)
+	require.Contains(t, out, `"command":"DumpEnv"`)
+}
@@ -0,0 +1,225 @@
+// Copyright 2023 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package execution
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+var (
+	// ServerReadTimeout is the maximum amount of time RunServer waits for a client to
+	// send its request, so a stalled client does not hold a connection forever.
+	ServerReadTimeout = 30 * time.Second
+	// ServerWriteTimeout is the maximum amount of time RunServer waits for a client to
+	// read the response, once the command finished.
+	ServerWriteTimeout = 30 * time.Second
+	// maxAcceptDelay caps the backoff between failed attempts to accept connections.
+	maxAcceptDelay = time.Second
+)
+
+// ServerResponse is the response written back by RunServer for every request.
+type ServerResponse struct {
+	// Output is the JSON document returned by the command, if any. Commands that
+	// partially fail, like StopPool, return it along with the error.
+	Output json.RawMessage `json:"output,omitempty"`
+	// Error is the error returned by the command, if any.
+	Error string `json:"error,omitempty"`
+	// ExitCode is the exit code the command would have had if it ran as a
+	// standalone process. See ResolveErrorToExitCode.
+	ExitCode int `json:"exit_code"`
+	// RetryAfter is the number of seconds to wait before retrying, if the cloud
+	// throttled the command and said for how long.
+	RetryAfter int `json:"retry_after,omitempty"`
+}
+
+// RunServer listens on a unix socket and runs one command per connection, for
+// providers that run as a long lived process instead of being executed for every
+// command. Each connection carries a JSON encoded Environment, which is validated
+// the same way GetEnvironment validates its own, and gets a ServerResponse back.
+// A panic while handling a connection fails that request only. RunServer returns
+// when ctx is canceled, after all in flight requests finish.
+func RunServer(ctx context.Context, provider ExternalProvider, socketPath string) error {
+	return RunServerWithOptions(ctx, provider, socketPath, RunOptions{})
+}
+
+// RunServerWithOptions is like RunServer, but runs every command with
+// RunWithOptions and opts. As all commands run in the same process, in memory
+// state set in opts, like a MemoryInstanceLocker, a CircuitBreaker with a
+// MemoryBreakerStore or the ResponseCache, is shared between commands. If CacheTTL
+// is set without a ResponseCache, the server creates one.
+// opts.Output is ignored, as the output of every command goes back to its client.
+// Providers implementing ConfigLoader have their config loaded once, from the config
+// files of the first command that needs it. Commands that pass different config files
+// fail with ErrInvalidConfig.
+func RunServerWithOptions(ctx context.Context, provider ExternalProvider, socketPath string, opts RunOptions) error {
+	if provider == nil {
+		return fmt.Errorf("provider must not be nil")
+	}
+
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", socketPath, err)
+	}
+
+	go func() {
+		<-ctx.Done()
+		listener.Close()
+	}()
+
+	opts.Output = nil
+	opts.serverConfig = &serverConfig{}
+	if opts.CacheTTL > 0 && opts.ResponseCache == nil {
+		opts.ResponseCache = NewResponseCache()
+	}
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	var acceptDelay time.Duration
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return fmt.Errorf("listener closed unexpectedly: %w", err)
+			}
+			// Errors like running out of file descriptors tend to persist for a
+			// while. Back off, instead of spinning on Accept.
+			acceptDelay = nextAcceptDelay(acceptDelay)
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-time.After(acceptDelay):
+			}
+			continue
+		}
+		acceptDelay = 0
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer conn.Close()
+			resp := handleServerConn(ctx, provider, conn, opts)
+			// Responses are best effort. If the client went away, there is nobody
+			// left to report the error to.
+			_ = conn.SetWriteDeadline(time.Now().Add(ServerWriteTimeout))
+			_ = json.NewEncoder(conn).Encode(resp)
+		}()
+	}
+}
+
+// nextAcceptDelay returns the time to wait after a failed Accept, doubling the
+// previous delay up to maxAcceptDelay.
+func nextAcceptDelay(delay time.Duration) time.Duration {
+	if delay == 0 {
+		return 5 * time.Millisecond
+	}
+	if delay *= 2; delay > maxAcceptDelay {
+		return maxAcceptDelay
+	}
+	return delay
+}
+
+// handleServerConn reads a request from conn and runs it.
+func handleServerConn(ctx context.Context, provider ExternalProvider, conn net.Conn, opts RunOptions) (resp ServerResponse) {
+	defer func() {
+		if r := recover(); r != nil {
+			resp = ServerResponse{
+				Error:    fmt.Sprintf("panic while running command: %v", r),
+				ExitCode: 1,
+			}
+		}
+	}()
+
+	env, err := decodeServerRequest(conn, opts)
+	if err != nil {
+		return ServerResponse{Error: err.Error(), ExitCode: ResolveErrorToExitCode(err)}
+	}
+
+	ret, err := RunWithOptions(ctx, provider, env, opts)
+	if err != nil {
+		retryAfter, _ := RetryAfterSeconds(err)
+		return ServerResponse{
+			Output:     outputToJSON(ret),
+			Error:      err.Error(),
+			ExitCode:   ResolveErrorToExitCode(err),
+			RetryAfter: retryAfter,
+		}
+	}
+
+	return ServerResponse{Output: outputToJSON(ret)}
+}
+
+// outputToJSON returns the output of a command as a JSON value. Commands like Metrics
+// return plain text, which is encoded as a JSON string.
+func outputToJSON(ret string) json.RawMessage {
+	if ret == "" {
+		return nil
+	}
+	if json.Valid([]byte(ret)) {
+		return json.RawMessage(ret)
+	}
+	asJs, _ := json.Marshal(ret)
+	return asJs
+}
+
+// decodeServerRequest decodes and validates the environment sent by a client.
+func decodeServerRequest(conn net.Conn, opts RunOptions) (Environment, error) {
+	if err := conn.SetReadDeadline(time.Now().Add(ServerReadTimeout)); err != nil {
+		return Environment{}, fmt.Errorf("failed to set read deadline: %w", err)
+	}
+	var env Environment
+	if err := json.NewDecoder(conn).Decode(&env); err != nil {
+		return Environment{}, fmt.Errorf("failed to decode request: %w", err)
+	}
+	return prepareEnvironment(env, opts)
+}
+
+// prepareEnvironment normalizes and validates an environment that was not read by
+// GetEnvironment, honoring the same options GetEnvironmentWithOptions does.
+func prepareEnvironment(env Environment, opts RunOptions) (Environment, error) {
+	switch env.Command {
+	case CreateInstanceCommand, EstimateCostCommand, RenderBootstrapCommand, WarmupCommand:
+		// Run the bootstrap params through the same normalization GetEnvironment
+		// applies to the params it reads from stdin.
+		data, err := json.Marshal(env.BootstrapParams)
+		if err != nil {
+			return Environment{}, fmt.Errorf("failed to encode bootstrap params: %w", err)
+		}
+		env.BootstrapParams, err = decodeBootstrapParams(data)
+		if err != nil {
+			return Environment{}, err
+		}
+	case CreateInstancesCommand:
+		data, err := json.Marshal(env.createInstancesRequest())
+		if err != nil {
+			return Environment{}, fmt.Errorf("failed to encode create instances request: %w", err)
+		}
+		if err := env.setCreateInstancesRequest(data); err != nil {
+			return Environment{}, err
+		}
+	}
+
+	if err := env.validate(opts); err != nil {
+		return Environment{}, fmt.Errorf("failed to validate execution environment: %w", err)
+	}
+	return env, nil
+}
@@ -0,0 +1,234 @@
+// Copyright 2023 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package execution
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/cloudbase/garm-provider-common/params"
+	"github.com/stretchr/testify/require"
+)
+
+type panickingProvider struct {
+	testExternalProvider
+}
+
+func (p *panickingProvider) DeleteInstance(context.Context, string) error {
+	panic("mock panic")
+}
+
+// startServer runs RunServer in the background for the duration of the test and
+// returns the path to its socket.
+func startServer(t *testing.T, provider ExternalProvider) string {
+	return startServerWithOptions(t, provider, RunOptions{})
+}
+
+// startServerWithOptions is like startServer, but runs RunServerWithOptions.
+func startServerWithOptions(t *testing.T, provider ExternalProvider, opts RunOptions) string {
+	socketPath := filepath.Join(t.TempDir(), "provider.sock")
+	ctx, cancel := context.WithCancel(context.Background())
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- RunServerWithOptions(ctx, provider, socketPath, opts)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		require.NoError(t, <-errCh)
+	})
+
+	require.Eventually(t, func() bool {
+		_, err := os.Stat(socketPath)
+		return err == nil
+	}, 5*time.Second, 10*time.Millisecond)
+	return socketPath
+}
+
+func sendServerRequest(t *testing.T, socketPath string, env Environment) ServerResponse {
+	conn, err := net.Dial("unix", socketPath)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	err = json.NewEncoder(conn).Encode(env)
+	require.NoError(t, err)
+
+	var resp ServerResponse
+	err = json.NewDecoder(conn).Decode(&resp)
+	require.NoError(t, err)
+	return resp
+}
+
+func TestRunServer(t *testing.T) {
+	tmpfile, err := os.CreateTemp("", "provider-config")
+	require.NoError(t, err)
+	tmpfile.Close()
+	t.Cleanup(func() { os.RemoveAll(tmpfile.Name()) })
+
+	provider := &panickingProvider{
+		testExternalProvider: testExternalProvider{
+			mockInstance: params.ProviderInstance{Name: "test-instance"},
+		},
+	}
+	socketPath := startServer(t, provider)
+
+	resp := sendServerRequest(t, socketPath, Environment{
+		Command:            GetInstanceCommand,
+		ControllerID:       "controller-id",
+		ProviderConfigFile: tmpfile.Name(),
+		InstanceID:         "instance-id",
+	})
+	require.Equal(t, "", resp.Error)
+	require.Equal(t, 0, resp.ExitCode)
+	require.JSONEq(t, `{"name": "test-instance"}`, string(resp.Output))
+
+	resp = sendServerRequest(t, socketPath, Environment{
+		Command:            GetInstanceCommand,
+		ControllerID:       "controller-id",
+		ProviderConfigFile: tmpfile.Name(),
+	})
+	require.Equal(t, "failed to validate execution environment: missing instance ID: GetInstance requires GARM_INSTANCE_ID", resp.Error)
+	require.Equal(t, 1, resp.ExitCode)
+
+	resp = sendServerRequest(t, startServer(t, &poolProvider{instances: testPoolInstances(), failFor: "i-2"}), Environment{
+		Command:            StopPoolCommand,
+		ControllerID:       "controller-id",
+		ProviderConfigFile: tmpfile.Name(),
+		PoolID:             "pool-id",
+	})
+	require.Equal(t, "failed to run StopPool: instance i-2: mock error", resp.Error)
+	require.Equal(t, 1, resp.ExitCode)
+	require.JSONEq(t, `{"pool_id": "pool-id", "instances": ["i-1", "runner-4"]}`, string(resp.Output))
+
+	// A panic only fails the request that caused it.
+	resp = sendServerRequest(t, socketPath, Environment{
+		Command:            DeleteInstanceCommand,
+		ControllerID:       "controller-id",
+		ProviderConfigFile: tmpfile.Name(),
+		InstanceID:         "instance-id",
+	})
+	require.Equal(t, "panic while running command: mock panic", resp.Error)
+	require.Equal(t, 1, resp.ExitCode)
+
+	resp = sendServerRequest(t, socketPath, Environment{
+		Command:            GetInstanceCommand,
+		ControllerID:       "controller-id",
+		ProviderConfigFile: tmpfile.Name(),
+		InstanceID:         "instance-id",
+	})
+	require.Equal(t, "", resp.Error)
+}
+
+func TestRunServerWithOptions(t *testing.T) {
+	tmpfile, err := os.CreateTemp("", "provider-config")
+	require.NoError(t, err)
+	tmpfile.Close()
+	t.Cleanup(func() { os.RemoveAll(tmpfile.Name()) })
+
+	var output bytes.Buffer
+	socketPath := startServerWithOptions(t, &panickingProvider{}, RunOptions{DryRun: true, Output: &output})
+
+	// The provider is not called in dry run mode, so it does not panic.
+	resp := sendServerRequest(t, socketPath, Environment{
+		Command:            DeleteInstanceCommand,
+		ControllerID:       "controller-id",
+		ProviderConfigFile: tmpfile.Name(),
+		InstanceID:         "instance-id",
+	})
+	require.Equal(t, "", resp.Error)
+	require.Equal(t, 0, resp.ExitCode)
+	require.Empty(t, output.String())
+}
+
+func TestRunServerResponseCache(t *testing.T) {
+	first := &countingDescriberProvider{}
+	second := &countingDescriberProvider{}
+	opts := RunOptions{CacheTTL: time.Hour}
+	sockets := []string{startServerWithOptions(t, first, opts), startServerWithOptions(t, second, opts)}
+
+	env := Environment{Command: DescribeProviderCommand, ControllerID: "controller-id"}
+	for _, socketPath := range sockets {
+		for i := 0; i < 2; i++ {
+			resp := sendServerRequest(t, socketPath, env)
+			require.Equal(t, "", resp.Error)
+		}
+	}
+	// Every server caches the responses of its own provider.
+	require.Equal(t, 1, first.calls)
+	require.Equal(t, 1, second.calls)
+}
+
+func TestRunServerLoadsConfigOnce(t *testing.T) {
+	config := writeConfigFile(t, "provider.toml", "")
+	other := writeConfigFile(t, "other.toml", "")
+
+	provider := &testConfigLoaderProvider{}
+	socketPath := startServer(t, provider)
+
+	env := Environment{
+		Command:            ListInstancesCommand,
+		ControllerID:       "controller-id",
+		ProviderConfigFile: config,
+		PoolID:             "pool-id",
+	}
+	for i := 0; i < 2; i++ {
+		resp := sendServerRequest(t, socketPath, env)
+		require.Equal(t, "", resp.Error)
+	}
+	require.Equal(t, [][]string{{config}}, provider.loadedFrom)
+
+	env.ProviderConfigFile = other
+	resp := sendServerRequest(t, socketPath, env)
+	require.Equal(t, fmt.Sprintf("failed to load config files %s: the server already loaded config files %s: invalid provider config", other, config), resp.Error)
+	require.Equal(t, ExitCodeInvalidConfig, resp.ExitCode)
+	require.Equal(t, [][]string{{config}}, provider.loadedFrom)
+}
+
+func TestRunServerReadTimeout(t *testing.T) {
+	readTimeout := ServerReadTimeout
+	ServerReadTimeout = 50 * time.Millisecond
+	t.Cleanup(func() { ServerReadTimeout = readTimeout })
+
+	socketPath := startServer(t, &testExternalProvider{})
+	conn, err := net.Dial("unix", socketPath)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	// The client never sends its request.
+	var resp ServerResponse
+	err = json.NewDecoder(conn).Decode(&resp)
+	require.NoError(t, err)
+	require.Contains(t, resp.Error, "failed to decode request")
+	require.Contains(t, resp.Error, "i/o timeout")
+}
+
+func TestNextAcceptDelay(t *testing.T) {
+	delay := nextAcceptDelay(0)
+	require.Equal(t, 5*time.Millisecond, delay)
+	require.Equal(t, 10*time.Millisecond, nextAcceptDelay(delay))
+	require.Equal(t, maxAcceptDelay, nextAcceptDelay(maxAcceptDelay))
+}
+
+func TestRunServerNilProvider(t *testing.T) {
+	err := RunServer(context.Background(), nil, filepath.Join(t.TempDir(), "provider.sock"))
+	require.EqualError(t, err, "provider must not be nil")
+}
@@ -0,0 +1,76 @@
+// Copyright 2023 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package execution
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	gErrors "github.com/cloudbase/garm-provider-common/errors"
+)
+
+// OutputSignatureSHA256 is the value of GARM_SIGN_OUTPUT that appends a SHA-256
+// checksum line to the output of a command.
+const OutputSignatureSHA256 = "sha256"
+
+// outputChecksum returns the checksum line of data, in the <algorithm>:<hex digest>
+// format.
+func outputChecksum(data []byte) string {
+	sum := sha256.Sum256(data)
+	return OutputSignatureSHA256 + ":" + hex.EncodeToString(sum[:])
+}
+
+// signOutput appends the checksum line to the output, if requested by GARM.
+func (e Environment) signOutput(output string) (string, error) {
+	switch e.SignOutput {
+	case "":
+		return output, nil
+	case OutputSignatureSHA256:
+		return output + "\n" + outputChecksum([]byte(output)), nil
+	default:
+		return "", fmt.Errorf("unsupported output signature algorithm %q", e.SignOutput)
+	}
+}
+
+// SplitSignedOutput splits the output of a provider that ran with GARM_SIGN_OUTPUT
+// set into the actual output and its checksum line. The result can be passed to
+// VerifyRunOutput.
+func SplitSignedOutput(output []byte) ([]byte, string, error) {
+	idx := strings.LastIndexByte(string(output), '\n')
+	if idx < 0 {
+		return nil, "", fmt.Errorf("output has no checksum line: %w", gErrors.ErrBadRequest)
+	}
+	return output[:idx], strings.TrimSpace(string(output[idx+1:])), nil
+}
+
+// VerifyRunOutput checks that data matches a checksum line produced by a provider
+// that ran with GARM_SIGN_OUTPUT set.
+func VerifyRunOutput(data []byte, checksum string) error {
+	algorithm, _, ok := strings.Cut(checksum, ":")
+	if !ok {
+		return fmt.Errorf("invalid checksum %q: %w", checksum, gErrors.ErrBadRequest)
+	}
+	if algorithm != OutputSignatureSHA256 {
+		return fmt.Errorf("unsupported checksum algorithm %q: %w", algorithm, gErrors.ErrBadRequest)
+	}
+
+	if subtle.ConstantTimeCompare([]byte(outputChecksum(data)), []byte(checksum)) != 1 {
+		return fmt.Errorf("output does not match its checksum: %w", gErrors.ErrBadRequest)
+	}
+	return nil
+}
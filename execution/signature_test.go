@@ -0,0 +1,94 @@
+// Copyright 2023 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package execution
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	gErrors "github.com/cloudbase/garm-provider-common/errors"
+	"github.com/cloudbase/garm-provider-common/params"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRunSignOutput(t *testing.T) {
+	provider := &testExternalProvider{
+		mockInstance: params.ProviderInstance{Name: "test-instance", OSType: params.Linux},
+	}
+	env := Environment{
+		Command:    GetInstanceCommand,
+		InstanceID: "test-instance",
+		SignOutput: OutputSignatureSHA256,
+	}
+
+	var output bytes.Buffer
+	out, err := RunWithOptions(context.Background(), provider, env, RunOptions{Output: &output})
+	require.NoError(t, err)
+	require.Equal(t, out, output.String())
+
+	data, checksum, err := SplitSignedOutput([]byte(out))
+	require.NoError(t, err)
+	require.Regexp(t, "^sha256:[0-9a-f]{64}$", checksum)
+	require.NoError(t, VerifyRunOutput(data, checksum))
+
+	unsigned, err := Run(context.Background(), provider, Environment{Command: GetInstanceCommand, InstanceID: "test-instance"})
+	require.NoError(t, err)
+	require.Equal(t, unsigned, string(data))
+}
+
+func TestVerifyRunOutput(t *testing.T) {
+	data := []byte(`{"name": "test-instance"}`)
+	checksum := outputChecksum(data)
+
+	tests := []struct {
+		name      string
+		data      []byte
+		checksum  string
+		errString string
+	}{
+		{name: "valid checksum", data: data, checksum: checksum},
+		{name: "corrupted data", data: []byte(`{"name": "test-instancf"}`), checksum: checksum, errString: "output does not match its checksum"},
+		{name: "missing algorithm", data: data, checksum: "abcdef", errString: `invalid checksum "abcdef"`},
+		{name: "unsupported algorithm", data: data, checksum: "md5:abcdef", errString: `unsupported checksum algorithm "md5"`},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			err := VerifyRunOutput(tc.data, tc.checksum)
+			if tc.errString == "" {
+				require.NoError(t, err)
+				return
+			}
+			require.ErrorIs(t, err, gErrors.ErrBadRequest)
+			require.ErrorContains(t, err, tc.errString)
+		})
+	}
+
+	_, _, err := SplitSignedOutput(data)
+	require.ErrorIs(t, err, gErrors.ErrBadRequest)
+}
+
+func TestValidateSignOutput(t *testing.T) {
+	env := Environment{
+		Command:      DescribeProviderCommand,
+		ControllerID: "controller-id",
+		SignOutput:   "md5",
+	}
+	require.EqualError(t, env.Validate(), `invalid GARM_SIGN_OUTPUT: unsupported algorithm "md5"`)
+
+	env.SignOutput = OutputSignatureSHA256
+	require.NoError(t, env.Validate())
+}
@@ -0,0 +1,79 @@
+// Copyright 2023 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package execution
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"regexp"
+	"unicode/utf8"
+)
+
+var (
+	// rxBearerToken matches literal bearer tokens, like the ones in Authorization
+	// headers. References to variables (eg: Bearer $Token) do not match.
+	rxBearerToken = regexp.MustCompile(`(?i)(bearer\s+)[A-Za-z0-9._~+/=-]+`)
+	// rxSecretAssignment matches literal values assigned to variables whose name
+	// suggests a secret, like BEARER_TOKEN="...", TOKEN='...', TOKEN=... or
+	// $Token="...". Parameter expansions, like ${TOKEN:-}, do not match. The second
+	// and third groups hold the quote, if any.
+	rxSecretAssignment = regexp.MustCompile(`(?im)((?:^|[^\w{])\w*(?:token|password|secret|jitconfig)\w*\s*[=:]\s*)(?:(")[^"$]+"|(')[^']+'|[^\s"'$;&|]+)`)
+	// rxBase64Blob matches long base64 strings, like the encoded files in a cloud
+	// config.
+	rxBase64Blob = regexp.MustCompile(`[A-Za-z0-9+/]{32,}={0,2}`)
+)
+
+// gzipMagic is the header of gzip data, like the output of util.CompressData.
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// redactUserData masks the secrets found in user data. Base64 encoded text, like
+// the install script embedded in a cloud config, is decoded and redacted as well.
+// Binary user data, like compressed or encrypted payloads, cannot be inspected and
+// is withheld entirely, as is base64 encoded gzip data.
+func redactUserData(userData []byte) []byte {
+	if len(userData) == 0 {
+		return userData
+	}
+	if !utf8.Valid(userData) {
+		return withheldUserData(userData)
+	}
+
+	redacted := rxBase64Blob.ReplaceAllFunc(userData, func(blob []byte) []byte {
+		decoded, err := base64.StdEncoding.DecodeString(string(blob))
+		if err != nil {
+			return blob
+		}
+		if bytes.HasPrefix(decoded, gzipMagic) {
+			return withheldUserData(decoded)
+		}
+		if !utf8.Valid(decoded) {
+			return blob
+		}
+		return []byte(base64.StdEncoding.EncodeToString(redactSecrets(decoded)))
+	})
+	return redactSecrets(redacted)
+}
+
+// withheldUserData returns the placeholder of user data that cannot be redacted.
+func withheldUserData(userData []byte) []byte {
+	return []byte(fmt.Sprintf("<%d bytes withheld>", len(userData)))
+}
+
+// redactSecrets masks the literal secrets in text, keeping the quotes around them.
+func redactSecrets(text []byte) []byte {
+	text = rxBearerToken.ReplaceAll(text, []byte("${1}"+redactedValue))
+	return rxSecretAssignment.ReplaceAll(text, []byte("${1}${2}${3}"+redactedValue+"${2}${3}"))
+}
@@ -0,0 +1,174 @@
+// Copyright 2023 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package execution
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/cloudbase/garm-provider-common/params"
+	"github.com/cloudbase/garm-provider-common/util"
+	"github.com/stretchr/testify/require"
+)
+
+const testInstallScript = `#!/bin/bash
+BEARER_TOKEN="super-secret-token"
+curl -H "Authorization: Bearer ${BEARER_TOKEN}" "${CALLBACK_URL}"
+TEMP_TOKEN="Authorization: Bearer download-token"
+`
+
+const redactedInstallScript = `#!/bin/bash
+BEARER_TOKEN="<redacted>"
+curl -H "Authorization: Bearer ${BEARER_TOKEN}" "${CALLBACK_URL}"
+TEMP_TOKEN="<redacted>"
+`
+
+func TestRedactUserData(t *testing.T) {
+	encoded := base64.StdEncoding.EncodeToString([]byte(testInstallScript))
+	redactedEncoded := base64.StdEncoding.EncodeToString([]byte(redactedInstallScript))
+	binary := []byte{0x1f, 0x8b, 0x08, 0x00, 0xff}
+	compressed, err := util.CompressData([]byte(testInstallScript))
+	require.NoError(t, err)
+	encodedCompressed := base64.StdEncoding.EncodeToString(compressed)
+
+	tests := []struct {
+		name     string
+		userData []byte
+		expected []byte
+	}{
+		{
+			name:     "plain script",
+			userData: []byte(testInstallScript),
+			expected: []byte(redactedInstallScript),
+		},
+		{
+			name:     "powershell",
+			userData: []byte(`[string]$Token="super-secret-token"` + "\n" + `$headers=@{"Authorization"="Bearer $Token"}`),
+			expected: []byte(`[string]$Token="<redacted>"` + "\n" + `$headers=@{"Authorization"="Bearer $Token"}`),
+		},
+		{
+			name:     "encoded file in cloud config",
+			userData: []byte("#cloud-config\nwrite_files:\n- encoding: b64\n  content: " + encoded + "\n"),
+			expected: []byte("#cloud-config\nwrite_files:\n- encoding: b64\n  content: " + redactedEncoded + "\n"),
+		},
+		{
+			name:     "single quoted and unquoted values",
+			userData: []byte("TOKEN=abc\nexport RUNNER_TOKEN='abc def'\nPASSWORD=abc; echo done\nTOKEN=${TOKEN:-}\n"),
+			expected: []byte("TOKEN=<redacted>\nexport RUNNER_TOKEN='<redacted>'\nPASSWORD=<redacted>; echo done\nTOKEN=${TOKEN:-}\n"),
+		},
+		{
+			name:     "binary",
+			userData: binary,
+			expected: []byte("<5 bytes withheld>"),
+		},
+		{
+			name:     "compressed",
+			userData: compressed,
+			expected: []byte(fmt.Sprintf("<%d bytes withheld>", len(compressed))),
+		},
+		{
+			name:     "encoded compressed file in cloud config",
+			userData: []byte("#cloud-config\nwrite_files:\n- encoding: gz+b64\n  content: " + encodedCompressed + "\n"),
+			expected: []byte(fmt.Sprintf("#cloud-config\nwrite_files:\n- encoding: gz+b64\n  content: <%d bytes withheld>\n", len(compressed))),
+		},
+		{
+			name:     "empty",
+			userData: nil,
+			expected: nil,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			require.Equal(t, string(tc.expected), string(redactUserData(tc.userData)))
+		})
+	}
+}
+
+type testUserDataProvider struct {
+	testExternalProvider
+
+	requested bool
+}
+
+func (p *testUserDataProvider) GetInstance(ctx context.Context, instance string) (params.ProviderInstance, error) {
+	p.requested = IsUserDataRequested(ctx)
+	return params.ProviderInstance{
+		ProviderID: instance,
+		UserData:   []byte(testInstallScript),
+	}, nil
+}
+
+func TestRunGetInstanceUserData(t *testing.T) {
+	tests := []struct {
+		name       string
+		include    bool
+		unredacted bool
+		expected   string
+	}{
+		{
+			name:     "omitted by default",
+			expected: "",
+		},
+		{
+			name:     "redacted",
+			include:  true,
+			expected: redactedInstallScript,
+		},
+		{
+			name:       "unredacted",
+			include:    true,
+			unredacted: true,
+			expected:   testInstallScript,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			env := Environment{
+				Command:            GetInstanceCommand,
+				InstanceID:         "instance-id",
+				IncludeUserData:    tc.include,
+				UserDataUnredacted: tc.unredacted,
+			}
+
+			provider := &testUserDataProvider{}
+			out, err := Run(context.Background(), provider, env)
+			require.NoError(t, err)
+			require.Equal(t, tc.include, provider.requested)
+
+			var instance params.ProviderInstance
+			require.NoError(t, json.Unmarshal([]byte(out), &instance))
+			require.Equal(t, tc.expected, string(instance.UserData))
+		})
+	}
+
+	// User data is never returned by other commands.
+	provider := &testUserDataProvider{
+		testExternalProvider: testExternalProvider{
+			mockInstance: params.ProviderInstance{ProviderID: "instance-id", UserData: []byte(testInstallScript)},
+		},
+	}
+	out, err := Run(context.Background(), provider, Environment{
+		Command:         ListInstancesCommand,
+		PoolID:          "pool-id",
+		IncludeUserData: true,
+	})
+	require.NoError(t, err)
+	require.NotContains(t, out, "user_data")
+}
@@ -0,0 +1,146 @@
+// Copyright 2023 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package execution
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	gErrors "github.com/cloudbase/garm-provider-common/errors"
+	"github.com/cloudbase/garm-provider-common/params"
+
+	"github.com/Masterminds/semver/v3"
+)
+
+const (
+	// InterfaceVersion010 is the first version of the external provider interface.
+	InterfaceVersion010 = "v0.1.0"
+	// InterfaceVersion011 is the second version of the external provider interface.
+	InterfaceVersion011 = "v0.1.1"
+)
+
+var rxInterfaceVersion = regexp.MustCompile(`^v[0-9]+\.[0-9]+\.[0-9]+$`)
+
+// compatibilityMatrix maps a GARM interface version to the provider interface
+// versions it is able to drive. This is the only place that needs to be updated
+// when a new interface version is released.
+var compatibilityMatrix = map[string][]string{
+	InterfaceVersion010: {InterfaceVersion010},
+	InterfaceVersion011: {InterfaceVersion010, InterfaceVersion011},
+}
+
+// normalizeInterfaceVersion returns the version in vMAJOR.MINOR.PATCH form.
+func normalizeInterfaceVersion(raw string) (string, error) {
+	version := strings.TrimSpace(raw)
+	if version != "" && !strings.HasPrefix(version, "v") {
+		version = "v" + version
+	}
+	if !rxInterfaceVersion.MatchString(version) {
+		return "", fmt.Errorf("invalid interface version %q", raw)
+	}
+	return version, nil
+}
+
+// ParseInterfaceVersion parses a version of the external provider interface, with
+// or without the "v" prefix, for use with AssertCompatible.
+func ParseInterfaceVersion(raw string) (semver.Version, error) {
+	normalized, err := normalizeInterfaceVersion(raw)
+	if err != nil {
+		return semver.Version{}, err
+	}
+	version, err := semver.StrictNewVersion(strings.TrimPrefix(normalized, "v"))
+	if err != nil {
+		return semver.Version{}, fmt.Errorf("invalid interface version %q: %w", raw, err)
+	}
+	return *version, nil
+}
+
+// AssertCompatible returns an error if a GARM implementing garmVersion of the
+// external provider interface is not able to drive a provider implementing
+// providerVersion. GARM should call this after querying the provider version.
+func AssertCompatible(providerVersion, garmVersion semver.Version) error {
+	provider := "v" + providerVersion.String()
+	garm := "v" + garmVersion.String()
+
+	supported, ok := compatibilityMatrix[garm]
+	if !ok {
+		return fmt.Errorf("unknown GARM interface version %s", garm)
+	}
+	for _, version := range supported {
+		if version == provider {
+			return nil
+		}
+	}
+	return fmt.Errorf(
+		"provider interface version %s is not supported by GARM interface version %s (supported: %s)",
+		provider, garm, strings.Join(supported, ", "))
+}
+
+// interfaceV010Commands holds the commands defined by version v0.1.0 of the
+// external provider interface.
+var interfaceV010Commands = map[ExecutionCommand]struct{}{
+	CreateInstanceCommand:     {},
+	DeleteInstanceCommand:     {},
+	GetInstanceCommand:        {},
+	ListInstancesCommand:      {},
+	StartInstanceCommand:      {},
+	StopInstanceCommand:       {},
+	RemoveAllInstancesCommand: {},
+}
+
+// isInterfaceV010 returns true if the environment was set up by a GARM that only
+// speaks version v0.1.0 of the external provider interface. An unset version is
+// not treated as v0.1.0, as this package is also driven by other callers.
+func (e Environment) isInterfaceV010() bool {
+	version, err := normalizeInterfaceVersion(e.InterfaceVersion)
+	return err == nil && version == InterfaceVersion010
+}
+
+// assertV010Command returns an error if a v0.1.0 GARM requested a command that is
+// not part of that version of the interface. Local commands are always allowed.
+func (e Environment) assertV010Command() error {
+	if !e.isInterfaceV010() || isLocalCommand(e.Command) {
+		return nil
+	}
+	if _, ok := interfaceV010Commands[e.Command]; !ok {
+		return fmt.Errorf("command %s is not part of interface version %s: %w", e.Command, InterfaceVersion010, gErrors.ErrNotImplemented)
+	}
+	return nil
+}
+
+// downgradeInstance removes the fields a v0.1.0 GARM does not know about from an
+// instance, so a provider built against a newer interface version can serve it.
+func (e Environment) downgradeInstance(instance params.ProviderInstance) params.ProviderInstance {
+	if !e.isInterfaceV010() {
+		return instance
+	}
+
+	instance.PowerState = ""
+	instance.RunnerLabels = nil
+	instance.UserData = nil
+	instance.SecurityGroups = nil
+	instance.Hostname = ""
+	instance.AvailabilityZone = ""
+	if instance.Addresses != nil {
+		addresses := make([]params.Address, len(instance.Addresses))
+		for idx, address := range instance.Addresses {
+			address.Family = ""
+			addresses[idx] = address
+		}
+		instance.Addresses = addresses
+	}
+	return instance
+}
@@ -0,0 +1,171 @@
+// Copyright 2023 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package execution
+
+import (
+	"context"
+	"testing"
+
+	gErrors "github.com/cloudbase/garm-provider-common/errors"
+	"github.com/cloudbase/garm-provider-common/params"
+
+	"github.com/Masterminds/semver/v3"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseInterfaceVersion(t *testing.T) {
+	tests := []struct {
+		name      string
+		raw       string
+		expected  string
+		errString string
+	}{
+		{
+			name:     "version with v prefix",
+			raw:      InterfaceVersion011,
+			expected: "0.1.1",
+		},
+		{
+			name:     "version without v prefix",
+			raw:      " 0.1.0 ",
+			expected: "0.1.0",
+		},
+		{
+			name:      "invalid version",
+			raw:       "bogus",
+			errString: `invalid interface version "bogus"`,
+		},
+		{
+			name:      "empty version",
+			raw:       "",
+			errString: `invalid interface version ""`,
+		},
+		{
+			name:      "leading zeros",
+			raw:       "v01.1.0",
+			errString: `invalid interface version "v01.1.0"`,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			version, err := ParseInterfaceVersion(tc.raw)
+			if tc.errString != "" {
+				require.ErrorContains(t, err, tc.errString)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tc.expected, version.String())
+		})
+	}
+}
+
+func TestAssertCompatible(t *testing.T) {
+	tests := []struct {
+		name            string
+		providerVersion semver.Version
+		garmVersion     semver.Version
+		errString       string
+	}{
+		{
+			name:            "same version",
+			providerVersion: *semver.MustParse(InterfaceVersion010),
+			garmVersion:     *semver.MustParse(InterfaceVersion010),
+		},
+		{
+			name:            "newer GARM drives older provider",
+			providerVersion: *semver.MustParse(InterfaceVersion010),
+			garmVersion:     *semver.MustParse(InterfaceVersion011),
+		},
+		{
+			name:            "version without v prefix",
+			providerVersion: *semver.MustParse("0.1.1"),
+			garmVersion:     *semver.MustParse("0.1.1"),
+		},
+		{
+			name:            "older GARM does not drive newer provider",
+			providerVersion: *semver.MustParse(InterfaceVersion011),
+			garmVersion:     *semver.MustParse(InterfaceVersion010),
+			errString:       "provider interface version v0.1.1 is not supported by GARM interface version v0.1.0 (supported: v0.1.0)",
+		},
+		{
+			name:            "unknown GARM version",
+			providerVersion: *semver.MustParse(InterfaceVersion010),
+			garmVersion:     *semver.MustParse("v9.0.0"),
+			errString:       "unknown GARM interface version v9.0.0",
+		},
+		{
+			name:            "pre-release provider version",
+			providerVersion: *semver.MustParse("v0.1.1-rc1"),
+			garmVersion:     *semver.MustParse(InterfaceVersion011),
+			errString:       "provider interface version v0.1.1-rc1 is not supported by GARM interface version v0.1.1 (supported: v0.1.0, v0.1.1)",
+		},
+		{
+			name:        "zero provider version",
+			garmVersion: *semver.MustParse(InterfaceVersion010),
+			errString:   "provider interface version v0.0.0 is not supported by GARM interface version v0.1.0 (supported: v0.1.0)",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			err := AssertCompatible(tc.providerVersion, tc.garmVersion)
+			if tc.errString == "" {
+				require.NoError(t, err)
+			} else {
+				require.EqualError(t, err, tc.errString)
+			}
+		})
+	}
+}
+
+func TestRunInterfaceV010Shim(t *testing.T) {
+	provider := &testExternalProvider{
+		mockInstance: params.ProviderInstance{
+			Name:             "test-instance",
+			Status:           params.InstanceRunning,
+			RunnerLabels:     []string{"linux"},
+			Addresses:        []params.Address{{Address: "10.0.0.5", Type: params.PrivateAddress}},
+			SecurityGroups:   []string{"sg-runners"},
+			AvailabilityZone: "eu-west-1a",
+		},
+	}
+
+	env := Environment{
+		Command:          GetInstanceCommand,
+		InterfaceVersion: "0.1.0",
+	}
+	out, err := Run(context.Background(), provider, env)
+	require.NoError(t, err)
+	require.JSONEq(t, `{"name": "test-instance", "status": "running", "addresses": [{"address": "10.0.0.5", "type": "private"}]}`, out)
+
+	env.InterfaceVersion = InterfaceVersion011
+	out, err = Run(context.Background(), provider, env)
+	require.NoError(t, err)
+	require.JSONEq(t, `{"name": "test-instance", "status": "running", "power_state": "on", "runner_labels": ["linux"], "addresses": [{"address": "10.0.0.5", "type": "private", "family": "ipv4"}], "security_groups": ["sg-runners"], "availability_zone": "eu-west-1a"}`, out)
+
+	// Commands added after v0.1.0 are not served to a v0.1.0 GARM.
+	env = Environment{
+		Command:          InstanceExistsCommand,
+		InterfaceVersion: InterfaceVersion010,
+	}
+	_, err = Run(context.Background(), provider, env)
+	require.ErrorIs(t, err, gErrors.ErrNotImplemented)
+	require.EqualError(t, err, "command InstanceExists is not part of interface version v0.1.0: not implemented")
+
+	env.Command = DumpEnvCommand
+	_, err = Run(context.Background(), provider, env)
+	require.NoError(t, err)
+}
@@ -0,0 +1,79 @@
+// Copyright 2023 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package execution
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+const warningsKey contextKey = "warnings"
+
+type warnings struct {
+	mux      sync.Mutex
+	messages []string
+}
+
+func withWarnings(ctx context.Context) (context.Context, *warnings) {
+	w := &warnings{}
+	return context.WithValue(ctx, warningsKey, w), w
+}
+
+// AddWarning attaches a warning to the result of the current command. Warnings
+// are written to stderr once the command finishes, and do not change its outcome
+// or exit code. Use them to give operators actionable signals, like a deprecated
+// image or a nearly exhausted quota. Known secrets are redacted from warnings, but
+// providers should still avoid formatting credentials into them.
+func AddWarning(ctx context.Context, format string, a ...interface{}) {
+	w, ok := ctx.Value(warningsKey).(*warnings)
+	if !ok {
+		return
+	}
+
+	w.mux.Lock()
+	defer w.mux.Unlock()
+	w.messages = append(w.messages, fmt.Sprintf(format, a...))
+}
+
+// secrets returns the secrets from the environment that must never be printed.
+func (e Environment) secrets() []string {
+	var ret []string
+	if e.BootstrapParams.InstanceToken != "" {
+		ret = append(ret, e.BootstrapParams.InstanceToken)
+	}
+	for _, tool := range e.BootstrapParams.Tools {
+		if tool.TempDownloadToken != nil && *tool.TempDownloadToken != "" {
+			ret = append(ret, *tool.TempDownloadToken)
+		}
+	}
+	return ret
+}
+
+// flush writes all warnings to stderr, with any secrets in env redacted.
+func (w *warnings) flush(env Environment, opts RunOptions) {
+	w.mux.Lock()
+	defer w.mux.Unlock()
+
+	secrets := env.secrets()
+	for _, msg := range w.messages {
+		for _, secret := range secrets {
+			msg = strings.ReplaceAll(msg, secret, redactedValue)
+		}
+		fmt.Fprintf(opts.stderr(), "WARNING: %s\n", msg)
+	}
+	w.messages = nil
+}
@@ -0,0 +1,84 @@
+// Copyright 2023 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package execution
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/cloudbase/garm-provider-common/params"
+	"github.com/stretchr/testify/require"
+)
+
+type warningProvider struct {
+	testExternalProvider
+}
+
+func (p *warningProvider) CreateInstance(ctx context.Context, bootstrapParams params.BootstrapInstance) (params.ProviderInstance, error) {
+	AddWarning(ctx, "image %s is deprecated", bootstrapParams.Image)
+	AddWarning(ctx, "registering with token %s", bootstrapParams.InstanceToken)
+	return p.mockInstance, p.mockErr
+}
+
+func TestRunWithOptionsWarnings(t *testing.T) {
+	var stderr bytes.Buffer
+	env := Environment{
+		Command: CreateInstanceCommand,
+		BootstrapParams: params.BootstrapInstance{
+			Image:         "ubuntu-20.04",
+			InstanceToken: "super-secret-token",
+		},
+	}
+
+	out, err := RunWithOptions(context.Background(), &warningProvider{}, env, RunOptions{Stderr: &stderr})
+	require.NoError(t, err)
+	require.NotEmpty(t, out)
+	require.Equal(t, "WARNING: image ubuntu-20.04 is deprecated\nWARNING: registering with token <redacted>\n", withoutSummary(stderr.String()))
+}
+
+func TestAddWarningWithoutCollector(t *testing.T) {
+	// Providers may call AddWarning outside of Run, in which case it is a no-op.
+	AddWarning(context.Background(), "ignored")
+}
+
+func TestRunToStreams(t *testing.T) {
+	var stdout, stderr bytes.Buffer
+	env := Environment{
+		Command:         CreateInstanceCommand,
+		BootstrapParams: params.BootstrapInstance{Image: "ubuntu-20.04", InstanceToken: "instance-token"},
+	}
+	provider := &warningProvider{
+		testExternalProvider: testExternalProvider{
+			mockInstance: params.ProviderInstance{ProviderID: "instance-id", Name: "test-instance"},
+		},
+	}
+
+	err := RunToStreams(context.Background(), provider, env, &stdout, &stderr)
+	require.NoError(t, err)
+	var instance params.ProviderInstance
+	require.NoError(t, json.Unmarshal(stdout.Bytes(), &instance))
+	require.Equal(t, "instance-id", instance.ProviderID)
+	require.Contains(t, stderr.String(), "WARNING: image ubuntu-20.04 is deprecated\n")
+
+	stdout.Reset()
+	stderr.Reset()
+	provider.mockErr = fmt.Errorf("mock error")
+	err = RunToStreams(context.Background(), provider, env, &stdout, &stderr)
+	require.EqualError(t, err, "failed to create instance in provider: mock error")
+	require.Empty(t, stdout.String())
+}
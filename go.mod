@@ -3,6 +3,8 @@ module github.com/cloudbase/garm-provider-common
 go 1.20
 
 require (
+	github.com/BurntSushi/toml v1.3.2
+	github.com/Masterminds/semver/v3 v3.2.1
 	github.com/google/uuid v1.3.0
 	github.com/gorilla/handlers v1.5.1
 	github.com/mattn/go-isatty v0.0.19
@@ -0,0 +1,53 @@
+// Copyright 2023 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package params
+
+import (
+	"fmt"
+
+	gErrors "github.com/cloudbase/garm-provider-common/errors"
+)
+
+// CreateInstancesRequest is read from stdin by the CreateInstances command.
+type CreateInstancesRequest struct {
+	// BootstrapParams is the template used for every instance in the batch. The
+	// provider is responsible for giving each instance a unique name.
+	BootstrapParams BootstrapInstance `json:"bootstrap_params"`
+	// Count is the number of instances to create.
+	Count int `json:"count"`
+	// MinCount is the number of instances below which the batch is considered
+	// failed. If zero, all Count instances must be created.
+	MinCount int `json:"min_count,omitempty"`
+}
+
+// MinInstances returns the number of instances that must be created for the batch
+// to succeed.
+func (r CreateInstancesRequest) MinInstances() int {
+	if r.MinCount == 0 {
+		return r.Count
+	}
+	return r.MinCount
+}
+
+// Validate checks that the counts of the request are consistent.
+func (r CreateInstancesRequest) Validate() error {
+	if r.Count <= 0 {
+		return fmt.Errorf("count must be positive, got %d: %w", r.Count, gErrors.ErrBadRequest)
+	}
+	if r.MinCount < 0 || r.MinCount > r.Count {
+		return fmt.Errorf("min_count must be between 0 and count (%d), got %d: %w", r.Count, r.MinCount, gErrors.ErrBadRequest)
+	}
+	return nil
+}
@@ -0,0 +1,65 @@
+// Copyright 2023 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package params
+
+import (
+	"testing"
+
+	gErrors "github.com/cloudbase/garm-provider-common/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCreateInstancesRequest(t *testing.T) {
+	tests := []struct {
+		name         string
+		request      CreateInstancesRequest
+		minInstances int
+		errString    string
+	}{
+		{
+			name:         "min count defaults to count",
+			request:      CreateInstancesRequest{Count: 3},
+			minInstances: 3,
+		},
+		{
+			name:         "min count set",
+			request:      CreateInstancesRequest{Count: 3, MinCount: 1},
+			minInstances: 1,
+		},
+		{
+			name:      "zero count",
+			request:   CreateInstancesRequest{},
+			errString: "count must be positive, got 0: invalid request",
+		},
+		{
+			name:      "min count above count",
+			request:   CreateInstancesRequest{Count: 2, MinCount: 3},
+			errString: "min_count must be between 0 and count (2), got 3: invalid request",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.request.Validate()
+			if tc.errString != "" {
+				require.ErrorIs(t, err, gErrors.ErrBadRequest)
+				require.EqualError(t, err, tc.errString)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tc.minInstances, tc.request.MinInstances())
+		})
+	}
+}
@@ -0,0 +1,123 @@
+// Copyright 2023 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package params
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	gErrors "github.com/cloudbase/garm-provider-common/errors"
+)
+
+// BootstrapConstraint checks that a combination of bootstrap params is valid. It
+// returns an error wrapping errors.ErrBadRequest if it is not.
+type BootstrapConstraint func(b BootstrapInstance) error
+
+// DefaultBootstrapConstraints are the constraints checked by ValidateBootstrapConstraints
+// for all providers. They only cover the keys of the CommonExtraSpecsKey object, as
+// all other extra specs belong to the provider.
+var DefaultBootstrapConstraints = []BootstrapConstraint{
+	Requires(CommonExtraSpecsKey+".spot_max_price", CommonExtraSpecsKey+".spot"),
+	Requires(CommonExtraSpecsKey+".anti_affinity", CommonExtraSpecsKey+".affinity_group"),
+}
+
+// ValidateBootstrapConstraints checks the bootstrap params against the default
+// constraints, followed by any extra constraints the provider defines.
+func ValidateBootstrapConstraints(b BootstrapInstance, extra ...BootstrapConstraint) error {
+	constraints := make([]BootstrapConstraint, 0, len(DefaultBootstrapConstraints)+len(extra))
+	constraints = append(constraints, DefaultBootstrapConstraints...)
+	constraints = append(constraints, extra...)
+
+	for _, constraint := range constraints {
+		if err := constraint(b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// MutuallyExclusive returns a constraint that rejects extra specs which set both
+// keys. A key is considered set if it holds anything other than null, false, 0, an
+// empty string, an empty list or an empty object. Keys of nested objects are
+// addressed with dots, like "garm.spot".
+func MutuallyExclusive(first, second string) BootstrapConstraint {
+	return func(b BootstrapInstance) error {
+		firstSet, err := isSetExtraSpec(b.ExtraSpecs, first)
+		if err != nil {
+			return err
+		}
+		secondSet, err := isSetExtraSpec(b.ExtraSpecs, second)
+		if err != nil {
+			return err
+		}
+		if firstSet && secondSet {
+			return fmt.Errorf("%s and %s are mutually exclusive: %w", first, second, gErrors.ErrBadRequest)
+		}
+		return nil
+	}
+}
+
+// Requires returns a constraint that rejects extra specs which set key, but not
+// dependency. Keys are addressed like in MutuallyExclusive.
+func Requires(key, dependency string) BootstrapConstraint {
+	return func(b BootstrapInstance) error {
+		keySet, err := isSetExtraSpec(b.ExtraSpecs, key)
+		if err != nil {
+			return err
+		}
+		dependencySet, err := isSetExtraSpec(b.ExtraSpecs, dependency)
+		if err != nil {
+			return err
+		}
+		if keySet && !dependencySet {
+			return fmt.Errorf("%s requires %s: %w", key, dependency, gErrors.ErrBadRequest)
+		}
+		return nil
+	}
+}
+
+// isSetExtraSpec returns true if the extra specs set the key, which may address a
+// nested object with dots. A parent that is not an object leaves the key unset.
+func isSetExtraSpec(extraSpecs json.RawMessage, key string) (bool, error) {
+	if len(extraSpecs) == 0 {
+		return false, nil
+	}
+
+	var specs map[string]json.RawMessage
+	if err := json.Unmarshal(extraSpecs, &specs); err != nil {
+		return false, fmt.Errorf("failed to decode extra specs: %s: %w", err, gErrors.ErrBadRequest)
+	}
+	parts := strings.Split(key, ".")
+	for _, parent := range parts[:len(parts)-1] {
+		var nested map[string]json.RawMessage
+		if err := json.Unmarshal(specs[parent], &nested); err != nil {
+			return false, nil
+		}
+		specs = nested
+	}
+	return isSetJSONValue(specs[parts[len(parts)-1]]), nil
+}
+
+// isSetJSONValue returns true if value is present and not a zero value.
+func isSetJSONValue(value json.RawMessage) bool {
+	switch string(bytes.TrimSpace(value)) {
+	case "", "null", "false", "0", `""`, "[]", "{}":
+		return false
+	default:
+		return true
+	}
+}
@@ -0,0 +1,101 @@
+// Copyright 2023 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package params
+
+import (
+	"fmt"
+	"testing"
+
+	gErrors "github.com/cloudbase/garm-provider-common/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidateBootstrapConstraints(t *testing.T) {
+	tests := []struct {
+		name       string
+		extraSpecs string
+		errString  string
+	}{
+		{name: "no extra specs", extraSpecs: ""},
+		{name: "common extra specs", extraSpecs: `{"garm": {"spot": true, "spot_max_price": "0.5"}}`},
+		{name: "provider keys are not checked", extraSpecs: `{"spot": true, "on_demand": true, "spot_max_price": "0.5"}`},
+		{name: "zero values are unset", extraSpecs: `{"garm": {"spot": false, "spot_max_price": "", "anti_affinity": false}}`},
+		{name: "non object namespace", extraSpecs: `{"garm": "spot"}`},
+		{
+			name:       "spot max price without spot",
+			extraSpecs: `{"garm": {"spot_max_price": "0.5"}, "spot": true}`,
+			errString:  "garm.spot_max_price requires garm.spot: invalid request",
+		},
+		{
+			name:       "anti affinity without affinity group",
+			extraSpecs: `{"garm": {"anti_affinity": true}}`,
+			errString:  "garm.anti_affinity requires garm.affinity_group: invalid request",
+		},
+		{
+			name:       "invalid extra specs",
+			extraSpecs: `["spot"]`,
+			errString:  "failed to decode extra specs",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			b := BootstrapInstance{ExtraSpecs: []byte(tc.extraSpecs)}
+			err := ValidateBootstrapConstraints(b)
+			if tc.errString == "" {
+				require.NoError(t, err)
+				return
+			}
+			require.ErrorIs(t, err, gErrors.ErrBadRequest)
+			require.ErrorContains(t, err, tc.errString)
+		})
+	}
+}
+
+func TestValidateBootstrapConstraintsExtra(t *testing.T) {
+	windowsOnly := func(b BootstrapInstance) error {
+		if b.OSType != Windows {
+			return fmt.Errorf("only windows is supported: %w", gErrors.ErrBadRequest)
+		}
+		return nil
+	}
+
+	b := BootstrapInstance{
+		OSType:     Linux,
+		ExtraSpecs: []byte(`{"disk_type": "ssd", "disk_tier": "premium"}`),
+	}
+	err := ValidateBootstrapConstraints(b, MutuallyExclusive("disk_type", "disk_tier"), windowsOnly)
+	require.EqualError(t, err, "disk_type and disk_tier are mutually exclusive: invalid request")
+
+	b.ExtraSpecs = []byte(`{"disk_type": "ssd"}`)
+	err = ValidateBootstrapConstraints(b, MutuallyExclusive("disk_type", "disk_tier"), windowsOnly)
+	require.EqualError(t, err, "only windows is supported: invalid request")
+
+	b.OSType = Windows
+	require.NoError(t, ValidateBootstrapConstraints(b, windowsOnly))
+}
+
+func TestMutuallyExclusiveNestedKeys(t *testing.T) {
+	constraint := MutuallyExclusive("image.id", "image.family")
+
+	b := BootstrapInstance{ExtraSpecs: []byte(`{"image": {"id": "ami-123", "family": "ubuntu"}}`)}
+	require.EqualError(t, constraint(b), "image.id and image.family are mutually exclusive: invalid request")
+
+	b.ExtraSpecs = []byte(`{"image": {"id": "ami-123"}, "family": "ubuntu"}`)
+	require.NoError(t, constraint(b))
+
+	b.ExtraSpecs = []byte(`{"image": null}`)
+	require.NoError(t, constraint(b))
+}
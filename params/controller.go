@@ -0,0 +1,33 @@
+// Copyright 2023 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package params
+
+import (
+	"regexp"
+	"strings"
+)
+
+var rxUUID = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+
+// NormalizeControllerID trims and lowercases a controller ID that is shaped like a
+// UUID, so it can be compared with IDs stored by providers using an exact match.
+// Controller IDs that are not UUIDs are returned unchanged.
+func NormalizeControllerID(id string) string {
+	trimmed := strings.TrimSpace(id)
+	if !rxUUID.MatchString(trimmed) {
+		return id
+	}
+	return strings.ToLower(trimmed)
+}
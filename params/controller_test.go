@@ -0,0 +1,61 @@
+// Copyright 2023 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package params
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNormalizeControllerID(t *testing.T) {
+	tests := []struct {
+		name     string
+		id       string
+		expected string
+	}{
+		{
+			name:     "normalized uuid",
+			id:       "9c2e8f1a-4b7d-4e2a-8f3c-1d5e6a7b8c9d",
+			expected: "9c2e8f1a-4b7d-4e2a-8f3c-1d5e6a7b8c9d",
+		},
+		{
+			name:     "uppercase uuid",
+			id:       "9C2E8F1A-4B7D-4E2A-8F3C-1D5E6A7B8C9D",
+			expected: "9c2e8f1a-4b7d-4e2a-8f3c-1d5e6a7b8c9d",
+		},
+		{
+			name:     "uuid with whitespace",
+			id:       " 9C2E8F1A-4b7d-4e2a-8f3c-1d5e6a7b8c9d\n",
+			expected: "9c2e8f1a-4b7d-4e2a-8f3c-1d5e6a7b8c9d",
+		},
+		{
+			name:     "not a uuid",
+			id:       " My-Controller ",
+			expected: " My-Controller ",
+		},
+		{
+			name:     "empty",
+			id:       "",
+			expected: "",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			require.Equal(t, tc.expected, NormalizeControllerID(tc.id))
+		})
+	}
+}
@@ -0,0 +1,232 @@
+// Copyright 2023 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package params
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	gErrors "github.com/cloudbase/garm-provider-common/errors"
+)
+
+var (
+	rxEnvVarName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+	rxPrice      = regexp.MustCompile(`^[0-9]+(\.[0-9]+)?$`)
+)
+
+// CommonExtraSpecsKey is the extra specs key that holds the CommonExtraSpecs. All
+// the keys interpreted by this library live in this one object, so they never clash
+// with the keys providers define, like {"garm": {"ttl": "24h"}, "ttl": 3}.
+const CommonExtraSpecsKey = "garm"
+
+// CommonExtraSpecs holds the extra specs keys that are interpreted by this library,
+// instead of being passed opaquely to the provider. They are read from the
+// CommonExtraSpecsKey object of the extra specs. Providers are free to define their
+// own keys alongside it.
+type CommonExtraSpecs struct {
+	// ExtraEnv is a map of environment variables that will be set for the runner.
+	ExtraEnv map[string]string `json:"extra_env,omitempty"`
+	// TTL is the maximum lifetime of an instance, as a duration string (eg: 24h).
+	TTL string `json:"ttl,omitempty"`
+	// AffinityGroup is the placement group in which the instance should be created.
+	AffinityGroup string `json:"affinity_group,omitempty"`
+	// AntiAffinity spreads the instances of AffinityGroup across failure domains,
+	// instead of packing them together.
+	AntiAffinity bool `json:"anti_affinity,omitempty"`
+	// Disks are the data disks attached to the instance.
+	Disks []DiskSpec `json:"disks,omitempty"`
+	// Spot creates the instance as a spot (or preemptible) instance.
+	Spot bool `json:"spot,omitempty"`
+	// SpotMaxPrice is the maximum hourly price to pay for a spot instance.
+	SpotMaxPrice string `json:"spot_max_price,omitempty"`
+}
+
+// GetCommonExtraSpecs returns the common extra specs from the raw extra specs JSON.
+// Only the CommonExtraSpecsKey object is decoded, the other keys belong to the
+// provider.
+func GetCommonExtraSpecs(extraSpecs json.RawMessage) (CommonExtraSpecs, error) {
+	var specs CommonExtraSpecs
+	if len(extraSpecs) == 0 {
+		return specs, nil
+	}
+
+	var namespaced struct {
+		Common *CommonExtraSpecs `json:"garm"`
+	}
+	if err := json.Unmarshal(extraSpecs, &namespaced); err != nil {
+		return CommonExtraSpecs{}, fmt.Errorf("failed to unmarshal extra specs: %s: %w", err, gErrors.ErrBadRequest)
+	}
+	if namespaced.Common != nil {
+		specs = *namespaced.Common
+	}
+	return specs, nil
+}
+
+// ExtraSpecsMap decodes the raw extra specs (as found in GARM_POOL_EXTRASPECS)
+// into a generic map. Numbers that hold a whole value are returned as int64 and
+// all other numbers as float64, so large integers don't lose precision. Whole
+// numbers that don't fit in an int64 are returned as a json.Number.
+func ExtraSpecsMap(raw string) (map[string]interface{}, error) {
+	ret := map[string]interface{}{}
+	if strings.TrimSpace(raw) == "" {
+		return ret, nil
+	}
+
+	dec := json.NewDecoder(bytes.NewReader([]byte(raw)))
+	dec.UseNumber()
+	if err := dec.Decode(&ret); err != nil {
+		return nil, fmt.Errorf("failed to decode extra specs: %s: %w", err, gErrors.ErrBadRequest)
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return nil, fmt.Errorf("failed to decode extra specs: unexpected data after the JSON object: %w", gErrors.ErrBadRequest)
+	}
+	if ret == nil {
+		// The raw extra specs were a JSON null.
+		return map[string]interface{}{}, nil
+	}
+
+	for key, val := range ret {
+		ret[key] = coerceJSONNumbers(val)
+	}
+	return ret, nil
+}
+
+func coerceJSONNumbers(val interface{}) interface{} {
+	switch v := val.(type) {
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return i
+		}
+		if strings.ContainsAny(v.String(), ".eE") {
+			if f, err := v.Float64(); err == nil {
+				return f
+			}
+		}
+		return v
+	case map[string]interface{}:
+		for key, elem := range v {
+			v[key] = coerceJSONNumbers(elem)
+		}
+	case []interface{}:
+		for idx, elem := range v {
+			v[idx] = coerceJSONNumbers(elem)
+		}
+	}
+	return val
+}
+
+// ApplyCommonExtraSpecs copies the common extra specs onto the bootstrap params.
+// Values set in extra specs take precedence over the ones already set.
+func (b *BootstrapInstance) ApplyCommonExtraSpecs() error {
+	specs, err := GetCommonExtraSpecs(b.ExtraSpecs)
+	if err != nil {
+		return err
+	}
+
+	if specs.ExtraEnv != nil {
+		b.ExtraEnv = specs.ExtraEnv
+	}
+
+	if specs.TTL != "" {
+		ttl, err := time.ParseDuration(specs.TTL)
+		if err != nil {
+			return fmt.Errorf("invalid ttl %q: %w", specs.TTL, gErrors.ErrBadRequest)
+		}
+		b.TTL = ttl
+	}
+
+	if specs.AffinityGroup != "" {
+		b.AffinityGroup = specs.AffinityGroup
+	}
+	if specs.AntiAffinity {
+		b.AntiAffinity = true
+	}
+
+	if specs.Disks != nil {
+		b.Disks = specs.Disks
+	}
+
+	if specs.Spot {
+		b.Spot = true
+	}
+	if specs.SpotMaxPrice != "" {
+		b.SpotMaxPrice = specs.SpotMaxPrice
+	}
+	return nil
+}
+
+// Validate checks the bootstrap params for values that would prevent a runner
+// from being set up correctly.
+func (b BootstrapInstance) Validate() error {
+	for name := range b.ExtraEnv {
+		if !rxEnvVarName.MatchString(name) {
+			return fmt.Errorf("invalid environment variable name %q in extra_env: %w", name, gErrors.ErrBadRequest)
+		}
+	}
+
+	if b.TTL < 0 {
+		return fmt.Errorf("ttl must not be negative, got %s: %w", b.TTL, gErrors.ErrBadRequest)
+	}
+
+	if b.AntiAffinity && b.AffinityGroup == "" {
+		return fmt.Errorf("anti_affinity requires an affinity_group: %w", gErrors.ErrBadRequest)
+	}
+
+	for idx, disk := range b.Disks {
+		if disk.SizeGB <= 0 {
+			return fmt.Errorf("disk at index %d must have a positive size, got %d: %w", idx, disk.SizeGB, gErrors.ErrBadRequest)
+		}
+		if disk.Type != "" && !disk.Type.IsValid() {
+			return fmt.Errorf("disk at index %d has an unknown type %q: %w", idx, disk.Type, gErrors.ErrBadRequest)
+		}
+	}
+
+	if b.SpotMaxPrice != "" {
+		if !b.Spot {
+			return fmt.Errorf("spot_max_price requires spot to be enabled: %w", gErrors.ErrBadRequest)
+		}
+		if !rxPrice.MatchString(b.SpotMaxPrice) || strings.Trim(b.SpotMaxPrice, "0.") == "" {
+			return fmt.Errorf("invalid spot_max_price %q, must be a positive decimal number: %w", b.SpotMaxPrice, gErrors.ErrBadRequest)
+		}
+	}
+
+	for idx, key := range b.SSHKeys {
+		if err := ValidateSSHPublicKey(key); err != nil {
+			return fmt.Errorf("invalid ssh key at index %d: %w", idx, err)
+		}
+	}
+	return nil
+}
+
+// RunnerEnv returns the extra environment variables for the runner in KEY=value
+// form, sorted by name.
+func (b BootstrapInstance) RunnerEnv() []string {
+	if len(b.ExtraEnv) == 0 {
+		return nil
+	}
+
+	ret := make([]string, 0, len(b.ExtraEnv))
+	for name, value := range b.ExtraEnv {
+		ret = append(ret, fmt.Sprintf("%s=%s", name, value))
+	}
+	sort.Strings(ret)
+	return ret
+}
@@ -0,0 +1,252 @@
+// Copyright 2023 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package params
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	gErrors "github.com/cloudbase/garm-provider-common/errors"
+)
+
+// fieldSchema is the subset of JSON Schema used to validate individual extra specs
+// fields.
+type fieldSchema struct {
+	Type                 interface{}             `json:"type,omitempty"`
+	Enum                 []interface{}           `json:"enum,omitempty"`
+	Minimum              *float64                `json:"minimum,omitempty"`
+	Maximum              *float64                `json:"maximum,omitempty"`
+	MinLength            *int                    `json:"minLength,omitempty"`
+	MaxLength            *int                    `json:"maxLength,omitempty"`
+	Pattern              string                  `json:"pattern,omitempty"`
+	Properties           map[string]*fieldSchema `json:"properties,omitempty"`
+	Required             []string                `json:"required,omitempty"`
+	AdditionalProperties json.RawMessage         `json:"additionalProperties,omitempty"`
+	Items                *fieldSchema            `json:"items,omitempty"`
+}
+
+// ValidateExtraSpecField validates the value found at keyPath in the raw extra specs
+// against the part of schema that describes it. keyPath is a JSON Pointer (RFC 6901),
+// like /extra_env/FOO or /disks/0/size. This allows validating a single field, without
+// the rest of the extra specs needing to be valid. Only a subset of JSON Schema is
+// supported: type, enum, minimum, maximum, minLength, maxLength, pattern, properties,
+// required, additionalProperties and items.
+func ValidateExtraSpecField(raw json.RawMessage, keyPath string, schema []byte) error {
+	var root fieldSchema
+	if err := json.Unmarshal(schema, &root); err != nil {
+		return fmt.Errorf("failed to decode schema: %w", err)
+	}
+
+	tokens, err := parseJSONPointer(keyPath)
+	if err != nil {
+		return fmt.Errorf("%s: %w", err, gErrors.ErrBadRequest)
+	}
+
+	var doc interface{}
+	if err := json.Unmarshal(raw, &doc); err != nil {
+		return fmt.Errorf("failed to decode extra specs: %s: %w", err, gErrors.ErrBadRequest)
+	}
+
+	value, err := getValue(doc, tokens)
+	if err != nil {
+		return fmt.Errorf("invalid extra specs path %q: %s: %w", keyPath, err, gErrors.ErrBadRequest)
+	}
+
+	current := &root
+	for _, token := range tokens {
+		current, err = current.child(token)
+		if err != nil {
+			return fmt.Errorf("invalid extra specs path %q: %s: %w", keyPath, err, gErrors.ErrBadRequest)
+		}
+		if current == nil {
+			// The schema does not constrain this part of the extra specs.
+			return nil
+		}
+	}
+
+	path := keyPath
+	if path == "" {
+		path = "/"
+	}
+	if err := current.validate(value, strings.TrimSuffix(path, "/")); err != nil {
+		return fmt.Errorf("invalid extra spec: %s: %w", err, gErrors.ErrBadRequest)
+	}
+	return nil
+}
+
+// child returns the schema of the given key or array index. A nil schema means that
+// any value is allowed.
+func (s *fieldSchema) child(token string) (*fieldSchema, error) {
+	if s.Items != nil {
+		return s.Items, nil
+	}
+	if prop, ok := s.Properties[token]; ok {
+		return prop, nil
+	}
+
+	additional := strings.TrimSpace(string(s.AdditionalProperties))
+	switch {
+	case additional == "" || additional == "true":
+		return nil, nil
+	case additional == "false":
+		return nil, fmt.Errorf("unknown key %q", token)
+	}
+
+	var ret fieldSchema
+	if err := json.Unmarshal(s.AdditionalProperties, &ret); err != nil {
+		return nil, fmt.Errorf("invalid additionalProperties in schema: %w", err)
+	}
+	return &ret, nil
+}
+
+// types returns the JSON types allowed by the schema.
+func (s *fieldSchema) types() []string {
+	switch t := s.Type.(type) {
+	case string:
+		return []string{t}
+	case []interface{}:
+		ret := make([]string, 0, len(t))
+		for _, val := range t {
+			if name, ok := val.(string); ok {
+				ret = append(ret, name)
+			}
+		}
+		return ret
+	default:
+		return nil
+	}
+}
+
+// jsonTypeMatches returns whether value is of the JSON type typ.
+func jsonTypeMatches(value interface{}, typ string) bool {
+	switch v := value.(type) {
+	case nil:
+		return typ == "null"
+	case bool:
+		return typ == "boolean"
+	case float64:
+		if typ == "integer" {
+			return v == float64(int64(v))
+		}
+		return typ == "number"
+	case string:
+		return typ == "string"
+	case []interface{}:
+		return typ == "array"
+	case map[string]interface{}:
+		return typ == "object"
+	default:
+		return false
+	}
+}
+
+// validate checks value against the schema. path is used in error messages.
+func (s *fieldSchema) validate(value interface{}, path string) error {
+	if types := s.types(); len(types) > 0 {
+		var matched bool
+		for _, typ := range types {
+			if jsonTypeMatches(value, typ) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return fmt.Errorf("%s: expected %s", path, strings.Join(types, " or "))
+		}
+	}
+
+	if len(s.Enum) > 0 {
+		var matched bool
+		for _, allowed := range s.Enum {
+			if reflect.DeepEqual(allowed, value) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return fmt.Errorf("%s: value is not one of the allowed values", path)
+		}
+	}
+
+	switch v := value.(type) {
+	case float64:
+		if s.Minimum != nil && v < *s.Minimum {
+			return fmt.Errorf("%s: value must be at least %v", path, *s.Minimum)
+		}
+		if s.Maximum != nil && v > *s.Maximum {
+			return fmt.Errorf("%s: value must be at most %v", path, *s.Maximum)
+		}
+	case string:
+		length := utf8.RuneCountInString(v)
+		if s.MinLength != nil && length < *s.MinLength {
+			return fmt.Errorf("%s: value must be at least %d characters long", path, *s.MinLength)
+		}
+		if s.MaxLength != nil && length > *s.MaxLength {
+			return fmt.Errorf("%s: value must be at most %d characters long", path, *s.MaxLength)
+		}
+		if s.Pattern != "" {
+			rx, err := regexp.Compile(s.Pattern)
+			if err != nil {
+				return fmt.Errorf("%s: invalid pattern in schema: %w", path, err)
+			}
+			if !rx.MatchString(v) {
+				return fmt.Errorf("%s: value does not match pattern %q", path, s.Pattern)
+			}
+		}
+	case []interface{}:
+		for idx, item := range v {
+			child, err := s.child(fmt.Sprintf("%d", idx))
+			if err != nil {
+				return fmt.Errorf("%s: %w", path, err)
+			}
+			if child == nil {
+				continue
+			}
+			if err := child.validate(item, fmt.Sprintf("%s/%d", path, idx)); err != nil {
+				return err
+			}
+		}
+	case map[string]interface{}:
+		for _, key := range s.Required {
+			if _, ok := v[key]; !ok {
+				return fmt.Errorf("%s: missing required key %q", path, key)
+			}
+		}
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			child, err := s.child(key)
+			if err != nil {
+				return fmt.Errorf("%s: %w", path, err)
+			}
+			if child == nil {
+				continue
+			}
+			escaped := strings.ReplaceAll(strings.ReplaceAll(key, "~", "~0"), "/", "~1")
+			if err := child.validate(v[key], path+"/"+escaped); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
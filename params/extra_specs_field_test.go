@@ -0,0 +1,114 @@
+// Copyright 2023 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package params
+
+import (
+	"testing"
+
+	gErrors "github.com/cloudbase/garm-provider-common/errors"
+	"github.com/stretchr/testify/require"
+)
+
+var testExtraSpecsSchema = []byte(`{
+	"type": "object",
+	"properties": {
+		"flavor": {"type": "string", "enum": ["small", "large"]},
+		"disk_size": {"type": "integer", "minimum": 10, "maximum": 500},
+		"image": {"type": "string", "minLength": 3, "pattern": "^[a-z0-9-]+$"},
+		"extra_env": {"type": "object", "additionalProperties": {"type": "string"}},
+		"disks": {
+			"type": "array",
+			"items": {"type": "object", "required": ["size"], "properties": {"size": {"type": "integer", "minimum": 1}}}
+		},
+		"network": {"type": "object", "additionalProperties": false, "properties": {"id": {"type": "string"}}}
+	}
+}`)
+
+func TestValidateExtraSpecField(t *testing.T) {
+	extraSpecs := []byte(`{
+		"flavor": "small",
+		"disk_size": 40,
+		"image": "ubuntu-22-04",
+		"extra_env": {"FOO": "bar", "NUM": 1},
+		"disks": [{"size": 10}, {"size": 0}, {}],
+		"network": {"id": "net", "subnet": "sub"},
+		"provider_key": {"anything": true}
+	}`)
+
+	tests := []struct {
+		name    string
+		keyPath string
+		errMsg  string
+	}{
+		{name: "valid enum", keyPath: "/flavor"},
+		{name: "valid integer", keyPath: "/disk_size"},
+		{name: "valid pattern", keyPath: "/image"},
+		{name: "valid additional property", keyPath: "/extra_env/FOO"},
+		{name: "valid array item", keyPath: "/disks/0"},
+		{name: "valid nested field", keyPath: "/disks/0/size"},
+		{name: "unconstrained field", keyPath: "/provider_key/anything"},
+		{name: "invalid additional property", keyPath: "/extra_env/NUM", errMsg: "/extra_env/NUM: expected string"},
+		{name: "invalid object", keyPath: "/extra_env", errMsg: "/extra_env/NUM: expected string"},
+		{name: "value below minimum", keyPath: "/disks/1/size", errMsg: "/disks/1/size: value must be at least 1"},
+		{name: "missing required key", keyPath: "/disks/2", errMsg: "/disks/2: missing required key \"size\""},
+		{name: "unknown key", keyPath: "/network/subnet", errMsg: "unknown key \"subnet\""},
+		{name: "missing value", keyPath: "/missing", errMsg: "key \"missing\" not found"},
+		{name: "invalid pointer", keyPath: "flavor", errMsg: "invalid JSON pointer"},
+		{name: "invalid root", keyPath: "", errMsg: "/disks/1/size: value must be at least 1"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			err := ValidateExtraSpecField(extraSpecs, tc.keyPath, testExtraSpecsSchema)
+			if tc.errMsg == "" {
+				require.NoError(t, err)
+				return
+			}
+			require.ErrorIs(t, err, gErrors.ErrBadRequest)
+			require.ErrorContains(t, err, tc.errMsg)
+		})
+	}
+}
+
+func TestValidateExtraSpecFieldValues(t *testing.T) {
+	tests := []struct {
+		name       string
+		extraSpecs string
+		keyPath    string
+		errMsg     string
+	}{
+		{name: "not in enum", extraSpecs: `{"flavor": "medium"}`, keyPath: "/flavor", errMsg: "/flavor: value is not one of the allowed values"},
+		{name: "wrong type", extraSpecs: `{"disk_size": "40"}`, keyPath: "/disk_size", errMsg: "/disk_size: expected integer"},
+		{name: "not an integer", extraSpecs: `{"disk_size": 40.5}`, keyPath: "/disk_size", errMsg: "/disk_size: expected integer"},
+		{name: "above maximum", extraSpecs: `{"disk_size": 501}`, keyPath: "/disk_size", errMsg: "/disk_size: value must be at most 500"},
+		{name: "too short", extraSpecs: `{"image": "ub"}`, keyPath: "/image", errMsg: "/image: value must be at least 3 characters long"},
+		{name: "pattern mismatch", extraSpecs: `{"image": "Ubuntu 22.04"}`, keyPath: "/image", errMsg: "/image: value does not match pattern"},
+		{name: "invalid extra specs", extraSpecs: `{"image": `, keyPath: "/image", errMsg: "failed to decode extra specs"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			err := ValidateExtraSpecField([]byte(tc.extraSpecs), tc.keyPath, testExtraSpecsSchema)
+			require.ErrorIs(t, err, gErrors.ErrBadRequest)
+			require.ErrorContains(t, err, tc.errMsg)
+		})
+	}
+}
+
+func TestValidateExtraSpecFieldInvalidSchema(t *testing.T) {
+	err := ValidateExtraSpecField([]byte(`{"flavor": "small"}`), "/flavor", []byte(`not json`))
+	require.ErrorContains(t, err, "failed to decode schema")
+	require.NotErrorIs(t, err, gErrors.ErrBadRequest)
+}
@@ -0,0 +1,348 @@
+// Copyright 2023 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package params
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+
+	gErrors "github.com/cloudbase/garm-provider-common/errors"
+)
+
+// jsonPatchOperation is a single operation of a JSON Patch (RFC 6902).
+type jsonPatchOperation struct {
+	Op    string          `json:"op"`
+	Path  string          `json:"path"`
+	From  string          `json:"from,omitempty"`
+	Value json.RawMessage `json:"value,omitempty"`
+}
+
+// ApplyExtraSpecsPatch applies extra specs on top of a set of provider defaults. If
+// patch is a JSON object, it is merged into defaults following the semantics of a
+// JSON Merge Patch (RFC 7386): nested objects are merged and null values remove keys.
+// If patch is a JSON array, it is applied as a JSON Patch (RFC 6902), which allows
+// surgical changes, like removing a single element from a list. The result must be a
+// JSON object.
+func ApplyExtraSpecsPatch(defaults json.RawMessage, patch json.RawMessage) (json.RawMessage, error) {
+	var doc interface{} = map[string]interface{}{}
+	if len(bytes.TrimSpace(defaults)) > 0 {
+		if err := json.Unmarshal(defaults, &doc); err != nil {
+			return nil, fmt.Errorf("failed to decode extra specs defaults: %s: %w", err, gErrors.ErrBadRequest)
+		}
+	}
+
+	trimmed := bytes.TrimSpace(patch)
+	switch {
+	case len(trimmed) == 0 || bytes.Equal(trimmed, []byte("null")):
+	case trimmed[0] == '{':
+		var mergePatch interface{}
+		if err := json.Unmarshal(trimmed, &mergePatch); err != nil {
+			return nil, fmt.Errorf("failed to decode extra specs: %s: %w", err, gErrors.ErrBadRequest)
+		}
+		doc = applyMergePatch(doc, mergePatch)
+	case trimmed[0] == '[':
+		var ops []jsonPatchOperation
+		if err := json.Unmarshal(trimmed, &ops); err != nil {
+			return nil, fmt.Errorf("failed to decode extra specs patch: %s: %w", err, gErrors.ErrBadRequest)
+		}
+		for idx, op := range ops {
+			var err error
+			doc, err = op.apply(doc)
+			if err != nil {
+				return nil, fmt.Errorf("invalid extra specs patch: operation %d (%s %s): %s: %w", idx, op.Op, op.Path, err, gErrors.ErrBadRequest)
+			}
+		}
+	default:
+		return nil, fmt.Errorf("extra specs must be a JSON object or a JSON patch array: %w", gErrors.ErrBadRequest)
+	}
+
+	if _, ok := doc.(map[string]interface{}); !ok {
+		return nil, fmt.Errorf("patched extra specs must be a JSON object: %w", gErrors.ErrBadRequest)
+	}
+
+	ret, err := json.Marshal(doc)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode extra specs: %w", err)
+	}
+	return ret, nil
+}
+
+// applyMergePatch applies a JSON Merge Patch (RFC 7386) to doc.
+func applyMergePatch(doc, patch interface{}) interface{} {
+	patchObj, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+
+	docObj, ok := doc.(map[string]interface{})
+	if !ok {
+		docObj = map[string]interface{}{}
+	}
+	for key, value := range patchObj {
+		if value == nil {
+			delete(docObj, key)
+			continue
+		}
+		docObj[key] = applyMergePatch(docObj[key], value)
+	}
+	return docObj
+}
+
+// parseJSONPointer splits a JSON Pointer (RFC 6901) into its unescaped tokens.
+func parseJSONPointer(pointer string) ([]string, error) {
+	if pointer == "" {
+		return nil, nil
+	}
+	if !strings.HasPrefix(pointer, "/") {
+		return nil, fmt.Errorf("invalid JSON pointer %q", pointer)
+	}
+
+	tokens := strings.Split(pointer[1:], "/")
+	for idx, token := range tokens {
+		tokens[idx] = strings.ReplaceAll(strings.ReplaceAll(token, "~1", "/"), "~0", "~")
+	}
+	return tokens, nil
+}
+
+// arrayIndex parses an array index token. If allowEnd is set, the index may point
+// just past the last element, which "-" refers to.
+func arrayIndex(token string, length int, allowEnd bool) (int, error) {
+	if token == "-" && allowEnd {
+		return length, nil
+	}
+
+	idx, err := strconv.Atoi(token)
+	if err != nil || idx < 0 || (token != "0" && strings.HasPrefix(token, "0")) {
+		return 0, fmt.Errorf("invalid array index %q", token)
+	}
+	if idx > length || (idx == length && !allowEnd) {
+		return 0, fmt.Errorf("array index %d out of range", idx)
+	}
+	return idx, nil
+}
+
+// getValue returns the value at the location tokens point to.
+func getValue(doc interface{}, tokens []string) (interface{}, error) {
+	for _, token := range tokens {
+		switch node := doc.(type) {
+		case map[string]interface{}:
+			value, ok := node[token]
+			if !ok {
+				return nil, fmt.Errorf("key %q not found", token)
+			}
+			doc = value
+		case []interface{}:
+			idx, err := arrayIndex(token, len(node), false)
+			if err != nil {
+				return nil, err
+			}
+			doc = node[idx]
+		default:
+			return nil, fmt.Errorf("cannot traverse into a scalar value")
+		}
+	}
+	return doc, nil
+}
+
+// modifyValue calls fn on the parent of the location tokens point to, and returns
+// the updated document.
+func modifyValue(doc interface{}, tokens []string, fn func(parent interface{}, key string) (interface{}, error)) (interface{}, error) {
+	if len(tokens) == 1 {
+		return fn(doc, tokens[0])
+	}
+
+	switch node := doc.(type) {
+	case map[string]interface{}:
+		child, ok := node[tokens[0]]
+		if !ok {
+			return nil, fmt.Errorf("key %q not found", tokens[0])
+		}
+		updated, err := modifyValue(child, tokens[1:], fn)
+		if err != nil {
+			return nil, err
+		}
+		node[tokens[0]] = updated
+		return node, nil
+	case []interface{}:
+		idx, err := arrayIndex(tokens[0], len(node), false)
+		if err != nil {
+			return nil, err
+		}
+		updated, err := modifyValue(node[idx], tokens[1:], fn)
+		if err != nil {
+			return nil, err
+		}
+		node[idx] = updated
+		return node, nil
+	default:
+		return nil, fmt.Errorf("cannot traverse into a scalar value")
+	}
+}
+
+func addValue(doc interface{}, tokens []string, value interface{}) (interface{}, error) {
+	if len(tokens) == 0 {
+		return value, nil
+	}
+	return modifyValue(doc, tokens, func(parent interface{}, key string) (interface{}, error) {
+		switch node := parent.(type) {
+		case map[string]interface{}:
+			node[key] = value
+			return node, nil
+		case []interface{}:
+			idx, err := arrayIndex(key, len(node), true)
+			if err != nil {
+				return nil, err
+			}
+			node = append(node, nil)
+			copy(node[idx+1:], node[idx:])
+			node[idx] = value
+			return node, nil
+		default:
+			return nil, fmt.Errorf("cannot add a value to a scalar value")
+		}
+	})
+}
+
+func removeValue(doc interface{}, tokens []string) (interface{}, error) {
+	if len(tokens) == 0 {
+		return nil, fmt.Errorf("cannot remove the root of the document")
+	}
+	return modifyValue(doc, tokens, func(parent interface{}, key string) (interface{}, error) {
+		switch node := parent.(type) {
+		case map[string]interface{}:
+			if _, ok := node[key]; !ok {
+				return nil, fmt.Errorf("key %q not found", key)
+			}
+			delete(node, key)
+			return node, nil
+		case []interface{}:
+			idx, err := arrayIndex(key, len(node), false)
+			if err != nil {
+				return nil, err
+			}
+			return append(node[:idx], node[idx+1:]...), nil
+		default:
+			return nil, fmt.Errorf("cannot remove a value from a scalar value")
+		}
+	})
+}
+
+// deepCopy returns a copy of a decoded JSON value that shares no state with it.
+func deepCopy(value interface{}) interface{} {
+	switch node := value.(type) {
+	case map[string]interface{}:
+		ret := make(map[string]interface{}, len(node))
+		for key, child := range node {
+			ret[key] = deepCopy(child)
+		}
+		return ret
+	case []interface{}:
+		ret := make([]interface{}, len(node))
+		for idx, child := range node {
+			ret[idx] = deepCopy(child)
+		}
+		return ret
+	default:
+		return value
+	}
+}
+
+func (o jsonPatchOperation) value() (interface{}, error) {
+	if len(o.Value) == 0 {
+		return nil, fmt.Errorf("missing value")
+	}
+	var value interface{}
+	if err := json.Unmarshal(o.Value, &value); err != nil {
+		return nil, fmt.Errorf("invalid value: %w", err)
+	}
+	return value, nil
+}
+
+// apply applies the operation to doc and returns the updated document.
+func (o jsonPatchOperation) apply(doc interface{}) (interface{}, error) {
+	path, err := parseJSONPointer(o.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	switch o.Op {
+	case "add":
+		value, err := o.value()
+		if err != nil {
+			return nil, err
+		}
+		return addValue(doc, path, value)
+	case "remove":
+		return removeValue(doc, path)
+	case "replace":
+		value, err := o.value()
+		if err != nil {
+			return nil, err
+		}
+		if _, err := getValue(doc, path); err != nil {
+			return nil, err
+		}
+		if len(path) == 0 {
+			return value, nil
+		}
+		doc, err = removeValue(doc, path)
+		if err != nil {
+			return nil, err
+		}
+		return addValue(doc, path, value)
+	case "move", "copy":
+		from, err := parseJSONPointer(o.From)
+		if err != nil {
+			return nil, err
+		}
+		value, err := getValue(doc, from)
+		if err != nil {
+			return nil, err
+		}
+		if o.Op == "copy" {
+			return addValue(doc, path, deepCopy(value))
+		}
+		if o.Path == o.From {
+			return doc, nil
+		}
+		if strings.HasPrefix(o.Path, o.From+"/") {
+			return nil, fmt.Errorf("cannot move a value into one of its children")
+		}
+		doc, err = removeValue(doc, from)
+		if err != nil {
+			return nil, err
+		}
+		return addValue(doc, path, value)
+	case "test":
+		expected, err := o.value()
+		if err != nil {
+			return nil, err
+		}
+		value, err := getValue(doc, path)
+		if err != nil {
+			return nil, err
+		}
+		if !reflect.DeepEqual(expected, value) {
+			return nil, fmt.Errorf("test failed")
+		}
+		return doc, nil
+	default:
+		return nil, fmt.Errorf("unknown operation %q", o.Op)
+	}
+}
@@ -0,0 +1,141 @@
+// Copyright 2023 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package params
+
+import (
+	"encoding/json"
+	"testing"
+
+	gErrors "github.com/cloudbase/garm-provider-common/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func TestApplyExtraSpecsPatch(t *testing.T) {
+	defaults := json.RawMessage(`{"disk_size": 50, "network": {"subnet": "default", "public_ip": true}, "tags": ["garm", "ci"]}`)
+
+	tests := []struct {
+		name      string
+		defaults  json.RawMessage
+		patch     json.RawMessage
+		expected  string
+		errString string
+	}{
+		{
+			name:     "empty patch",
+			defaults: defaults,
+			patch:    nil,
+			expected: string(defaults),
+		},
+		{
+			name:     "no defaults",
+			defaults: nil,
+			patch:    json.RawMessage(`{"disk_size": 100}`),
+			expected: `{"disk_size": 100}`,
+		},
+		{
+			name:     "merge object",
+			defaults: defaults,
+			patch:    json.RawMessage(`{"disk_size": 100, "network": {"public_ip": false}, "tags": null}`),
+			expected: `{"disk_size": 100, "network": {"subnet": "default", "public_ip": false}}`,
+		},
+		{
+			name:     "json patch",
+			defaults: defaults,
+			patch: json.RawMessage(`[
+				{"op": "test", "path": "/disk_size", "value": 50},
+				{"op": "replace", "path": "/disk_size", "value": 100},
+				{"op": "remove", "path": "/tags/1"},
+				{"op": "add", "path": "/tags/-", "value": "gpu"},
+				{"op": "add", "path": "/tags/0", "value": "first"},
+				{"op": "copy", "from": "/network/subnet", "path": "/subnet"},
+				{"op": "move", "from": "/network/public_ip", "path": "/public_ip"}
+			]`),
+			expected: `{"disk_size": 100, "network": {"subnet": "default"}, "tags": ["first", "garm", "gpu"], "subnet": "default", "public_ip": true}`,
+		},
+		{
+			name:     "escaped pointer",
+			defaults: json.RawMessage(`{"a/b": {"c~d": 1}}`),
+			patch:    json.RawMessage(`[{"op": "replace", "path": "/a~1b/c~0d", "value": 2}]`),
+			expected: `{"a/b": {"c~d": 2}}`,
+		},
+		{
+			name:      "failed test operation",
+			defaults:  defaults,
+			patch:     json.RawMessage(`[{"op": "test", "path": "/disk_size", "value": 10}]`),
+			errString: "invalid extra specs patch: operation 0 (test /disk_size): test failed",
+		},
+		{
+			name:      "remove missing key",
+			defaults:  defaults,
+			patch:     json.RawMessage(`[{"op": "remove", "path": "/bogus"}]`),
+			errString: `invalid extra specs patch: operation 0 (remove /bogus): key "bogus" not found`,
+		},
+		{
+			name:      "missing value",
+			defaults:  defaults,
+			patch:     json.RawMessage(`[{"op": "add", "path": "/bogus"}]`),
+			errString: "invalid extra specs patch: operation 0 (add /bogus): missing value",
+		},
+		{
+			name:      "unknown operation",
+			defaults:  defaults,
+			patch:     json.RawMessage(`[{"op": "bogus", "path": "/disk_size"}]`),
+			errString: `invalid extra specs patch: operation 0 (bogus /disk_size): unknown operation "bogus"`,
+		},
+		{
+			name:      "index out of range",
+			defaults:  defaults,
+			patch:     json.RawMessage(`[{"op": "add", "path": "/tags/5", "value": "x"}]`),
+			errString: "array index 5 out of range",
+		},
+		{
+			name:      "invalid pointer",
+			defaults:  defaults,
+			patch:     json.RawMessage(`[{"op": "remove", "path": "tags"}]`),
+			errString: `invalid JSON pointer "tags"`,
+		},
+		{
+			name:      "result is not an object",
+			defaults:  defaults,
+			patch:     json.RawMessage(`[{"op": "replace", "path": "", "value": [1]}]`),
+			errString: "patched extra specs must be a JSON object",
+		},
+		{
+			name:      "scalar patch",
+			defaults:  defaults,
+			patch:     json.RawMessage(`"bogus"`),
+			errString: "extra specs must be a JSON object or a JSON patch array",
+		},
+		{
+			name:      "malformed patch",
+			defaults:  defaults,
+			patch:     json.RawMessage(`[{"op": 1}]`),
+			errString: "failed to decode extra specs patch",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			ret, err := ApplyExtraSpecsPatch(tc.defaults, tc.patch)
+			if tc.errString != "" {
+				require.ErrorIs(t, err, gErrors.ErrBadRequest)
+				require.ErrorContains(t, err, tc.errString)
+				return
+			}
+			require.NoError(t, err)
+			require.JSONEq(t, tc.expected, string(ret))
+		})
+	}
+}
@@ -0,0 +1,357 @@
+// Copyright 2023 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package params
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	gErrors "github.com/cloudbase/garm-provider-common/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func TestApplyCommonExtraSpecs(t *testing.T) {
+	b := BootstrapInstance{
+		ExtraSpecs: []byte(`{"garm": {"extra_env": {"HTTP_PROXY": "http://proxy:3128", "REGISTRY": "registry.example.com"}}, "provider_key": 1}`),
+	}
+
+	err := b.ApplyCommonExtraSpecs()
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{
+		"HTTP_PROXY": "http://proxy:3128",
+		"REGISTRY":   "registry.example.com",
+	}, b.ExtraEnv)
+	require.Equal(t, []string{"HTTP_PROXY=http://proxy:3128", "REGISTRY=registry.example.com"}, b.RunnerEnv())
+}
+
+func TestApplyCommonExtraSpecsEmpty(t *testing.T) {
+	b := BootstrapInstance{}
+
+	err := b.ApplyCommonExtraSpecs()
+	require.NoError(t, err)
+	require.Nil(t, b.ExtraEnv)
+	require.Nil(t, b.RunnerEnv())
+}
+
+func TestApplyCommonExtraSpecsInvalid(t *testing.T) {
+	b := BootstrapInstance{
+		ExtraSpecs: []byte(`{"garm": {"extra_env": ["HTTP_PROXY"]}}`),
+	}
+
+	err := b.ApplyCommonExtraSpecs()
+	require.ErrorIs(t, err, gErrors.ErrBadRequest)
+}
+
+func TestApplyCommonExtraSpecsIgnoresProviderKeys(t *testing.T) {
+	b := BootstrapInstance{
+		ExtraSpecs: []byte(`{"ttl": 24, "disks": "ssd", "spot": "yes", "extra_env": ["FOO"], "garm": {"ttl": "1h"}}`),
+	}
+
+	err := b.ApplyCommonExtraSpecs()
+	require.NoError(t, err)
+	require.Equal(t, time.Hour, b.TTL)
+	require.Nil(t, b.Disks)
+	require.False(t, b.Spot)
+	require.Nil(t, b.ExtraEnv)
+}
+
+func TestValidateExtraEnv(t *testing.T) {
+	tests := []struct {
+		name      string
+		extraEnv  map[string]string
+		errString string
+	}{
+		{
+			name:     "valid names",
+			extraEnv: map[string]string{"HTTP_PROXY": "", "_private": "", "VAR1": ""},
+		},
+		{
+			name:      "name starts with a digit",
+			extraEnv:  map[string]string{"1VAR": ""},
+			errString: `invalid environment variable name "1VAR" in extra_env`,
+		},
+		{
+			name:      "name contains an equal sign",
+			extraEnv:  map[string]string{"VAR=1": ""},
+			errString: `invalid environment variable name "VAR=1" in extra_env`,
+		},
+		{
+			name:      "empty name",
+			extraEnv:  map[string]string{"": ""},
+			errString: `invalid environment variable name "" in extra_env`,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			err := BootstrapInstance{ExtraEnv: tc.extraEnv}.Validate()
+			if tc.errString == "" {
+				require.NoError(t, err)
+			} else {
+				require.ErrorIs(t, err, gErrors.ErrBadRequest)
+				require.ErrorContains(t, err, tc.errString)
+			}
+		})
+	}
+}
+
+func TestApplyCommonExtraSpecsTTL(t *testing.T) {
+	tests := []struct {
+		name      string
+		specs     string
+		expected  time.Duration
+		errString string
+	}{
+		{
+			name:     "ttl set",
+			specs:    `{"garm": {"ttl": "24h"}}`,
+			expected: 24 * time.Hour,
+		},
+		{
+			name:     "ttl not set",
+			specs:    `{}`,
+			expected: 0,
+		},
+		{
+			name:      "invalid ttl",
+			specs:     `{"garm": {"ttl": "one day"}}`,
+			errString: `invalid ttl "one day"`,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			b := BootstrapInstance{ExtraSpecs: []byte(tc.specs)}
+			err := b.ApplyCommonExtraSpecs()
+			if tc.errString != "" {
+				require.ErrorIs(t, err, gErrors.ErrBadRequest)
+				require.ErrorContains(t, err, tc.errString)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tc.expected, b.TTL)
+		})
+	}
+}
+
+func TestValidateTTL(t *testing.T) {
+	require.NoError(t, BootstrapInstance{TTL: time.Hour}.Validate())
+
+	err := BootstrapInstance{TTL: -time.Hour}.Validate()
+	require.ErrorIs(t, err, gErrors.ErrBadRequest)
+	require.ErrorContains(t, err, "ttl must not be negative")
+}
+
+func TestApplyCommonExtraSpecsAffinity(t *testing.T) {
+	b := BootstrapInstance{
+		ExtraSpecs: []byte(`{"garm": {"affinity_group": "runners", "anti_affinity": true}}`),
+	}
+
+	err := b.ApplyCommonExtraSpecs()
+	require.NoError(t, err)
+	require.Equal(t, "runners", b.AffinityGroup)
+	require.True(t, b.AntiAffinity)
+	require.NoError(t, b.Validate())
+}
+
+func TestValidateAffinity(t *testing.T) {
+	require.NoError(t, BootstrapInstance{AffinityGroup: "runners"}.Validate())
+
+	err := BootstrapInstance{AntiAffinity: true}.Validate()
+	require.ErrorIs(t, err, gErrors.ErrBadRequest)
+	require.ErrorContains(t, err, "anti_affinity requires an affinity_group")
+}
+
+func TestApplyCommonExtraSpecsDisks(t *testing.T) {
+	b := BootstrapInstance{
+		ExtraSpecs: []byte(`{"garm": {"disks": [{"size_gb": 100, "type": "ssd", "mount_point": "/var/lib/docker"}, {"size_gb": 20}]}}`),
+	}
+
+	err := b.ApplyCommonExtraSpecs()
+	require.NoError(t, err)
+	require.Equal(t, []DiskSpec{
+		{SizeGB: 100, Type: DiskTypeSSD, MountPoint: "/var/lib/docker"},
+		{SizeGB: 20},
+	}, b.Disks)
+	require.NoError(t, b.Validate())
+}
+
+func TestValidateDisks(t *testing.T) {
+	tests := []struct {
+		name      string
+		disks     []DiskSpec
+		errString string
+	}{
+		{
+			name:  "valid disks",
+			disks: []DiskSpec{{SizeGB: 10, Type: DiskTypeStandard}, {SizeGB: 1, Type: DiskTypeNVMe}},
+		},
+		{
+			name:      "negative size",
+			disks:     []DiskSpec{{SizeGB: 10}, {SizeGB: -5, Type: DiskTypeSSD}},
+			errString: "disk at index 1 must have a positive size, got -5",
+		},
+		{
+			name:      "zero size",
+			disks:     []DiskSpec{{Type: DiskTypeSSD}},
+			errString: "disk at index 0 must have a positive size, got 0",
+		},
+		{
+			name:      "unknown type",
+			disks:     []DiskSpec{{SizeGB: 10, Type: "floppy"}},
+			errString: `disk at index 0 has an unknown type "floppy"`,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			err := BootstrapInstance{Disks: tc.disks}.Validate()
+			if tc.errString == "" {
+				require.NoError(t, err)
+				return
+			}
+			require.ErrorIs(t, err, gErrors.ErrBadRequest)
+			require.ErrorContains(t, err, tc.errString)
+		})
+	}
+}
+
+func TestExtraSpecsMap(t *testing.T) {
+	tests := []struct {
+		name     string
+		raw      string
+		expected map[string]interface{}
+	}{
+		{
+			name:     "empty",
+			raw:      "",
+			expected: map[string]interface{}{},
+		},
+		{
+			name:     "null",
+			raw:      "null",
+			expected: map[string]interface{}{},
+		},
+		{
+			name: "numbers",
+			raw:  `{"count": 9007199254740993, "ratio": 0.5, "size": 1e3, "huge": 18446744073709551616}`,
+			expected: map[string]interface{}{
+				"count": int64(9007199254740993),
+				"ratio": 0.5,
+				"size":  float64(1000),
+				"huge":  json.Number("18446744073709551616"),
+			},
+		},
+		{
+			name: "nested",
+			raw:  `{"disks": [{"size_gb": 100, "type": "ssd"}], "enabled": true, "tags": {"cores": 4}}`,
+			expected: map[string]interface{}{
+				"disks": []interface{}{
+					map[string]interface{}{"size_gb": int64(100), "type": "ssd"},
+				},
+				"enabled": true,
+				"tags":    map[string]interface{}{"cores": int64(4)},
+			},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			ret, err := ExtraSpecsMap(tc.raw)
+			require.NoError(t, err)
+			require.Equal(t, tc.expected, ret)
+		})
+	}
+}
+
+func TestExtraSpecsMapInvalid(t *testing.T) {
+	for _, raw := range []string{`{"count": `, `[1, 2]`, `{"a": 1} {"b": 2}`} {
+		_, err := ExtraSpecsMap(raw)
+		require.ErrorIs(t, err, gErrors.ErrBadRequest, raw)
+	}
+}
+
+func TestApplyCommonExtraSpecsSpot(t *testing.T) {
+	b := BootstrapInstance{
+		ExtraSpecs: []byte(`{"garm": {"spot": true, "spot_max_price": "0.045"}}`),
+	}
+
+	err := b.ApplyCommonExtraSpecs()
+	require.NoError(t, err)
+	require.True(t, b.Spot)
+	require.Equal(t, "0.045", b.SpotMaxPrice)
+	require.NoError(t, b.Validate())
+}
+
+func TestValidateSpot(t *testing.T) {
+	tests := []struct {
+		name      string
+		spot      bool
+		maxPrice  string
+		errString string
+	}{
+		{
+			name: "spot without max price",
+			spot: true,
+		},
+		{
+			name:     "whole max price",
+			spot:     true,
+			maxPrice: "2",
+		},
+		{
+			name:      "max price without spot",
+			maxPrice:  "0.5",
+			errString: "spot_max_price requires spot to be enabled",
+		},
+		{
+			name:      "negative max price",
+			spot:      true,
+			maxPrice:  "-0.5",
+			errString: `invalid spot_max_price "-0.5", must be a positive decimal number`,
+		},
+		{
+			name:      "zero max price",
+			spot:      true,
+			maxPrice:  "0.00",
+			errString: `invalid spot_max_price "0.00", must be a positive decimal number`,
+		},
+		{
+			name:      "max price with currency",
+			spot:      true,
+			maxPrice:  "$0.5",
+			errString: `invalid spot_max_price "$0.5", must be a positive decimal number`,
+		},
+		{
+			name:      "max price in exponent form",
+			spot:      true,
+			maxPrice:  "5e-2",
+			errString: `invalid spot_max_price "5e-2", must be a positive decimal number`,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			err := BootstrapInstance{Spot: tc.spot, SpotMaxPrice: tc.maxPrice}.Validate()
+			if tc.errString == "" {
+				require.NoError(t, err)
+				return
+			}
+			require.ErrorIs(t, err, gErrors.ErrBadRequest)
+			require.ErrorContains(t, err, tc.errString)
+		})
+	}
+}
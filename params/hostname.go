@@ -0,0 +1,41 @@
+// Copyright 2023 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package params
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	gErrors "github.com/cloudbase/garm-provider-common/errors"
+)
+
+// rxHostnameLabel matches a single label of a hostname, as defined in RFC 1123.
+var rxHostnameLabel = regexp.MustCompile(`^[A-Za-z0-9]([A-Za-z0-9-]{0,61}[A-Za-z0-9])?$`)
+
+// ValidateHostname checks that hostname is a valid RFC 1123 hostname. A single
+// trailing dot, as in a fully qualified domain name, is allowed.
+func ValidateHostname(hostname string) error {
+	name := strings.TrimSuffix(hostname, ".")
+	if name == "" || len(name) > 253 {
+		return fmt.Errorf("invalid hostname %q, must be between 1 and 253 characters long: %w", hostname, gErrors.ErrBadRequest)
+	}
+	for _, label := range strings.Split(name, ".") {
+		if !rxHostnameLabel.MatchString(label) {
+			return fmt.Errorf("invalid hostname %q, labels must be up to 63 letters, digits or hyphens, and must not start or end with a hyphen: %w", hostname, gErrors.ErrBadRequest)
+		}
+	}
+	return nil
+}
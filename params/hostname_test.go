@@ -0,0 +1,53 @@
+// Copyright 2023 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package params
+
+import (
+	"strings"
+	"testing"
+
+	gErrors "github.com/cloudbase/garm-provider-common/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidateHostname(t *testing.T) {
+	tests := []struct {
+		name     string
+		hostname string
+		valid    bool
+	}{
+		{name: "short", hostname: "runner-1", valid: true},
+		{name: "fqdn", hostname: "runner-1.garm.example.com", valid: true},
+		{name: "trailing dot", hostname: "runner-1.example.com.", valid: true},
+		{name: "empty", hostname: ""},
+		{name: "leading hyphen", hostname: "-runner"},
+		{name: "trailing hyphen", hostname: "runner-.example.com"},
+		{name: "empty label", hostname: "runner..example.com"},
+		{name: "underscore", hostname: "runner_1"},
+		{name: "label too long", hostname: strings.Repeat("a", 64)},
+		{name: "too long", hostname: strings.Repeat("a.", 127) + "a"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			err := ValidateHostname(tc.hostname)
+			if tc.valid {
+				require.NoError(t, err)
+				return
+			}
+			require.ErrorIs(t, err, gErrors.ErrBadRequest)
+		})
+	}
+}
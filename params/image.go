@@ -0,0 +1,77 @@
+// Copyright 2023 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package params
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	gErrors "github.com/cloudbase/garm-provider-common/errors"
+)
+
+// ImageRefCanonicalizer validates an image reference in one of the shapes a
+// provider accepts (URN, family, full resource ID, shorthand, etc) and returns it
+// in the canonical form of the provider. It returns an error wrapping
+// errors.ErrBadRequest if the reference is malformed.
+type ImageRefCanonicalizer func(raw string) (string, error)
+
+var (
+	imageRefCanonicalizersMux sync.RWMutex
+	imageRefCanonicalizers    = map[string]ImageRefCanonicalizer{}
+)
+
+// RegisterImageRefCanonicalizer registers the canonicalizer used by
+// CanonicalImageRef for the provider. It is meant to be called from an init
+// function of the provider, and panics if the provider already registered one.
+// The registry is looked up by GARM_PROVIDER_NAME, which GARM only sets for
+// binaries that serve several providers. Single provider binaries should set
+// execution.RunOptions.ImageRefCanonicalizer instead.
+func RegisterImageRefCanonicalizer(providerName string, canonicalizer ImageRefCanonicalizer) {
+	imageRefCanonicalizersMux.Lock()
+	defer imageRefCanonicalizersMux.Unlock()
+
+	if canonicalizer == nil {
+		panic("params: nil image reference canonicalizer for provider " + providerName)
+	}
+	if _, ok := imageRefCanonicalizers[providerName]; ok {
+		panic("params: image reference canonicalizer registered twice for provider " + providerName)
+	}
+	imageRefCanonicalizers[providerName] = canonicalizer
+}
+
+// CanonicalImageRef returns the canonical form of an image reference, using the
+// canonicalizer registered for the provider. Providers without one get the
+// reference with surrounding whitespace removed, as long as it is not empty.
+func CanonicalImageRef(providerName, raw string) (string, error) {
+	imageRefCanonicalizersMux.RLock()
+	canonicalizer, ok := imageRefCanonicalizers[providerName]
+	imageRefCanonicalizersMux.RUnlock()
+
+	if ok {
+		return canonicalizer(raw)
+	}
+	return defaultImageRef(raw)
+}
+
+// defaultImageRef passes the reference through, as image names like
+// "Ubuntu 22.04 LTS" are valid in some clouds.
+func defaultImageRef(raw string) (string, error) {
+	ref := strings.TrimSpace(raw)
+	if ref == "" {
+		return "", fmt.Errorf("image reference must not be empty: %w", gErrors.ErrBadRequest)
+	}
+	return ref, nil
+}
@@ -0,0 +1,94 @@
+// Copyright 2023 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package params
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	gErrors "github.com/cloudbase/garm-provider-common/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func init() {
+	RegisterImageRefCanonicalizer("test-azure", func(raw string) (string, error) {
+		parts := strings.Split(raw, ":")
+		if len(parts) != 4 {
+			return "", fmt.Errorf("image URN %q must be publisher:offer:sku:version: %w", raw, gErrors.ErrBadRequest)
+		}
+		return strings.ToLower(raw), nil
+	})
+}
+
+func TestCanonicalImageRef(t *testing.T) {
+	tests := []struct {
+		name         string
+		providerName string
+		raw          string
+		expected     string
+		errString    string
+	}{
+		{
+			name:     "default passthrough",
+			raw:      " ubuntu-22.04 ",
+			expected: "ubuntu-22.04",
+		},
+		{
+			name:      "default empty",
+			raw:       " ",
+			errString: "image reference must not be empty: invalid request",
+		},
+		{
+			name:     "default inner whitespace",
+			raw:      "Ubuntu 22.04 LTS\n",
+			expected: "Ubuntu 22.04 LTS",
+		},
+		{
+			name:         "registered provider",
+			providerName: "test-azure",
+			raw:          "Canonical:0001-com-ubuntu-server-jammy:22_04-lts:latest",
+			expected:     "canonical:0001-com-ubuntu-server-jammy:22_04-lts:latest",
+		},
+		{
+			name:         "registered provider malformed",
+			providerName: "test-azure",
+			raw:          "ubuntu",
+			errString:    `image URN "ubuntu" must be publisher:offer:sku:version: invalid request`,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			ref, err := CanonicalImageRef(tc.providerName, tc.raw)
+			if tc.errString != "" {
+				require.ErrorIs(t, err, gErrors.ErrBadRequest)
+				require.EqualError(t, err, tc.errString)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tc.expected, ref)
+		})
+	}
+}
+
+func TestRegisterImageRefCanonicalizerTwice(t *testing.T) {
+	require.Panics(t, func() {
+		RegisterImageRefCanonicalizer("test-azure", func(raw string) (string, error) { return raw, nil })
+	})
+	require.Panics(t, func() {
+		RegisterImageRefCanonicalizer("test-nil", nil)
+	})
+}
@@ -0,0 +1,92 @@
+// Copyright 2023 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package params
+
+import (
+	"fmt"
+	"strings"
+
+	gErrors "github.com/cloudbase/garm-provider-common/errors"
+)
+
+const instanceRefSeparator = "/"
+
+// InstanceRef is a structured instance ID, for clouds where the ID of an instance
+// is only unique within a region or zone. Its string form is one of "id",
+// "zone/id" or "region/zone/id". IDs that contain the separator always use the
+// last form, with empty region and zone if they are not set.
+type InstanceRef struct {
+	// Region is the region the instance lives in, if any.
+	Region string `json:"region,omitempty"`
+	// Zone is the availability zone the instance lives in, if any.
+	Zone string `json:"zone,omitempty"`
+	// ID is the ID of the instance in the provider.
+	ID string `json:"id"`
+}
+
+// ParseInstanceRef parses an instance ID in the format returned by InstanceRef.Format.
+// The ID itself may contain the separator only in the "region/zone/id" form.
+func ParseInstanceRef(ref string) (InstanceRef, error) {
+	parts := strings.SplitN(ref, instanceRefSeparator, 3)
+
+	var ret InstanceRef
+	switch len(parts) {
+	case 1:
+		ret.ID = parts[0]
+	case 2:
+		ret.Zone, ret.ID = parts[0], parts[1]
+	default:
+		ret.Region, ret.Zone, ret.ID = parts[0], parts[1], parts[2]
+	}
+
+	if ret.ID == "" {
+		return InstanceRef{}, fmt.Errorf("invalid instance reference %q: missing instance ID: %w", ref, gErrors.ErrBadRequest)
+	}
+	return ret, nil
+}
+
+// Format returns the string form of the reference, which can be parsed back using
+// ParseInstanceRef. The region and zone may not contain the separator.
+func (r InstanceRef) Format() (string, error) {
+	if r.ID == "" {
+		return "", fmt.Errorf("invalid instance reference: missing instance ID: %w", gErrors.ErrBadRequest)
+	}
+	if strings.Contains(r.Region, instanceRefSeparator) {
+		return "", fmt.Errorf("invalid instance reference: region %q contains %q: %w", r.Region, instanceRefSeparator, gErrors.ErrBadRequest)
+	}
+	if strings.Contains(r.Zone, instanceRefSeparator) {
+		return "", fmt.Errorf("invalid instance reference: zone %q contains %q: %w", r.Zone, instanceRefSeparator, gErrors.ErrBadRequest)
+	}
+
+	switch {
+	case r.Region != "" || strings.Contains(r.ID, instanceRefSeparator):
+		return strings.Join([]string{r.Region, r.Zone, r.ID}, instanceRefSeparator), nil
+	case r.Zone != "":
+		return strings.Join([]string{r.Zone, r.ID}, instanceRefSeparator), nil
+	default:
+		return r.ID, nil
+	}
+}
+
+// String returns the string form of the reference, as returned by Format. It is
+// meant for display purposes. References that Format rejects are joined as is, and
+// may not parse back to the same reference.
+func (r InstanceRef) String() string {
+	ref, err := r.Format()
+	if err != nil {
+		return strings.Join([]string{r.Region, r.Zone, r.ID}, instanceRefSeparator)
+	}
+	return ref
+}
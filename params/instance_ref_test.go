@@ -0,0 +1,142 @@
+// Copyright 2023 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package params
+
+import (
+	"testing"
+
+	gErrors "github.com/cloudbase/garm-provider-common/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseInstanceRef(t *testing.T) {
+	tests := []struct {
+		name      string
+		ref       string
+		expected  InstanceRef
+		errString string
+	}{
+		{
+			name:     "id only",
+			ref:      "i-123",
+			expected: InstanceRef{ID: "i-123"},
+		},
+		{
+			name:     "zone and id",
+			ref:      "us-east-1a/i-123",
+			expected: InstanceRef{Zone: "us-east-1a", ID: "i-123"},
+		},
+		{
+			name:     "region, zone and id",
+			ref:      "us-east-1/us-east-1a/i-123",
+			expected: InstanceRef{Region: "us-east-1", Zone: "us-east-1a", ID: "i-123"},
+		},
+		{
+			name:     "region without zone",
+			ref:      "westeurope//vm-123",
+			expected: InstanceRef{Region: "westeurope", ID: "vm-123"},
+		},
+		{
+			name:     "id containing separator",
+			ref:      "westeurope/1/groups/garm/vm-123",
+			expected: InstanceRef{Region: "westeurope", Zone: "1", ID: "groups/garm/vm-123"},
+		},
+		{
+			name:     "id containing separator without region",
+			ref:      "//groups/garm/vm-123",
+			expected: InstanceRef{ID: "groups/garm/vm-123"},
+		},
+		{
+			name:      "empty",
+			ref:       "",
+			errString: "missing instance ID",
+		},
+		{
+			name:      "zone without id",
+			ref:       "us-east-1a/",
+			errString: "missing instance ID",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			ref, err := ParseInstanceRef(tc.ref)
+			if tc.errString != "" {
+				require.ErrorIs(t, err, gErrors.ErrBadRequest)
+				require.ErrorContains(t, err, tc.errString)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tc.expected, ref)
+			formatted, err := ref.Format()
+			require.NoError(t, err)
+			require.Equal(t, tc.ref, formatted)
+		})
+	}
+}
+
+func TestInstanceRefRoundTrip(t *testing.T) {
+	refs := []InstanceRef{
+		{ID: "i-123"},
+		{Zone: "us-east-1a", ID: "i-123"},
+		{Region: "us-east-1", Zone: "us-east-1a", ID: "i-123"},
+		{Region: "us-east-1", ID: "i-123"},
+		{Region: "westeurope", Zone: "1", ID: "groups/garm/vm-123"},
+		{Zone: "z", ID: "a/b"},
+		{ID: "a/b"},
+		{ID: "/subscriptions/123/vm-123"},
+	}
+
+	for _, ref := range refs {
+		formatted, err := ref.Format()
+		require.NoError(t, err)
+		require.Equal(t, formatted, ref.String())
+		parsed, err := ParseInstanceRef(formatted)
+		require.NoError(t, err)
+		require.Equal(t, ref, parsed)
+	}
+}
+
+func TestInstanceRefFormatErrors(t *testing.T) {
+	tests := []struct {
+		name      string
+		ref       InstanceRef
+		errString string
+	}{
+		{
+			name:      "missing id",
+			ref:       InstanceRef{Zone: "us-east-1a"},
+			errString: "missing instance ID",
+		},
+		{
+			name:      "region containing separator",
+			ref:       InstanceRef{Region: "us/east", ID: "i-123"},
+			errString: `region "us/east" contains "/"`,
+		},
+		{
+			name:      "zone containing separator",
+			ref:       InstanceRef{Zone: "a/b", ID: "i-123"},
+			errString: `zone "a/b" contains "/"`,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := tc.ref.Format()
+			require.ErrorIs(t, err, gErrors.ErrBadRequest)
+			require.ErrorContains(t, err, tc.errString)
+		})
+	}
+}
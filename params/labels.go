@@ -0,0 +1,42 @@
+// Copyright 2023 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package params
+
+import "strings"
+
+// NormalizeLabels trims and lowercases runner labels, and removes empty and
+// duplicate labels. GitHub treats labels as case insensitive, so labels that
+// only differ in case are considered duplicates. The order of the labels is
+// preserved.
+func NormalizeLabels(labels []string) []string {
+	if labels == nil {
+		return nil
+	}
+
+	seen := make(map[string]struct{}, len(labels))
+	ret := make([]string, 0, len(labels))
+	for _, label := range labels {
+		label = strings.ToLower(strings.TrimSpace(label))
+		if label == "" {
+			continue
+		}
+		if _, ok := seen[label]; ok {
+			continue
+		}
+		seen[label] = struct{}{}
+		ret = append(ret, label)
+	}
+	return ret
+}
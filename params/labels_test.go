@@ -0,0 +1,71 @@
+// Copyright 2023 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package params
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNormalizeLabels(t *testing.T) {
+	tests := []struct {
+		name     string
+		labels   []string
+		expected []string
+	}{
+		{
+			name:     "nil labels",
+			labels:   nil,
+			expected: nil,
+		},
+		{
+			name:     "already normalized",
+			labels:   []string{"self-hosted", "linux", "x64"},
+			expected: []string{"self-hosted", "linux", "x64"},
+		},
+		{
+			name:     "lowercase",
+			labels:   []string{"Self-Hosted", "LINUX"},
+			expected: []string{"self-hosted", "linux"},
+		},
+		{
+			name:     "whitespace",
+			labels:   []string{"  linux", "x64\t", " gpu "},
+			expected: []string{"linux", "x64", "gpu"},
+		},
+		{
+			name:     "duplicates keep first occurrence",
+			labels:   []string{"linux", "gpu", "Linux", " linux ", "x64", "gpu"},
+			expected: []string{"linux", "gpu", "x64"},
+		},
+		{
+			name:     "empty labels are dropped",
+			labels:   []string{"", "linux", "   "},
+			expected: []string{"linux"},
+		},
+		{
+			name:     "only empty labels",
+			labels:   []string{"", " "},
+			expected: []string{},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			require.Equal(t, tc.expected, NormalizeLabels(tc.labels))
+		})
+	}
+}
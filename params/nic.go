@@ -0,0 +1,42 @@
+// Copyright 2023 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package params
+
+import (
+	"fmt"
+
+	gErrors "github.com/cloudbase/garm-provider-common/errors"
+)
+
+// NICSpec describes a network interface attached to, or detached from, an instance.
+type NICSpec struct {
+	// ID is the provider ID of an existing network interface. When detaching, it
+	// identifies the interface to remove.
+	ID string `json:"id,omitempty"`
+	// Network is the network or VPC the interface is connected to.
+	Network string `json:"network,omitempty"`
+	// Subnet is the subnet of Network the interface gets an address from.
+	Subnet string `json:"subnet,omitempty"`
+	// SecurityGroups are the security groups or firewall rules applied to the interface.
+	SecurityGroups []string `json:"security_groups,omitempty"`
+}
+
+// Validate checks that the spec identifies an interface or a network.
+func (n NICSpec) Validate() error {
+	if n.ID == "" && n.Network == "" {
+		return fmt.Errorf("nic spec must have an id or a network: %w", gErrors.ErrBadRequest)
+	}
+	return nil
+}
@@ -0,0 +1,31 @@
+// Copyright 2023 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package params
+
+import (
+	"testing"
+
+	gErrors "github.com/cloudbase/garm-provider-common/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNICSpecValidate(t *testing.T) {
+	require.NoError(t, NICSpec{ID: "eni-123"}.Validate())
+	require.NoError(t, NICSpec{Network: "job-network", Subnet: "job-subnet"}.Validate())
+
+	err := NICSpec{Subnet: "job-subnet"}.Validate()
+	require.ErrorIs(t, err, gErrors.ErrBadRequest)
+	require.EqualError(t, err, "nic spec must have an id or a network: invalid request")
+}
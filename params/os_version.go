@@ -0,0 +1,70 @@
+// Copyright 2023 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package params
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	gErrors "github.com/cloudbase/garm-provider-common/errors"
+)
+
+var (
+	rxOSVersionName = regexp.MustCompile(`^[a-z]+$`)
+	rxLinuxVersion  = regexp.MustCompile(`^v?(\d+(\.\d+)*)$`)
+	// Windows Server versions are often written as an LTSC release (eg: ltsc2022).
+	rxWindowsVersion = regexp.MustCompile(`^(?:v|ltsc)?(\d+(\.\d+)*)$`)
+)
+
+// CanonicalOSVersion normalizes an OS version string, so that versions written in
+// different forms can be compared. Distribution and product names are dropped, leaving
+// only the numeric version. For example, "ubuntu-22.04", "Ubuntu 22.04 LTS" and
+// "22.04" all resolve to "22.04", while "Windows Server 2022" and "ltsc2022" resolve
+// to "2022". Providers can use it to match versions against their image catalog.
+func CanonicalOSVersion(osType OSType, raw string) (string, error) {
+	var rxVersion *regexp.Regexp
+	switch osType {
+	case Linux:
+		rxVersion = rxLinuxVersion
+	case Windows:
+		rxVersion = rxWindowsVersion
+	default:
+		return "", fmt.Errorf("unsupported os type %q: %w", osType, gErrors.ErrBadRequest)
+	}
+
+	tokens := strings.FieldsFunc(strings.ToLower(raw), func(r rune) bool {
+		return r == ' ' || r == '\t' || r == '-' || r == '_' || r == '/'
+	})
+
+	var version string
+	for _, token := range tokens {
+		if matches := rxVersion.FindStringSubmatch(token); matches != nil {
+			if version != "" {
+				return "", fmt.Errorf("ambiguous os version %q: %w", raw, gErrors.ErrBadRequest)
+			}
+			version = matches[1]
+			continue
+		}
+		if !rxOSVersionName.MatchString(token) {
+			return "", fmt.Errorf("invalid os version %q: %w", raw, gErrors.ErrBadRequest)
+		}
+	}
+
+	if version == "" {
+		return "", fmt.Errorf("os version %q does not contain a version number: %w", raw, gErrors.ErrBadRequest)
+	}
+	return version, nil
+}
@@ -0,0 +1,124 @@
+// Copyright 2023 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package params
+
+import (
+	"testing"
+
+	gErrors "github.com/cloudbase/garm-provider-common/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCanonicalOSVersion(t *testing.T) {
+	tests := []struct {
+		name      string
+		osType    OSType
+		raw       string
+		expected  string
+		errString string
+	}{
+		{
+			name:     "bare version",
+			osType:   Linux,
+			raw:      "22.04",
+			expected: "22.04",
+		},
+		{
+			name:     "distribution prefix",
+			osType:   Linux,
+			raw:      "ubuntu-22.04",
+			expected: "22.04",
+		},
+		{
+			name:     "distribution name and suffix",
+			osType:   Linux,
+			raw:      " Ubuntu 22.04 LTS ",
+			expected: "22.04",
+		},
+		{
+			name:     "version prefix",
+			osType:   Linux,
+			raw:      "centos-stream-v9",
+			expected: "9",
+		},
+		{
+			name:     "windows server",
+			osType:   Windows,
+			raw:      "Windows Server 2022",
+			expected: "2022",
+		},
+		{
+			name:     "windows ltsc",
+			osType:   Windows,
+			raw:      "ltsc2022",
+			expected: "2022",
+		},
+		{
+			name:     "windows build number",
+			osType:   Windows,
+			raw:      "10.0.20348",
+			expected: "10.0.20348",
+		},
+		{
+			name:      "ltsc is not a linux version",
+			osType:    Linux,
+			raw:       "ltsc2022",
+			errString: `invalid os version "ltsc2022"`,
+		},
+		{
+			name:      "no version number",
+			osType:    Linux,
+			raw:       "ubuntu",
+			errString: `os version "ubuntu" does not contain a version number`,
+		},
+		{
+			name:      "empty",
+			osType:    Linux,
+			raw:       "",
+			errString: `os version "" does not contain a version number`,
+		},
+		{
+			name:      "garbage",
+			osType:    Linux,
+			raw:       "22.04; rm -rf /",
+			errString: `invalid os version "22.04; rm -rf /"`,
+		},
+		{
+			name:      "several version numbers",
+			osType:    Linux,
+			raw:       "22.04-24.04",
+			errString: `ambiguous os version "22.04-24.04"`,
+		},
+		{
+			name:      "unsupported os type",
+			osType:    Unknown,
+			raw:       "22.04",
+			errString: `unsupported os type "unknown"`,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			version, err := CanonicalOSVersion(tc.osType, tc.raw)
+			if tc.errString != "" {
+				require.ErrorIs(t, err, gErrors.ErrBadRequest)
+				require.ErrorContains(t, err, tc.errString)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tc.expected, version)
+		})
+	}
+}
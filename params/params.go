@@ -16,11 +16,15 @@ package params
 
 import (
 	"encoding/json"
+	"net"
+	"time"
 )
 
 type (
 	AddressType    string
+	AddressFamily  string
 	InstanceStatus string
+	PowerState     string
 	OSType         string
 	OSArch         string
 )
@@ -50,11 +54,103 @@ const (
 	InstanceStatusUnknown      InstanceStatus = "unknown"
 )
 
+var knownInstanceStatuses = map[InstanceStatus]struct{}{
+	InstanceRunning:            {},
+	InstanceStopped:            {},
+	InstanceError:              {},
+	InstancePendingDelete:      {},
+	InstancePendingForceDelete: {},
+	InstanceDeleting:           {},
+	InstancePendingCreate:      {},
+	InstanceCreating:           {},
+	InstanceStatusUnknown:      {},
+}
+
+// IsValid returns true if the status is one of the known instance statuses.
+func (s InstanceStatus) IsValid() bool {
+	_, ok := knownInstanceStatuses[s]
+	return ok
+}
+
+// IsTransitional returns true if the instance is being created or deleted, and
+// thus cannot be started or stopped.
+func (s InstanceStatus) IsTransitional() bool {
+	switch s {
+	case InstancePendingCreate, InstanceCreating,
+		InstancePendingDelete, InstancePendingForceDelete, InstanceDeleting:
+		return true
+	default:
+		return false
+	}
+}
+
+// PowerState describes whether an instance is powered on, independently of its
+// lifecycle status. An instance that was stopped still exists in the provider and
+// reports PowerStateOff. Instances that no longer exist are not found at all.
+const (
+	PowerStateOn      PowerState = "on"
+	PowerStateOff     PowerState = "off"
+	PowerStateUnknown PowerState = "unknown"
+)
+
+// PowerStateFromStatus returns the power state implied by an instance status.
+// Statuses that say nothing about the power state of an instance resolve to
+// PowerStateUnknown.
+func PowerStateFromStatus(status InstanceStatus) PowerState {
+	switch status {
+	case InstanceRunning:
+		return PowerStateOn
+	case InstanceStopped:
+		return PowerStateOff
+	default:
+		return PowerStateUnknown
+	}
+}
+
 const (
 	PublicAddress  AddressType = "public"
 	PrivateAddress AddressType = "private"
 )
 
+const (
+	IPv4Address AddressFamily = "ipv4"
+	IPv6Address AddressFamily = "ipv6"
+)
+
+// DiskType is the class of storage backing a data disk.
+type DiskType string
+
+const (
+	// DiskTypeStandard is general purpose storage, usually backed by spinning disks.
+	DiskTypeStandard DiskType = "standard"
+	// DiskTypeSSD is SSD backed storage.
+	DiskTypeSSD DiskType = "ssd"
+	// DiskTypeNVMe is local NVMe storage, which usually does not outlive the instance.
+	DiskTypeNVMe DiskType = "nvme"
+)
+
+// IsValid returns true if the disk type is one of the known types.
+func (d DiskType) IsValid() bool {
+	switch d {
+	case DiskTypeStandard, DiskTypeSSD, DiskTypeNVMe:
+		return true
+	default:
+		return false
+	}
+}
+
+// DiskSpec describes a data disk that should be attached to an instance, in
+// addition to its root volume.
+type DiskSpec struct {
+	// SizeGB is the size of the disk, in GB.
+	SizeGB int `json:"size_gb"`
+	// Type is the type of the disk. If empty, the provider picks its default.
+	Type DiskType `json:"type,omitempty"`
+	// MountPoint is a hint of where the disk should be mounted (eg: /var/lib/docker).
+	// Providers that set up disks in user data may use it.
+	MountPoint string `json:"mount_point,omitempty"`
+}
+
 type UserDataOptions struct {
 	DisableUpdatesOnBoot bool     `json:"disable_updates_on_boot"`
 	ExtraPackages        []string `json:"extra_packages"`
@@ -62,8 +158,11 @@ type UserDataOptions struct {
 }
 
 type BootstrapInstance struct {
-	Name  string                      `json:"name"`
-	Tools []RunnerApplicationDownload `json:"tools"`
+	Name string `json:"name"`
+	// OriginalName is the name of the instance as sent by GARM, if Name was rewritten
+	// to satisfy the naming rules of the provider.
+	OriginalName string                      `json:"original_name,omitempty"`
+	Tools        []RunnerApplicationDownload `json:"tools"`
 	// RepoURL is the URL the github runner agent needs to configure itself.
 	RepoURL string `json:"repo_url"`
 	// CallbackUrl is the URL where the instance can send a post, signaling
@@ -115,6 +214,11 @@ type BootstrapInstance struct {
 	// PoolID is the ID of the garm pool to which this runner belongs.
 	PoolID string `json:"pool_id"`
 
+	// ControllerID is the ID of the garm controller that owns this runner. If GARM
+	// does not send it, it is filled in from GARM_CONTROLLER_ID before the params are
+	// passed to the provider.
+	ControllerID string `json:"controller_id,omitempty"`
+
 	// UserDataOptions are the options for the user data generation.
 	UserDataOptions UserDataOptions `json:"user_data_options"`
 
@@ -123,11 +227,54 @@ type BootstrapInstance struct {
 	// from the metadata service instead of the runner registration token. The runner registration token
 	// is not available if the runner is configured to use JIT.
 	JitConfigEnabled bool `json:"jit_config_enabled"`
+
+	// ExtraEnv is a map of environment variables that providers should set for the runner,
+	// typically by baking them into the user data. This is usually set via the "extra_env"
+	// key of the "garm" object in extra specs.
+	ExtraEnv map[string]string `json:"extra_env,omitempty"`
+
+	// TTL is the maximum lifetime of the instance. Providers that support it should
+	// translate it into an auto termination setting or tag in the cloud, so instances
+	// GARM lost track of do not leak. A value of 0 means no TTL. This is usually set
+	// via the "ttl" key of the "garm" object in extra specs.
+	TTL time.Duration `json:"ttl,omitempty"`
+
+	// AffinityGroup is a placement hint. Instances that share an affinity group should be
+	// placed close together (eg: in the same placement group or host aggregate), unless
+	// AntiAffinity is set. Providers that do not support placement hints ignore it. This
+	// is usually set via the "affinity_group" key of the "garm" object in extra specs.
+	AffinityGroup string `json:"affinity_group,omitempty"`
+
+	// AntiAffinity asks for the instances of AffinityGroup to be spread across failure
+	// domains (hosts, racks or zones, depending on the provider) instead of being placed
+	// together. It requires AffinityGroup to be set. This is usually set via the
+	// "anti_affinity" key of the "garm" object in extra specs.
+	AntiAffinity bool `json:"anti_affinity,omitempty"`
+
+	// Disks are the data disks that should be attached to the instance, in addition to
+	// its root volume. This is usually set via the "disks" key of the "garm" object in
+	// extra specs.
+	Disks []DiskSpec `json:"disks,omitempty"`
+
+	// Spot asks for the instance to be created as a spot (or preemptible) instance.
+	// Providers translate it to the equivalent offering of their cloud. Handling of
+	// interruptions is provider specific. This is usually set via the "spot" key of
+	// the "garm" object in extra specs.
+	Spot bool `json:"spot,omitempty"`
+
+	// SpotMaxPrice is the maximum hourly price to pay for a spot instance, as a
+	// decimal number in the currency of the cloud. It requires Spot to be set. An
+	// empty value means the on demand price. This is usually set via the
+	// "spot_max_price" key of the "garm" object in extra specs.
+	SpotMaxPrice string `json:"spot_max_price,omitempty"`
 }
 
 type Address struct {
 	Address string      `json:"address"`
 	Type    AddressType `json:"type"`
+	// Family is the IP family of the address (ipv4 or ipv6). It is empty if the
+	// address is not an IP address, like a DNS name.
+	Family AddressFamily `json:"family,omitempty"`
 }
 
 type ProviderInstance struct {
@@ -146,6 +293,10 @@ type ProviderInstance struct {
 	// Windows are supported.
 	OSType OSType `json:"os_type,omitempty"`
 
+	// Hostname is the hostname the cloud assigned to the instance, if it differs from
+	// Name. It must be a valid RFC 1123 hostname.
+	Hostname string `json:"hostname,omitempty"`
+
 	// OSName is the name of the OS. Eg: ubuntu, centos, etc.
 	OSName string `json:"os_name,omitempty"`
 
@@ -159,10 +310,205 @@ type ProviderInstance struct {
 	// for this instance.
 	Addresses []Address `json:"addresses,omitempty"`
 
+	// SecurityGroups are the security groups or firewall rules attached to the
+	// instance, as named or identified by the cloud. They help diagnose runners that
+	// cannot reach GitHub or GARM.
+	SecurityGroups []string `json:"security_groups,omitempty"`
+
+	// AvailabilityZone is the availability zone the instance was placed in. GARM uses
+	// it to show placement and to detect runners concentrated in a single zone.
+	// Providers leave it empty if the cloud does not report it.
+	AvailabilityZone string `json:"availability_zone,omitempty"`
+
 	// Status is the status of the instance inside the provider (eg: running, stopped, etc)
 	Status InstanceStatus `json:"status,omitempty"`
 
+	// PowerState is the power state of the instance (on, off or unknown). Unlike Status,
+	// which describes the lifecycle of the instance, this only tells us if the instance is
+	// powered on. A stopped instance still exists and must be reported with PowerStateOff.
+	PowerState PowerState `json:"power_state,omitempty"`
+
+	// RunnerLabels are the github runner labels the provider applied to the runner. These
+	// mirror BootstrapInstance.Labels and are distinct from any tags or metadata the provider
+	// sets on the cloud resource. GARM uses them to detect label mismatches.
+	RunnerLabels []string `json:"runner_labels,omitempty"`
+
 	// ProviderFault holds any error messages captured from the IaaS provider that is
 	// responsible for managing the lifecycle of the runner.
 	ProviderFault []byte `json:"provider_fault,omitempty"`
+
+	// UserData is the current user data of the instance. It is only returned by
+	// GetInstance, when GARM_INCLUDE_USERDATA is set. It is base64 encoded in JSON.
+	UserData []byte `json:"user_data,omitempty"`
+}
+
+// InstanceStatusUpdate is a status transition for an instance, pushed to the
+// provider by GARM.
+type InstanceStatusUpdate struct {
+	// InstanceID is the ID of the instance in the provider.
+	InstanceID string `json:"instance_id"`
+	// Status is the new status of the instance.
+	Status InstanceStatus `json:"status"`
+	// Reason is an optional, human readable explanation for the transition.
+	Reason string `json:"reason,omitempty"`
+}
+
+// InstanceExistence is the response of the InstanceExists command.
+type InstanceExistence struct {
+	// Exists is true if the instance exists in the provider.
+	Exists bool `json:"exists"`
+}
+
+// PoolOperationResult is the response of commands that operate on all instances
+// in a pool.
+type PoolOperationResult struct {
+	// PoolID is the ID of the pool.
+	PoolID string `json:"pool_id"`
+	// Instances holds the IDs of the instances that were affected by the operation.
+	Instances []string `json:"instances"`
+}
+
+// InstanceLookupResult is one entry of the response of GetInstances.
+type InstanceLookupResult struct {
+	// ID is the instance ID that was requested.
+	ID string `json:"id"`
+	// NotFound is set if the instance does not exist in the provider.
+	NotFound bool `json:"not_found,omitempty"`
+	// Instance holds the instance, if it was found.
+	Instance *ProviderInstance `json:"instance,omitempty"`
+}
+
+// RenderedBootstrap is the response of RenderBootstrap.
+type RenderedBootstrap struct {
+	// UserData is the user data the provider would pass to the instance. It is
+	// base64 encoded in JSON.
+	UserData []byte `json:"user_data"`
+}
+
+// BootDiagnostics holds the information a cloud exposes about the boot of an
+// instance.
+type BootDiagnostics struct {
+	// Screenshot is an image of the console of the instance, if the cloud supports
+	// it. It is base64 encoded in JSON.
+	Screenshot []byte `json:"screenshot,omitempty"`
+	// ScreenshotFormat is the format of Screenshot (eg: png, jpeg).
+	ScreenshotFormat string `json:"screenshot_format,omitempty"`
+	// SerialLog is an excerpt of the serial console log of the instance, usually
+	// the last kernel and init messages.
+	SerialLog string `json:"serial_log,omitempty"`
+}
+
+// InstanceEvent is an event the cloud recorded for an instance, like a failure to
+// schedule it or to pull its image.
+type InstanceEvent struct {
+	// Timestamp is the time at which the event happened.
+	Timestamp time.Time `json:"timestamp"`
+	// Type is the severity of the event, as reported by the cloud (eg: error, warning).
+	Type string `json:"type,omitempty"`
+	// Reason is a short, machine readable reason for the event, as reported by the
+	// cloud (eg: InsufficientCapacity).
+	Reason string `json:"reason,omitempty"`
+	// Message is the human readable description of the event.
+	Message string `json:"message"`
+}
+
+// RemoveAllResult is the response of RemoveAllInstances in best effort mode.
+type RemoveAllResult struct {
+	// Removed holds the IDs of the instances that were removed.
+	Removed []string `json:"removed"`
+	// Failed maps the IDs of the instances that could not be removed to the error
+	// that was returned.
+	Failed map[string]string `json:"failed,omitempty"`
+}
+
+// CostEstimate is the estimated cost of running an instance.
+type CostEstimate struct {
+	// Hourly is the estimated cost of running the instance for one hour.
+	Hourly float64 `json:"hourly"`
+	// Monthly is the estimated cost of running the instance for one month.
+	Monthly float64 `json:"monthly"`
+	// Currency is the ISO 4217 code of the currency the cost is expressed in (eg: USD).
+	Currency string `json:"currency"`
+}
+
+// ProviderDescription is the static self-description of a provider.
+type ProviderDescription struct {
+	// Name is the name of the provider.
+	Name string `json:"name"`
+	// Description is a short, human readable description of the provider.
+	Description string `json:"description,omitempty"`
+	// SupportedClouds is a list of clouds the provider can create instances in.
+	SupportedClouds []string `json:"supported_clouds,omitempty"`
+	// RequiredConfigKeys is a list of keys that must be set in the provider config file.
+	RequiredConfigKeys []string `json:"required_config_keys,omitempty"`
+	// SupportedOSTypes is a list of OS types the provider can create runners for.
+	SupportedOSTypes []OSType `json:"supported_os_types,omitempty"`
+	// SupportedActions is a list of the actions the provider accepts in ExecAction.
+	SupportedActions []string `json:"supported_actions,omitempty"`
+}
+
+// AddressFamilyOf returns the IP family of an address, or an empty string if the
+// address is not an IP address.
+func AddressFamilyOf(address string) AddressFamily {
+	ip := net.ParseIP(address)
+	switch {
+	case ip == nil:
+		return ""
+	case ip.To4() != nil:
+		return IPv4Address
+	default:
+		return IPv6Address
+	}
+}
+
+// family returns the family of the address, falling back to parsing the address
+// if the provider did not set it.
+func (a Address) family() AddressFamily {
+	if a.Family != "" {
+		return a.Family
+	}
+	return AddressFamilyOf(a.Address)
+}
+
+// isUsable returns true if the address can be used to reach the instance from
+// another host. Addresses that are not IP addresses are assumed to be DNS names,
+// and thus usable.
+func (a Address) isUsable() bool {
+	ip := net.ParseIP(a.Address)
+	if ip == nil {
+		return a.Address != ""
+	}
+	return !ip.IsLoopback() && !ip.IsUnspecified() && !ip.IsLinkLocalUnicast()
+}
+
+func (p ProviderInstance) addressesOfFamily(family AddressFamily) []Address {
+	var ret []Address
+	for _, address := range p.Addresses {
+		if address.family() == family {
+			ret = append(ret, address)
+		}
+	}
+	return ret
+}
+
+// IPv4Addresses returns the IPv4 addresses of the instance.
+func (p ProviderInstance) IPv4Addresses() []Address {
+	return p.addressesOfFamily(IPv4Address)
+}
+
+// IPv6Addresses returns the IPv6 addresses of the instance.
+func (p ProviderInstance) IPv6Addresses() []Address {
+	return p.addressesOfFamily(IPv6Address)
+}
+
+// HasUsableAddress returns true if at least one of the addresses of the instance
+// can be used to reach it. Loopback, link local and unspecified addresses are not
+// usable.
+func (p ProviderInstance) HasUsableAddress() bool {
+	for _, address := range p.Addresses {
+		if address.isUsable() {
+			return true
+		}
+	}
+	return false
 }
@@ -0,0 +1,100 @@
+// Copyright 2023 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package params
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPowerStateFromStatus(t *testing.T) {
+	tests := []struct {
+		status InstanceStatus
+		want   PowerState
+	}{
+		{status: InstanceRunning, want: PowerStateOn},
+		{status: InstanceStopped, want: PowerStateOff},
+		{status: InstanceCreating, want: PowerStateUnknown},
+		{status: InstanceError, want: PowerStateUnknown},
+		{status: "", want: PowerStateUnknown},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.status), func(t *testing.T) {
+			assert.Equal(t, tt.want, PowerStateFromStatus(tt.status))
+		})
+	}
+}
+
+func TestAddressFamilies(t *testing.T) {
+	instance := ProviderInstance{
+		Addresses: []Address{
+			{Address: "10.0.0.5", Type: PrivateAddress},
+			{Address: "2001:db8::5", Type: PublicAddress},
+			{Address: "runner.example.com", Type: PublicAddress},
+			{Address: "192.0.2.1", Type: PublicAddress, Family: IPv4Address},
+		},
+	}
+
+	assert.Equal(t, []Address{
+		{Address: "10.0.0.5", Type: PrivateAddress},
+		{Address: "192.0.2.1", Type: PublicAddress, Family: IPv4Address},
+	}, instance.IPv4Addresses())
+	assert.Equal(t, []Address{
+		{Address: "2001:db8::5", Type: PublicAddress},
+	}, instance.IPv6Addresses())
+}
+
+func TestHasUsableAddress(t *testing.T) {
+	tests := []struct {
+		name      string
+		addresses []Address
+		expected  bool
+	}{
+		{
+			name:      "no addresses",
+			addresses: nil,
+			expected:  false,
+		},
+		{
+			name:      "ipv6 only",
+			addresses: []Address{{Address: "2001:db8::5"}},
+			expected:  true,
+		},
+		{
+			name:      "dns name",
+			addresses: []Address{{Address: "runner.example.com"}},
+			expected:  true,
+		},
+		{
+			name: "only unusable addresses",
+			addresses: []Address{
+				{Address: "127.0.0.1"},
+				{Address: "::1"},
+				{Address: "fe80::1"},
+				{Address: "169.254.0.10"},
+				{Address: "0.0.0.0"},
+				{Address: ""},
+			},
+			expected: false,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.expected, ProviderInstance{Addresses: tc.addresses}.HasUsableAddress())
+		})
+	}
+}
@@ -0,0 +1,132 @@
+// Copyright 2023 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package params
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+
+	gErrors "github.com/cloudbase/garm-provider-common/errors"
+)
+
+// ProxyConfig holds the proxy settings used to reach the internet from behind a
+// corporate proxy.
+type ProxyConfig struct {
+	// HTTPProxy is the proxy used for plain HTTP requests.
+	HTTPProxy string `json:"http_proxy,omitempty"`
+	// HTTPSProxy is the proxy used for HTTPS requests.
+	HTTPSProxy string `json:"https_proxy,omitempty"`
+	// NoProxy is a comma separated list of hosts, domains and CIDRs that are
+	// reached directly.
+	NoProxy string `json:"no_proxy,omitempty"`
+}
+
+// IsZero returns true if no proxy is configured.
+func (p ProxyConfig) IsZero() bool {
+	return p == ProxyConfig{}
+}
+
+// Validate checks that the proxies are URLs with a host. Like net/http and curl, a
+// proxy without a scheme, like proxy.example.com:3128, is accepted and taken to be
+// an HTTP proxy.
+func (p ProxyConfig) Validate() error {
+	if err := validateProxyURL("http_proxy", p.HTTPProxy); err != nil {
+		return err
+	}
+	return validateProxyURL("https_proxy", p.HTTPSProxy)
+}
+
+func validateProxyURL(name, value string) error {
+	if value == "" {
+		return nil
+	}
+	parsed, err := parseProxyURL(value)
+	if err != nil || parsed.Host == "" {
+		// The value is not included, as it may hold credentials.
+		return fmt.Errorf("invalid %s, must be a URL like http://proxy.example.com:3128: %w", name, gErrors.ErrBadRequest)
+	}
+	return nil
+}
+
+// parseProxyURL parses a proxy URL, defaulting to the http scheme if it has none.
+func parseProxyURL(value string) (*url.URL, error) {
+	if !strings.Contains(value, "://") {
+		return url.Parse("http://" + value)
+	}
+	return url.Parse(value)
+}
+
+// Redacted returns a copy of the config with the passwords in the proxy URLs
+// redacted.
+func (p ProxyConfig) Redacted() ProxyConfig {
+	redact := func(value string) string {
+		parsed, err := parseProxyURL(value)
+		if err != nil {
+			return value
+		}
+		if !strings.Contains(value, "://") {
+			return strings.TrimPrefix(parsed.Redacted(), "http://")
+		}
+		return parsed.Redacted()
+	}
+	if p.HTTPProxy != "" {
+		p.HTTPProxy = redact(p.HTTPProxy)
+	}
+	if p.HTTPSProxy != "" {
+		p.HTTPSProxy = redact(p.HTTPSProxy)
+	}
+	return p
+}
+
+// Env returns the proxy settings as environment variables. Both the upper and the
+// lower case forms are set, as tools disagree on which one they honor.
+func (p ProxyConfig) Env() map[string]string {
+	env := map[string]string{}
+	set := func(name, value string) {
+		if value != "" {
+			env[name] = value
+			env[strings.ToLower(name)] = value
+		}
+	}
+	set("HTTP_PROXY", p.HTTPProxy)
+	set("HTTPS_PROXY", p.HTTPSProxy)
+	set("NO_PROXY", p.NoProxy)
+	return env
+}
+
+// WithProxy returns a copy of the bootstrap params with the proxy settings added to
+// ExtraEnv, so providers bake them into the user data of the runner. Variables
+// already set in ExtraEnv, usually via extra specs, take precedence. The proxy
+// settings are validated here, as this is where they are handed to runners.
+func (b BootstrapInstance) WithProxy(proxy ProxyConfig) (BootstrapInstance, error) {
+	if err := proxy.Validate(); err != nil {
+		return b, fmt.Errorf("invalid proxy config: %w", err)
+	}
+	proxyEnv := proxy.Env()
+	if len(proxyEnv) == 0 {
+		return b, nil
+	}
+
+	extraEnv := make(map[string]string, len(b.ExtraEnv)+len(proxyEnv))
+	for name, value := range proxyEnv {
+		extraEnv[name] = value
+	}
+	for name, value := range b.ExtraEnv {
+		extraEnv[name] = value
+	}
+	b.ExtraEnv = extraEnv
+	return b, nil
+}
@@ -0,0 +1,92 @@
+// Copyright 2023 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package params
+
+import (
+	"fmt"
+	"sort"
+
+	gErrors "github.com/cloudbase/garm-provider-common/errors"
+)
+
+// SchemaKeyType is the JSON type of the value of an extra specs key.
+type SchemaKeyType string
+
+const (
+	SchemaKeyString  SchemaKeyType = "string"
+	SchemaKeyNumber  SchemaKeyType = "number"
+	SchemaKeyInteger SchemaKeyType = "integer"
+	SchemaKeyBoolean SchemaKeyType = "boolean"
+	SchemaKeyObject  SchemaKeyType = "object"
+	SchemaKeyArray   SchemaKeyType = "array"
+)
+
+// IsValid returns true if t is one of the known key types.
+func (t SchemaKeyType) IsValid() bool {
+	switch t {
+	case SchemaKeyString, SchemaKeyNumber, SchemaKeyInteger,
+		SchemaKeyBoolean, SchemaKeyObject, SchemaKeyArray:
+		return true
+	}
+	return false
+}
+
+// SchemaKey describes a top level extra specs key.
+type SchemaKey struct {
+	// Name is the name of the key.
+	Name string `json:"name"`
+	// Type is the JSON type of the value.
+	Type SchemaKeyType `json:"type"`
+	// Required is set if pools of the provider must set the key.
+	Required bool `json:"required,omitempty"`
+	// Description is a short, human readable description of the key.
+	Description string `json:"description,omitempty"`
+}
+
+// SchemaDoc is a provider curated description of the extra specs keys a provider
+// accepts, meant for tooling like pool editors. It is a lighter alternative to a
+// JSON Schema.
+type SchemaDoc struct {
+	// Keys are the extra specs keys the provider accepts.
+	Keys []SchemaKey `json:"keys"`
+}
+
+// Validate checks that every key has a unique name and a known type.
+func (d SchemaDoc) Validate() error {
+	seen := map[string]struct{}{}
+	for idx, key := range d.Keys {
+		if key.Name == "" {
+			return fmt.Errorf("key at index %d has no name: %w", idx, gErrors.ErrBadRequest)
+		}
+		if _, ok := seen[key.Name]; ok {
+			return fmt.Errorf("duplicate key %q: %w", key.Name, gErrors.ErrBadRequest)
+		}
+		seen[key.Name] = struct{}{}
+		if !key.Type.IsValid() {
+			return fmt.Errorf("key %q has an unknown type %q: %w", key.Name, key.Type, gErrors.ErrBadRequest)
+		}
+	}
+	return nil
+}
+
+// Sorted returns a copy of the doc with the keys sorted by name.
+func (d SchemaDoc) Sorted() SchemaDoc {
+	keys := make([]SchemaKey, len(d.Keys))
+	copy(keys, d.Keys)
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].Name < keys[j].Name
+	})
+	return SchemaDoc{Keys: keys}
+}
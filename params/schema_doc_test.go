@@ -0,0 +1,83 @@
+// Copyright 2023 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package params
+
+import (
+	"testing"
+
+	gErrors "github.com/cloudbase/garm-provider-common/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSchemaDocValidate(t *testing.T) {
+	tests := []struct {
+		name      string
+		doc       SchemaDoc
+		errString string
+	}{
+		{
+			name: "valid",
+			doc: SchemaDoc{Keys: []SchemaKey{
+				{Name: "subnet_id", Type: SchemaKeyString, Required: true, Description: "The subnet runners are connected to."},
+				{Name: "disk_size", Type: SchemaKeyInteger},
+			}},
+		},
+		{
+			name: "empty",
+		},
+		{
+			name:      "missing name",
+			doc:       SchemaDoc{Keys: []SchemaKey{{Type: SchemaKeyString}}},
+			errString: "key at index 0 has no name: invalid request",
+		},
+		{
+			name: "duplicate key",
+			doc: SchemaDoc{Keys: []SchemaKey{
+				{Name: "disk_size", Type: SchemaKeyInteger},
+				{Name: "disk_size", Type: SchemaKeyString},
+			}},
+			errString: `duplicate key "disk_size": invalid request`,
+		},
+		{
+			name:      "unknown type",
+			doc:       SchemaDoc{Keys: []SchemaKey{{Name: "disk_size", Type: "int"}}},
+			errString: `key "disk_size" has an unknown type "int": invalid request`,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.doc.Validate()
+			if tc.errString == "" {
+				require.NoError(t, err)
+				return
+			}
+			require.ErrorIs(t, err, gErrors.ErrBadRequest)
+			require.EqualError(t, err, tc.errString)
+		})
+	}
+}
+
+func TestSchemaDocSorted(t *testing.T) {
+	doc := SchemaDoc{Keys: []SchemaKey{
+		{Name: "subnet_id", Type: SchemaKeyString},
+		{Name: "disk_size", Type: SchemaKeyInteger},
+	}}
+
+	sorted := doc.Sorted()
+	require.Equal(t, "disk_size", sorted.Keys[0].Name)
+	require.Equal(t, "subnet_id", doc.Keys[0].Name)
+	require.Equal(t, []SchemaKey{}, SchemaDoc{}.Sorted().Keys)
+}
@@ -0,0 +1,39 @@
+// Copyright 2023 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package params
+
+import (
+	"bytes"
+	"fmt"
+
+	gErrors "github.com/cloudbase/garm-provider-common/errors"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// ValidateSSHPublicKey checks that key holds a single SSH public key in the
+// OpenSSH authorized_keys format. Any key type or certificate understood by
+// golang.org/x/crypto/ssh is accepted, along with leading options and a trailing
+// comment.
+func ValidateSSHPublicKey(key string) error {
+	_, _, _, rest, err := ssh.ParseAuthorizedKey([]byte(key))
+	if err != nil {
+		return fmt.Errorf("invalid ssh public key: %s: %w", err, gErrors.ErrBadRequest)
+	}
+	if len(bytes.TrimSpace(rest)) > 0 {
+		return fmt.Errorf("invalid ssh public key: expected a single key: %w", gErrors.ErrBadRequest)
+	}
+	return nil
+}
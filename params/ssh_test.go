@@ -0,0 +1,141 @@
+// Copyright 2023 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package params
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"strings"
+	"testing"
+
+	gErrors "github.com/cloudbase/garm-provider-common/errors"
+	"github.com/stretchr/testify/require"
+
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	testRSAKey     = "ssh-rsa AAAAB3NzaC1yc2EAAAADAQABAAAAgQDJXLfrydysSd9KKMGu/ztnBhgZpD+n0VEoMJlRHDOFffCT22AhKBWGosQk1oyfOrpnt9e0cnTAsv3Bn22WdiIIMiMAo+gWbo6vcDDut0k5Gcc1W8R3mYN8EqUOVPxTTxlvF6rnpIB7gZOyPjMZ+TciIQA0mYat+BwIkCSnA7KMsw== test@example"
+	testEd25519Key = "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAINpDQJZxc5XPLbBwvHPh9I0zWeuEIyQOyLCl2msHQMXB test@example"
+	testECDSAKey   = "ecdsa-sha2-nistp256 AAAAE2VjZHNhLXNoYTItbmlzdHAyNTYAAAAIbmlzdHAyNTYAAABBBJtDvH+rPuj4JuYThWRkfeH8glN+3flM6DswJl0q9OzpwQM7brK7uRA82Hu/l1KoQhLAM5yEBvCaWQSZ+BXzSGc= test@example"
+)
+
+// testCertificate returns a user certificate in the authorized_keys format.
+func testCertificate(t *testing.T) string {
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	sshPub, err := ssh.NewPublicKey(pub)
+	require.NoError(t, err)
+	_, caKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	signer, err := ssh.NewSignerFromKey(caKey)
+	require.NoError(t, err)
+
+	cert := &ssh.Certificate{
+		Key:         sshPub,
+		CertType:    ssh.UserCert,
+		ValidBefore: ssh.CertTimeInfinity,
+	}
+	require.NoError(t, cert.SignCert(rand.Reader, signer))
+	return strings.TrimSpace(string(ssh.MarshalAuthorizedKey(cert)))
+}
+
+func TestValidateSSHPublicKey(t *testing.T) {
+	tests := []struct {
+		name      string
+		key       string
+		errString string
+	}{
+		{
+			name: "rsa key",
+			key:  testRSAKey,
+		},
+		{
+			name: "ed25519 key",
+			key:  testEd25519Key,
+		},
+		{
+			name: "ecdsa key",
+			key:  testECDSAKey,
+		},
+		{
+			name: "key without comment",
+			key:  "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAINpDQJZxc5XPLbBwvHPh9I0zWeuEIyQOyLCl2msHQMXB",
+		},
+		{
+			name: "key with options",
+			key:  `no-pty,from="10.0.0.1" ` + testEd25519Key,
+		},
+		{
+			name: "security key",
+			key:  "sk-ssh-ed25519@openssh.com AAAAGnNrLXNzaC1lZDI1NTE5QG9wZW5zc2guY29tAAAAIAABAgMEBQYHCAkKCwwNDg8QERITFBUWFxgZGhscHR4fAAAABHNzaDo= test@example",
+		},
+		{
+			name: "certificate",
+			key:  testCertificate(t),
+		},
+		{
+			name:      "garbage",
+			key:       "bogus",
+			errString: "invalid ssh public key",
+		},
+		{
+			name:      "missing key data",
+			key:       "ssh-ed25519",
+			errString: "invalid ssh public key",
+		},
+		{
+			name:      "invalid base64",
+			key:       "ssh-ed25519 not-base64!",
+			errString: "invalid ssh public key",
+		},
+		{
+			name:      "truncated key data",
+			key:       "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAINpDQJZxc5XPLbBwvHPh9I0zWeuEIyQOyLCl2msH",
+			errString: "invalid ssh public key",
+		},
+		{
+			name:      "invalid rsa exponent",
+			key:       "ssh-rsa AAAAB3NzaC1yc2EAAAABBAAAAIEAgAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAMDk=",
+			errString: "invalid ssh public key",
+		},
+		{
+			name:      "multiple keys",
+			key:       testRSAKey + "\n" + testEd25519Key,
+			errString: "invalid ssh public key: expected a single key",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			err := ValidateSSHPublicKey(tc.key)
+			if tc.errString == "" {
+				require.NoError(t, err)
+			} else {
+				require.ErrorIs(t, err, gErrors.ErrBadRequest)
+				require.ErrorContains(t, err, tc.errString)
+			}
+		})
+	}
+}
+
+func TestValidateBootstrapSSHKeys(t *testing.T) {
+	err := BootstrapInstance{SSHKeys: []string{testRSAKey, testEd25519Key}}.Validate()
+	require.NoError(t, err)
+
+	err = BootstrapInstance{SSHKeys: []string{testRSAKey, "bogus"}}.Validate()
+	require.ErrorIs(t, err, gErrors.ErrBadRequest)
+	require.ErrorContains(t, err, "invalid ssh key at index 1")
+}
@@ -0,0 +1,72 @@
+// Copyright 2023 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package params
+
+import "sort"
+
+const (
+	// TagControllerID is the name of the tag holding the ID of the garm controller.
+	TagControllerID = "garm:controller_id"
+	// TagPoolID is the name of the tag holding the ID of the garm pool.
+	TagPoolID = "garm:pool_id"
+	// TagInstanceName is the name of the tag holding the name of the instance, as
+	// known to garm.
+	TagInstanceName = "garm:instance_name"
+)
+
+// StandardTags returns the canonical set of tags that identify the garm resources
+// an instance belongs to, for providers to apply to every cloud resource they
+// create. Providers merge them with their own tags. Tags with an empty value are
+// left out. The instance name is the one sent by garm, even if it was rewritten.
+func (b BootstrapInstance) StandardTags() map[string]string {
+	name := b.OriginalName
+	if name == "" {
+		name = b.Name
+	}
+
+	tags := map[string]string{}
+	for tag, value := range map[string]string{
+		TagControllerID: b.ControllerID,
+		TagPoolID:       b.PoolID,
+		TagInstanceName: name,
+	} {
+		if value != "" {
+			tags[tag] = value
+		}
+	}
+	return tags
+}
+
+// DiffTags compares the tags currently set on a cloud resource with the desired
+// tags. It returns the tags that need to be set, either because they are missing
+// or because their value changed, and the sorted names of the tags that need to be
+// removed.
+func DiffTags(current, desired map[string]string) (toAdd map[string]string, toRemove []string) {
+	toAdd = map[string]string{}
+	for name, value := range desired {
+		if currentValue, ok := current[name]; !ok || currentValue != value {
+			toAdd[name] = value
+		}
+	}
+
+	for name := range current {
+		if _, ok := desired[name]; !ok {
+			toRemove = append(toRemove, name)
+		}
+	}
+	sort.Strings(toRemove)
+
+	return toAdd, toRemove
+}
@@ -0,0 +1,123 @@
+// Copyright 2023 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package params
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDiffTags(t *testing.T) {
+	tests := []struct {
+		name     string
+		current  map[string]string
+		desired  map[string]string
+		toAdd    map[string]string
+		toRemove []string
+	}{
+		{
+			name:    "no changes",
+			current: map[string]string{"garm:pool_id": "pool"},
+			desired: map[string]string{"garm:pool_id": "pool"},
+			toAdd:   map[string]string{},
+		},
+		{
+			name:    "additions",
+			current: map[string]string{"garm:pool_id": "pool"},
+			desired: map[string]string{"garm:pool_id": "pool", "team": "infra"},
+			toAdd:   map[string]string{"team": "infra"},
+		},
+		{
+			name:     "removals",
+			current:  map[string]string{"garm:pool_id": "pool", "b": "1", "a": "2"},
+			desired:  map[string]string{"garm:pool_id": "pool"},
+			toAdd:    map[string]string{},
+			toRemove: []string{"a", "b"},
+		},
+		{
+			name:    "value changes",
+			current: map[string]string{"garm:pool_id": "old-pool"},
+			desired: map[string]string{"garm:pool_id": "new-pool"},
+			toAdd:   map[string]string{"garm:pool_id": "new-pool"},
+		},
+		{
+			name:     "nil maps",
+			current:  nil,
+			desired:  nil,
+			toAdd:    map[string]string{},
+			toRemove: nil,
+		},
+		{
+			name:    "empty current",
+			current: nil,
+			desired: map[string]string{"team": "infra"},
+			toAdd:   map[string]string{"team": "infra"},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			toAdd, toRemove := DiffTags(tc.current, tc.desired)
+			require.Equal(t, tc.toAdd, toAdd)
+			require.Equal(t, tc.toRemove, toRemove)
+		})
+	}
+}
+
+func TestStandardTags(t *testing.T) {
+	tests := []struct {
+		name     string
+		params   BootstrapInstance
+		expected map[string]string
+	}{
+		{
+			name: "all values set",
+			params: BootstrapInstance{
+				Name:         "garm-abc",
+				PoolID:       "pool-id",
+				ControllerID: "controller-id",
+			},
+			expected: map[string]string{
+				TagControllerID: "controller-id",
+				TagPoolID:       "pool-id",
+				TagInstanceName: "garm-abc",
+			},
+		},
+		{
+			name: "rewritten name",
+			params: BootstrapInstance{
+				Name:         "garm_abc",
+				OriginalName: "garm-abc",
+				PoolID:       "pool-id",
+			},
+			expected: map[string]string{
+				TagPoolID:       "pool-id",
+				TagInstanceName: "garm-abc",
+			},
+		},
+		{
+			name:     "no values set",
+			params:   BootstrapInstance{},
+			expected: map[string]string{},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			require.Equal(t, tc.expected, tc.params.StandardTags())
+		})
+	}
+}
@@ -0,0 +1,42 @@
+// Copyright 2023 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package params
+
+import (
+	"bytes"
+	"fmt"
+
+	gErrors "github.com/cloudbase/garm-provider-common/errors"
+)
+
+// ValidateUserDataSize returns an error if userData is larger than maxBytes. Clouds
+// cap the size of user data, and an oversized payload usually fails the boot without
+// a clear error. A maxBytes value lower than 1 disables the check.
+func ValidateUserDataSize(userData []byte, maxBytes int) error {
+	if maxBytes < 1 || len(userData) <= maxBytes {
+		return nil
+	}
+	return fmt.Errorf("user data size of %d bytes exceeds the limit of %d bytes: %w", len(userData), maxBytes, gErrors.ErrBadRequest)
+}
+
+// ValidateUserDataNotEmpty returns an error if userData is empty or only holds
+// whitespace. Instances created with empty user data boot, but never register
+// as runners.
+func ValidateUserDataNotEmpty(userData []byte) error {
+	if len(bytes.TrimSpace(userData)) == 0 {
+		return fmt.Errorf("user data is empty: %w", gErrors.ErrBadRequest)
+	}
+	return nil
+}
@@ -0,0 +1,64 @@
+// Copyright 2023 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package params
+
+import (
+	"strings"
+	"testing"
+
+	gErrors "github.com/cloudbase/garm-provider-common/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidateUserDataSize(t *testing.T) {
+	tests := []struct {
+		name      string
+		size      int
+		maxBytes  int
+		errString string
+	}{
+		{name: "below the limit", size: 1024, maxBytes: 16384},
+		{name: "at the limit", size: 16384, maxBytes: 16384},
+		{name: "no limit", size: 1 << 20, maxBytes: 0},
+		{
+			name:      "above the limit",
+			size:      16385,
+			maxBytes:  16384,
+			errString: "user data size of 16385 bytes exceeds the limit of 16384 bytes: invalid request",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			err := ValidateUserDataSize([]byte(strings.Repeat("a", tc.size)), tc.maxBytes)
+			if tc.errString == "" {
+				require.NoError(t, err)
+				return
+			}
+			require.ErrorIs(t, err, gErrors.ErrBadRequest)
+			require.EqualError(t, err, tc.errString)
+		})
+	}
+}
+
+func TestValidateUserDataNotEmpty(t *testing.T) {
+	require.NoError(t, ValidateUserDataNotEmpty([]byte("#cloud-config\n")))
+
+	for _, userData := range [][]byte{nil, []byte(""), []byte(" \n\t")} {
+		err := ValidateUserDataNotEmpty(userData)
+		require.ErrorIs(t, err, gErrors.ErrBadRequest)
+		require.EqualError(t, err, "user data is empty: invalid request")
+	}
+}
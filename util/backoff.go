@@ -0,0 +1,80 @@
+// Copyright 2023 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package util
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"time"
+)
+
+var (
+	// RetryBaseDelay is the base delay between the attempts of Retry.
+	RetryBaseDelay = 500 * time.Millisecond
+	// RetryMaxDelay is the maximum delay between the attempts of Retry.
+	RetryMaxDelay = 30 * time.Second
+)
+
+// BackoffWithJitter returns the time to wait before retrying, after attempt failed
+// attempts, starting at 0. It implements exponential backoff with full jitter: the
+// delay is a random value between 0 and base * 2^attempt, capped at max. The jitter
+// spreads out the retries of clients that failed at the same time.
+func BackoffWithJitter(attempt int, base, max time.Duration) time.Duration {
+	if base <= 0 || max <= 0 {
+		return 0
+	}
+	if attempt < 0 {
+		attempt = 0
+	}
+
+	ceiling := base
+	for i := 0; i < attempt && ceiling < max; i++ {
+		ceiling *= 2
+	}
+	if ceiling > max || ceiling <= 0 {
+		ceiling = max
+	}
+	return time.Duration(rand.Int63n(int64(ceiling) + 1))
+}
+
+// Retry calls fn until it succeeds, returns an error that is not retryable or
+// maxAttempts is reached, waiting between attempts as computed by BackoffWithJitter
+// using RetryBaseDelay and RetryMaxDelay. A nil retryable retries all errors. The
+// last error is returned.
+func Retry(ctx context.Context, maxAttempts int, fn func() error, retryable func(error) bool) error {
+	if maxAttempts < 1 {
+		maxAttempts = 1
+	}
+
+	var err error
+	for attempt := 0; attempt < maxAttempts; attempt++ {
+		if attempt > 0 {
+			timer := time.NewTimer(BackoffWithJitter(attempt-1, RetryBaseDelay, RetryMaxDelay))
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return fmt.Errorf("giving up after %d attempts: %w", attempt, err)
+			case <-timer.C:
+			}
+		}
+
+		err = fn()
+		if err == nil || (retryable != nil && !retryable(err)) {
+			return err
+		}
+	}
+	return err
+}
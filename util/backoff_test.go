@@ -0,0 +1,129 @@
+// Copyright 2023 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package util
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestBackoffWithJitter(t *testing.T) {
+	tests := []struct {
+		name    string
+		attempt int
+		base    time.Duration
+		max     time.Duration
+		ceiling time.Duration
+	}{
+		{name: "first attempt", attempt: 0, base: time.Second, max: time.Minute, ceiling: time.Second},
+		{name: "third attempt", attempt: 2, base: time.Second, max: time.Minute, ceiling: 4 * time.Second},
+		{name: "capped", attempt: 10, base: time.Second, max: 5 * time.Second, ceiling: 5 * time.Second},
+		{name: "does not overflow", attempt: 1000, base: time.Second, max: time.Hour, ceiling: time.Hour},
+		{name: "negative attempt", attempt: -1, base: time.Second, max: time.Minute, ceiling: time.Second},
+		{name: "no base", attempt: 3, base: 0, max: time.Minute, ceiling: 0},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			for i := 0; i < 100; i++ {
+				delay := BackoffWithJitter(tc.attempt, tc.base, tc.max)
+				require.GreaterOrEqual(t, delay, time.Duration(0))
+				require.LessOrEqual(t, delay, tc.ceiling)
+			}
+		})
+	}
+}
+
+func setRetryDelays(t *testing.T, base, max time.Duration) {
+	oldBase, oldMax := RetryBaseDelay, RetryMaxDelay
+	RetryBaseDelay, RetryMaxDelay = base, max
+	t.Cleanup(func() {
+		RetryBaseDelay, RetryMaxDelay = oldBase, oldMax
+	})
+}
+
+func TestRetry(t *testing.T) {
+	setRetryDelays(t, time.Millisecond, 5*time.Millisecond)
+	errTransient := fmt.Errorf("transient error")
+	errFatal := fmt.Errorf("fatal error")
+
+	tests := []struct {
+		name          string
+		errs          []error
+		maxAttempts   int
+		expectedCalls int
+		expectedErr   error
+	}{
+		{
+			name:          "succeeds after failures",
+			errs:          []error{errTransient, errTransient, nil},
+			maxAttempts:   5,
+			expectedCalls: 3,
+		},
+		{
+			name:          "runs out of attempts",
+			errs:          []error{errTransient, errTransient, errTransient},
+			maxAttempts:   3,
+			expectedCalls: 3,
+			expectedErr:   errTransient,
+		},
+		{
+			name:          "stops on errors that are not retryable",
+			errs:          []error{errTransient, errFatal, nil},
+			maxAttempts:   5,
+			expectedCalls: 2,
+			expectedErr:   errFatal,
+		},
+		{
+			name:          "runs at least once",
+			errs:          []error{errTransient},
+			maxAttempts:   0,
+			expectedCalls: 1,
+			expectedErr:   errTransient,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			calls := 0
+			err := Retry(context.Background(), tc.maxAttempts, func() error {
+				err := tc.errs[calls]
+				calls++
+				return err
+			}, func(err error) bool {
+				return err != errFatal
+			})
+			require.Equal(t, tc.expectedErr, err)
+			require.Equal(t, tc.expectedCalls, calls)
+		})
+	}
+}
+
+func TestRetryContextCanceled(t *testing.T) {
+	setRetryDelays(t, time.Hour, time.Hour)
+	ctx, cancel := context.WithCancel(context.Background())
+
+	errTransient := fmt.Errorf("transient error")
+	err := Retry(ctx, 5, func() error {
+		cancel()
+		return errTransient
+	}, nil)
+	require.ErrorIs(t, err, errTransient)
+	require.EqualError(t, err, "giving up after 1 attempts: transient error")
+}
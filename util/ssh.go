@@ -0,0 +1,77 @@
+// Copyright 2023 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package util
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+
+	runnerErrors "github.com/cloudbase/garm-provider-common/errors"
+
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	// SSHKeyTypeED25519 is an ed25519 SSH key.
+	SSHKeyTypeED25519 = "ed25519"
+	// SSHKeyTypeRSA is an RSA SSH key, of SSHRSAKeyBits bits.
+	SSHKeyTypeRSA = "rsa"
+
+	// SSHRSAKeyBits is the size of the RSA keys generated by GenerateSSHHostKey.
+	SSHRSAKeyBits = 3072
+)
+
+// GenerateSSHHostKey generates an SSH host key pair of the given type, which is one
+// of SSHKeyTypeED25519 or SSHKeyTypeRSA. Providers can stamp it into the user data
+// of an instance, so the host key is known before the instance boots.
+//
+// The private key is PEM encoded (PKCS#8 for ed25519, PKCS#1 for RSA) and the
+// public key is in the authorized_keys format.
+func GenerateSSHHostKey(keyType string) (priv, pub []byte, err error) {
+	var privKey interface{}
+	var block *pem.Block
+	switch keyType {
+	case SSHKeyTypeED25519:
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to generate ed25519 key: %w", err)
+		}
+		der, err := x509.MarshalPKCS8PrivateKey(key)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to marshal ed25519 key: %w", err)
+		}
+		privKey = key
+		block = &pem.Block{Type: "PRIVATE KEY", Bytes: der}
+	case SSHKeyTypeRSA:
+		key, err := rsa.GenerateKey(rand.Reader, SSHRSAKeyBits)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to generate rsa key: %w", err)
+		}
+		privKey = key
+		block = &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}
+	default:
+		return nil, nil, fmt.Errorf("unsupported SSH key type %q (supported: %s, %s): %w", keyType, SSHKeyTypeED25519, SSHKeyTypeRSA, runnerErrors.ErrBadRequest)
+	}
+
+	signer, err := ssh.NewSignerFromKey(privKey)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create signer: %w", err)
+	}
+	return pem.EncodeToMemory(block), ssh.MarshalAuthorizedKey(signer.PublicKey()), nil
+}
@@ -0,0 +1,55 @@
+// Copyright 2023 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package util
+
+import (
+	"testing"
+
+	runnerErrors "github.com/cloudbase/garm-provider-common/errors"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestGenerateSSHHostKey(t *testing.T) {
+	tests := []struct {
+		keyType string
+		sshType string
+	}{
+		{keyType: SSHKeyTypeED25519, sshType: ssh.KeyAlgoED25519},
+		{keyType: SSHKeyTypeRSA, sshType: ssh.KeyAlgoRSA},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.keyType, func(t *testing.T) {
+			priv, pub, err := GenerateSSHHostKey(tc.keyType)
+			require.NoError(t, err)
+
+			signer, err := ssh.ParsePrivateKey(priv)
+			require.NoError(t, err)
+			require.Equal(t, tc.sshType, signer.PublicKey().Type())
+
+			pubKey, _, _, _, err := ssh.ParseAuthorizedKey(pub)
+			require.NoError(t, err)
+			require.Equal(t, signer.PublicKey().Marshal(), pubKey.Marshal())
+		})
+	}
+}
+
+func TestGenerateSSHHostKeyUnsupportedType(t *testing.T) {
+	_, _, err := GenerateSSHHostKey("dsa")
+	require.ErrorIs(t, err, runnerErrors.ErrBadRequest)
+	require.ErrorContains(t, err, `unsupported SSH key type "dsa"`)
+}